@@ -0,0 +1,509 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: api/routerpb/router.proto
+
+package routerpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Router_ListRoutes_FullMethodName      = "/ipv6router.v1.Router/ListRoutes"
+	Router_LookupRoute_FullMethodName     = "/ipv6router.v1.Router/LookupRoute"
+	Router_AddRoute_FullMethodName        = "/ipv6router.v1.Router/AddRoute"
+	Router_DeleteRoute_FullMethodName     = "/ipv6router.v1.Router/DeleteRoute"
+	Router_ListNeighbors_FullMethodName   = "/ipv6router.v1.Router/ListNeighbors"
+	Router_AddNeighbor_FullMethodName     = "/ipv6router.v1.Router/AddNeighbor"
+	Router_DeleteNeighbors_FullMethodName = "/ipv6router.v1.Router/DeleteNeighbors"
+	Router_ListInterfaces_FullMethodName  = "/ipv6router.v1.Router/ListInterfaces"
+	Router_WatchRoutes_FullMethodName     = "/ipv6router.v1.Router/WatchRoutes"
+	Router_WatchNeighbors_FullMethodName  = "/ipv6router.v1.Router/WatchNeighbors"
+)
+
+// RouterClient is the client API for Router service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type RouterClient interface {
+	ListRoutes(ctx context.Context, in *ListRoutesRequest, opts ...grpc.CallOption) (*ListRoutesResponse, error)
+	// 宛先アドレスに使われる経路。リーク経路はリーク先の経路を返す
+	LookupRoute(ctx context.Context, in *LookupRouteRequest, opts ...grpc.CallOption) (*Route, error)
+	// スタティック経路の追加と削除
+	AddRoute(ctx context.Context, in *AddRouteRequest, opts ...grpc.CallOption) (*AddRouteResponse, error)
+	DeleteRoute(ctx context.Context, in *DeleteRouteRequest, opts ...grpc.CallOption) (*DeleteRouteResponse, error)
+	ListNeighbors(ctx context.Context, in *ListNeighborsRequest, opts ...grpc.CallOption) (*ListNeighborsResponse, error)
+	// スタティックなエントリの追加
+	AddNeighbor(ctx context.Context, in *AddNeighborRequest, opts ...grpc.CallOption) (*AddNeighborResponse, error)
+	// addressを指定すればそのエントリを消す。指定しなければinterfaceかVRFの学習したエントリを全て消す
+	DeleteNeighbors(ctx context.Context, in *DeleteNeighborsRequest, opts ...grpc.CallOption) (*DeleteNeighborsResponse, error)
+	ListInterfaces(ctx context.Context, in *ListInterfacesRequest, opts ...grpc.CallOption) (*ListInterfacesResponse, error)
+	// FIBに経路が入ったり消えたりするたびにイベントを送る
+	WatchRoutes(ctx context.Context, in *WatchRoutesRequest, opts ...grpc.CallOption) (Router_WatchRoutesClient, error)
+	// NDテーブルのエントリが入ったり消えたりするたびにイベントを送る
+	WatchNeighbors(ctx context.Context, in *WatchNeighborsRequest, opts ...grpc.CallOption) (Router_WatchNeighborsClient, error)
+}
+
+type routerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewRouterClient(cc grpc.ClientConnInterface) RouterClient {
+	return &routerClient{cc}
+}
+
+func (c *routerClient) ListRoutes(ctx context.Context, in *ListRoutesRequest, opts ...grpc.CallOption) (*ListRoutesResponse, error) {
+	out := new(ListRoutesResponse)
+	err := c.cc.Invoke(ctx, Router_ListRoutes_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *routerClient) LookupRoute(ctx context.Context, in *LookupRouteRequest, opts ...grpc.CallOption) (*Route, error) {
+	out := new(Route)
+	err := c.cc.Invoke(ctx, Router_LookupRoute_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *routerClient) AddRoute(ctx context.Context, in *AddRouteRequest, opts ...grpc.CallOption) (*AddRouteResponse, error) {
+	out := new(AddRouteResponse)
+	err := c.cc.Invoke(ctx, Router_AddRoute_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *routerClient) DeleteRoute(ctx context.Context, in *DeleteRouteRequest, opts ...grpc.CallOption) (*DeleteRouteResponse, error) {
+	out := new(DeleteRouteResponse)
+	err := c.cc.Invoke(ctx, Router_DeleteRoute_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *routerClient) ListNeighbors(ctx context.Context, in *ListNeighborsRequest, opts ...grpc.CallOption) (*ListNeighborsResponse, error) {
+	out := new(ListNeighborsResponse)
+	err := c.cc.Invoke(ctx, Router_ListNeighbors_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *routerClient) AddNeighbor(ctx context.Context, in *AddNeighborRequest, opts ...grpc.CallOption) (*AddNeighborResponse, error) {
+	out := new(AddNeighborResponse)
+	err := c.cc.Invoke(ctx, Router_AddNeighbor_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *routerClient) DeleteNeighbors(ctx context.Context, in *DeleteNeighborsRequest, opts ...grpc.CallOption) (*DeleteNeighborsResponse, error) {
+	out := new(DeleteNeighborsResponse)
+	err := c.cc.Invoke(ctx, Router_DeleteNeighbors_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *routerClient) ListInterfaces(ctx context.Context, in *ListInterfacesRequest, opts ...grpc.CallOption) (*ListInterfacesResponse, error) {
+	out := new(ListInterfacesResponse)
+	err := c.cc.Invoke(ctx, Router_ListInterfaces_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *routerClient) WatchRoutes(ctx context.Context, in *WatchRoutesRequest, opts ...grpc.CallOption) (Router_WatchRoutesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Router_ServiceDesc.Streams[0], Router_WatchRoutes_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &routerWatchRoutesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Router_WatchRoutesClient interface {
+	Recv() (*RouteEvent, error)
+	grpc.ClientStream
+}
+
+type routerWatchRoutesClient struct {
+	grpc.ClientStream
+}
+
+func (x *routerWatchRoutesClient) Recv() (*RouteEvent, error) {
+	m := new(RouteEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *routerClient) WatchNeighbors(ctx context.Context, in *WatchNeighborsRequest, opts ...grpc.CallOption) (Router_WatchNeighborsClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Router_ServiceDesc.Streams[1], Router_WatchNeighbors_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &routerWatchNeighborsClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Router_WatchNeighborsClient interface {
+	Recv() (*NeighborEvent, error)
+	grpc.ClientStream
+}
+
+type routerWatchNeighborsClient struct {
+	grpc.ClientStream
+}
+
+func (x *routerWatchNeighborsClient) Recv() (*NeighborEvent, error) {
+	m := new(NeighborEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// RouterServer is the server API for Router service.
+// All implementations must embed UnimplementedRouterServer
+// for forward compatibility
+type RouterServer interface {
+	ListRoutes(context.Context, *ListRoutesRequest) (*ListRoutesResponse, error)
+	// 宛先アドレスに使われる経路。リーク経路はリーク先の経路を返す
+	LookupRoute(context.Context, *LookupRouteRequest) (*Route, error)
+	// スタティック経路の追加と削除
+	AddRoute(context.Context, *AddRouteRequest) (*AddRouteResponse, error)
+	DeleteRoute(context.Context, *DeleteRouteRequest) (*DeleteRouteResponse, error)
+	ListNeighbors(context.Context, *ListNeighborsRequest) (*ListNeighborsResponse, error)
+	// スタティックなエントリの追加
+	AddNeighbor(context.Context, *AddNeighborRequest) (*AddNeighborResponse, error)
+	// addressを指定すればそのエントリを消す。指定しなければinterfaceかVRFの学習したエントリを全て消す
+	DeleteNeighbors(context.Context, *DeleteNeighborsRequest) (*DeleteNeighborsResponse, error)
+	ListInterfaces(context.Context, *ListInterfacesRequest) (*ListInterfacesResponse, error)
+	// FIBに経路が入ったり消えたりするたびにイベントを送る
+	WatchRoutes(*WatchRoutesRequest, Router_WatchRoutesServer) error
+	// NDテーブルのエントリが入ったり消えたりするたびにイベントを送る
+	WatchNeighbors(*WatchNeighborsRequest, Router_WatchNeighborsServer) error
+	mustEmbedUnimplementedRouterServer()
+}
+
+// UnimplementedRouterServer must be embedded to have forward compatible implementations.
+type UnimplementedRouterServer struct {
+}
+
+func (UnimplementedRouterServer) ListRoutes(context.Context, *ListRoutesRequest) (*ListRoutesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListRoutes not implemented")
+}
+func (UnimplementedRouterServer) LookupRoute(context.Context, *LookupRouteRequest) (*Route, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method LookupRoute not implemented")
+}
+func (UnimplementedRouterServer) AddRoute(context.Context, *AddRouteRequest) (*AddRouteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddRoute not implemented")
+}
+func (UnimplementedRouterServer) DeleteRoute(context.Context, *DeleteRouteRequest) (*DeleteRouteResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteRoute not implemented")
+}
+func (UnimplementedRouterServer) ListNeighbors(context.Context, *ListNeighborsRequest) (*ListNeighborsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListNeighbors not implemented")
+}
+func (UnimplementedRouterServer) AddNeighbor(context.Context, *AddNeighborRequest) (*AddNeighborResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AddNeighbor not implemented")
+}
+func (UnimplementedRouterServer) DeleteNeighbors(context.Context, *DeleteNeighborsRequest) (*DeleteNeighborsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteNeighbors not implemented")
+}
+func (UnimplementedRouterServer) ListInterfaces(context.Context, *ListInterfacesRequest) (*ListInterfacesResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListInterfaces not implemented")
+}
+func (UnimplementedRouterServer) WatchRoutes(*WatchRoutesRequest, Router_WatchRoutesServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchRoutes not implemented")
+}
+func (UnimplementedRouterServer) WatchNeighbors(*WatchNeighborsRequest, Router_WatchNeighborsServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchNeighbors not implemented")
+}
+func (UnimplementedRouterServer) mustEmbedUnimplementedRouterServer() {}
+
+// UnsafeRouterServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to RouterServer will
+// result in compilation errors.
+type UnsafeRouterServer interface {
+	mustEmbedUnimplementedRouterServer()
+}
+
+func RegisterRouterServer(s grpc.ServiceRegistrar, srv RouterServer) {
+	s.RegisterService(&Router_ServiceDesc, srv)
+}
+
+func _Router_ListRoutes_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListRoutesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RouterServer).ListRoutes(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Router_ListRoutes_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RouterServer).ListRoutes(ctx, req.(*ListRoutesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Router_LookupRoute_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LookupRouteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RouterServer).LookupRoute(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Router_LookupRoute_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RouterServer).LookupRoute(ctx, req.(*LookupRouteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Router_AddRoute_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddRouteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RouterServer).AddRoute(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Router_AddRoute_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RouterServer).AddRoute(ctx, req.(*AddRouteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Router_DeleteRoute_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteRouteRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RouterServer).DeleteRoute(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Router_DeleteRoute_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RouterServer).DeleteRoute(ctx, req.(*DeleteRouteRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Router_ListNeighbors_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListNeighborsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RouterServer).ListNeighbors(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Router_ListNeighbors_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RouterServer).ListNeighbors(ctx, req.(*ListNeighborsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Router_AddNeighbor_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(AddNeighborRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RouterServer).AddNeighbor(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Router_AddNeighbor_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RouterServer).AddNeighbor(ctx, req.(*AddNeighborRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Router_DeleteNeighbors_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteNeighborsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RouterServer).DeleteNeighbors(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Router_DeleteNeighbors_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RouterServer).DeleteNeighbors(ctx, req.(*DeleteNeighborsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Router_ListInterfaces_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListInterfacesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RouterServer).ListInterfaces(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Router_ListInterfaces_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RouterServer).ListInterfaces(ctx, req.(*ListInterfacesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Router_WatchRoutes_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRoutesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(RouterServer).WatchRoutes(m, &routerWatchRoutesServer{stream})
+}
+
+type Router_WatchRoutesServer interface {
+	Send(*RouteEvent) error
+	grpc.ServerStream
+}
+
+type routerWatchRoutesServer struct {
+	grpc.ServerStream
+}
+
+func (x *routerWatchRoutesServer) Send(m *RouteEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _Router_WatchNeighbors_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchNeighborsRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(RouterServer).WatchNeighbors(m, &routerWatchNeighborsServer{stream})
+}
+
+type Router_WatchNeighborsServer interface {
+	Send(*NeighborEvent) error
+	grpc.ServerStream
+}
+
+type routerWatchNeighborsServer struct {
+	grpc.ServerStream
+}
+
+func (x *routerWatchNeighborsServer) Send(m *NeighborEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Router_ServiceDesc is the grpc.ServiceDesc for Router service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Router_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "ipv6router.v1.Router",
+	HandlerType: (*RouterServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListRoutes",
+			Handler:    _Router_ListRoutes_Handler,
+		},
+		{
+			MethodName: "LookupRoute",
+			Handler:    _Router_LookupRoute_Handler,
+		},
+		{
+			MethodName: "AddRoute",
+			Handler:    _Router_AddRoute_Handler,
+		},
+		{
+			MethodName: "DeleteRoute",
+			Handler:    _Router_DeleteRoute_Handler,
+		},
+		{
+			MethodName: "ListNeighbors",
+			Handler:    _Router_ListNeighbors_Handler,
+		},
+		{
+			MethodName: "AddNeighbor",
+			Handler:    _Router_AddNeighbor_Handler,
+		},
+		{
+			MethodName: "DeleteNeighbors",
+			Handler:    _Router_DeleteNeighbors_Handler,
+		},
+		{
+			MethodName: "ListInterfaces",
+			Handler:    _Router_ListInterfaces_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchRoutes",
+			Handler:       _Router_WatchRoutes_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "WatchNeighbors",
+			Handler:       _Router_WatchNeighbors_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "api/routerpb/router.proto",
+}
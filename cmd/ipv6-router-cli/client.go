@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+/**
+ * ルータのHTTP/JSONのAPIをunixソケットで呼ぶクライアント
+ * 型はルータのAPIのJSONに合わせる。
+ */
+type client struct {
+	http *http.Client
+}
+
+type route struct {
+	Vrf       string `json:"vrf"`
+	Prefix    string `json:"prefix"`
+	Type      string `json:"type"`
+	Proto     string `json:"proto"`
+	NextHop   string `json:"nextHop,omitempty"`
+	Interface string `json:"interface,omitempty"`
+	LeakVrf   string `json:"leakVrf,omitempty"`
+	Metric    uint32 `json:"metric"`
+	Distance  uint8  `json:"distance"`
+}
+
+type neighbor struct {
+	Vrf       string `json:"vrf"`
+	Address   string `json:"address"`
+	Mac       string `json:"mac"`
+	Interface string `json:"interface"`
+	Static    bool   `json:"static"`
+}
+
+type commit struct {
+	Index   int       `json:"index"`
+	Time    time.Time `json:"time"`
+	Comment string    `json:"comment"`
+}
+
+type dropCounts struct {
+	Total      map[string]uint64 `json:"total"`
+	Local      map[string]uint64 `json:"local"`
+	Interfaces []struct {
+		Name  string            `json:"name"`
+		Drops map[string]uint64 `json:"drops"`
+	} `json:"interfaces"`
+}
+
+type dropTrace struct {
+	Enabled bool     `json:"enabled"`
+	Reasons []string `json:"reasons"`
+	Packets []struct {
+		Time      time.Time `json:"time"`
+		Interface string    `json:"interface,omitempty"`
+		Reason    string    `json:"reason"`
+		Type      string    `json:"type"`
+		Data      string    `json:"data"`
+	} `json:"packets,omitempty"`
+}
+
+type capture struct {
+	Id         int      `json:"id"`
+	Interface  string   `json:"interface,omitempty"`
+	Stages     []string `json:"stages"`
+	Filter     string   `json:"filter,omitempty"`
+	SnapLen    uint32   `json:"snapLen"`
+	MaxPackets uint64   `json:"maxPackets,omitempty"`
+	MaxBytes   uint64   `json:"maxBytes,omitempty"`
+	Output     string   `json:"output"`
+	Packets    uint64   `json:"packets"`
+	Bytes      uint64   `json:"bytes"`
+	Lost       uint64   `json:"lost"`
+	Active     bool     `json:"active"`
+	StopReason string   `json:"stopReason,omitempty"`
+}
+
+type packetTrace struct {
+	Remaining int    `json:"remaining"`
+	Interface string `json:"interface,omitempty"`
+	Filter    string `json:"filter,omitempty"`
+	Packets   []struct {
+		Id        int       `json:"id"`
+		Time      time.Time `json:"time"`
+		Interface string    `json:"interface"`
+		Length    int       `json:"length"`
+		Summary   string    `json:"summary"`
+		Steps     []struct {
+			Node      string `json:"node"`
+			Decision  string `json:"decision"`
+			Route     string `json:"route,omitempty"`
+			Neighbor  string `json:"neighbor,omitempty"`
+			Interface string `json:"interface,omitempty"`
+		} `json:"steps"`
+	} `json:"packets"`
+}
+
+type flows struct {
+	Enabled         bool   `json:"enabled"`
+	Collector       string `json:"collector,omitempty"`
+	ActiveTimeout   int    `json:"activeTimeout,omitempty"`
+	InactiveTimeout int    `json:"inactiveTimeout,omitempty"`
+	Exported        uint64 `json:"exported"`
+	Messages        uint64 `json:"messages"`
+	Errors          uint64 `json:"errors"`
+	CacheFull       uint64 `json:"cacheFull"`
+	Flows           []struct {
+		Src          string    `json:"src"`
+		Dst          string    `json:"dst"`
+		Proto        uint8     `json:"proto"`
+		SrcPort      uint16    `json:"srcPort"`
+		DstPort      uint16    `json:"dstPort"`
+		InInterface  string    `json:"inInterface"`
+		OutInterface string    `json:"outInterface,omitempty"`
+		Packets      uint64    `json:"packets"`
+		Bytes        uint64    `json:"bytes"`
+		Start        time.Time `json:"start"`
+		Last         time.Time `json:"last"`
+	} `json:"flows"`
+}
+
+type sflow struct {
+	Enabled         bool   `json:"enabled"`
+	Collector       string `json:"collector,omitempty"`
+	Agent           string `json:"agent,omitempty"`
+	PollingInterval int    `json:"pollingInterval,omitempty"`
+	Datagrams       uint64 `json:"datagrams"`
+	Errors          uint64 `json:"errors"`
+	Interfaces      []struct {
+		Name         string `json:"name"`
+		SamplingRate uint32 `json:"samplingRate"`
+		Pool         uint32 `json:"pool"`
+		Samples      uint64 `json:"samples"`
+	} `json:"interfaces"`
+}
+
+type logging struct {
+	Level string          `json:"level"`
+	Debug map[string]bool `json:"debug"`
+}
+
+type netInterface struct {
+	Name      string `json:"name"`
+	Mac       string `json:"mac"`
+	Up        bool   `json:"up"`
+	Present   bool   `json:"present"`
+	Vrf       string `json:"vrf"`
+	Address   string `json:"address,omitempty"`
+	LinkLocal string `json:"linkLocal"`
+	Stats     struct {
+		RxPackets uint64 `json:"rxPackets"`
+		RxBytes   uint64 `json:"rxBytes"`
+		RxErrors  uint64 `json:"rxErrors"`
+		TxPackets uint64 `json:"txPackets"`
+		TxBytes   uint64 `json:"txBytes"`
+		TxErrors  uint64 `json:"txErrors"`
+	} `json:"stats"`
+}
+
+func newClient(socketPath string) *client {
+	return &client{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+/* リクエストを送り、レスポンスのJSONをoutに入れる。outがnilならボディは読み捨てる */
+func (c *client) do(method string, path string, query url.Values, body any, out any) error {
+	var reqBody io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(b)
+	}
+
+	u := url.URL{Scheme: "http", Host: "ipv6-router", Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequest(method, u.String(), reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to connect to router: %s", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(res.Body).Decode(&apiErr) != nil || apiErr.Error == "" {
+			return errors.New(res.Status)
+		}
+		return errors.New(apiErr.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+func (c *client) routes(vrf string) ([]route, error) {
+	var routes []route
+	err := c.do(http.MethodGet, "/routes", url.Values{"vrf": optional(vrf)}, nil, &routes)
+	return routes, err
+}
+
+func (c *client) lookupRoute(vrf string, dst string) (*route, error) {
+	var r route
+	err := c.do(http.MethodGet, "/routes/lookup", url.Values{"vrf": optional(vrf), "dst": {dst}}, nil, &r)
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func (c *client) neighbors(vrf string) ([]neighbor, error) {
+	var neighbors []neighbor
+	err := c.do(http.MethodGet, "/neighbors", url.Values{"vrf": optional(vrf)}, nil, &neighbors)
+	return neighbors, err
+}
+
+func (c *client) deleteNeighbors(vrf string, ifName string, addr string) error {
+	query := url.Values{"vrf": optional(vrf), "interface": optional(ifName), "address": optional(addr)}
+	return c.do(http.MethodDelete, "/neighbors", query, nil, nil)
+}
+
+func (c *client) interfaces() ([]netInterface, error) {
+	var interfaces []netInterface
+	err := c.do(http.MethodGet, "/interfaces", nil, nil, &interfaces)
+	return interfaces, err
+}
+
+/* sourceは"running"か"candidate" */
+func (c *client) config(source string) (string, error) {
+	var res struct {
+		Config string `json:"config"`
+	}
+	err := c.do(http.MethodGet, "/config", url.Values{"source": {source}}, nil, &res)
+	return res.Config, err
+}
+
+func (c *client) editCandidate(line string) error {
+	return c.do(http.MethodPost, "/config/candidate", nil, map[string]string{"command": line}, nil)
+}
+
+func (c *client) discardCandidate() error {
+	return c.do(http.MethodDelete, "/config/candidate", nil, nil, nil)
+}
+
+func (c *client) diff() ([]string, error) {
+	var res struct {
+		Diff []string `json:"diff"`
+	}
+	err := c.do(http.MethodGet, "/config/diff", nil, nil, &res)
+	return res.Diff, err
+}
+
+func (c *client) commit(confirmTimeout time.Duration) error {
+	body := map[string]int{"confirmTimeout": int(confirmTimeout / time.Second)}
+	return c.do(http.MethodPost, "/config/commit", nil, body, nil)
+}
+
+func (c *client) rollback(n int) error {
+	return c.do(http.MethodPost, "/config/rollback", nil, map[string]int{"index": n}, nil)
+}
+
+func (c *client) commits() ([]commit, error) {
+	var commits []commit
+	err := c.do(http.MethodGet, "/config/commits", nil, nil, &commits)
+	return commits, err
+}
+
+func (c *client) drops(ifName string) (*dropCounts, error) {
+	var d dropCounts
+	err := c.do(http.MethodGet, "/drops", url.Values{"interface": optional(ifName)}, nil, &d)
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (c *client) dropTrace() (*dropTrace, error) {
+	var t dropTrace
+	err := c.do(http.MethodGet, "/drops/trace", nil, nil, &t)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+/* reasonsが空なら全ての理由のパケットを残す */
+func (c *client) setDropTrace(enabled bool, reasons []string) error {
+	return c.do(http.MethodPut, "/drops/trace", nil, map[string]any{"enabled": enabled, "reasons": reasons}, nil)
+}
+
+func (c *client) captures() ([]capture, error) {
+	var captures []capture
+	err := c.do(http.MethodGet, "/captures", nil, nil, &captures)
+	return captures, err
+}
+
+func (c *client) stopCapture(id string) error {
+	return c.do(http.MethodDelete, "/captures", url.Values{"id": {id}}, nil, nil)
+}
+
+func (c *client) packetTrace() (*packetTrace, error) {
+	var t packetTrace
+	err := c.do(http.MethodGet, "/trace", nil, nil, &t)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+/* 次に受信するcount個のパケットをトレースする。ifNameとfilterは空なら絞らない */
+func (c *client) startPacketTrace(count int, ifName string, filter string) error {
+	return c.do(http.MethodPut, "/trace", nil, map[string]any{"count": count, "interface": ifName, "filter": filter}, nil)
+}
+
+func (c *client) clearPacketTrace() error {
+	return c.do(http.MethodDelete, "/trace", nil, nil, nil)
+}
+
+func (c *client) flows() (*flows, error) {
+	var f flows
+	err := c.do(http.MethodGet, "/flows", nil, nil, &f)
+	if err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+func (c *client) sflow() (*sflow, error) {
+	var s sflow
+	err := c.do(http.MethodGet, "/sflow", nil, nil, &s)
+	if err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func (c *client) logging() (*logging, error) {
+	var l logging
+	err := c.do(http.MethodGet, "/logging", nil, nil, &l)
+	if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+/* levelが空ならレベルは変えない。debugに入れたサブシステムだけ切り替わる */
+func (c *client) setLogging(level string, debug map[string]bool) error {
+	return c.do(http.MethodPut, "/logging", nil, logging{Level: level, Debug: debug}, nil)
+}
+
+/* 空の値はクエリに入れない */
+func optional(v string) []string {
+	if v == "" {
+		return nil
+	}
+	return []string{v}
+}
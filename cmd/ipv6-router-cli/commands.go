@@ -0,0 +1,998 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+type cliMode int
+
+const (
+	MODE_EXEC cliMode = iota
+	MODE_CONFIG
+	MODE_INTERFACE
+)
+
+/**
+ * コマンドの木。名前が<>で囲まれていれば引数で、それ以外はキーワード
+ * キーワードは一意に決まれば省略できる(sh ipv6 ro)。
+ */
+type command struct {
+	name     string
+	help     string
+	children []*command
+	// 引数の補完候補。インターフェイス名などルータに問い合わせるもの
+	complete func(c *cli) []string
+	// ここで終わるコマンドの処理。引数は名前をキーにして渡す
+	run func(c *cli, args map[string]string) error
+}
+
+type cli struct {
+	client *client
+	out    io.Writer
+	json   bool
+	mode   cliMode
+	ifName string   // MODE_INTERFACEで設定しているインターフェイス
+	words  []string // 実行中のコマンドの単語。キーワードは省略していない形
+	quit   bool
+}
+
+func keyword(name string, help string, children ...*command) *command {
+	return &command{name: name, help: help, children: children}
+}
+
+func argument(name string, help string, children ...*command) *command {
+	return &command{name: name, help: help, children: children}
+}
+
+func (cmd *command) do(run func(c *cli, args map[string]string) error) *command {
+	cmd.run = run
+	return cmd
+}
+
+func (cmd *command) completeWith(complete func(c *cli) []string) *command {
+	cmd.complete = complete
+	return cmd
+}
+
+func (cmd *command) isArgument() bool {
+	return strings.HasPrefix(cmd.name, "<")
+}
+
+/* 省略できる"vrf <vrf>"を付ける */
+func withVrf(cmd *command) *command {
+	cmd.children = append(cmd.children, keyword("vrf", "VRF", argument("<vrf>", "VRF name").do(cmd.run)))
+	return cmd
+}
+
+var execCommands = []*command{
+	keyword("show", "Show running system information",
+		keyword("ipv6", "IPv6 information",
+			withVrf(keyword("route", "IPv6 routing table",
+				withVrf(argument("<address>", "Destination to look up").do(showRouteLookup)),
+			).do(showRoutes)),
+			withVrf(keyword("neighbors", "IPv6 neighbor table").do(showNeighbors)),
+		),
+		keyword("interfaces", "Interface status and counters").do(showInterfaces),
+		keyword("logging", "Log level and debugging subsystems").do(showLogging),
+		keyword("drops", "Dropped packets by reason",
+			keyword("interface", "Interface",
+				argument("<ifname>", "Interface name").completeWith(interfaceNames).do(showDrops),
+			),
+			keyword("trace", "Traced dropped packets").do(showDropTrace),
+		).do(showDrops),
+		keyword("captures", "Packet capture sessions").do(showCaptures),
+		keyword("trace", "Traced packets and their processing steps").do(showPacketTrace),
+		keyword("flows", "Flow cache and IPFIX export").do(showFlows),
+		keyword("sflow", "sFlow agent and sampled interfaces").do(showSflow),
+		showConfigCommands[0],
+		showConfigCommands[1],
+		showConfigCommands[2],
+	),
+	keyword("clear", "Reset functions",
+		keyword("ipv6", "IPv6 information",
+			withVrf(keyword("neighbors", "Flush learned neighbor entries",
+				keyword("interface", "Interface",
+					argument("<ifname>", "Interface name").completeWith(interfaceNames).do(clearNeighbors),
+				),
+			).do(clearNeighbors)),
+		),
+	),
+	keyword("debug", "Enable debug logging",
+		argument("<subsys>", "Subsystem").completeWith(logSubsystems).do(debug(true)),
+	),
+	keyword("no", "Negate a command",
+		keyword("debug", "Disable debug logging",
+			argument("<subsys>", "Subsystem").completeWith(logSubsystems).do(debug(false)),
+		),
+		keyword("capture", "Stop a packet capture",
+			argument("<id>", "Capture ID").do(func(c *cli, args map[string]string) error {
+				return c.client.stopCapture(args["<id>"])
+			}),
+		),
+		keyword("trace", "Stop tracing",
+			keyword("drops", "Stop keeping dropped packets").do(func(c *cli, args map[string]string) error {
+				return c.client.setDropTrace(false, nil)
+			}),
+			keyword("packets", "Stop tracing and clear traced packets").do(func(c *cli, args map[string]string) error {
+				return c.client.clearPacketTrace()
+			}),
+		),
+	),
+	keyword("trace", "Start tracing",
+		keyword("drops", "Keep dropped packets for show drops trace",
+			argument("<reason>", "Drop reason like no_route, all reasons if omitted").do(traceDrops),
+		).do(traceDrops),
+		keyword("packets", "Trace the processing of the next received packets",
+			argument("<count>", "Number of packets",
+				keyword("interface", "Only packets received on the interface",
+					argument("<ifname>", "Interface name").completeWith(interfaceNames).do(tracePackets),
+				),
+				keyword("host", "Only packets from or to the address",
+					argument("<address>", "IPv6 address").do(tracePackets),
+				),
+			).do(tracePackets),
+		),
+	),
+	keyword("logging", "Logging",
+		keyword("level", "Log level",
+			argument("<level>", "debug, info, warn or error").completeWith(func(c *cli) []string {
+				return []string{"debug", "info", "warn", "error"}
+			}).do(func(c *cli, args map[string]string) error {
+				return c.client.setLogging(args["<level>"], nil)
+			}),
+		),
+	),
+	keyword("configure", "Enter configuration mode").do(func(c *cli, args map[string]string) error {
+		c.mode = MODE_CONFIG
+		return nil
+	}),
+	keyword("output", "Output format",
+		keyword("json", "JSON").do(func(c *cli, args map[string]string) error {
+			c.json = true
+			return nil
+		}),
+		keyword("text", "Human readable text").do(func(c *cli, args map[string]string) error {
+			c.json = false
+			return nil
+		}),
+	),
+	keyword("exit", "Exit the CLI").do(quit),
+	keyword("quit", "Exit the CLI").do(quit),
+}
+
+// 設定を見るコマンド。実行モードと設定モードの両方で使う
+var showConfigCommands = []*command{
+	keyword("running-config", "Running configuration").do(showConfig("running")),
+	keyword("candidate-config", "Candidate configuration").do(showConfig("candidate")),
+	keyword("commits", "Commit history").do(showCommits),
+}
+
+/* 設定モードのコマンドは候補設定を変更し、commitで反映する */
+var configCommands = []*command{
+	keyword("ipv6", "IPv6 configuration",
+		keyword("route", "Static route",
+			argument("<prefix>", "Destination prefix",
+				withVrf(argument("<nexthop>", "Next hop address").do(editCandidate)),
+			),
+		),
+		keyword("neighbor", "Static neighbor",
+			argument("<address>", "Neighbor address",
+				argument("<ifname>", "Interface name",
+					argument("<mac>", "MAC address").do(editCandidate),
+				).completeWith(interfaceNames),
+			),
+		),
+	),
+	keyword("ipfix", "IPFIX flow export",
+		keyword("collector", "Collector to export flows to",
+			argument("<address>", "Collector address",
+				argument("<port>", "Collector port, usually 4739",
+					keyword("active", "Active timeout",
+						argument("<active>", "Seconds, 60 if omitted",
+							keyword("inactive", "Inactive timeout",
+								argument("<inactive>", "Seconds, 15 if omitted").do(editCandidate),
+							),
+						).do(editCandidate),
+					),
+					keyword("inactive", "Inactive timeout",
+						argument("<inactive>", "Seconds, 15 if omitted").do(editCandidate),
+					),
+				).do(editCandidate),
+			),
+		),
+	),
+	keyword("sflow", "sFlow packet sampling",
+		keyword("collector", "Collector to send samples to",
+			argument("<address>", "Collector address",
+				argument("<port>", "Collector port, usually 6343",
+					keyword("polling", "Counter polling interval",
+						argument("<seconds>", "Seconds, 20 if omitted").do(editCandidate),
+					),
+				).do(editCandidate),
+			),
+		),
+	),
+	keyword("no", "Negate a command",
+		keyword("ipv6", "IPv6 configuration",
+			keyword("route", "Static route",
+				withVrf(argument("<prefix>", "Destination prefix").do(editCandidate)),
+			),
+			keyword("neighbor", "Static neighbor",
+				argument("<address>", "Neighbor address",
+					argument("<ifname>", "Interface name").completeWith(interfaceNames).do(editCandidate),
+				).do(editCandidate),
+			),
+		),
+		keyword("interface", "Interface",
+			argument("<ifname>", "Interface name",
+				keyword("ipv6", "IPv6 configuration",
+					keyword("address", "Remove the address").do(editCandidate),
+				),
+				keyword("sflow", "sFlow packet sampling",
+					keyword("sampling-rate", "Stop sampling the interface").do(editCandidate),
+				),
+			).completeWith(interfaceNames),
+		),
+		keyword("ipfix", "IPFIX flow export",
+			keyword("collector", "Stop exporting flows").do(editCandidate),
+		),
+		keyword("sflow", "sFlow packet sampling",
+			keyword("collector", "Stop sending samples").do(editCandidate),
+		),
+	),
+	keyword("interface", "Select an interface to configure",
+		argument("<ifname>", "Interface name",
+			keyword("ipv6", "IPv6 configuration",
+				keyword("address", "IPv6 address",
+					argument("<prefix>", "Address and prefix length").do(editCandidate),
+				),
+			),
+			keyword("sflow", "sFlow packet sampling",
+				keyword("sampling-rate", "Sample 1 in N received frames",
+					argument("<rate>", "N").do(editCandidate),
+				),
+			),
+		).completeWith(interfaceNames).do(func(c *cli, args map[string]string) error {
+			c.mode = MODE_INTERFACE
+			c.ifName = args["<ifname>"]
+			return nil
+		}),
+	),
+	keyword("commit", "Apply the candidate configuration",
+		keyword("confirmed", "Roll back unless committed again in time",
+			argument("<timeout>", "Seconds or duration like 5m").do(commitCandidate),
+		),
+	).do(commitCandidate),
+	keyword("rollback", "Load a previous commit into the candidate",
+		argument("<n>", "Commit number, 0 is the running configuration").do(rollback),
+	),
+	keyword("diff", "Show changes from the running configuration").do(showDiff),
+	keyword("discard", "Discard changes in the candidate").do(func(c *cli, args map[string]string) error {
+		return c.client.discardCandidate()
+	}),
+	keyword("show", "Show configuration", showConfigCommands...),
+	keyword("end", "Return to exec mode").do(end),
+	keyword("exit", "Return to exec mode").do(end),
+}
+
+var interfaceCommands = []*command{
+	keyword("ipv6", "IPv6 configuration",
+		keyword("address", "IPv6 address",
+			argument("<prefix>", "Address and prefix length").do(editCandidate),
+		),
+	),
+	keyword("sflow", "sFlow packet sampling",
+		keyword("sampling-rate", "Sample 1 in N received frames",
+			argument("<rate>", "N").do(editCandidate),
+		),
+	),
+	keyword("no", "Negate a command",
+		keyword("ipv6", "IPv6 configuration",
+			keyword("address", "Remove the address").do(editCandidate),
+		),
+		keyword("sflow", "sFlow packet sampling",
+			keyword("sampling-rate", "Stop sampling the interface").do(editCandidate),
+		),
+	),
+	keyword("end", "Return to exec mode").do(end),
+	keyword("exit", "Return to configuration mode").do(func(c *cli, args map[string]string) error {
+		c.mode = MODE_CONFIG
+		c.ifName = ""
+		return nil
+	}),
+}
+
+func (c *cli) commands() []*command {
+	switch c.mode {
+	case MODE_CONFIG:
+		return configCommands
+	case MODE_INTERFACE:
+		return interfaceCommands
+	}
+	return execCommands
+}
+
+func (c *cli) prompt() string {
+	switch c.mode {
+	case MODE_CONFIG:
+		return "ipv6-router(config)# "
+	case MODE_INTERFACE:
+		return "ipv6-router(config-if)# "
+	}
+	return "ipv6-router# "
+}
+
+/* 1行のコマンドを実行する */
+func (c *cli) execute(line string) error {
+	words := strings.Fields(line)
+	if len(words) == 0 {
+		return nil
+	}
+
+	args := map[string]string{}
+	if c.mode == MODE_INTERFACE {
+		args["<ifname>"] = c.ifName
+	}
+	children := c.commands()
+	var cmd *command
+	// 省略したキーワードは元の名前に戻しておく
+	c.words = c.words[:0]
+	for _, word := range words {
+		next, err := matchCommand(children, word)
+		if err != nil {
+			return err
+		}
+		if next.isArgument() {
+			args[next.name] = word
+			c.words = append(c.words, word)
+		} else {
+			c.words = append(c.words, next.name)
+		}
+		cmd = next
+		children = cmd.children
+	}
+
+	if cmd.run == nil {
+		return errors.New("% Incomplete command")
+	}
+	return cmd.run(c, args)
+}
+
+/* キーワードを優先し、なければ引数として受け取る */
+func matchCommand(commands []*command, word string) (*command, error) {
+	var matched []*command
+	var arg *command
+	for _, cmd := range commands {
+		if cmd.isArgument() {
+			if arg == nil {
+				arg = cmd
+			}
+			continue
+		}
+		if cmd.name == word {
+			return cmd, nil
+		}
+		if strings.HasPrefix(cmd.name, word) {
+			matched = append(matched, cmd)
+		}
+	}
+
+	if len(matched) == 1 {
+		return matched[0], nil
+	}
+	if len(matched) > 1 {
+		return nil, fmt.Errorf("%% Ambiguous command: %s", word)
+	}
+	if arg != nil {
+		return arg, nil
+	}
+	return nil, fmt.Errorf("%% Unknown command: %s", word)
+}
+
+/*
+ * 入力途中の最後の単語の候補を返す。
+ * 最後の単語が空なら次に入力できるものすべてで、引数は補完できるものがあればその値を返す。
+ */
+func (c *cli) candidates(line string) (prefix string, cmds []*command, values []string) {
+	words := strings.Fields(line)
+	if len(line) == 0 || strings.HasSuffix(line, " ") {
+		words = append(words, "")
+	}
+
+	children := c.commands()
+	for _, word := range words[:len(words)-1] {
+		next, err := matchCommand(children, word)
+		if err != nil {
+			return "", nil, nil
+		}
+		children = next.children
+	}
+
+	prefix = words[len(words)-1]
+	for _, cmd := range children {
+		if !cmd.isArgument() {
+			if strings.HasPrefix(cmd.name, prefix) {
+				cmds = append(cmds, cmd)
+				values = append(values, cmd.name)
+			}
+			continue
+		}
+		cmds = append(cmds, cmd)
+		if cmd.complete == nil {
+			continue
+		}
+		for _, v := range cmd.complete(c) {
+			if strings.HasPrefix(v, prefix) {
+				values = append(values, v)
+			}
+		}
+	}
+	return prefix, cmds, values
+}
+
+/* 入力中の行の最後の単語を補完する。候補が複数あれば共通部分まで補完する */
+func (c *cli) completeLine(line string) (string, bool) {
+	prefix, cmds, values := c.candidates(line)
+	if len(values) == 0 {
+		return line, false
+	}
+	// 候補を挙げられない引数も入力できるときは、何か入力されるまで補完しない
+	if prefix == "" {
+		for _, cmd := range cmds {
+			if cmd.isArgument() && cmd.complete == nil {
+				return line, false
+			}
+		}
+	}
+
+	common := values[0]
+	for _, v := range values[1:] {
+		for !strings.HasPrefix(v, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	if len(values) == 1 {
+		common += " "
+	}
+	if common == prefix {
+		return line, false
+	}
+	return line + common[len(prefix):], true
+}
+
+/* 次に入力できるものを説明付きで表示する */
+func (c *cli) help(line string) {
+	_, cmds, _ := c.candidates(line)
+	w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+	for _, cmd := range cmds {
+		fmt.Fprintf(w, "  %s\t%s\n", cmd.name, cmd.help)
+	}
+	if cmd := c.lineCommand(line); cmd != nil && cmd.run != nil {
+		fmt.Fprintf(w, "  <cr>\t\n")
+	}
+	w.Flush()
+}
+
+/* 入力済みの単語で決まるコマンド */
+func (c *cli) lineCommand(line string) *command {
+	words := strings.Fields(line)
+	if len(words) == 0 || !strings.HasSuffix(line, " ") {
+		return nil
+	}
+	children := c.commands()
+	var cmd *command
+	for _, word := range words {
+		next, err := matchCommand(children, word)
+		if err != nil {
+			return nil
+		}
+		cmd = next
+		children = cmd.children
+	}
+	return cmd
+}
+
+func interfaceNames(c *cli) []string {
+	interfaces, err := c.client.interfaces()
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, inf := range interfaces {
+		names = append(names, inf.Name)
+	}
+	return names
+}
+
+func logSubsystems(c *cli) []string {
+	l, err := c.client.logging()
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for subsys := range l.Debug {
+		names = append(names, subsys)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func quit(c *cli, args map[string]string) error {
+	c.quit = true
+	return nil
+}
+
+/* 設定モードを抜ける。commitしていない変更は候補設定に残る */
+func end(c *cli, args map[string]string) error {
+	c.mode = MODE_EXEC
+	c.ifName = ""
+	diff, err := c.client.diff()
+	if err == nil && len(diff) > 0 {
+		fmt.Fprintf(c.out, "%% Uncommitted changes remain in the candidate configuration\n")
+	}
+	return nil
+}
+
+func (c *cli) printJson(v any) error {
+	enc := json.NewEncoder(c.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+var protoCodes = map[string]string{
+	"connected": "C",
+	"static":    "S",
+	"ripng":     "R",
+	"ospfv3":    "O",
+	"ebgp":      "B",
+	"ibgp":      "B",
+	"isis":      "I",
+}
+
+func showRoutes(c *cli, args map[string]string) error {
+	routes, err := c.client.routes(args["<vrf>"])
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJson(routes)
+	}
+
+	fmt.Fprintf(c.out, "Codes: C - connected, S - static, R - RIPng, O - OSPFv3, B - BGP, I - IS-IS\n")
+	sort.SliceStable(routes, func(i, j int) bool { return routes[i].Vrf < routes[j].Vrf })
+	vrf := ""
+	for _, r := range routes {
+		if r.Vrf != vrf {
+			vrf = r.Vrf
+			fmt.Fprintf(c.out, "\nVRF %s:\n", vrf)
+		}
+		code := protoCodes[r.Proto]
+		if code == "" {
+			code = "?"
+		}
+		switch r.Type {
+		case "connected":
+			fmt.Fprintf(c.out, "%s    %s is directly connected, %s\n", code, r.Prefix, r.Interface)
+		case "vrf-leak":
+			fmt.Fprintf(c.out, "%s    %s [%d/%d] leaked to vrf %s\n", code, r.Prefix, r.Distance, r.Metric, r.LeakVrf)
+		default:
+			fmt.Fprintf(c.out, "%s    %s [%d/%d] via %s", code, r.Prefix, r.Distance, r.Metric, r.NextHop)
+			if r.Interface != "" {
+				fmt.Fprintf(c.out, ", %s", r.Interface)
+			}
+			fmt.Fprintf(c.out, "\n")
+		}
+	}
+	return nil
+}
+
+func showRouteLookup(c *cli, args map[string]string) error {
+	r, err := c.client.lookupRoute(args["<vrf>"], args["<address>"])
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJson(r)
+	}
+
+	fmt.Fprintf(c.out, "Routing entry for %s in vrf %s\n", r.Prefix, r.Vrf)
+	fmt.Fprintf(c.out, "  Known via \"%s\", distance %d, metric %d\n", r.Proto, r.Distance, r.Metric)
+	switch r.Type {
+	case "connected":
+		fmt.Fprintf(c.out, "  Directly connected, %s\n", r.Interface)
+	case "vrf-leak":
+		fmt.Fprintf(c.out, "  Leaked to vrf %s\n", r.LeakVrf)
+	default:
+		fmt.Fprintf(c.out, "  via %s", r.NextHop)
+		if r.Interface != "" {
+			fmt.Fprintf(c.out, ", %s", r.Interface)
+		}
+		fmt.Fprintf(c.out, "\n")
+	}
+	return nil
+}
+
+func showNeighbors(c *cli, args map[string]string) error {
+	neighbors, err := c.client.neighbors(args["<vrf>"])
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJson(neighbors)
+	}
+
+	sort.Slice(neighbors, func(i, j int) bool {
+		if neighbors[i].Vrf != neighbors[j].Vrf {
+			return neighbors[i].Vrf < neighbors[j].Vrf
+		}
+		return neighbors[i].Address < neighbors[j].Address
+	})
+	w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "IPv6 Address\tMAC Address\tInterface\tVRF\tType\n")
+	for _, n := range neighbors {
+		typ := "dynamic"
+		if n.Static {
+			typ = "static"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", n.Address, n.Mac, n.Interface, n.Vrf, typ)
+	}
+	return w.Flush()
+}
+
+func showInterfaces(c *cli, args map[string]string) error {
+	interfaces, err := c.client.interfaces()
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJson(interfaces)
+	}
+
+	for _, inf := range interfaces {
+		state := "down"
+		if inf.Up {
+			state = "up"
+		}
+		if !inf.Present {
+			state += " (removed)"
+		}
+		fmt.Fprintf(c.out, "%s is %s\n", inf.Name, state)
+		fmt.Fprintf(c.out, "  Hardware address %s, vrf %s\n", inf.Mac, inf.Vrf)
+		if inf.Address != "" {
+			fmt.Fprintf(c.out, "  IPv6 address %s\n", inf.Address)
+		}
+		fmt.Fprintf(c.out, "  IPv6 link-local address %s\n", inf.LinkLocal)
+		fmt.Fprintf(c.out, "  %d packets input, %d bytes, %d errors\n", inf.Stats.RxPackets, inf.Stats.RxBytes, inf.Stats.RxErrors)
+		fmt.Fprintf(c.out, "  %d packets output, %d bytes, %d errors\n", inf.Stats.TxPackets, inf.Stats.TxBytes, inf.Stats.TxErrors)
+	}
+	return nil
+}
+
+func clearNeighbors(c *cli, args map[string]string) error {
+	return c.client.deleteNeighbors(args["<vrf>"], args["<ifname>"], "")
+}
+
+/* 入力したコマンドをそのまま候補設定に送る。インターフェイスの設定モードでは"interface X"を付ける */
+func editCandidate(c *cli, args map[string]string) error {
+	words := c.words
+	if c.mode == MODE_INTERFACE {
+		if words[0] == "no" {
+			words = append([]string{"no", "interface", c.ifName}, words[1:]...)
+		} else {
+			words = append([]string{"interface", c.ifName}, words...)
+		}
+	}
+	return c.client.editCandidate(strings.Join(words, " "))
+}
+
+func commitCandidate(c *cli, args map[string]string) error {
+	var timeout time.Duration
+	if s, ok := args["<timeout>"]; ok {
+		if sec, err := strconv.Atoi(s); err == nil {
+			timeout = time.Duration(sec) * time.Second
+		} else if d, err := time.ParseDuration(s); err == nil {
+			timeout = d
+		}
+		if timeout < time.Second {
+			return fmt.Errorf("%% Invalid timeout: %s", s)
+		}
+	}
+
+	err := c.client.commit(timeout)
+	if err != nil {
+		return err
+	}
+	if timeout > 0 {
+		fmt.Fprintf(c.out, "Commit will be rolled back in %s unless committed again\n", timeout)
+	}
+	return nil
+}
+
+func rollback(c *cli, args map[string]string) error {
+	n, err := strconv.Atoi(args["<n>"])
+	if err != nil {
+		return fmt.Errorf("%% Invalid commit number: %s", args["<n>"])
+	}
+	err = c.client.rollback(n)
+	if err != nil {
+		return err
+	}
+	return showDiff(c, args)
+}
+
+func showDiff(c *cli, args map[string]string) error {
+	diff, err := c.client.diff()
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJson(diff)
+	}
+	for _, line := range diff {
+		fmt.Fprintf(c.out, "%s\n", line)
+	}
+	return nil
+}
+
+func showConfig(source string) func(c *cli, args map[string]string) error {
+	return func(c *cli, args map[string]string) error {
+		text, err := c.client.config(source)
+		if err != nil {
+			return err
+		}
+		if c.json {
+			return c.printJson(map[string]string{"config": text})
+		}
+		fmt.Fprintf(c.out, "%s", text)
+		return nil
+	}
+}
+
+func showCommits(c *cli, args map[string]string) error {
+	commits, err := c.client.commits()
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJson(commits)
+	}
+	w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+	for _, commit := range commits {
+		fmt.Fprintf(w, "%d\t%s\t%s\n", commit.Index, commit.Time.Format(time.DateTime), commit.Comment)
+	}
+	return w.Flush()
+}
+
+func showLogging(c *cli, args map[string]string) error {
+	l, err := c.client.logging()
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJson(l)
+	}
+	fmt.Fprintf(c.out, "Log level: %s\n", l.Level)
+	var enabled []string
+	for subsys, on := range l.Debug {
+		if on {
+			enabled = append(enabled, subsys)
+		}
+	}
+	sort.Strings(enabled)
+	if len(enabled) == 0 {
+		fmt.Fprintf(c.out, "Debugging: none\n")
+	} else {
+		fmt.Fprintf(c.out, "Debugging: %s\n", strings.Join(enabled, ", "))
+	}
+	return nil
+}
+
+func debug(on bool) func(c *cli, args map[string]string) error {
+	return func(c *cli, args map[string]string) error {
+		return c.client.setLogging("", map[string]bool{args["<subsys>"]: on})
+	}
+}
+
+func showDrops(c *cli, args map[string]string) error {
+	d, err := c.client.drops(args["<ifname>"])
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJson(d)
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Interface\tReason\tPackets\n")
+	for _, inf := range d.Interfaces {
+		printDropCounts(w, inf.Name, inf.Drops)
+	}
+	if args["<ifname>"] == "" {
+		printDropCounts(w, "(local)", d.Local)
+	}
+	return w.Flush()
+}
+
+func printDropCounts(w io.Writer, name string, counts map[string]uint64) {
+	var reasons []string
+	for reason := range counts {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(w, "%s\t%s\t%d\n", name, reason, counts[reason])
+	}
+}
+
+func showDropTrace(c *cli, args map[string]string) error {
+	t, err := c.client.dropTrace()
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJson(t)
+	}
+
+	state := "disabled"
+	if t.Enabled {
+		state = "enabled"
+		if len(t.Reasons) > 0 {
+			state += " for " + strings.Join(t.Reasons, ", ")
+		}
+	}
+	fmt.Fprintf(c.out, "Drop trace is %s, %d packets\n", state, len(t.Packets))
+	for _, p := range t.Packets {
+		ifName := p.Interface
+		if ifName == "" {
+			ifName = "(local)"
+		}
+		fmt.Fprintf(c.out, "%s %s %s %s\n  %s\n", p.Time.Format(time.TimeOnly), ifName, p.Reason, p.Type, p.Data)
+	}
+	return nil
+}
+
+func showCaptures(c *cli, args map[string]string) error {
+	captures, err := c.client.captures()
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJson(captures)
+	}
+
+	w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "ID\tInterface\tStages\tFilter\tOutput\tPackets\tBytes\tLost\tState\n")
+	for _, s := range captures {
+		ifName := s.Interface
+		if ifName == "" {
+			ifName = "(all)"
+		}
+		state := "running"
+		if !s.Active {
+			state = "stopped (" + s.StopReason + ")"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%d\t%d\t%d\t%s\n", s.Id, ifName, strings.Join(s.Stages, ","), s.Filter, s.Output, s.Packets, s.Bytes, s.Lost, state)
+	}
+	return w.Flush()
+}
+
+func showPacketTrace(c *cli, args map[string]string) error {
+	t, err := c.client.packetTrace()
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJson(t)
+	}
+
+	state := "stopped"
+	if t.Remaining > 0 {
+		state = fmt.Sprintf("running, %d packets to go", t.Remaining)
+	}
+	fmt.Fprintf(c.out, "Packet trace is %s", state)
+	if t.Interface != "" {
+		fmt.Fprintf(c.out, ", interface %s", t.Interface)
+	}
+	if t.Filter != "" {
+		fmt.Fprintf(c.out, ", filter %q", t.Filter)
+	}
+	fmt.Fprintln(c.out)
+	for _, p := range t.Packets {
+		fmt.Fprintf(c.out, "\nPacket %d\n  %s %s %d bytes: %s\n", p.Id, p.Time.Format("15:04:05.000000"), p.Interface, p.Length, p.Summary)
+		for _, step := range p.Steps {
+			fmt.Fprintf(c.out, "  %-16s %s", step.Node, step.Decision)
+			if step.Route != "" {
+				fmt.Fprintf(c.out, ", route %s", step.Route)
+			}
+			if step.Neighbor != "" {
+				fmt.Fprintf(c.out, ", neighbor %s", step.Neighbor)
+			}
+			if step.Interface != "" {
+				fmt.Fprintf(c.out, ", out %s", step.Interface)
+			}
+			fmt.Fprintln(c.out)
+		}
+	}
+	return nil
+}
+
+func showFlows(c *cli, args map[string]string) error {
+	f, err := c.client.flows()
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJson(f)
+	}
+
+	if f.Enabled {
+		fmt.Fprintf(c.out, "Exporting to %s, active timeout %ds, inactive timeout %ds\n", f.Collector, f.ActiveTimeout, f.InactiveTimeout)
+	} else {
+		fmt.Fprintf(c.out, "IPFIX export is disabled\n")
+	}
+	fmt.Fprintf(c.out, "%d flows exported in %d messages, %d send errors, %d packets not counted for full cache\n\n", f.Exported, f.Messages, f.Errors, f.CacheFull)
+
+	w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Source\tDestination\tProto\tIn\tOut\tPackets\tBytes\tAge\n")
+	for _, flow := range f.Flows {
+		src, dst := flow.Src, flow.Dst
+		if flow.SrcPort != 0 || flow.DstPort != 0 {
+			src = fmt.Sprintf("[%s]:%d", flow.Src, flow.SrcPort)
+			dst = fmt.Sprintf("[%s]:%d", flow.Dst, flow.DstPort)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%d\t%d\t%s\n", src, dst, flow.Proto, flow.InInterface, flow.OutInterface, flow.Packets, flow.Bytes, time.Since(flow.Start).Round(time.Second))
+	}
+	return w.Flush()
+}
+
+func showSflow(c *cli, args map[string]string) error {
+	s, err := c.client.sflow()
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJson(s)
+	}
+
+	if s.Enabled {
+		fmt.Fprintf(c.out, "Sending to %s from agent %s, counter polling every %ds\n", s.Collector, s.Agent, s.PollingInterval)
+	} else {
+		fmt.Fprintf(c.out, "sFlow is disabled\n")
+	}
+	fmt.Fprintf(c.out, "%d datagrams sent, %d send errors\n\n", s.Datagrams, s.Errors)
+
+	w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Interface\tRate\tPool\tSamples\n")
+	for _, i := range s.Interfaces {
+		fmt.Fprintf(w, "%s\t1/%d\t%d\t%d\n", i.Name, i.SamplingRate, i.Pool, i.Samples)
+	}
+	return w.Flush()
+}
+
+func tracePackets(c *cli, args map[string]string) error {
+	count, err := strconv.Atoi(args["<count>"])
+	if err != nil {
+		return fmt.Errorf("invalid count %q", args["<count>"])
+	}
+	filter := ""
+	if addr, ok := args["<address>"]; ok {
+		filter = "host " + addr
+	}
+	return c.client.startPacketTrace(count, args["<ifname>"], filter)
+}
+
+func traceDrops(c *cli, args map[string]string) error {
+	var reasons []string
+	if reason, ok := args["<reason>"]; ok {
+		reasons = append(reasons, reason)
+	}
+	return c.client.setDropTrace(true, reasons)
+}
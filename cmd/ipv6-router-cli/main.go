@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+/**
+ * ipv6-router-cli
+ * 動いているルータにunixソケットのAPIでつなぎ、経路やNDテーブル、インターフェイスを見たり設定したりする。
+ * 引数があればそのコマンドだけを実行し、なければ対話モードになる。標準入力が端末でなければ1行ずつ実行する。
+ */
+const DEFAULT_SOCKET = "/var/run/ipv6-router.sock"
+
+func main() {
+	socketPath := flag.String("socket", DEFAULT_SOCKET, "path of the router API socket")
+	jsonOutput := flag.Bool("json", false, "print results as JSON")
+	flag.Parse()
+
+	c := &cli{
+		client: newClient(*socketPath),
+		out:    os.Stdout,
+		json:   *jsonOutput,
+	}
+
+	if flag.NArg() > 0 {
+		err := c.execute(strings.Join(flag.Args(), " "))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		os.Exit(runScript(c, os.Stdin))
+	}
+
+	err := runInteractive(c)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+/* 1行ずつ実行する。エラーがあれば表示して続け、終了コードで知らせる */
+func runScript(c *cli, r io.Reader) int {
+	status := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() && !c.quit {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "!") {
+			continue
+		}
+		err := c.execute(line)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+		}
+	}
+	return status
+}
+
+/* 端末をrawモードにして、TABで補完、?で次に入力できるものを表示する */
+func runInteractive(c *cli) error {
+	oldState, err := term.MakeRaw(int(os.Stdin.Fd()))
+	if err != nil {
+		return err
+	}
+	defer term.Restore(int(os.Stdin.Fd()), oldState)
+
+	screen := struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}
+	t := term.NewTerminal(screen, c.prompt())
+	c.out = t
+
+	t.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		// 行の途中での補完は扱わない
+		if pos != len(line) {
+			return "", 0, false
+		}
+		switch key {
+		case '\t':
+			newLine, ok := c.completeLine(line)
+			if !ok {
+				return "", 0, false
+			}
+			return newLine, len(newLine), true
+		case '?':
+			fmt.Fprintf(t, "%s%s?\n", c.prompt(), line)
+			c.help(line)
+			return line, pos, true
+		}
+		return "", 0, false
+	}
+
+	for !c.quit {
+		t.SetPrompt(c.prompt())
+		line, err := t.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = c.execute(line)
+		if err != nil {
+			fmt.Fprintln(t, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,1611 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+/**
+ * 経路、NDテーブル、インターフェイスを見たり変えたりするHTTP/JSONのAPI
+ * HTTPのハンドラはgoroutineで動くので、ルータの状態にはapiRunでイベントループに処理を渡してから触る。
+ * gRPCのAPIもここの操作を使う。
+ */
+const API_DEFAULT_SOCKET = "/var/run/ipv6-router.sock"
+
+// イベントループで実行を待っている処理
+var apiCalls = make(chan func(), 16)
+
+// 処理を渡したことをイベントループに知らせるパイプ。読み出し側をepollで監視する
+var apiWakeFds = [2]int{-1, -1}
+
+// パイプへの書き込みと停止時にパイプを閉じるのを排他する
+var apiWakeMutex sync.Mutex
+
+// 停止すると閉じる。実行を待っているハンドラはこれでエラーを返す
+var apiStopped = make(chan struct{})
+
+// 待ち受けているHTTPとgRPCのソケット。停止するときに閉じる
+var apiListeners []net.Listener
+
+type apiRoute struct {
+	Vrf       string `json:"vrf"`
+	Prefix    string `json:"prefix"`
+	Type      string `json:"type"`
+	Proto     string `json:"proto"`
+	NextHop   string `json:"nextHop,omitempty"`
+	Interface string `json:"interface,omitempty"`
+	LeakVrf   string `json:"leakVrf,omitempty"`
+	Metric    uint32 `json:"metric"`
+	Distance  uint8  `json:"distance"`
+}
+
+type apiNeighbor struct {
+	Vrf       string `json:"vrf"`
+	Address   string `json:"address"`
+	Mac       string `json:"mac"`
+	Interface string `json:"interface"`
+	Static    bool   `json:"static"`
+}
+
+type apiInterface struct {
+	Name      string            `json:"name"`
+	Mac       string            `json:"mac"`
+	Up        bool              `json:"up"`
+	Present   bool              `json:"present"`
+	Vrf       string            `json:"vrf"`
+	Address   string            `json:"address,omitempty"`
+	LinkLocal string            `json:"linkLocal"`
+	Stats     apiInterfaceStats `json:"stats"`
+}
+
+type apiInterfaceStats struct {
+	RxPackets uint64 `json:"rxPackets"`
+	RxBytes   uint64 `json:"rxBytes"`
+	RxErrors  uint64 `json:"rxErrors"`
+	TxPackets uint64 `json:"txPackets"`
+	TxBytes   uint64 `json:"txBytes"`
+	TxErrors  uint64 `json:"txErrors"`
+}
+
+type apiConfigCommitEntry struct {
+	Index   int       `json:"index"`
+	Time    time.Time `json:"time"`
+	Comment string    `json:"comment"`
+}
+
+type apiDropCounts struct {
+	Total      map[string]uint64   `json:"total"`
+	Local      map[string]uint64   `json:"local"`
+	Interfaces []apiInterfaceDrops `json:"interfaces"`
+}
+
+type apiInterfaceDrops struct {
+	Name  string            `json:"name"`
+	Drops map[string]uint64 `json:"drops"`
+}
+
+type apiDropTraceState struct {
+	Enabled bool               `json:"enabled"`
+	Reasons []string           `json:"reasons"`
+	Packets []apiDroppedPacket `json:"packets,omitempty"`
+}
+
+type apiDroppedPacket struct {
+	Time      time.Time `json:"time"`
+	Interface string    `json:"interface,omitempty"`
+	Reason    string    `json:"reason"`
+	Type      string    `json:"type"` // "ethernet"か"ipv6"
+	Data      string    `json:"data"` // 16進数
+}
+
+type apiCaptureRequest struct {
+	Interface  string   `json:"interface"` // 空なら全てのインターフェイス
+	Stages     []string `json:"stages"`    // 空ならrxとtx
+	Filter     string   `json:"filter"`
+	SnapLen    uint32   `json:"snapLen"`
+	MaxPackets uint64   `json:"maxPackets"`
+	MaxBytes   uint64   `json:"maxBytes"`
+	File       string   `json:"file"`   // 書き出すファイル
+	Socket     string   `json:"socket"` // 書き出すunixソケット。fileとどちらか
+}
+
+type apiCapture struct {
+	Id         int      `json:"id"`
+	Interface  string   `json:"interface,omitempty"`
+	Stages     []string `json:"stages"`
+	Filter     string   `json:"filter,omitempty"`
+	SnapLen    uint32   `json:"snapLen"`
+	MaxPackets uint64   `json:"maxPackets,omitempty"`
+	MaxBytes   uint64   `json:"maxBytes,omitempty"`
+	Output     string   `json:"output"`
+	Packets    uint64   `json:"packets"`
+	Bytes      uint64   `json:"bytes"`
+	Lost       uint64   `json:"lost"`
+	Active     bool     `json:"active"`
+	StopReason string   `json:"stopReason,omitempty"`
+}
+
+type apiPacketTraceRequest struct {
+	Count     int    `json:"count"`
+	Interface string `json:"interface"` // 空なら全てのインターフェイス
+	Filter    string `json:"filter"`
+}
+
+type apiPacketTrace struct {
+	Remaining int               `json:"remaining"`
+	Interface string            `json:"interface,omitempty"`
+	Filter    string            `json:"filter,omitempty"`
+	Packets   []apiTracedPacket `json:"packets"`
+}
+
+type apiTracedPacket struct {
+	Id        int                  `json:"id"`
+	Time      time.Time            `json:"time"`
+	Interface string               `json:"interface"`
+	Length    int                  `json:"length"`
+	Summary   string               `json:"summary"`
+	Steps     []apiPacketTraceStep `json:"steps"`
+}
+
+type apiPacketTraceStep struct {
+	Node      string `json:"node"`
+	Decision  string `json:"decision"`
+	Route     string `json:"route,omitempty"`
+	Neighbor  string `json:"neighbor,omitempty"`
+	Interface string `json:"interface,omitempty"`
+}
+
+type apiFlowState struct {
+	Enabled         bool      `json:"enabled"`
+	Collector       string    `json:"collector,omitempty"`
+	ActiveTimeout   int       `json:"activeTimeout,omitempty"`   // 秒
+	InactiveTimeout int       `json:"inactiveTimeout,omitempty"` // 秒
+	Exported        uint64    `json:"exported"`
+	Messages        uint64    `json:"messages"`
+	Errors          uint64    `json:"errors"`
+	CacheFull       uint64    `json:"cacheFull"`
+	Flows           []apiFlow `json:"flows"`
+}
+
+type apiFlow struct {
+	Src          string    `json:"src"`
+	Dst          string    `json:"dst"`
+	Proto        uint8     `json:"proto"`
+	SrcPort      uint16    `json:"srcPort"`
+	DstPort      uint16    `json:"dstPort"`
+	InInterface  string    `json:"inInterface"`
+	OutInterface string    `json:"outInterface,omitempty"`
+	Packets      uint64    `json:"packets"`
+	Bytes        uint64    `json:"bytes"`
+	Start        time.Time `json:"start"`
+	Last         time.Time `json:"last"`
+}
+
+type apiSflowState struct {
+	Enabled         bool                `json:"enabled"`
+	Collector       string              `json:"collector,omitempty"`
+	Agent           string              `json:"agent,omitempty"`
+	PollingInterval int                 `json:"pollingInterval,omitempty"` // 秒
+	Datagrams       uint64              `json:"datagrams"`
+	Errors          uint64              `json:"errors"`
+	Interfaces      []apiSflowInterface `json:"interfaces"`
+}
+
+type apiSflowInterface struct {
+	Name         string `json:"name"`
+	SamplingRate uint32 `json:"samplingRate"`
+	Pool         uint32 `json:"pool"`
+	Samples      uint64 `json:"samples"`
+}
+
+type apiLoggingState struct {
+	Level string          `json:"level"`
+	Debug map[string]bool `json:"debug"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+// 操作のエラーの種類。HTTPのステータスコードやgRPCのステータスに変換する
+var errApiInvalid = errors.New("invalid")
+var errApiNotFound = errors.New("not found")
+var errApiShutdown = errors.New("router is shutting down")
+
+/*
+ * APIを待ち受ける。networkは"unix"か"tcp"で、unixのときは残っているソケットファイルを消してから使う。
+ */
+func configApi(network string, address string) {
+	err := apiInitWakeup()
+	if err != nil {
+		apiLog.Error("failed to start api", "err", err)
+		return
+	}
+
+	if network == "unix" {
+		os.Remove(address)
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		apiLog.Error("failed to listen api", "network", network, "address", address, "err", err)
+		return
+	}
+
+	apiListeners = append(apiListeners, listener)
+	go func() {
+		err := http.Serve(listener, apiMux())
+		apiLog.Info("api server is stopped", "network", network, "address", address, "err", err)
+	}()
+
+	apiLog.Info("configure api", "network", network, "address", address)
+}
+
+/* HTTPとgRPCのAPIで共有する。既に作っていれば何もしない */
+func apiInitWakeup() error {
+	if apiWakeFds[0] >= 0 {
+		return nil
+	}
+	var fds [2]int
+	err := syscall.Pipe2(fds[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("create pipe: %s", err)
+	}
+	err = epollAdd(fds[0], syscall.EPOLLIN, func(events uint32) { apiRunCalls() })
+	if err != nil {
+		syscall.Close(fds[0])
+		syscall.Close(fds[1])
+		return err
+	}
+	apiWakeFds = fds
+	return nil
+}
+
+/* イベントループから呼ばれ、渡された処理を全て実行する */
+func apiRunCalls() {
+	buf := make([]byte, 64)
+	for {
+		n, err := syscall.Read(apiWakeFds[0], buf)
+		if err != nil || n < len(buf) {
+			break
+		}
+	}
+
+	for {
+		select {
+		case fn := <-apiCalls:
+			fn()
+		default:
+			return
+		}
+	}
+}
+
+/*
+ * イベントループで処理を実行し、終わるまで待つ。
+ * ルータが停止して処理が実行されなければerrApiShutdownを返す。
+ */
+func apiRun(fn func()) error {
+	done := make(chan struct{})
+	call := func() {
+		fn()
+		close(done)
+	}
+	select {
+	case apiCalls <- call:
+	case <-apiStopped:
+		return errApiShutdown
+	}
+
+	apiWakeMutex.Lock()
+	if apiWakeFds[1] >= 0 {
+		syscall.Write(apiWakeFds[1], []byte{1})
+	}
+	apiWakeMutex.Unlock()
+
+	select {
+	case <-done:
+		return nil
+	case <-apiStopped:
+		// 停止する前に実行されていれば結果を返す
+		select {
+		case <-done:
+			return nil
+		default:
+			return errApiShutdown
+		}
+	}
+}
+
+/*
+ * 新しい接続を受け付けるのをやめ、受け付け済みの操作を実行してからパイプを閉じる。
+ * その後に渡された処理は実行せず、待っているハンドラにはエラーを返させる。
+ * unixソケットのファイルはCloseで消える。
+ */
+func apiShutdown() {
+	for _, listener := range apiListeners {
+		listener.Close()
+	}
+	apiListeners = nil
+
+	apiWakeMutex.Lock()
+	defer apiWakeMutex.Unlock()
+	select {
+	case <-apiStopped:
+		return
+	default:
+	}
+	if apiWakeFds[0] >= 0 {
+		apiRunCalls()
+		epollDelete(apiWakeFds[0])
+		syscall.Close(apiWakeFds[0])
+		syscall.Close(apiWakeFds[1])
+		apiWakeFds = [2]int{-1, -1}
+	}
+	close(apiStopped)
+}
+
+/*
+ * FIBの経路の一覧。vrfを指定しなければ全てのVRF
+ */
+func apiListRoutes(vrfName string) ([]apiRoute, error) {
+	routes := []apiRoute{}
+	found := false
+	if err := apiRun(func() {
+		for _, v := range vrfs {
+			if vrfName != "" && v.name != vrfName {
+				continue
+			}
+			found = true
+			patriciaTrieWalk(v.fib, func(prefix in6Addr, prefixLen uint8, route *ipv6RouteEntry) {
+				routes = append(routes, newApiRoute(v, prefix, prefixLen, route))
+			})
+		}
+	}); err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("vrf %s %w", vrfName, errApiNotFound)
+	}
+	return routes, nil
+}
+
+/* 宛先アドレスに使われる経路。リーク経路はリーク先の経路を返す */
+func apiLookupRoute(vrfName string, dst string) (*apiRoute, error) {
+	dstAddr, err := apiParseAddr(dst)
+	if err != nil {
+		return nil, err
+	}
+	vrfName = apiVrfName(vrfName)
+
+	var route *apiRoute
+	found := false
+	if err := apiRun(func() {
+		v := getVrfByName(vrfName)
+		if v == nil {
+			return
+		}
+		found = true
+		node, outVrf := vrfRouteLookup(v, dstAddr)
+		if node == nil || node.route == nil {
+			return
+		}
+		prefixLen := node.prefixLen()
+		res := newApiRoute(outVrf, in6AddrClearPrefix(node.addr, prefixLen), prefixLen, node.route)
+		route = &res
+	}); err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("vrf %s %w", vrfName, errApiNotFound)
+	}
+	if route == nil {
+		return nil, fmt.Errorf("route to %s in vrf %s %w", fmtIpStr(dstAddr), vrfName, errApiNotFound)
+	}
+	return route, nil
+}
+
+/* スタティック経路の追加。運用設定を変更する */
+func apiAddRoute(vrfName string, prefixStr string, nextHopStr string) error {
+	_, _, err := apiParsePrefix(prefixStr)
+	if err != nil {
+		return err
+	}
+	_, err = apiParseAddr(nextHopStr)
+	if err != nil {
+		return err
+	}
+	vrfName = apiVrfName(vrfName)
+
+	if runErr := apiRun(func() {
+		if getVrfByName(vrfName) == nil {
+			err = fmt.Errorf("vrf %s %w", vrfName, errApiNotFound)
+			return
+		}
+		err = apiEditRunning(fmt.Sprintf("ipv6 route %s %s vrf %s", prefixStr, nextHopStr, vrfName))
+	}); runErr != nil {
+		return runErr
+	}
+	return err
+}
+
+/* スタティック経路の削除。運用設定を変更する */
+func apiDeleteRoute(vrfName string, prefixStr string) error {
+	_, _, err := apiParsePrefix(prefixStr)
+	if err != nil {
+		return err
+	}
+	_, ipNet, _ := net.ParseCIDR(prefixStr)
+	vrfName = apiVrfName(vrfName)
+
+	if runErr := apiRun(func() {
+		if _, ok := runningConfig.routes[configRouteKey{vrf: vrfName, prefix: ipNet.String()}]; !ok {
+			err = fmt.Errorf("static route %s in vrf %s %w", prefixStr, vrfName, errApiNotFound)
+			return
+		}
+		err = apiEditRunning(fmt.Sprintf("no ipv6 route %s vrf %s", prefixStr, vrfName))
+	}); runErr != nil {
+		return runErr
+	}
+	return err
+}
+
+/* NDテーブルのエントリの一覧。vrfを指定しなければ全てのVRF */
+func apiListNeighbors(vrfName string) ([]apiNeighbor, error) {
+	neighbors := []apiNeighbor{}
+	found := false
+	if err := apiRun(func() {
+		for _, v := range vrfs {
+			if vrfName != "" && v.name != vrfName {
+				continue
+			}
+			found = true
+			for _, entry := range v.ndTable {
+				for ; entry != nil; entry = entry.next {
+					neighbors = append(neighbors, newApiNeighbor(v, entry))
+				}
+			}
+		}
+	}); err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("vrf %s %w", vrfName, errApiNotFound)
+	}
+	return neighbors, nil
+}
+
+/* スタティックなエントリの追加。運用設定を変更する */
+func apiAddNeighbor(ifName string, addrStr string, macStr string) error {
+	_, err := apiParseAddr(addrStr)
+	if err != nil {
+		return err
+	}
+	hwAddr, err := net.ParseMAC(macStr)
+	if err != nil || len(hwAddr) != 6 {
+		return fmt.Errorf("%w mac addr %q", errApiInvalid, macStr)
+	}
+
+	if runErr := apiRun(func() {
+		if getNetDevByName(ifName) == nil {
+			err = fmt.Errorf("interface %s %w", ifName, errApiNotFound)
+			return
+		}
+		err = apiEditRunning(fmt.Sprintf("ipv6 neighbor %s %s %s", addrStr, ifName, macStr))
+	}); runErr != nil {
+		return runErr
+	}
+	return err
+}
+
+/*
+ * addrStrを指定すればそのエントリを消す。指定しなければinterfaceかVRFの学習したエントリを全て消す。
+ * interfaceを指定したときはインターフェイスが所属するVRFを使う。
+ */
+func apiDeleteNeighbors(vrfName string, ifName string, addrStr string) error {
+	var addr in6Addr
+	if addrStr != "" {
+		var err error
+		addr, err = apiParseAddr(addrStr)
+		if err != nil {
+			return err
+		}
+	}
+	vrfName = apiVrfName(vrfName)
+
+	var err error
+	if runErr := apiRun(func() {
+		if ifName != "" {
+			netDev := getNetDevByName(ifName)
+			if netDev == nil {
+				err = fmt.Errorf("interface %s %w", ifName, errApiNotFound)
+				return
+			}
+			if addrStr == "" {
+				flushNDTableEntries(netDev)
+				return
+			}
+			vrfName = netDev.vrf.name
+		}
+		v := getVrfByName(vrfName)
+		if v == nil {
+			err = fmt.Errorf("vrf %s %w", vrfName, errApiNotFound)
+			return
+		}
+		if addrStr != "" {
+			// 設定したエントリなら運用設定から消す
+			for key := range runningConfig.neighbors {
+				netDev := getNetDevByName(key.ifName)
+				if key.address == fmtIpStr(addr) && netDev != nil && netDev.vrf == v {
+					err = apiEditRunning(fmt.Sprintf("no ipv6 neighbor %s %s", key.address, key.ifName))
+					return
+				}
+			}
+			if !deleteNDTableEntry(v, addr) {
+				err = fmt.Errorf("neighbor %s in vrf %s %w", fmtIpStr(addr), v.name, errApiNotFound)
+			}
+			return
+		}
+		for _, netDev := range netDevices {
+			if netDev.vrf == v {
+				flushNDTableEntries(netDev)
+			}
+		}
+	}); runErr != nil {
+		return runErr
+	}
+	return err
+}
+
+/* インターフェイスのアドレス、状態、送受信の統計 */
+func apiListInterfaces() ([]apiInterface, error) {
+	interfaces := []apiInterface{}
+	if err := apiRun(func() {
+		for _, netDev := range netDevices {
+			inf := apiInterface{
+				Name:    netDev.name,
+				Mac:     fmtMacStr(netDev.macAddr),
+				Up:      netDev.up,
+				Present: netDev.socketFd >= 0,
+				Vrf:     netDev.vrf.name,
+				Stats: apiInterfaceStats{
+					RxPackets: netDev.stats.rxPackets,
+					RxBytes:   netDev.stats.rxBytes,
+					RxErrors:  netDev.stats.rxErrors,
+					TxPackets: netDev.stats.txPackets,
+					TxBytes:   netDev.stats.txBytes,
+					TxErrors:  netDev.stats.txErrors,
+				},
+			}
+			if ipv6Dev := netDev.ipv6Dev; ipv6Dev != nil {
+				if ipv6Dev.configured {
+					inf.Address = fmt.Sprintf("%s/%d", fmtIpStr(ipv6Dev.address), ipv6Dev.prefixLen)
+				}
+				inf.LinkLocal = fmtIpStr(ipv6Dev.linkLocalAddr)
+			}
+			interfaces = append(interfaces, inf)
+		}
+	}); err != nil {
+		return nil, err
+	}
+	return interfaces, nil
+}
+
+/* インターフェイスのアドレスを設定する。設定済みのアドレスは置き換える。運用設定を変更する */
+func apiSetInterfaceAddress(ifName string, prefixStr string) error {
+	ip, _, err := net.ParseCIDR(prefixStr)
+	if err != nil || ip.To4() != nil {
+		return fmt.Errorf("%w ipv6 address %q", errApiInvalid, prefixStr)
+	}
+
+	if runErr := apiRun(func() {
+		if getNetDevByName(ifName) == nil {
+			err = fmt.Errorf("interface %s %w", ifName, errApiNotFound)
+			return
+		}
+		err = apiEditRunning(fmt.Sprintf("interface %s ipv6 address %s", ifName, prefixStr))
+	}); runErr != nil {
+		return runErr
+	}
+	return err
+}
+
+/* インターフェイスのアドレスの設定を外す。運用設定を変更する */
+func apiDeleteInterfaceAddress(ifName string) error {
+	var err error
+	if runErr := apiRun(func() {
+		if _, ok := runningConfig.addresses[ifName]; !ok {
+			err = fmt.Errorf("address of interface %s %w", ifName, errApiNotFound)
+			return
+		}
+		err = apiEditRunning(fmt.Sprintf("no interface %s ipv6 address", ifName))
+	}); runErr != nil {
+		return runErr
+	}
+	return err
+}
+
+/* 運用設定を変更する。イベントループで呼ぶこと */
+func apiEditRunning(line string) error {
+	err := configEditRunning(line)
+	if err != nil {
+		return fmt.Errorf("%w configuration: %s", errApiInvalid, err)
+	}
+	return nil
+}
+
+/* 設定のテキスト。sourceは"running"か"candidate" */
+func apiGetConfig(source string) (string, error) {
+	var text string
+	var err error
+	if runErr := apiRun(func() {
+		switch source {
+		case "", "running":
+			text = runningConfig.text()
+		case "candidate":
+			text = candidateConfig.text()
+		default:
+			err = fmt.Errorf("%w configuration source %q", errApiInvalid, source)
+		}
+	}); runErr != nil {
+		return "", runErr
+	}
+	return text, err
+}
+
+/* 候補設定をテキストの設定で置き換える */
+func apiLoadCandidate(text string) error {
+	cfg, err := parseRouterConfig(text)
+	if err != nil {
+		return fmt.Errorf("%w configuration: %s", errApiInvalid, err)
+	}
+	return apiRun(func() { candidateConfig = cfg })
+}
+
+/* 候補設定を1行分変更する */
+func apiEditCandidate(line string) error {
+	var err error
+	if runErr := apiRun(func() { err = candidateConfig.edit(strings.Fields(line), "") }); runErr != nil {
+		return runErr
+	}
+	if err != nil {
+		return fmt.Errorf("%w configuration: %s", errApiInvalid, err)
+	}
+	return nil
+}
+
+/* 候補設定の変更を捨てて運用設定に戻す */
+func apiDiscardCandidate() error {
+	return apiRun(func() { candidateConfig = runningConfig.clone() })
+}
+
+/* 運用設定から候補設定への差分 */
+func apiDiffConfig() ([]string, error) {
+	diff := []string{}
+	if err := apiRun(func() { diff = append(diff, diffRouterConfig(runningConfig, candidateConfig)...) }); err != nil {
+		return nil, err
+	}
+	return diff, nil
+}
+
+/* 候補設定をcommitする。confirmTimeoutが0より大きければcommit confirmed */
+func apiCommit(confirmTimeout time.Duration) error {
+	if confirmTimeout < 0 {
+		return fmt.Errorf("%w confirm timeout %s", errApiInvalid, confirmTimeout)
+	}
+	var err error
+	if runErr := apiRun(func() { err = commitCandidateConfig(confirmTimeout) }); runErr != nil {
+		return runErr
+	}
+	if err != nil {
+		return fmt.Errorf("%w configuration: %s", errApiInvalid, err)
+	}
+	return nil
+}
+
+/* n個前のcommitの設定を候補設定に読み込む */
+func apiRollback(n int) error {
+	var err error
+	if runErr := apiRun(func() { err = rollbackCandidateConfig(n) }); runErr != nil {
+		return runErr
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", err, errApiNotFound)
+	}
+	return nil
+}
+
+/* commitの履歴。indexはrollbackで指定する番号 */
+func apiListCommits() ([]apiConfigCommitEntry, error) {
+	commits := []apiConfigCommitEntry{}
+	if err := apiRun(func() {
+		for i, c := range configHistory {
+			commits = append(commits, apiConfigCommitEntry{Index: i, Time: c.time, Comment: c.comment})
+		}
+	}); err != nil {
+		return nil, err
+	}
+	return commits, nil
+}
+
+func apiMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/routes", apiRoutes)
+	mux.HandleFunc("/routes/lookup", apiRouteLookup)
+	mux.HandleFunc("/neighbors", apiNeighbors)
+	mux.HandleFunc("/interfaces", apiInterfaces)
+	mux.HandleFunc("/interfaces/address", apiInterfaceAddress)
+	mux.HandleFunc("/config", apiConfig)
+	mux.HandleFunc("/config/candidate", apiConfigCandidate)
+	mux.HandleFunc("/config/diff", apiConfigDiff)
+	mux.HandleFunc("/config/commit", apiConfigCommit)
+	mux.HandleFunc("/config/rollback", apiConfigRollback)
+	mux.HandleFunc("/config/commits", apiConfigCommits)
+	mux.HandleFunc("/logging", apiLogging)
+	mux.HandleFunc("/metrics", apiMetrics)
+	mux.HandleFunc("/drops", apiDrops)
+	mux.HandleFunc("/drops/trace", apiDropTrace)
+	mux.HandleFunc("/captures", apiCaptures)
+	mux.HandleFunc("/trace", apiTrace)
+	mux.HandleFunc("/flows", apiFlows)
+	mux.HandleFunc("/sflow", apiSflow)
+	return mux
+}
+
+func apiReply(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+/* 操作のエラーをステータスコードに変換して返す。エラーがなければ204を返す */
+func apiReplyResult(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, errApiInvalid):
+		apiReply(w, http.StatusBadRequest, apiError{Error: err.Error()})
+	case errors.Is(err, errApiNotFound):
+		apiReply(w, http.StatusNotFound, apiError{Error: err.Error()})
+	case errors.Is(err, errApiShutdown):
+		apiReply(w, http.StatusServiceUnavailable, apiError{Error: err.Error()})
+	default:
+		apiReply(w, http.StatusInternalServerError, apiError{Error: err.Error()})
+	}
+}
+
+func apiReplyMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	apiReply(w, http.StatusMethodNotAllowed, apiError{Error: fmt.Sprintf("method %s not allowed", r.Method)})
+}
+
+/*
+ * GET: FIBの経路の一覧。?vrf=default
+ * POST: スタティック経路の追加。{"vrf": "default", "prefix": "2001:db8::/64", "nextHop": "2001:db8::1"}
+ * DELETE: スタティック経路の削除。?vrf=default&prefix=2001:db8::/64
+ */
+func apiRoutes(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+		routes, err := apiListRoutes(query.Get("vrf"))
+		if err != nil {
+			apiReplyResult(w, err)
+			return
+		}
+		apiReply(w, http.StatusOK, routes)
+	case http.MethodPost:
+		var req struct {
+			Vrf     string `json:"vrf"`
+			Prefix  string `json:"prefix"`
+			NextHop string `json:"nextHop"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			apiReplyResult(w, fmt.Errorf("%w request: %s", errApiInvalid, err))
+			return
+		}
+		apiReplyResult(w, apiAddRoute(req.Vrf, req.Prefix, req.NextHop))
+	case http.MethodDelete:
+		apiReplyResult(w, apiDeleteRoute(query.Get("vrf"), query.Get("prefix")))
+	default:
+		apiReplyMethodNotAllowed(w, r)
+	}
+}
+
+/* GET: 宛先アドレスに使われる経路。?dst=2001:db8::1&vrf=default */
+func apiRouteLookup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apiReplyMethodNotAllowed(w, r)
+		return
+	}
+	route, err := apiLookupRoute(r.URL.Query().Get("vrf"), r.URL.Query().Get("dst"))
+	if err != nil {
+		apiReplyResult(w, err)
+		return
+	}
+	apiReply(w, http.StatusOK, route)
+}
+
+/*
+ * GET: NDテーブルのエントリの一覧。?vrf=default
+ * POST: スタティックなエントリの追加。{"interface": "router1-host1", "address": "2001:db8::2", "mac": "02:00:00:00:00:01"}
+ * DELETE: エントリの削除。?address=2001:db8::2&interface=router1-host1&vrf=default
+ */
+func apiNeighbors(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch r.Method {
+	case http.MethodGet:
+		neighbors, err := apiListNeighbors(query.Get("vrf"))
+		if err != nil {
+			apiReplyResult(w, err)
+			return
+		}
+		apiReply(w, http.StatusOK, neighbors)
+	case http.MethodPost:
+		var req struct {
+			Interface string `json:"interface"`
+			Address   string `json:"address"`
+			Mac       string `json:"mac"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			apiReplyResult(w, fmt.Errorf("%w request: %s", errApiInvalid, err))
+			return
+		}
+		apiReplyResult(w, apiAddNeighbor(req.Interface, req.Address, req.Mac))
+	case http.MethodDelete:
+		apiReplyResult(w, apiDeleteNeighbors(query.Get("vrf"), query.Get("interface"), query.Get("address")))
+	default:
+		apiReplyMethodNotAllowed(w, r)
+	}
+}
+
+/* GET: インターフェイスのアドレス、状態、送受信の統計 */
+func apiInterfaces(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apiReplyMethodNotAllowed(w, r)
+		return
+	}
+	interfaces, err := apiListInterfaces()
+	if err != nil {
+		apiReplyResult(w, err)
+		return
+	}
+	apiReply(w, http.StatusOK, interfaces)
+}
+
+/*
+ * POST: インターフェイスのアドレスの設定。{"interface": "router1-host1", "address": "2001:db8::1/64"}
+ * DELETE: アドレスの設定を外す。?interface=router1-host1
+ */
+func apiInterfaceAddress(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		var req struct {
+			Interface string `json:"interface"`
+			Address   string `json:"address"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			apiReplyResult(w, fmt.Errorf("%w request: %s", errApiInvalid, err))
+			return
+		}
+		apiReplyResult(w, apiSetInterfaceAddress(req.Interface, req.Address))
+	case http.MethodDelete:
+		apiReplyResult(w, apiDeleteInterfaceAddress(r.URL.Query().Get("interface")))
+	default:
+		apiReplyMethodNotAllowed(w, r)
+	}
+}
+
+/* ログレベルとサブシステムごとのデバッグの状態。atomicで持っているのでイベントループを通さない */
+func apiGetLogging() apiLoggingState {
+	res := apiLoggingState{Level: strings.ToLower(logLevel.Level().String()), Debug: map[string]bool{}}
+	for _, subsys := range logSubsystems() {
+		res.Debug[subsys] = logDebug[subsys].Load()
+	}
+	return res
+}
+
+/* levelが空ならレベルは変えない。debugに含まれるサブシステムだけ切り替える */
+func apiSetLogging(level string, debug map[string]bool) error {
+	for subsys := range debug {
+		if _, ok := logDebug[subsys]; !ok {
+			return fmt.Errorf("%w log subsystem %q", errApiInvalid, subsys)
+		}
+	}
+	if level != "" {
+		err := configLogLevel(level)
+		if err != nil {
+			return fmt.Errorf("%w log level %q", errApiInvalid, level)
+		}
+	}
+	for subsys, on := range debug {
+		configLogDebug(subsys, on)
+	}
+	apiLog.Info("logging changed", "level", logLevel.Level().String())
+	return nil
+}
+
+/* 0でない数だけを理由の名前で */
+func apiDropCountsByName(counts *[DROP_REASON_MAX]uint64) map[string]uint64 {
+	res := map[string]uint64{}
+	for reason, n := range counts {
+		if n > 0 {
+			res[dropReason(reason).String()] = n
+		}
+	}
+	return res
+}
+
+/* 捨てたパケットの理由ごとの数。ifNameを指定すればそのインターフェイスだけ */
+func apiGetDrops(ifName string) (*apiDropCounts, error) {
+	res := &apiDropCounts{Interfaces: []apiInterfaceDrops{}}
+	found := ifName == ""
+	if err := apiRun(func() {
+		res.Total = apiDropCountsByName(&dropCounts)
+		res.Local = apiDropCountsByName(&dropLocalCounts)
+		for _, netDev := range netDevices {
+			if ifName != "" && netDev.name != ifName {
+				continue
+			}
+			found = true
+			res.Interfaces = append(res.Interfaces, apiInterfaceDrops{Name: netDev.name, Drops: apiDropCountsByName(&netDev.stats.drops)})
+		}
+	}); err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("interface %s %w", ifName, errApiNotFound)
+	}
+	return res, nil
+}
+
+func apiGetDropTrace() (apiDropTraceState, error) {
+	res := apiDropTraceState{Reasons: []string{}, Packets: []apiDroppedPacket{}}
+	if err := apiRun(func() {
+		res.Enabled = dropTrace.enabled
+		for reason := range dropTrace.reasons {
+			res.Reasons = append(res.Reasons, reason.String())
+		}
+		for _, entry := range dropTraceEntries() {
+			typ := "ipv6"
+			if entry.ethernet {
+				typ = "ethernet"
+			}
+			res.Packets = append(res.Packets, apiDroppedPacket{
+				Time:      entry.time,
+				Interface: entry.dev,
+				Reason:    entry.reason.String(),
+				Type:      typ,
+				Data:      hex.EncodeToString(entry.data),
+			})
+		}
+	}); err != nil {
+		return apiDropTraceState{}, err
+	}
+	sort.Strings(res.Reasons)
+	return res, nil
+}
+
+/* トレースを切り替える。reasonsが空なら全ての理由で残す */
+func apiSetDropTrace(enabled bool, reasonNames []string) error {
+	var reasons []dropReason
+	for _, name := range reasonNames {
+		reason, ok := parseDropReason(name)
+		if !ok {
+			return fmt.Errorf("%w drop reason %q", errApiInvalid, name)
+		}
+		reasons = append(reasons, reason)
+	}
+	return apiRun(func() { configDropTrace(enabled, reasons) })
+}
+
+/*
+ * キャプチャを始めてセッションのIDを返す。
+ * ファイルやソケットを開くのはイベントループを止めないように外でする。
+ */
+func apiStartCapture(req apiCaptureRequest) (int, error) {
+	s := &captureSession{
+		ifName:     req.Interface,
+		filterExpr: req.Filter,
+		snapLen:    req.SnapLen,
+		maxPackets: req.MaxPackets,
+		maxBytes:   req.MaxBytes,
+	}
+	if s.snapLen == 0 {
+		s.snapLen = CAPTURE_DEFAULT_SNAPLEN
+	}
+	stages := req.Stages
+	if len(stages) == 0 {
+		stages = []string{CAPTURE_RX.String(), CAPTURE_TX.String()}
+	}
+	for _, name := range stages {
+		stage, ok := parseCaptureStage(name)
+		if !ok {
+			return 0, fmt.Errorf("%w capture stage %q", errApiInvalid, name)
+		}
+		s.stages[stage] = true
+	}
+	filter, err := parseCaptureFilter(req.Filter)
+	if err != nil {
+		return 0, fmt.Errorf("%w capture filter: %s", errApiInvalid, err)
+	}
+	s.filter = filter
+	if (req.File == "") == (req.Socket == "") {
+		return 0, fmt.Errorf("%w capture output: either file or socket is required", errApiInvalid)
+	}
+	if req.Interface != "" {
+		found := false
+		if err := apiRun(func() { found = getNetDevByName(req.Interface) != nil }); err != nil {
+			return 0, err
+		}
+		if !found {
+			return 0, fmt.Errorf("interface %s %w", req.Interface, errApiNotFound)
+		}
+	}
+
+	var out io.WriteCloser
+	if req.File != "" {
+		s.output = req.File
+		out, err = os.OpenFile(req.File, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	} else {
+		s.output = "unix:" + req.Socket
+		out, err = net.Dial("unix", req.Socket)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("%w capture output: %s", errApiInvalid, err)
+	}
+	if err := apiRun(func() { startCapture(s, out) }); err != nil {
+		out.Close()
+		return 0, err
+	}
+	return s.id, nil
+}
+
+func apiListCaptures() ([]apiCapture, error) {
+	res := []apiCapture{}
+	if err := apiRun(func() {
+		for _, s := range captureSessions {
+			res = append(res, apiCapture{
+				Id:         s.id,
+				Interface:  s.ifName,
+				Stages:     s.stageNames(),
+				Filter:     s.filterExpr,
+				SnapLen:    s.snapLen,
+				MaxPackets: s.maxPackets,
+				MaxBytes:   s.maxBytes,
+				Output:     s.output,
+				Packets:    s.packets,
+				Bytes:      s.bytes,
+				Lost:       s.lost,
+				Active:     s.active,
+				StopReason: s.stopReason,
+			})
+		}
+	}); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+/* 動いていれば止めて、一覧から消す */
+func apiStopCapture(id int) error {
+	found := false
+	if err := apiRun(func() { found = deleteCapture(id) }); err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("capture %d %w", id, errApiNotFound)
+	}
+	return nil
+}
+
+/* 次に受信するcount個のパケットのトレースを始める。それまでのトレースは消える */
+func apiStartPacketTrace(req apiPacketTraceRequest) error {
+	if req.Count <= 0 || req.Count > PACKET_TRACE_MAX {
+		return fmt.Errorf("%w trace count %d, must be 1 to %d", errApiInvalid, req.Count, PACKET_TRACE_MAX)
+	}
+	filter, err := parseCaptureFilter(req.Filter)
+	if err != nil {
+		return fmt.Errorf("%w trace filter: %s", errApiInvalid, err)
+	}
+	if runErr := apiRun(func() {
+		if req.Interface != "" && getNetDevByName(req.Interface) == nil {
+			err = fmt.Errorf("interface %s %w", req.Interface, errApiNotFound)
+			return
+		}
+		configPacketTrace(req.Count, req.Interface, req.Filter, filter)
+	}); runErr != nil {
+		return runErr
+	}
+	return err
+}
+
+/* トレースを止め、残したパケットを消す */
+func apiClearPacketTrace() error {
+	return apiRun(func() { configPacketTrace(0, "", "", nil) })
+}
+
+func apiGetPacketTrace() (apiPacketTrace, error) {
+	res := apiPacketTrace{Packets: []apiTracedPacket{}}
+	if err := apiRun(func() {
+		res.Remaining = packetTrace.remaining
+		res.Interface = packetTrace.ifName
+		res.Filter = packetTrace.filterExpr
+		for _, entry := range packetTrace.entries {
+			p := apiTracedPacket{
+				Id:        entry.id,
+				Time:      entry.time,
+				Interface: entry.dev,
+				Length:    entry.length,
+				Summary:   entry.summary,
+				Steps:     []apiPacketTraceStep{},
+			}
+			for _, step := range entry.steps {
+				p.Steps = append(p.Steps, apiPacketTraceStep{
+					Node:      step.node,
+					Decision:  step.decision,
+					Route:     step.route,
+					Neighbor:  step.neighbor,
+					Interface: step.outDev,
+				})
+			}
+			res.Packets = append(res.Packets, p)
+		}
+	}); err != nil {
+		return apiPacketTrace{}, err
+	}
+	return res, nil
+}
+
+func apiGetPacketTraceText() (string, error) {
+	var text string
+	if err := apiRun(func() { text = packetTraceText() }); err != nil {
+		return "", err
+	}
+	return text, nil
+}
+
+/* エクスポートの状態とフローキャッシュにあるフロー。バイト数の多い順 */
+func apiGetFlows() (apiFlowState, error) {
+	res := apiFlowState{Flows: []apiFlow{}}
+	if err := apiRun(func() {
+		res.Enabled = ipfixExporter.enabled
+		if res.Enabled {
+			res.Collector = ipfixExporter.collector
+			res.ActiveTimeout = int(ipfixExporter.activeTimeout.Seconds())
+			res.InactiveTimeout = int(ipfixExporter.inactiveTimeout.Seconds())
+		}
+		res.Exported = ipfixExporter.exported
+		res.Messages = ipfixExporter.messages
+		res.Errors = ipfixExporter.errors
+		res.CacheFull = ipfixExporter.cacheFull
+		for _, flow := range ipfixExporter.flows {
+			f := apiFlow{
+				Src:         fmtIpStr(flow.key.srcAddr),
+				Dst:         fmtIpStr(flow.key.dstAddr),
+				Proto:       flow.key.proto,
+				SrcPort:     flow.key.srcPort,
+				DstPort:     flow.key.dstPort,
+				InInterface: flow.inDev.name,
+				Packets:     flow.packets,
+				Bytes:       flow.octets,
+				Start:       flow.start,
+				Last:        flow.last,
+			}
+			if flow.outDev != nil {
+				f.OutInterface = flow.outDev.name
+			}
+			res.Flows = append(res.Flows, f)
+		}
+	}); err != nil {
+		return apiFlowState{}, err
+	}
+	sort.Slice(res.Flows, func(i, j int) bool { return res.Flows[i].Bytes > res.Flows[j].Bytes })
+	return res, nil
+}
+
+/* sFlowエージェントの状態とサンプリングしているインターフェイス。インターフェイス名の順 */
+func apiGetSflow() (apiSflowState, error) {
+	res := apiSflowState{Interfaces: []apiSflowInterface{}}
+	if err := apiRun(func() {
+		res.Enabled = sflowAgent.enabled
+		if res.Enabled {
+			res.Collector = sflowAgent.collector
+			res.Agent = sflowAgent.agentAddr.String()
+			res.PollingInterval = int(sflowAgent.pollingInterval.Seconds())
+		}
+		res.Datagrams = sflowAgent.sent
+		res.Errors = sflowAgent.errors
+		for _, netDev := range netDevices {
+			if netDev.sflow == nil {
+				continue
+			}
+			res.Interfaces = append(res.Interfaces, apiSflowInterface{
+				Name:         netDev.name,
+				SamplingRate: netDev.sflow.rate,
+				Pool:         netDev.sflow.pool,
+				Samples:      netDev.sflow.samples,
+			})
+		}
+	}); err != nil {
+		return apiSflowState{}, err
+	}
+	sort.Slice(res.Interfaces, func(i, j int) bool { return res.Interfaces[i].Name < res.Interfaces[j].Name })
+	return res, nil
+}
+
+/* Prometheusのテキスト形式のメトリクス */
+func apiGetMetrics() ([]byte, error) {
+	var metrics []byte
+	if err := apiRun(func() { metrics = writeMetrics() }); err != nil {
+		return nil, err
+	}
+	return metrics, nil
+}
+
+/* GET: 設定のテキスト。?source=running|candidate */
+func apiConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apiReplyMethodNotAllowed(w, r)
+		return
+	}
+	text, err := apiGetConfig(r.URL.Query().Get("source"))
+	if err != nil {
+		apiReplyResult(w, err)
+		return
+	}
+	apiReply(w, http.StatusOK, map[string]string{"config": text})
+}
+
+/*
+ * PUT: 候補設定の置き換え。{"config": "ipv6 route ...\n..."}
+ * POST: 候補設定の1行分の変更。{"command": "no ipv6 route 2001:db8::/64"}
+ * DELETE: 候補設定の変更を捨てる
+ */
+func apiConfigCandidate(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPut:
+		var req struct {
+			Config string `json:"config"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			apiReplyResult(w, fmt.Errorf("%w request: %s", errApiInvalid, err))
+			return
+		}
+		apiReplyResult(w, apiLoadCandidate(req.Config))
+	case http.MethodPost:
+		var req struct {
+			Command string `json:"command"`
+		}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			apiReplyResult(w, fmt.Errorf("%w request: %s", errApiInvalid, err))
+			return
+		}
+		apiReplyResult(w, apiEditCandidate(req.Command))
+	case http.MethodDelete:
+		apiReplyResult(w, apiDiscardCandidate())
+	default:
+		apiReplyMethodNotAllowed(w, r)
+	}
+}
+
+/* GET: 運用設定から候補設定への差分 */
+func apiConfigDiff(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apiReplyMethodNotAllowed(w, r)
+		return
+	}
+	diff, err := apiDiffConfig()
+	if err != nil {
+		apiReplyResult(w, err)
+		return
+	}
+	apiReply(w, http.StatusOK, map[string][]string{"diff": diff})
+}
+
+/* POST: 候補設定のcommit。{"confirmTimeout": 60}で60秒以内に再びcommitしなければ元に戻す */
+func apiConfigCommit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apiReplyMethodNotAllowed(w, r)
+		return
+	}
+	var req struct {
+		ConfirmTimeout int `json:"confirmTimeout"`
+	}
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			apiReplyResult(w, fmt.Errorf("%w request: %s", errApiInvalid, err))
+			return
+		}
+	}
+	apiReplyResult(w, apiCommit(time.Duration(req.ConfirmTimeout)*time.Second))
+}
+
+/* POST: commitの履歴の設定を候補設定に読み込む。{"index": 1} */
+func apiConfigRollback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apiReplyMethodNotAllowed(w, r)
+		return
+	}
+	var req struct {
+		Index int `json:"index"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		apiReplyResult(w, fmt.Errorf("%w request: %s", errApiInvalid, err))
+		return
+	}
+	apiReplyResult(w, apiRollback(req.Index))
+}
+
+/* GET: commitの履歴 */
+func apiConfigCommits(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apiReplyMethodNotAllowed(w, r)
+		return
+	}
+	commits, err := apiListCommits()
+	if err != nil {
+		apiReplyResult(w, err)
+		return
+	}
+	apiReply(w, http.StatusOK, commits)
+}
+
+/*
+ * GET: ログレベルとデバッグの状態
+ * PUT: ログレベルとデバッグの切り替え。{"level": "info", "debug": {"nd": true, "fib": false}}
+ */
+func apiLogging(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		apiReply(w, http.StatusOK, apiGetLogging())
+	case http.MethodPut:
+		var req apiLoggingState
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			apiReplyResult(w, fmt.Errorf("%w request: %s", errApiInvalid, err))
+			return
+		}
+		err = apiSetLogging(req.Level, req.Debug)
+		if err != nil {
+			apiReplyResult(w, err)
+			return
+		}
+		apiReply(w, http.StatusOK, apiGetLogging())
+	default:
+		apiReplyMethodNotAllowed(w, r)
+	}
+}
+
+/* GET: 捨てたパケットの理由ごとの数。?interface=で絞る */
+func apiDrops(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apiReplyMethodNotAllowed(w, r)
+		return
+	}
+	drops, err := apiGetDrops(r.URL.Query().Get("interface"))
+	if err != nil {
+		apiReplyResult(w, err)
+		return
+	}
+	apiReply(w, http.StatusOK, drops)
+}
+
+/*
+ * GET: トレースの状態と残っているパケット
+ * PUT: トレースの切り替え。{"enabled": true, "reasons": ["no_route", "no_neighbor"]}
+ */
+func apiDropTrace(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		res, err := apiGetDropTrace()
+		if err != nil {
+			apiReplyResult(w, err)
+			return
+		}
+		apiReply(w, http.StatusOK, res)
+	case http.MethodPut:
+		var req apiDropTraceState
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			apiReplyResult(w, fmt.Errorf("%w request: %s", errApiInvalid, err))
+			return
+		}
+		apiReplyResult(w, apiSetDropTrace(req.Enabled, req.Reasons))
+	default:
+		apiReplyMethodNotAllowed(w, r)
+	}
+}
+
+/*
+ * GET: キャプチャのセッションの一覧
+ * POST: キャプチャを始める。{"interface": "eth0", "stages": ["rx", "dropped"], "filter": "icmp6", "file": "/tmp/eth0.pcapng"}
+ * DELETE: キャプチャを止める。?id=1
+ */
+func apiCaptures(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		captures, err := apiListCaptures()
+		if err != nil {
+			apiReplyResult(w, err)
+			return
+		}
+		apiReply(w, http.StatusOK, captures)
+	case http.MethodPost:
+		var req apiCaptureRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			apiReplyResult(w, fmt.Errorf("%w request: %s", errApiInvalid, err))
+			return
+		}
+		id, err := apiStartCapture(req)
+		if err != nil {
+			apiReplyResult(w, err)
+			return
+		}
+		apiReply(w, http.StatusCreated, map[string]int{"id": id})
+	case http.MethodDelete:
+		id, err := strconv.Atoi(r.URL.Query().Get("id"))
+		if err != nil {
+			apiReplyResult(w, fmt.Errorf("%w capture id %q", errApiInvalid, r.URL.Query().Get("id")))
+			return
+		}
+		apiReplyResult(w, apiStopCapture(id))
+	default:
+		apiReplyMethodNotAllowed(w, r)
+	}
+}
+
+/*
+ * GET: トレースしたパケット。?format=textなら"show trace"のテキスト
+ * PUT: トレースを始める。{"count": 10, "interface": "eth0", "filter": "icmp6 and host 2001:db8::2"}
+ * DELETE: トレースを止めて消す
+ */
+func apiTrace(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Get("format") == "text" {
+			text, err := apiGetPacketTraceText()
+			if err != nil {
+				apiReplyResult(w, err)
+				return
+			}
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			w.Write([]byte(text))
+			return
+		}
+		res, err := apiGetPacketTrace()
+		if err != nil {
+			apiReplyResult(w, err)
+			return
+		}
+		apiReply(w, http.StatusOK, res)
+	case http.MethodPut:
+		var req apiPacketTraceRequest
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			apiReplyResult(w, fmt.Errorf("%w request: %s", errApiInvalid, err))
+			return
+		}
+		apiReplyResult(w, apiStartPacketTrace(req))
+	case http.MethodDelete:
+		apiReplyResult(w, apiClearPacketTrace())
+	default:
+		apiReplyMethodNotAllowed(w, r)
+	}
+}
+
+/* GET: IPFIXのエクスポートの状態とフローキャッシュ */
+func apiFlows(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apiReplyMethodNotAllowed(w, r)
+		return
+	}
+	res, err := apiGetFlows()
+	if err != nil {
+		apiReplyResult(w, err)
+		return
+	}
+	apiReply(w, http.StatusOK, res)
+}
+
+/* GET: sFlowエージェントの状態 */
+func apiSflow(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apiReplyMethodNotAllowed(w, r)
+		return
+	}
+	res, err := apiGetSflow()
+	if err != nil {
+		apiReplyResult(w, err)
+		return
+	}
+	apiReply(w, http.StatusOK, res)
+}
+
+/* GET: Prometheusのメトリクス */
+func apiMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		apiReplyMethodNotAllowed(w, r)
+		return
+	}
+	metrics, err := apiGetMetrics()
+	if err != nil {
+		apiReplyResult(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(metrics)
+}
+
+func newApiRoute(v *vrf, prefix in6Addr, prefixLen uint8, route *ipv6RouteEntry) apiRoute {
+	res := apiRoute{
+		Vrf:      v.name,
+		Prefix:   fmt.Sprintf("%s/%d", fmtIpStr(prefix), prefixLen),
+		Type:     route.routeType.String(),
+		Proto:    route.proto.String(),
+		Metric:   route.metric,
+		Distance: route.adminDistance(),
+	}
+	if route.dev != nil {
+		res.Interface = route.dev.name
+	}
+	switch route.routeType {
+	case NETWORK:
+		res.NextHop = fmtIpStr(route.nextHop)
+	case VRF_LEAK:
+		res.LeakVrf = route.vrf.name
+	}
+	return res
+}
+
+func newApiNeighbor(v *vrf, entry *ndTableEntry) apiNeighbor {
+	return apiNeighbor{
+		Vrf:       v.name,
+		Address:   fmtIpStr(entry.v6Addr),
+		Mac:       fmtMacStr(entry.macAddr),
+		Interface: entry.dev.name,
+		Static:    entry.static,
+	}
+}
+
+func apiVrfName(name string) string {
+	if name == "" {
+		return DEFAULT_VRF_NAME
+	}
+	return name
+}
+
+func apiParseAddr(addrStr string) (in6Addr, error) {
+	ip := net.ParseIP(addrStr)
+	if ip == nil || ip.To4() != nil {
+		return in6Addr{}, fmt.Errorf("%w ipv6 addr %q", errApiInvalid, addrStr)
+	}
+	return in6Addr(ip.To16()), nil
+}
+
+func apiParsePrefix(prefixStr string) (in6Addr, uint8, error) {
+	ip, ipNet, err := net.ParseCIDR(prefixStr)
+	if err != nil || ip.To4() != nil {
+		return in6Addr{}, 0, fmt.Errorf("%w ipv6 prefix %q", errApiInvalid, prefixStr)
+	}
+	prefixLen, _ := ipNet.Mask.Size()
+	return in6Addr(ipNet.IP.To16()), uint8(prefixLen), nil
+}
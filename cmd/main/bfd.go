@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+)
+
+/**
+ * BFD(RFC 5880)のシングルホップIPv6(RFC 5881)
+ * ネクストホップや近隣ルータの生存を監視し、落ちたら登録したクライアントに知らせる
+ */
+const BFD_PORT uint16 = 3784
+const BFD_VERSION uint8 = 1
+const BFD_PACKET_LEN = 24
+
+// セッションがUpでないときの送信間隔の下限
+const BFD_SLOW_TX_INTERVAL = time.Second
+
+const BFD_DEFAULT_DETECT_MULT uint8 = 3
+const BFD_DEFAULT_MIN_TX = 300 * time.Millisecond
+const BFD_DEFAULT_MIN_RX = 300 * time.Millisecond
+
+type bfdState uint8
+
+const (
+	BFD_STATE_ADMIN_DOWN bfdState = iota
+	BFD_STATE_DOWN
+	BFD_STATE_INIT
+	BFD_STATE_UP
+)
+
+const (
+	BFD_DIAG_NONE uint8 = iota
+	BFD_DIAG_DETECT_EXPIRED
+	BFD_DIAG_ECHO_FAILED
+	BFD_DIAG_NEIGHBOR_DOWN
+)
+
+const BFD_DIAG_ADMIN_DOWN uint8 = 7
+
+const BFD_FLAG_POLL uint8 = 0x20
+const BFD_FLAG_FINAL uint8 = 0x10
+
+type bfdSession struct {
+	dev         *netDevice
+	peer        in6Addr
+	srcPort     uint16
+	state       bfdState
+	remoteState bfdState
+	diag        uint8
+	localDiscr  uint32
+	remoteDiscr uint32
+
+	detectMult    uint8
+	desiredMinTx  time.Duration // 広告している送信間隔
+	requiredMinRx time.Duration
+	configMinTx   time.Duration // Upのときに使う送信間隔
+
+	remoteDetectMult   uint8
+	remoteDesiredMinTx time.Duration
+	remoteMinRx        time.Duration
+
+	polling bool // パラメータ変更のPollシーケンス中
+
+	clients     []*bfdClient
+	txTimer     *timer
+	detectTimer *timer
+}
+
+/* セッションを使うクライアント。状態が変わるとfnが呼ばれる */
+type bfdClient struct {
+	session *bfdSession
+	fn      func(up bool)
+}
+
+var bfdSessions []*bfdSession
+
+var bfdDetectMult = BFD_DEFAULT_DETECT_MULT
+var bfdMinTx = BFD_DEFAULT_MIN_TX
+var bfdMinRx = BFD_DEFAULT_MIN_RX
+
+// BFDで監視している静的経路
+var bfdStaticRoutes = map[ribKey]*bfdClient{}
+
+/* "bfd interval"の設定 */
+type bfdIntervalConfig struct {
+	minTx      time.Duration
+	minRx      time.Duration
+	detectMult uint8
+}
+
+/* MINTX min-rx MINRX multiplier MULTIPLIER。間隔はミリ秒 */
+func parseBfdInterval(words []string) (*bfdIntervalConfig, error) {
+	if len(words) != 5 || words[1] != "min-rx" || words[3] != "multiplier" {
+		return nil, fmt.Errorf("usage: bfd interval MINTX min-rx MINRX multiplier MULTIPLIER")
+	}
+	minTx, err := strconv.ParseUint(words[0], 10, 32)
+	if err != nil || minTx == 0 {
+		return nil, fmt.Errorf("invalid interval %s", words[0])
+	}
+	minRx, err := strconv.ParseUint(words[2], 10, 32)
+	if err != nil || minRx == 0 {
+		return nil, fmt.Errorf("invalid min-rx %s", words[2])
+	}
+	detectMult, err := strconv.ParseUint(words[4], 10, 8)
+	if err != nil || detectMult == 0 {
+		return nil, fmt.Errorf("invalid multiplier %s", words[4])
+	}
+	return &bfdIntervalConfig{
+		minTx:      time.Duration(minTx) * time.Millisecond,
+		minRx:      time.Duration(minRx) * time.Millisecond,
+		detectMult: uint8(detectMult),
+	}, nil
+}
+
+/* 設定ファイルに書く形 */
+func (config *bfdIntervalConfig) String() string {
+	return fmt.Sprintf("%d min-rx %d multiplier %d", config.minTx.Milliseconds(), config.minRx.Milliseconds(), config.detectMult)
+}
+
+func (state bfdState) String() string {
+	return [...]string{"AdminDown", "Down", "Init", "Up"}[state]
+}
+
+func (s *bfdSession) String() string {
+	return fmt.Sprintf("%s%%%s", fmtIpStr(s.peer), s.dev.name)
+}
+
+/* これから作るセッションのタイマー値を設定する */
+func configBfd(minTx time.Duration, minRx time.Duration, detectMult uint8) {
+	bfdMinTx = minTx
+	bfdMinRx = minRx
+	bfdDetectMult = detectMult
+	configLog.Info("configure bfd", "minTx", minTx.String(), "minRx", minRx.String(), "multiplier", detectMult)
+}
+
+/*
+ * BFDで監視する静的経路を設定する。経路はセッションがUpの間だけRIBに入る。
+ * ネクストホップは直結のネットワークにある必要がある。
+ */
+func configIpv6NetRouteBfd(prefix in6Addr, prefixLen uint8, nextHop in6Addr) {
+	node := patriciaTrieSearch(defaultVrf.fib, nextHop)
+	if node == nil || node.route == nil || node.route.routeType != CONNECTED {
+		bfdLog.Warn("bfd next hop is not directly connected", "nexthop", nextHop)
+		return
+	}
+
+	key := ribKey{prefix: in6AddrClearPrefix(prefix, prefixLen), prefixLen: prefixLen}
+	unconfigIpv6NetRouteBfd(key.prefix, key.prefixLen)
+
+	route := &ipv6RouteEntry{
+		routeType: NETWORK,
+		nextHop:   nextHop,
+		proto:     PROTO_STATIC,
+	}
+	bfdStaticRoutes[key] = bfdRegister(node.route.dev, nextHop, func(up bool) {
+		if up {
+			ribAdd(defaultVrf, key.prefix, key.prefixLen, route)
+		} else {
+			ribDelete(defaultVrf, key.prefix, key.prefixLen, PROTO_STATIC)
+		}
+	})
+
+	configLog.Info("configure route with bfd", "prefix", fmtPrefixStr(prefix, prefixLen), "nexthop", nextHop)
+}
+
+/* BFDで監視する静的経路を消す。使う経路がなくなればセッションも消える */
+func unconfigIpv6NetRouteBfd(prefix in6Addr, prefixLen uint8) {
+	key := ribKey{prefix: in6AddrClearPrefix(prefix, prefixLen), prefixLen: prefixLen}
+	client, ok := bfdStaticRoutes[key]
+	if !ok {
+		return
+	}
+	delete(bfdStaticRoutes, key)
+	bfdUnregister(client)
+	ribDelete(defaultVrf, key.prefix, key.prefixLen, PROTO_STATIC)
+	configLog.Info("unconfigure route with bfd", "prefix", fmtPrefixStr(key.prefix, key.prefixLen))
+}
+
+/* 相手とのセッションを作るか既存のものを使い、状態変化を受け取るクライアントを登録する */
+func bfdRegister(netDev *netDevice, peer in6Addr, fn func(up bool)) *bfdClient {
+	var session *bfdSession
+	for _, s := range bfdSessions {
+		if s.dev == netDev && s.peer == peer {
+			session = s
+			break
+		}
+	}
+	if session == nil {
+		session = bfdNewSession(netDev, peer)
+	}
+
+	client := &bfdClient{session: session, fn: fn}
+	session.clients = append(session.clients, client)
+	return client
+}
+
+/* クライアントの登録を外す。使うクライアントがいなくなったらセッションを消す */
+func bfdUnregister(client *bfdClient) {
+	if client == nil {
+		return
+	}
+	s := client.session
+	for i, c := range s.clients {
+		if c == client {
+			s.clients = append(s.clients[:i], s.clients[i+1:]...)
+			break
+		}
+	}
+	if len(s.clients) > 0 {
+		return
+	}
+
+	s.txTimer.stop()
+	s.detectTimer.stop()
+	for i, v := range bfdSessions {
+		if v == s {
+			bfdSessions = append(bfdSessions[:i], bfdSessions[i+1:]...)
+			break
+		}
+	}
+	bfdLog.Info("bfd session deleted", "peer", s.String())
+}
+
+func bfdNewSession(netDev *netDevice, peer in6Addr) *bfdSession {
+	if len(bfdSessions) == 0 {
+		registerUdpHandler(BFD_PORT, bfdInput)
+	}
+
+	s := &bfdSession{
+		dev:           netDev,
+		peer:          peer,
+		srcPort:       uint16(49152 + rand.Intn(16384)),
+		state:         BFD_STATE_DOWN,
+		localDiscr:    bfdNewDiscr(),
+		detectMult:    bfdDetectMult,
+		desiredMinTx:  BFD_SLOW_TX_INTERVAL,
+		requiredMinRx: bfdMinRx,
+		configMinTx:   bfdMinTx,
+		remoteMinRx:   time.Microsecond,
+	}
+	bfdSessions = append(bfdSessions, s)
+	bfdLog.Info("bfd session created", "peer", s.String(), "discriminator", s.localDiscr)
+
+	s.txTimer = newTimer(0, func() { bfdTxTimerExpired(s) })
+	return s
+}
+
+func bfdNewDiscr() uint32 {
+	for {
+		discr := rand.Uint32()
+		if discr != 0 && bfdSessionByDiscr(discr) == nil {
+			return discr
+		}
+	}
+}
+
+func bfdSessionByDiscr(discr uint32) *bfdSession {
+	for _, s := range bfdSessions {
+		if s.localDiscr == discr {
+			return s
+		}
+	}
+	return nil
+}
+
+/* 送信間隔は75%から100%の間でばらつかせる(RFC 5880 6.8.7) */
+func bfdTxInterval(s *bfdSession) time.Duration {
+	interval := s.desiredMinTx
+	if s.remoteMinRx > interval {
+		interval = s.remoteMinRx
+	}
+	maxPercent := 100
+	if s.detectMult == 1 {
+		maxPercent = 90
+	}
+	return interval * time.Duration(75+rand.Intn(maxPercent-75)) / 100
+}
+
+func bfdTxTimerExpired(s *bfdSession) {
+	// 相手が受信しないと言っている間は送らない
+	if s.remoteMinRx > 0 || s.polling {
+		bfdSend(s, 0)
+	}
+	s.txTimer.reset(bfdTxInterval(s))
+}
+
+func bfdSend(s *bfdSession, flags uint8) {
+	if s.polling && flags&BFD_FLAG_FINAL == 0 {
+		flags |= BFD_FLAG_POLL
+	}
+
+	var b bytes.Buffer
+	b.WriteByte(BFD_VERSION<<5 | s.diag)
+	b.WriteByte(uint8(s.state)<<6 | flags)
+	b.WriteByte(s.detectMult)
+	b.WriteByte(BFD_PACKET_LEN)
+	b.Write(uint32ToByte(s.localDiscr))
+	b.Write(uint32ToByte(s.remoteDiscr))
+	b.Write(uint32ToByte(uint32(s.desiredMinTx / time.Microsecond)))
+	b.Write(uint32ToByte(uint32(s.requiredMinRx / time.Microsecond)))
+	b.Write(uint32ToByte(0)) // エコーは使わない
+
+	srcAddr := s.dev.ipv6Dev.address
+	if in6AddrIsLinkLocal(s.peer) {
+		srcAddr = s.dev.ipv6Dev.linkLocalAddr
+	}
+	packet := udpEncap(srcAddr, s.peer, s.srcPort, BFD_PORT, b.Bytes())
+	ipv6EncapDevUnicastOutput(s.dev, srcAddr, s.peer, packet, IPV6_PROTOCOL_NUM_UDP)
+}
+
+/* 停止するときはAdminDownを送り、障害で落ちたのではないことを相手に知らせる(RFC 5880 6.8.16) */
+func bfdShutdown() {
+	for _, s := range bfdSessions {
+		s.txTimer.stop()
+		s.detectTimer.stop()
+		s.state = BFD_STATE_ADMIN_DOWN
+		s.diag = BFD_DIAG_ADMIN_DOWN
+		bfdSend(s, 0)
+	}
+}
+
+/* BFDパケットの受信処理(RFC 5880 6.8.6) */
+func bfdInput(netDev *netDevice, ipv6header *ipv6Header, srcPort uint16, payload []byte) {
+	// シングルホップなので途中のルータを通ってきたものは受け取らない(GTSM)
+	if ipv6header.hopLimit != 0xff {
+		return
+	}
+	if len(payload) < BFD_PACKET_LEN {
+		return
+	}
+
+	version := payload[0] >> 5
+	state := bfdState(payload[1] >> 6)
+	flags := payload[1] & 0x3f
+	detectMult := payload[2]
+	length := payload[3]
+	myDiscr := byteToUint32(payload[4:8])
+	yourDiscr := byteToUint32(payload[8:12])
+	desiredMinTx := time.Duration(byteToUint32(payload[12:16])) * time.Microsecond
+	requiredMinRx := time.Duration(byteToUint32(payload[16:20])) * time.Microsecond
+
+	if version != BFD_VERSION || int(length) < BFD_PACKET_LEN || int(length) > len(payload) || detectMult == 0 || myDiscr == 0 {
+		return
+	}
+	// 認証は扱わない
+	if flags&0x04 != 0 {
+		return
+	}
+
+	var s *bfdSession
+	if yourDiscr != 0 {
+		s = bfdSessionByDiscr(yourDiscr)
+	} else if state == BFD_STATE_DOWN || state == BFD_STATE_ADMIN_DOWN {
+		for _, v := range bfdSessions {
+			if v.dev == netDev && v.peer == ipv6header.srcAddr {
+				s = v
+				break
+			}
+		}
+	}
+	if s == nil || s.dev != netDev {
+		return
+	}
+
+	s.remoteDiscr = myDiscr
+	s.remoteState = state
+	s.remoteDetectMult = detectMult
+	s.remoteDesiredMinTx = desiredMinTx
+	prevRemoteMinRx := s.remoteMinRx
+	s.remoteMinRx = requiredMinRx
+
+	if flags&BFD_FLAG_FINAL != 0 && s.polling {
+		s.polling = false
+	}
+
+	// 検出時間は相手の検出倍率と、相手の送信間隔と自分の受信間隔の大きい方の積
+	detectTime := s.requiredMinRx
+	if desiredMinTx > detectTime {
+		detectTime = desiredMinTx
+	}
+	detectTime *= time.Duration(detectMult)
+	if s.detectTimer == nil {
+		s.detectTimer = newTimer(detectTime, func() { bfdDetectTimerExpired(s) })
+	} else {
+		s.detectTimer.reset(detectTime)
+	}
+
+	if state == BFD_STATE_ADMIN_DOWN {
+		if s.state != BFD_STATE_DOWN {
+			bfdSetState(s, BFD_STATE_DOWN, BFD_DIAG_NEIGHBOR_DOWN)
+		}
+	} else {
+		switch s.state {
+		case BFD_STATE_DOWN:
+			if state == BFD_STATE_DOWN {
+				bfdSetState(s, BFD_STATE_INIT, BFD_DIAG_NONE)
+			} else if state == BFD_STATE_INIT {
+				bfdSetState(s, BFD_STATE_UP, BFD_DIAG_NONE)
+			}
+		case BFD_STATE_INIT:
+			if state == BFD_STATE_INIT || state == BFD_STATE_UP {
+				bfdSetState(s, BFD_STATE_UP, BFD_DIAG_NONE)
+			}
+		case BFD_STATE_UP:
+			if state == BFD_STATE_DOWN {
+				bfdSetState(s, BFD_STATE_DOWN, BFD_DIAG_NEIGHBOR_DOWN)
+			}
+		}
+	}
+
+	if flags&BFD_FLAG_POLL != 0 {
+		bfdSend(s, BFD_FLAG_FINAL)
+	}
+	// 相手の受信間隔が短くなったらすぐに新しい間隔で送り始める
+	if s.remoteMinRx < prevRemoteMinRx {
+		s.txTimer.reset(bfdTxInterval(s))
+	}
+}
+
+func bfdDetectTimerExpired(s *bfdSession) {
+	if s.state == BFD_STATE_INIT || s.state == BFD_STATE_UP {
+		bfdLog.Info("bfd detection time expired", "peer", s.String())
+		s.remoteDiscr = 0
+		bfdSetState(s, BFD_STATE_DOWN, BFD_DIAG_DETECT_EXPIRED)
+	}
+}
+
+func bfdSetState(s *bfdSession, state bfdState, diag uint8) {
+	prev := s.state
+	bfdLog.Info("bfd session state changed", "peer", s.String(), "prev", prev.String(), "state", state.String())
+	s.state = state
+	s.diag = diag
+
+	if state == BFD_STATE_UP {
+		// Upになったら設定した間隔に速める。Pollシーケンスで相手に知らせる
+		s.desiredMinTx = s.configMinTx
+		s.polling = true
+		bfdSend(s, 0)
+		s.txTimer.reset(bfdTxInterval(s))
+	} else if prev == BFD_STATE_UP {
+		s.desiredMinTx = BFD_SLOW_TX_INTERVAL
+		s.polling = false
+	}
+
+	if state == BFD_STATE_UP || prev == BFD_STATE_UP {
+		// コールバックの中で登録が外されることがあるのでコピーしてから呼ぶ
+		clients := append([]*bfdClient{}, s.clients...)
+		for _, c := range clients {
+			c.fn(state == BFD_STATE_UP)
+		}
+	}
+}
@@ -0,0 +1,759 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+	"time"
+)
+
+/**
+ * BGP-4(RFC 4271)のセッション管理
+ * TCPはカーネルのソケットを使い、ノンブロッキングにしてイベントループのepollで監視する。
+ * そのためピアとの通信に使うアドレスはカーネル側のインターフェイスにも設定されている必要がある。
+ * リンクローカルアドレスはカーネルが自動で設定するので、リンクローカルでピアを張るのが簡単。
+ */
+const IPV6_PROTOCOL_NUM_TCP uint8 = 0x06
+
+const BGP_HOLD_TIME uint16 = 90
+const BGP_OPEN_HOLD_TIME = 240 * time.Second
+const BGP_CONNECT_RETRY_TIME = 30 * time.Second
+const BGP_IDLE_HOLD_TIME = 5 * time.Second
+
+// 停止するときに送りきれていないデータを待つ時間
+const BGP_DRAIN_TIMEOUT = time.Second
+
+type bgpState int
+
+const (
+	BGP_STATE_IDLE bgpState = iota
+	BGP_STATE_CONNECT
+	BGP_STATE_ACTIVE
+	BGP_STATE_OPEN_SENT
+	BGP_STATE_OPEN_CONFIRM
+	BGP_STATE_ESTABLISHED
+)
+
+/* ピアとのTCPコネクション */
+type bgpConn struct {
+	fd         int
+	peer       *bgpPeer
+	inbound    bool // 相手から張られたコネクションか
+	connecting bool // ノンブロッキングのconnectの完了待ち
+	closed     bool
+	rbuf       []byte
+	wbuf       []byte   // 書き込みきれなかったデータ
+	open       *bgpOpen // 受信したOPEN
+}
+
+type bgpPeer struct {
+	addr      in6Addr
+	dev       *netDevice // リンクローカルアドレスでピアを張るときのインターフェイス
+	remoteAs  uint32
+	state     bgpState
+	conn      *bgpConn
+	collision *bgpConn // OPEN交換中に相手から張られた2本目のコネクション(RFC 4271 6.8)
+
+	remoteId  uint32
+	as4       bool
+	holdTime  uint16 // ネゴシエーションしたホールドタイム
+	localAddr in6Addr
+
+	adjRibIn     map[ribKey]*bgpPathAttrs // インポートポリシー適用後の受信経路
+	adjRibOut    map[ribKey]*bgpPathAttrs // 広告済みの経路
+	importPolicy []bgpPolicyRule
+	exportPolicy []bgpPolicyRule
+	bfd          bool // セッションをBFDで監視する
+	bfdClient    *bfdClient
+
+	connectRetryTimer *timer
+	holdTimer         *timer
+	keepaliveTimer    *timer
+}
+
+var bgpLocalAs uint32
+var bgpRouterId uint32
+var bgpPeers []*bgpPeer
+var bgpListenFd = -1
+var bgpScanTimer *timer
+
+func (state bgpState) String() string {
+	return [...]string{"Idle", "Connect", "Active", "OpenSent", "OpenConfirm", "Established"}[state]
+}
+
+func (peer *bgpPeer) isIbgp() bool {
+	return peer.remoteAs == bgpLocalAs
+}
+
+func (peer *bgpPeer) String() string {
+	if peer.dev != nil {
+		return fmt.Sprintf("%s%%%s", fmtIpStr(peer.addr), peer.dev.name)
+	}
+	return fmtIpStr(peer.addr)
+}
+
+/* BGPを有効にする。ピアからの接続を受け付けるソケットもここで開く */
+func configBgpRouter(asn uint32, routerId string) {
+	bgpLocalAs = asn
+	bgpRouterId = parseRouterId(routerId)
+	configLog.Info("configure bgp", "as", bgpLocalAs, "routerId", fmtRouterIdStr(bgpRouterId))
+
+	if bgpListenFd >= 0 {
+		return
+	}
+	fd, err := bgpListen()
+	if err != nil {
+		bgpLog.Error("failed to listen", "err", err)
+		return
+	}
+	bgpListenFd = fd
+
+	bgpScanTimer = newTimer(BGP_SCAN_INTERVAL, bgpScan)
+}
+
+/*
+ * BGPを止める。ASやルータIDを変えるときにも使う。
+ * ピアにはCeaseを送って経路を取り消させ、自分が生成した経路と再配布した経路も捨てる。
+ */
+func unconfigBgp() {
+	for len(bgpPeers) > 0 {
+		unconfigBgpNeighbor(bgpPeers[0].addr)
+	}
+	for key := range bgpNetworks {
+		unconfigBgpNetwork(key.prefix, key.prefixLen)
+	}
+	redistributed := bgpRedistributed
+	bgpRedistributed = map[ribKey]*ipv6RouteEntry{}
+	for key := range redistributed {
+		bgpDecide(key)
+	}
+
+	bgpScanTimer.stop()
+	bgpScanTimer = nil
+	if bgpListenFd >= 0 {
+		epollDelete(bgpListenFd)
+		syscall.Close(bgpListenFd)
+		bgpListenFd = -1
+	}
+	bgpLocalAs = 0
+	bgpRouterId = 0
+	configLog.Info("unconfigure bgp")
+}
+
+/*
+ * ピアを設定する。netDevはピアのアドレスがリンクローカルアドレスのときに指定する。
+ */
+func configBgpNeighbor(addr in6Addr, remoteAs uint32, netDev *netDevice) {
+	if bgpLocalAs == 0 {
+		configLog.Warn("bgp is not configured")
+		return
+	}
+	if in6AddrIsLinkLocal(addr) && netDev == nil {
+		configLog.Warn("link local bgp neighbor needs interface", "peer", addr)
+		return
+	}
+
+	peer := &bgpPeer{
+		addr:      addr,
+		dev:       netDev,
+		remoteAs:  remoteAs,
+		adjRibIn:  make(map[ribKey]*bgpPathAttrs),
+		adjRibOut: make(map[ribKey]*bgpPathAttrs),
+	}
+	bgpPeers = append(bgpPeers, peer)
+	configLog.Info("configure bgp neighbor", "peer", peer.String(), "remoteAs", remoteAs)
+
+	bgpStart(peer)
+}
+
+/* ピアを消す。セッションがあればCease(Peer De-configured)を送り、受信した経路を取り消す */
+func unconfigBgpNeighbor(addr in6Addr) {
+	peer := getBgpPeer(addr)
+	if peer == nil {
+		return
+	}
+
+	bgpPeerDown(peer, &bgpError{code: BGP_ERR_CEASE, subcode: BGP_ERR_CEASE_PEER_DECONFIGURED})
+	peer.connectRetryTimer.stop()
+	for i := range bgpPeers {
+		if bgpPeers[i] == peer {
+			bgpPeers = append(bgpPeers[:i], bgpPeers[i+1:]...)
+			break
+		}
+	}
+	configLog.Info("unconfigure bgp neighbor", "peer", peer.String())
+}
+
+/* ポリシーを変えたときなどにセッションを張り直し、経路を受け取り直す */
+func bgpResetNeighbor(addr in6Addr) {
+	peer := getBgpPeer(addr)
+	if peer == nil || peer.state == BGP_STATE_IDLE {
+		return
+	}
+	bgpLog.Info("reset bgp neighbor", "peer", peer.String())
+	bgpPeerDown(peer, &bgpError{code: BGP_ERR_CEASE, subcode: BGP_ERR_CEASE_ADMIN_RESET})
+}
+
+/* ピアをBFDで監視し、BFDのセッションが落ちたらBGPのセッションも落とす。シングルホップのピアのみ */
+func configBgpNeighborBfd(addr in6Addr) {
+	peer := getBgpPeer(addr)
+	if peer == nil {
+		configLog.Warn("bgp neighbor not found", "peer", addr)
+		return
+	}
+	peer.bfd = true
+	configLog.Info("configure bgp bfd", "peer", peer.String())
+
+	if peer.state == BGP_STATE_ESTABLISHED && peer.bfdClient == nil {
+		bgpStartBfd(peer)
+	}
+}
+
+/* ピアのBFDでの監視をやめる。セッションはそのまま */
+func unconfigBgpNeighborBfd(addr in6Addr) {
+	peer := getBgpPeer(addr)
+	if peer == nil || !peer.bfd {
+		return
+	}
+	peer.bfd = false
+	bfdUnregister(peer.bfdClient)
+	peer.bfdClient = nil
+	configLog.Info("unconfigure bgp bfd", "peer", peer.String())
+}
+
+func getBgpPeer(addr in6Addr) *bgpPeer {
+	for _, peer := range bgpPeers {
+		if peer.addr == addr {
+			return peer
+		}
+	}
+	return nil
+}
+
+func bgpSetState(peer *bgpPeer, state bgpState) {
+	if peer.state == state {
+		return
+	}
+	bgpLog.Info("bgp neighbor state changed", "peer", peer.String(), "prev", peer.state.String(), "state", state.String())
+	peer.state = state
+}
+
+func bgpListen() (int, error) {
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return -1, err
+	}
+	syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1)
+	err = syscall.Bind(fd, &syscall.SockaddrInet6{Port: BGP_PORT})
+	if err == nil {
+		err = syscall.Listen(fd, 16)
+	}
+	if err == nil {
+		err = epollAdd(fd, syscall.EPOLLIN, func(events uint32) { bgpAccept(fd) })
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+/* 接続を始める。失敗してもConnectRetryタイマーで再試行する */
+func bgpStart(peer *bgpPeer) {
+	peer.connectRetryTimer.stop()
+	peer.connectRetryTimer = newTimer(BGP_CONNECT_RETRY_TIME, func() { bgpConnectRetryExpired(peer) })
+
+	fd, err := syscall.Socket(syscall.AF_INET6, syscall.SOCK_STREAM|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		bgpLog.Error("failed to create socket", "err", err)
+		bgpSetState(peer, BGP_STATE_ACTIVE)
+		return
+	}
+	sa := &syscall.SockaddrInet6{Port: BGP_PORT, Addr: peer.addr}
+	if peer.dev != nil {
+		sa.ZoneId = uint32(peer.dev.sockAddr.Ifindex)
+	}
+
+	conn := &bgpConn{fd: fd, peer: peer, connecting: true}
+	err = syscall.Connect(fd, sa)
+	if err != nil && err != syscall.EINPROGRESS {
+		bgpLog.Warn("failed to connect", "peer", peer.String(), "err", err)
+		syscall.Close(fd)
+		bgpSetState(peer, BGP_STATE_ACTIVE)
+		return
+	}
+	err = epollAdd(fd, syscall.EPOLLOUT, func(events uint32) { bgpConnEvent(conn, events) })
+	if err != nil {
+		bgpLog.Error("failed to watch connection", "peer", peer.String(), "err", err)
+		syscall.Close(fd)
+		bgpSetState(peer, BGP_STATE_ACTIVE)
+		return
+	}
+
+	peer.conn = conn
+	bgpSetState(peer, BGP_STATE_CONNECT)
+}
+
+func bgpConnectRetryExpired(peer *bgpPeer) {
+	switch peer.state {
+	case BGP_STATE_IDLE, BGP_STATE_CONNECT, BGP_STATE_ACTIVE:
+		if peer.conn != nil {
+			bgpConnClose(peer.conn)
+			peer.conn = nil
+		}
+		bgpStart(peer)
+	}
+}
+
+func bgpAccept(listenFd int) {
+	for {
+		fd, sa, err := syscall.Accept4(listenFd, syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC)
+		if err != nil {
+			if err != syscall.EAGAIN {
+				bgpLog.Warn("failed to accept", "err", err)
+			}
+			return
+		}
+
+		sa6, ok := sa.(*syscall.SockaddrInet6)
+		var peer *bgpPeer
+		if ok {
+			peer = getBgpPeer(in6Addr(sa6.Addr))
+		}
+		if peer == nil || (peer.dev != nil && sa6.ZoneId != uint32(peer.dev.sockAddr.Ifindex)) {
+			bgpLog.Info("connection from unknown peer rejected")
+			syscall.Close(fd)
+			continue
+		}
+
+		conn := &bgpConn{fd: fd, peer: peer, inbound: true}
+		err = epollAdd(fd, syscall.EPOLLIN, func(events uint32) { bgpConnEvent(conn, events) })
+		if err != nil {
+			bgpLog.Error("failed to watch connection", "peer", peer.String(), "err", err)
+			syscall.Close(fd)
+			continue
+		}
+		bgpLog.Info("connection accepted", "peer", peer.String())
+
+		switch peer.state {
+		case BGP_STATE_IDLE, BGP_STATE_CONNECT, BGP_STATE_ACTIVE:
+			// 接続中のコネクションは捨てて受け付けた方を使う
+			if peer.conn != nil {
+				bgpConnClose(peer.conn)
+			}
+			peer.conn = conn
+			bgpConnOpened(conn)
+		case BGP_STATE_OPEN_SENT, BGP_STATE_OPEN_CONFIRM:
+			if peer.collision != nil {
+				bgpConnClose(conn)
+				continue
+			}
+			// どちらを残すかはOPENを受け取ってルータIDで決める
+			peer.collision = conn
+			bgpConnLocalAddr(conn)
+			bgpSendOpen(conn)
+		default:
+			bgpConnSend(conn, bgpNotificationToPacket(&bgpError{code: BGP_ERR_CEASE, subcode: BGP_ERR_CEASE_COLLISION_RESOLUTION}))
+			bgpConnClose(conn)
+		}
+	}
+}
+
+func bgpConnLocalAddr(conn *bgpConn) {
+	sa, err := syscall.Getsockname(conn.fd)
+	if err != nil {
+		return
+	}
+	if sa6, ok := sa.(*syscall.SockaddrInet6); ok {
+		conn.peer.localAddr = in6Addr(sa6.Addr)
+	}
+}
+
+/* TCPコネクションが確立したらOPENを送る */
+func bgpConnOpened(conn *bgpConn) {
+	peer := conn.peer
+	bgpConnLocalAddr(conn)
+	peer.connectRetryTimer.stop()
+
+	bgpSendOpen(conn)
+	bgpSetState(peer, BGP_STATE_OPEN_SENT)
+
+	peer.holdTimer.stop()
+	peer.holdTimer = newTimer(BGP_OPEN_HOLD_TIME, func() { bgpHoldTimerExpired(peer) })
+}
+
+func bgpSendOpen(conn *bgpConn) {
+	open := bgpOpen{
+		version:  BGP_VERSION,
+		as:       bgpLocalAs,
+		holdTime: BGP_HOLD_TIME,
+		routerId: bgpRouterId,
+	}
+	bgpConnSend(conn, open.toPacket())
+}
+
+func bgpConnEvent(conn *bgpConn, events uint32) {
+	if conn.closed {
+		return
+	}
+	peer := conn.peer
+
+	if conn.connecting {
+		errno, err := syscall.GetsockoptInt(conn.fd, syscall.SOL_SOCKET, syscall.SO_ERROR)
+		if err != nil || errno != 0 {
+			bgpLog.Warn("failed to connect", "peer", peer.String(), "err", syscall.Errno(errno).Error())
+			bgpConnClose(conn)
+			peer.conn = nil
+			bgpSetState(peer, BGP_STATE_ACTIVE)
+			return
+		}
+		conn.connecting = false
+		epollModify(conn.fd, syscall.EPOLLIN)
+		bgpLog.Info("connection established", "peer", peer.String())
+		bgpConnOpened(conn)
+		return
+	}
+
+	if events&syscall.EPOLLOUT != 0 {
+		bgpConnFlush(conn)
+		if conn.closed {
+			return
+		}
+	}
+
+	if events&(syscall.EPOLLIN|syscall.EPOLLHUP|syscall.EPOLLERR) != 0 {
+		bgpConnRead(conn)
+	}
+}
+
+func bgpConnRead(conn *bgpConn) {
+	buf := make([]byte, BGP_MAX_MESSAGE_LEN)
+	for {
+		n, err := syscall.Read(conn.fd, buf)
+		if err == syscall.EAGAIN {
+			break
+		}
+		if err != nil || n == 0 {
+			bgpLog.Info("connection closed", "peer", conn.peer.String())
+			bgpConnDown(conn, nil)
+			return
+		}
+		conn.rbuf = append(conn.rbuf, buf[:n]...)
+	}
+
+	for !conn.closed && len(conn.rbuf) >= BGP_HEADER_LEN {
+		for _, b := range conn.rbuf[:16] {
+			if b != 0xff {
+				bgpConnDown(conn, &bgpError{code: BGP_ERR_HEADER, subcode: BGP_ERR_HEADER_NOT_SYNCHRONIZED})
+				return
+			}
+		}
+		length := int(byteToUint16(conn.rbuf[16:18]))
+		if length < BGP_HEADER_LEN || length > BGP_MAX_MESSAGE_LEN {
+			bgpConnDown(conn, &bgpError{code: BGP_ERR_HEADER, subcode: BGP_ERR_HEADER_BAD_LENGTH, data: conn.rbuf[16:18]})
+			return
+		}
+		if len(conn.rbuf) < length {
+			break
+		}
+		msgType := conn.rbuf[18]
+		body := conn.rbuf[BGP_HEADER_LEN:length]
+		conn.rbuf = conn.rbuf[length:]
+
+		bgpMessageInput(conn, msgType, body)
+	}
+}
+
+/* データを送る。送りきれなければEPOLLOUTで続きを送る */
+func bgpConnSend(conn *bgpConn, msg []byte) {
+	if conn.closed {
+		return
+	}
+	conn.wbuf = append(conn.wbuf, msg...)
+	bgpConnFlush(conn)
+}
+
+func bgpConnFlush(conn *bgpConn) {
+	for len(conn.wbuf) > 0 {
+		n, err := syscall.Write(conn.fd, conn.wbuf)
+		if err == syscall.EAGAIN {
+			epollModify(conn.fd, syscall.EPOLLIN|syscall.EPOLLOUT)
+			return
+		}
+		if err != nil {
+			bgpLog.Warn("failed to write", "peer", conn.peer.String(), "err", err)
+			bgpConnDown(conn, nil)
+			return
+		}
+		conn.wbuf = conn.wbuf[n:]
+	}
+	epollModify(conn.fd, syscall.EPOLLIN)
+}
+
+func bgpConnClose(conn *bgpConn) {
+	if conn.closed {
+		return
+	}
+	conn.closed = true
+	epollDelete(conn.fd)
+	syscall.Close(conn.fd)
+}
+
+/* コネクションでエラーが起きた。衝突検出中の2本目ならそれだけを閉じる */
+func bgpConnDown(conn *bgpConn, notification *bgpError) {
+	peer := conn.peer
+	if conn == peer.collision {
+		if notification != nil {
+			bgpConnSend(conn, bgpNotificationToPacket(notification))
+		}
+		bgpConnClose(conn)
+		peer.collision = nil
+		return
+	}
+	bgpPeerDown(peer, notification)
+}
+
+/*
+ * セッションを落とす。受信した経路を取り消し、しばらく待ってから接続し直す。
+ */
+func bgpPeerDown(peer *bgpPeer, notification *bgpError) {
+	if notification != nil {
+		bgpLog.Info("send notification", "peer", peer.String(), "code", notification.code, "subcode", notification.subcode)
+	}
+	for _, conn := range []*bgpConn{peer.conn, peer.collision} {
+		if conn == nil {
+			continue
+		}
+		if notification != nil && !conn.connecting {
+			bgpConnSend(conn, bgpNotificationToPacket(notification))
+		}
+		bgpConnClose(conn)
+	}
+	peer.conn = nil
+	peer.collision = nil
+
+	peer.holdTimer.stop()
+	peer.keepaliveTimer.stop()
+	peer.connectRetryTimer.stop()
+	bfdUnregister(peer.bfdClient)
+	peer.bfdClient = nil
+
+	established := peer.state == BGP_STATE_ESTABLISHED
+	bgpSetState(peer, BGP_STATE_IDLE)
+
+	if established {
+		var keys []ribKey
+		for key := range peer.adjRibIn {
+			keys = append(keys, key)
+		}
+		peer.adjRibIn = make(map[ribKey]*bgpPathAttrs)
+		peer.adjRibOut = make(map[ribKey]*bgpPathAttrs)
+		for _, key := range keys {
+			bgpDecide(key)
+		}
+	}
+
+	peer.connectRetryTimer = newTimer(BGP_IDLE_HOLD_TIME, func() { bgpConnectRetryExpired(peer) })
+}
+
+/* 停止するときはCease(Administrative Shutdown)を送ってセッションを閉じ、相手に経路を取り消させる */
+func bgpShutdown() {
+	for _, peer := range bgpPeers {
+		for _, conn := range []*bgpConn{peer.conn, peer.collision} {
+			if conn == nil {
+				continue
+			}
+			if !conn.connecting && peer.state >= BGP_STATE_OPEN_SENT {
+				bgpLog.Info("send cease", "peer", peer.String())
+				bgpConnSend(conn, bgpNotificationToPacket(&bgpError{code: BGP_ERR_CEASE, subcode: BGP_ERR_CEASE_ADMIN_SHUTDOWN}))
+				bgpConnDrain(conn)
+			}
+			bgpConnClose(conn)
+		}
+		peer.conn = nil
+		peer.collision = nil
+
+		peer.holdTimer.stop()
+		peer.keepaliveTimer.stop()
+		peer.connectRetryTimer.stop()
+		bgpSetState(peer, BGP_STATE_IDLE)
+	}
+
+	if bgpListenFd >= 0 {
+		epollDelete(bgpListenFd)
+		syscall.Close(bgpListenFd)
+		bgpListenFd = -1
+	}
+}
+
+/* 書き込みきれていないデータをブロックして送る。相手が受け取らなければBGP_DRAIN_TIMEOUTで諦める */
+func bgpConnDrain(conn *bgpConn) {
+	if conn.closed || len(conn.wbuf) == 0 {
+		return
+	}
+	tv := syscall.NsecToTimeval(int64(BGP_DRAIN_TIMEOUT))
+	syscall.SetsockoptTimeval(conn.fd, syscall.SOL_SOCKET, syscall.SO_SNDTIMEO, &tv)
+	syscall.SetNonblock(conn.fd, false)
+	bgpConnFlush(conn)
+}
+
+func bgpHoldTimerExpired(peer *bgpPeer) {
+	bgpLog.Info("hold timer expired", "peer", peer.String())
+	bgpPeerDown(peer, &bgpError{code: BGP_ERR_HOLD_TIMER_EXPIRED})
+}
+
+func bgpKeepaliveTimerExpired(peer *bgpPeer) {
+	if peer.conn == nil {
+		return
+	}
+	bgpConnSend(peer.conn, bgpKeepaliveToPacket())
+	peer.keepaliveTimer = newTimer(time.Duration(peer.holdTime/3)*time.Second, func() { bgpKeepaliveTimerExpired(peer) })
+}
+
+func bgpRestartHoldTimer(peer *bgpPeer) {
+	peer.holdTimer.stop()
+	if peer.holdTime > 0 {
+		peer.holdTimer = newTimer(time.Duration(peer.holdTime)*time.Second, func() { bgpHoldTimerExpired(peer) })
+	}
+}
+
+func bgpMessageInput(conn *bgpConn, msgType uint8, body []byte) {
+	peer := conn.peer
+
+	switch msgType {
+	case BGP_MSG_OPEN:
+		open, err := bgpParseOpen(body)
+		if err != nil {
+			bgpConnDown(conn, err.(*bgpError))
+			return
+		}
+		bgpOpenInput(conn, open)
+	case BGP_MSG_KEEPALIVE:
+		if conn != peer.conn {
+			return
+		}
+		switch peer.state {
+		case BGP_STATE_OPEN_CONFIRM:
+			bgpRestartHoldTimer(peer)
+			bgpEstablished(peer)
+		case BGP_STATE_ESTABLISHED:
+			bgpRestartHoldTimer(peer)
+		default:
+			bgpPeerDown(peer, &bgpError{code: BGP_ERR_FSM})
+		}
+	case BGP_MSG_UPDATE:
+		if conn != peer.conn || peer.state != BGP_STATE_ESTABLISHED {
+			bgpConnDown(conn, &bgpError{code: BGP_ERR_FSM})
+			return
+		}
+		bgpRestartHoldTimer(peer)
+		update, err := bgpParseUpdate(body, peer.as4)
+		if err != nil {
+			bgpPeerDown(peer, err.(*bgpError))
+			return
+		}
+		bgpUpdateInput(peer, update)
+	case BGP_MSG_NOTIFICATION:
+		if len(body) >= 2 {
+			bgpLog.Info("received notification", "peer", peer.String(), "code", body[0], "subcode", body[1])
+		}
+		bgpConnDown(conn, nil)
+	default:
+		bgpConnDown(conn, &bgpError{code: BGP_ERR_HEADER, subcode: BGP_ERR_HEADER_BAD_TYPE, data: []byte{msgType}})
+	}
+}
+
+func bgpOpenInput(conn *bgpConn, open *bgpOpen) {
+	peer := conn.peer
+
+	if open.as != peer.remoteAs {
+		bgpConnDown(conn, &bgpError{code: BGP_ERR_OPEN, subcode: BGP_ERR_OPEN_BAD_PEER_AS})
+		return
+	}
+	if open.routerId == 0 || open.routerId == bgpRouterId {
+		bgpConnDown(conn, &bgpError{code: BGP_ERR_OPEN, subcode: BGP_ERR_OPEN_BAD_BGP_ID})
+		return
+	}
+	if open.holdTime == 1 || open.holdTime == 2 {
+		bgpConnDown(conn, &bgpError{code: BGP_ERR_OPEN, subcode: BGP_ERR_OPEN_UNACCEPTABLE_HOLD_TIME})
+		return
+	}
+	// IPv6ユニキャストしか扱わないので、その能力がなければ話せない
+	if !open.mpIpv6 {
+		data := []byte{BGP_CAP_MULTIPROTOCOL, 4, 0, byte(BGP_AFI_IPV6), 0, BGP_SAFI_UNICAST}
+		bgpConnDown(conn, &bgpError{code: BGP_ERR_OPEN, subcode: BGP_ERR_OPEN_UNSUPPORTED_CAPABILITY, data: data})
+		return
+	}
+	conn.open = open
+
+	if conn == peer.collision {
+		// ルータIDが大きい方が張ったコネクションを残す。2本とも相手から張られたものなら古い方を残す
+		keepLocal := bgpRouterId > open.routerId
+		if peer.state == BGP_STATE_ESTABLISHED || peer.conn.inbound || keepLocal {
+			bgpConnDown(conn, &bgpError{code: BGP_ERR_CEASE, subcode: BGP_ERR_CEASE_COLLISION_RESOLUTION})
+			return
+		}
+		bgpLog.Info("connection collision, keep the new connection", "peer", peer.String())
+		old := peer.conn
+		bgpConnSend(old, bgpNotificationToPacket(&bgpError{code: BGP_ERR_CEASE, subcode: BGP_ERR_CEASE_COLLISION_RESOLUTION}))
+		bgpConnClose(old)
+		peer.conn = conn
+		peer.collision = nil
+		peer.state = BGP_STATE_OPEN_SENT
+	} else if peer.state != BGP_STATE_OPEN_SENT {
+		bgpPeerDown(peer, &bgpError{code: BGP_ERR_FSM})
+		return
+	}
+
+	peer.remoteId = open.routerId
+	peer.as4 = open.as4
+	peer.holdTime = BGP_HOLD_TIME
+	if open.holdTime < peer.holdTime {
+		peer.holdTime = open.holdTime
+	}
+
+	bgpConnSend(conn, bgpKeepaliveToPacket())
+	bgpSetState(peer, BGP_STATE_OPEN_CONFIRM)
+
+	bgpRestartHoldTimer(peer)
+	peer.keepaliveTimer.stop()
+	if peer.holdTime > 0 {
+		peer.keepaliveTimer = newTimer(time.Duration(peer.holdTime/3)*time.Second, func() { bgpKeepaliveTimerExpired(peer) })
+	}
+}
+
+/* セッションが確立したら持っている経路をすべて広告する */
+func bgpEstablished(peer *bgpPeer) {
+	bgpSetState(peer, BGP_STATE_ESTABLISHED)
+
+	if peer.collision != nil {
+		bgpConnDown(peer.collision, &bgpError{code: BGP_ERR_CEASE, subcode: BGP_ERR_CEASE_COLLISION_RESOLUTION})
+	}
+
+	peer.adjRibIn = make(map[ribKey]*bgpPathAttrs)
+	peer.adjRibOut = make(map[ribKey]*bgpPathAttrs)
+	for key := range bgpLocRib {
+		bgpAdvertise(peer, key)
+	}
+
+	if peer.bfd {
+		bgpStartBfd(peer)
+	}
+}
+
+func bgpStartBfd(peer *bgpPeer) {
+	dev := peer.dev
+	if dev == nil {
+		node := patriciaTrieSearch(defaultVrf.fib, peer.addr)
+		if node == nil || node.route == nil || node.route.routeType != CONNECTED {
+			bgpLog.Warn("neighbor is not directly connected, bfd is not started", "peer", peer.String())
+			return
+		}
+		dev = node.route.dev
+	}
+	peer.bfdClient = bfdRegister(dev, peer.addr, func(up bool) {
+		if !up && peer.state == BGP_STATE_ESTABLISHED {
+			bgpLog.Info("bfd session down", "peer", peer.String())
+			bgpPeerDown(peer, &bgpError{code: BGP_ERR_CEASE})
+		}
+	})
+}
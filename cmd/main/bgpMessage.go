@@ -0,0 +1,594 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+/**
+ * BGP-4(RFC 4271)のメッセージと、IPv6ユニキャスト経路を運ぶマルチプロトコル拡張(RFC 4760, RFC 2545)
+ */
+const BGP_PORT = 179
+const BGP_VERSION uint8 = 4
+const BGP_HEADER_LEN = 19
+const BGP_MAX_MESSAGE_LEN = 4096
+
+const (
+	BGP_MSG_OPEN uint8 = iota + 1
+	BGP_MSG_UPDATE
+	BGP_MSG_NOTIFICATION
+	BGP_MSG_KEEPALIVE
+)
+
+const BGP_ATTR_FLAG_OPTIONAL uint8 = 0x80
+const BGP_ATTR_FLAG_TRANSITIVE uint8 = 0x40
+const BGP_ATTR_FLAG_PARTIAL uint8 = 0x20
+const BGP_ATTR_FLAG_EXTENDED uint8 = 0x10
+
+const (
+	BGP_ATTR_ORIGIN           uint8 = 1
+	BGP_ATTR_AS_PATH          uint8 = 2
+	BGP_ATTR_NEXT_HOP         uint8 = 3
+	BGP_ATTR_MED              uint8 = 4
+	BGP_ATTR_LOCAL_PREF       uint8 = 5
+	BGP_ATTR_ATOMIC_AGGREGATE uint8 = 6
+	BGP_ATTR_AGGREGATOR       uint8 = 7
+	BGP_ATTR_MP_REACH_NLRI    uint8 = 14
+	BGP_ATTR_MP_UNREACH_NLRI  uint8 = 15
+)
+
+const (
+	BGP_ORIGIN_IGP uint8 = iota
+	BGP_ORIGIN_EGP
+	BGP_ORIGIN_INCOMPLETE
+)
+
+const BGP_AS_SET uint8 = 1
+const BGP_AS_SEQUENCE uint8 = 2
+
+// 4オクテットAS番号を話せない相手に送るAS番号(RFC 6793)
+const BGP_AS_TRANS uint32 = 23456
+
+const BGP_AFI_IPV6 uint16 = 2
+const BGP_SAFI_UNICAST uint8 = 1
+
+const BGP_OPT_PARAM_CAPABILITY uint8 = 2
+const BGP_CAP_MULTIPROTOCOL uint8 = 1
+const BGP_CAP_AS4 uint8 = 65
+
+const BGP_DEFAULT_LOCAL_PREF uint32 = 100
+
+// NOTIFICATIONのエラーコード
+const (
+	BGP_ERR_HEADER uint8 = iota + 1
+	BGP_ERR_OPEN
+	BGP_ERR_UPDATE
+	BGP_ERR_HOLD_TIMER_EXPIRED
+	BGP_ERR_FSM
+	BGP_ERR_CEASE
+)
+
+const BGP_ERR_HEADER_NOT_SYNCHRONIZED uint8 = 1
+const BGP_ERR_HEADER_BAD_LENGTH uint8 = 2
+const BGP_ERR_HEADER_BAD_TYPE uint8 = 3
+
+const BGP_ERR_OPEN_UNSUPPORTED_VERSION uint8 = 1
+const BGP_ERR_OPEN_BAD_PEER_AS uint8 = 2
+const BGP_ERR_OPEN_BAD_BGP_ID uint8 = 3
+const BGP_ERR_OPEN_UNACCEPTABLE_HOLD_TIME uint8 = 6
+const BGP_ERR_OPEN_UNSUPPORTED_CAPABILITY uint8 = 7
+
+const BGP_ERR_UPDATE_MALFORMED_ATTR_LIST uint8 = 1
+const BGP_ERR_UPDATE_UNRECOGNIZED_WELL_KNOWN uint8 = 2
+const BGP_ERR_UPDATE_MISSING_WELL_KNOWN uint8 = 3
+const BGP_ERR_UPDATE_ATTR_LENGTH uint8 = 5
+const BGP_ERR_UPDATE_INVALID_ORIGIN uint8 = 6
+const BGP_ERR_UPDATE_OPTIONAL_ATTR uint8 = 9
+const BGP_ERR_UPDATE_INVALID_NETWORK uint8 = 10
+const BGP_ERR_UPDATE_MALFORMED_AS_PATH uint8 = 11
+
+const BGP_ERR_CEASE_ADMIN_SHUTDOWN uint8 = 2
+const BGP_ERR_CEASE_PEER_DECONFIGURED uint8 = 3
+const BGP_ERR_CEASE_ADMIN_RESET uint8 = 4
+const BGP_ERR_CEASE_CONNECTION_REJECTED uint8 = 5
+const BGP_ERR_CEASE_COLLISION_RESOLUTION uint8 = 7
+
+/* NOTIFICATIONとして相手に返すエラー */
+type bgpError struct {
+	code    uint8
+	subcode uint8
+	data    []byte
+}
+
+func (e *bgpError) Error() string {
+	return fmt.Sprintf("bgp error code %d subcode %d", e.code, e.subcode)
+}
+
+type bgpOpen struct {
+	version  uint8
+	as       uint32 // 4オクテットAS番号の能力があればその値
+	holdTime uint16
+	routerId uint32
+	mpIpv6   bool // IPv6ユニキャストのマルチプロトコル能力
+	as4      bool // 4オクテットAS番号の能力
+}
+
+type bgpAsPathSegment struct {
+	segType uint8
+	asns    []uint32
+}
+
+type bgpPathAttrs struct {
+	origin        uint8
+	asPath        []bgpAsPathSegment
+	med           uint32
+	hasMed        bool
+	localPref     uint32
+	hasLocalPref  bool
+	nextHop       in6Addr  // グローバルネクストホップ
+	linkLocalHop  in6Addr  // リンクローカルネクストホップ(RFC 2545)。なければ未指定アドレス
+	unknownAttrs  [][]byte // 中継する未知のオプション推移属性
+	hasAtomicAggr bool
+}
+
+type bgpUpdate struct {
+	attrs     *bgpPathAttrs
+	nlri      []ribKey
+	withdrawn []ribKey
+}
+
+/* BGPヘッダを付ける */
+func bgpMessage(msgType uint8, body []byte) []byte {
+	var b bytes.Buffer
+
+	b.Write(bytes.Repeat([]byte{0xff}, 16))
+	b.Write(uint16ToByte(uint16(BGP_HEADER_LEN + len(body))))
+	b.WriteByte(msgType)
+	b.Write(body)
+
+	return b.Bytes()
+}
+
+func (open bgpOpen) toPacket() []byte {
+	var caps bytes.Buffer
+
+	// IPv6ユニキャスト
+	caps.Write([]byte{BGP_CAP_MULTIPROTOCOL, 4})
+	caps.Write(uint16ToByte(BGP_AFI_IPV6))
+	caps.Write([]byte{0, BGP_SAFI_UNICAST})
+	// 4オクテットAS番号
+	caps.Write([]byte{BGP_CAP_AS4, 4})
+	caps.Write(uint32ToByte(open.as))
+
+	var b bytes.Buffer
+	b.WriteByte(open.version)
+	myAs := open.as
+	if myAs > 0xffff {
+		myAs = BGP_AS_TRANS
+	}
+	b.Write(uint16ToByte(uint16(myAs)))
+	b.Write(uint16ToByte(open.holdTime))
+	b.Write(uint32ToByte(open.routerId))
+	b.WriteByte(uint8(caps.Len() + 2))
+	b.WriteByte(BGP_OPT_PARAM_CAPABILITY)
+	b.WriteByte(uint8(caps.Len()))
+	b.Write(caps.Bytes())
+
+	return bgpMessage(BGP_MSG_OPEN, b.Bytes())
+}
+
+func bgpParseOpen(body []byte) (*bgpOpen, error) {
+	if len(body) < 10 {
+		return nil, &bgpError{code: BGP_ERR_HEADER, subcode: BGP_ERR_HEADER_BAD_LENGTH}
+	}
+
+	open := &bgpOpen{
+		version:  body[0],
+		as:       uint32(byteToUint16(body[1:3])),
+		holdTime: byteToUint16(body[3:5]),
+		routerId: byteToUint32(body[5:9]),
+	}
+	if open.version != BGP_VERSION {
+		return nil, &bgpError{code: BGP_ERR_OPEN, subcode: BGP_ERR_OPEN_UNSUPPORTED_VERSION, data: uint16ToByte(uint16(BGP_VERSION))}
+	}
+
+	optLen := int(body[9])
+	params := body[10:]
+	if len(params) != optLen {
+		return nil, &bgpError{code: BGP_ERR_HEADER, subcode: BGP_ERR_HEADER_BAD_LENGTH}
+	}
+	for len(params) >= 2 {
+		paramType, paramLen := params[0], int(params[1])
+		if len(params) < 2+paramLen {
+			return nil, &bgpError{code: BGP_ERR_HEADER, subcode: BGP_ERR_HEADER_BAD_LENGTH}
+		}
+		// 能力以外のパラメータは無視する
+		if paramType == BGP_OPT_PARAM_CAPABILITY {
+			caps := params[2 : 2+paramLen]
+			for len(caps) >= 2 {
+				capCode, capLen := caps[0], int(caps[1])
+				if len(caps) < 2+capLen {
+					return nil, &bgpError{code: BGP_ERR_HEADER, subcode: BGP_ERR_HEADER_BAD_LENGTH}
+				}
+				value := caps[2 : 2+capLen]
+				switch capCode {
+				case BGP_CAP_MULTIPROTOCOL:
+					if capLen == 4 && byteToUint16(value[0:2]) == BGP_AFI_IPV6 && value[3] == BGP_SAFI_UNICAST {
+						open.mpIpv6 = true
+					}
+				case BGP_CAP_AS4:
+					if capLen == 4 {
+						open.as4 = true
+						open.as = byteToUint32(value)
+					}
+				}
+				caps = caps[2+capLen:]
+			}
+		}
+		params = params[2+paramLen:]
+	}
+
+	return open, nil
+}
+
+func bgpNotificationToPacket(e *bgpError) []byte {
+	body := []byte{e.code, e.subcode}
+	body = append(body, e.data...)
+	return bgpMessage(BGP_MSG_NOTIFICATION, body)
+}
+
+func bgpKeepaliveToPacket() []byte {
+	return bgpMessage(BGP_MSG_KEEPALIVE, nil)
+}
+
+/* プレフィックス長と、プレフィックス長を満たす最小のバイト列 */
+func bgpEncodePrefix(key ribKey) []byte {
+	n := (int(key.prefixLen) + 7) / 8
+	b := []byte{key.prefixLen}
+	return append(b, key.prefix[:n]...)
+}
+
+func bgpParsePrefixes(buffer []byte) ([]ribKey, error) {
+	var keys []ribKey
+	for len(buffer) > 0 {
+		prefixLen := buffer[0]
+		n := (int(prefixLen) + 7) / 8
+		if prefixLen > 128 || len(buffer) < 1+n {
+			return nil, &bgpError{code: BGP_ERR_UPDATE, subcode: BGP_ERR_UPDATE_INVALID_NETWORK}
+		}
+		var prefix in6Addr
+		copy(prefix[:], buffer[1:1+n])
+		keys = append(keys, ribKey{prefix: in6AddrClearPrefix(prefix, prefixLen), prefixLen: prefixLen})
+		buffer = buffer[1+n:]
+	}
+	return keys, nil
+}
+
+func bgpAttrToPacket(flags uint8, attrType uint8, value []byte) []byte {
+	if len(value) > 0xff {
+		flags |= BGP_ATTR_FLAG_EXTENDED
+	}
+	b := []byte{flags, attrType}
+	if flags&BGP_ATTR_FLAG_EXTENDED != 0 {
+		b = append(b, uint16ToByte(uint16(len(value)))...)
+	} else {
+		b = append(b, uint8(len(value)))
+	}
+	return append(b, value...)
+}
+
+func bgpAsPathToPacket(segments []bgpAsPathSegment, as4 bool) []byte {
+	var b bytes.Buffer
+	for _, seg := range segments {
+		b.WriteByte(seg.segType)
+		b.WriteByte(uint8(len(seg.asns)))
+		for _, asn := range seg.asns {
+			if as4 {
+				b.Write(uint32ToByte(asn))
+			} else if asn > 0xffff {
+				b.Write(uint16ToByte(uint16(BGP_AS_TRANS)))
+			} else {
+				b.Write(uint16ToByte(uint16(asn)))
+			}
+		}
+	}
+	return b.Bytes()
+}
+
+/*
+ * UPDATEメッセージを作る。IPv6の経路はすべてMP_REACH_NLRI/MP_UNREACH_NLRIで運ぶので
+ * IPv4の取り消し経路とNLRIは常に空になる。
+ */
+func bgpUpdateToPacket(update bgpUpdate, as4 bool) []byte {
+	var attrs bytes.Buffer
+
+	if len(update.withdrawn) > 0 {
+		var mp bytes.Buffer
+		mp.Write(uint16ToByte(BGP_AFI_IPV6))
+		mp.WriteByte(BGP_SAFI_UNICAST)
+		for _, key := range update.withdrawn {
+			mp.Write(bgpEncodePrefix(key))
+		}
+		attrs.Write(bgpAttrToPacket(BGP_ATTR_FLAG_OPTIONAL, BGP_ATTR_MP_UNREACH_NLRI, mp.Bytes()))
+	}
+
+	if len(update.nlri) > 0 {
+		a := update.attrs
+		attrs.Write(bgpAttrToPacket(BGP_ATTR_FLAG_TRANSITIVE, BGP_ATTR_ORIGIN, []byte{a.origin}))
+		attrs.Write(bgpAttrToPacket(BGP_ATTR_FLAG_TRANSITIVE, BGP_ATTR_AS_PATH, bgpAsPathToPacket(a.asPath, as4)))
+		if a.hasMed {
+			attrs.Write(bgpAttrToPacket(BGP_ATTR_FLAG_OPTIONAL, BGP_ATTR_MED, uint32ToByte(a.med)))
+		}
+		if a.hasLocalPref {
+			attrs.Write(bgpAttrToPacket(BGP_ATTR_FLAG_TRANSITIVE, BGP_ATTR_LOCAL_PREF, uint32ToByte(a.localPref)))
+		}
+		if a.hasAtomicAggr {
+			attrs.Write(bgpAttrToPacket(BGP_ATTR_FLAG_TRANSITIVE, BGP_ATTR_ATOMIC_AGGREGATE, nil))
+		}
+
+		var mp bytes.Buffer
+		mp.Write(uint16ToByte(BGP_AFI_IPV6))
+		mp.WriteByte(BGP_SAFI_UNICAST)
+		if a.linkLocalHop != (in6Addr{}) {
+			mp.WriteByte(32)
+			mp.Write(a.nextHop[:])
+			mp.Write(a.linkLocalHop[:])
+		} else {
+			mp.WriteByte(16)
+			mp.Write(a.nextHop[:])
+		}
+		mp.WriteByte(0) // Reserved
+		for _, key := range update.nlri {
+			mp.Write(bgpEncodePrefix(key))
+		}
+		attrs.Write(bgpAttrToPacket(BGP_ATTR_FLAG_OPTIONAL, BGP_ATTR_MP_REACH_NLRI, mp.Bytes()))
+
+		for _, attr := range a.unknownAttrs {
+			attrs.Write(attr)
+		}
+	}
+
+	var b bytes.Buffer
+	b.Write(uint16ToByte(0)) // IPv4の取り消し経路長
+	b.Write(uint16ToByte(uint16(attrs.Len())))
+	b.Write(attrs.Bytes())
+
+	return bgpMessage(BGP_MSG_UPDATE, b.Bytes())
+}
+
+func bgpParseAsPath(value []byte, as4 bool) ([]bgpAsPathSegment, error) {
+	asLen := 2
+	if as4 {
+		asLen = 4
+	}
+
+	var segments []bgpAsPathSegment
+	for len(value) > 0 {
+		if len(value) < 2 {
+			return nil, &bgpError{code: BGP_ERR_UPDATE, subcode: BGP_ERR_UPDATE_MALFORMED_AS_PATH}
+		}
+		seg := bgpAsPathSegment{segType: value[0]}
+		count := int(value[1])
+		if (seg.segType != BGP_AS_SET && seg.segType != BGP_AS_SEQUENCE) || len(value) < 2+count*asLen {
+			return nil, &bgpError{code: BGP_ERR_UPDATE, subcode: BGP_ERR_UPDATE_MALFORMED_AS_PATH}
+		}
+		for i := 0; i < count; i++ {
+			pos := 2 + i*asLen
+			if as4 {
+				seg.asns = append(seg.asns, byteToUint32(value[pos:pos+4]))
+			} else {
+				seg.asns = append(seg.asns, uint32(byteToUint16(value[pos:pos+2])))
+			}
+		}
+		segments = append(segments, seg)
+		value = value[2+count*asLen:]
+	}
+	return segments, nil
+}
+
+func bgpParseUpdate(body []byte, as4 bool) (*bgpUpdate, error) {
+	malformed := &bgpError{code: BGP_ERR_UPDATE, subcode: BGP_ERR_UPDATE_MALFORMED_ATTR_LIST}
+
+	if len(body) < 4 {
+		return nil, malformed
+	}
+	withdrawnLen := int(byteToUint16(body[0:2]))
+	if len(body) < 4+withdrawnLen {
+		return nil, malformed
+	}
+	// IPv4の経路はネゴシエーションしていないので無視する
+	attrsLen := int(byteToUint16(body[2+withdrawnLen : 4+withdrawnLen]))
+	attrsBuf := body[4+withdrawnLen:]
+	if len(attrsBuf) < attrsLen {
+		return nil, malformed
+	}
+	attrsBuf = attrsBuf[:attrsLen]
+
+	update := &bgpUpdate{}
+	attrs := &bgpPathAttrs{}
+	seen := map[uint8]bool{}
+
+	for len(attrsBuf) > 0 {
+		if len(attrsBuf) < 3 {
+			return nil, malformed
+		}
+		flags, attrType := attrsBuf[0], attrsBuf[1]
+		hdrLen := 3
+		valueLen := int(attrsBuf[2])
+		if flags&BGP_ATTR_FLAG_EXTENDED != 0 {
+			if len(attrsBuf) < 4 {
+				return nil, malformed
+			}
+			hdrLen = 4
+			valueLen = int(byteToUint16(attrsBuf[2:4]))
+		}
+		if len(attrsBuf) < hdrLen+valueLen {
+			return nil, &bgpError{code: BGP_ERR_UPDATE, subcode: BGP_ERR_UPDATE_ATTR_LENGTH}
+		}
+		raw := attrsBuf[:hdrLen+valueLen]
+		value := attrsBuf[hdrLen : hdrLen+valueLen]
+		attrsBuf = attrsBuf[hdrLen+valueLen:]
+
+		// 同じ属性が複数あるのは不正
+		if seen[attrType] {
+			return nil, malformed
+		}
+		seen[attrType] = true
+
+		switch attrType {
+		case BGP_ATTR_ORIGIN:
+			if valueLen != 1 {
+				return nil, &bgpError{code: BGP_ERR_UPDATE, subcode: BGP_ERR_UPDATE_ATTR_LENGTH, data: raw}
+			}
+			if value[0] > BGP_ORIGIN_INCOMPLETE {
+				return nil, &bgpError{code: BGP_ERR_UPDATE, subcode: BGP_ERR_UPDATE_INVALID_ORIGIN, data: raw}
+			}
+			attrs.origin = value[0]
+		case BGP_ATTR_AS_PATH:
+			asPath, err := bgpParseAsPath(value, as4)
+			if err != nil {
+				return nil, err
+			}
+			attrs.asPath = asPath
+		case BGP_ATTR_NEXT_HOP:
+			// IPv4のネクストホップは使わない
+		case BGP_ATTR_MED:
+			if valueLen != 4 {
+				return nil, &bgpError{code: BGP_ERR_UPDATE, subcode: BGP_ERR_UPDATE_ATTR_LENGTH, data: raw}
+			}
+			attrs.med = byteToUint32(value)
+			attrs.hasMed = true
+		case BGP_ATTR_LOCAL_PREF:
+			if valueLen != 4 {
+				return nil, &bgpError{code: BGP_ERR_UPDATE, subcode: BGP_ERR_UPDATE_ATTR_LENGTH, data: raw}
+			}
+			attrs.localPref = byteToUint32(value)
+			attrs.hasLocalPref = true
+		case BGP_ATTR_ATOMIC_AGGREGATE:
+			attrs.hasAtomicAggr = true
+		case BGP_ATTR_MP_REACH_NLRI:
+			if valueLen < 5 {
+				return nil, &bgpError{code: BGP_ERR_UPDATE, subcode: BGP_ERR_UPDATE_OPTIONAL_ATTR, data: raw}
+			}
+			afi, safi, nhLen := byteToUint16(value[0:2]), value[2], int(value[3])
+			if afi != BGP_AFI_IPV6 || safi != BGP_SAFI_UNICAST {
+				continue
+			}
+			if (nhLen != 16 && nhLen != 32) || valueLen < 5+nhLen {
+				return nil, &bgpError{code: BGP_ERR_UPDATE, subcode: BGP_ERR_UPDATE_OPTIONAL_ATTR, data: raw}
+			}
+			attrs.nextHop = in6Addr(value[4:20])
+			if nhLen == 32 {
+				attrs.linkLocalHop = in6Addr(value[20:36])
+			}
+			nlri, err := bgpParsePrefixes(value[5+nhLen:])
+			if err != nil {
+				return nil, err
+			}
+			update.nlri = nlri
+		case BGP_ATTR_MP_UNREACH_NLRI:
+			if valueLen < 3 {
+				return nil, &bgpError{code: BGP_ERR_UPDATE, subcode: BGP_ERR_UPDATE_OPTIONAL_ATTR, data: raw}
+			}
+			if byteToUint16(value[0:2]) != BGP_AFI_IPV6 || value[2] != BGP_SAFI_UNICAST {
+				continue
+			}
+			withdrawn, err := bgpParsePrefixes(value[3:])
+			if err != nil {
+				return nil, err
+			}
+			update.withdrawn = withdrawn
+		default:
+			if flags&BGP_ATTR_FLAG_OPTIONAL == 0 {
+				return nil, &bgpError{code: BGP_ERR_UPDATE, subcode: BGP_ERR_UPDATE_UNRECOGNIZED_WELL_KNOWN, data: raw}
+			}
+			// 未知のオプション推移属性はPartialビットを立てて中継する。非推移属性は捨てる
+			if flags&BGP_ATTR_FLAG_TRANSITIVE != 0 {
+				attr := append([]byte{}, raw...)
+				attr[0] |= BGP_ATTR_FLAG_PARTIAL
+				attrs.unknownAttrs = append(attrs.unknownAttrs, attr)
+			}
+		}
+	}
+
+	if len(update.nlri) > 0 {
+		if !seen[BGP_ATTR_ORIGIN] {
+			return nil, &bgpError{code: BGP_ERR_UPDATE, subcode: BGP_ERR_UPDATE_MISSING_WELL_KNOWN, data: []byte{BGP_ATTR_ORIGIN}}
+		}
+		if !seen[BGP_ATTR_AS_PATH] {
+			return nil, &bgpError{code: BGP_ERR_UPDATE, subcode: BGP_ERR_UPDATE_MISSING_WELL_KNOWN, data: []byte{BGP_ATTR_AS_PATH}}
+		}
+		update.attrs = attrs
+	}
+
+	return update, nil
+}
+
+/* AS_PATHの長さ。AS_SETはまとめて1と数える */
+func (attrs *bgpPathAttrs) asPathLen() int {
+	n := 0
+	for _, seg := range attrs.asPath {
+		if seg.segType == BGP_AS_SET {
+			n++
+		} else {
+			n += len(seg.asns)
+		}
+	}
+	return n
+}
+
+/* 経路を広告してきた隣接AS。AS_PATHが空なら0 */
+func (attrs *bgpPathAttrs) neighborAs() uint32 {
+	if len(attrs.asPath) == 0 || attrs.asPath[0].segType != BGP_AS_SEQUENCE || len(attrs.asPath[0].asns) == 0 {
+		return 0
+	}
+	return attrs.asPath[0].asns[0]
+}
+
+func (attrs *bgpPathAttrs) asPathContains(asn uint32) bool {
+	for _, seg := range attrs.asPath {
+		for _, a := range seg.asns {
+			if a == asn {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/* 先頭のAS_SEQUENCEにASを追加したコピー */
+func (attrs *bgpPathAttrs) prependAs(asn uint32, count int) []bgpAsPathSegment {
+	var asns []uint32
+	for i := 0; i < count; i++ {
+		asns = append(asns, asn)
+	}
+
+	var segments []bgpAsPathSegment
+	if len(attrs.asPath) > 0 && attrs.asPath[0].segType == BGP_AS_SEQUENCE && len(attrs.asPath[0].asns)+count <= 255 {
+		segments = append(segments, bgpAsPathSegment{segType: BGP_AS_SEQUENCE, asns: append(asns, attrs.asPath[0].asns...)})
+		segments = append(segments, attrs.asPath[1:]...)
+	} else {
+		segments = append(segments, bgpAsPathSegment{segType: BGP_AS_SEQUENCE, asns: asns})
+		segments = append(segments, attrs.asPath...)
+	}
+	return segments
+}
+
+func (attrs *bgpPathAttrs) fmtAsPath() string {
+	var b bytes.Buffer
+	for _, seg := range attrs.asPath {
+		if seg.segType == BGP_AS_SET {
+			b.WriteString("{")
+		}
+		for i, asn := range seg.asns {
+			if i > 0 || (b.Len() > 0 && seg.segType != BGP_AS_SET) {
+				b.WriteString(" ")
+			}
+			fmt.Fprintf(&b, "%d", asn)
+		}
+		if seg.segType == BGP_AS_SET {
+			b.WriteString("}")
+		}
+	}
+	return b.String()
+}
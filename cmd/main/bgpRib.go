@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * BGPの経路選択(RFC 4271 9.1)と、FIBへのインストール、ピアへの広告
+ */
+const BGP_SCAN_INTERVAL = 30 * time.Second
+
+type bgpPolicyAction int
+
+const (
+	BGP_POLICY_PERMIT bgpPolicyAction = iota
+	BGP_POLICY_DENY
+)
+
+/*
+ * インポート/エクスポートポリシーのルール。上から順に評価し最初にマッチしたものを適用する。
+ * ge/leが0ならプレフィックス長の完全一致。ルールがあってどれにもマッチしなければ拒否する。
+ */
+type bgpPolicyRule struct {
+	prefix       in6Addr
+	prefixLen    uint8
+	ge           uint8
+	le           uint8
+	action       bgpPolicyAction
+	setLocalPref uint32 // 0なら変更しない
+	setMed       uint32
+	hasSetMed    bool
+	prependCount int // エクスポート時に自ASを余分に付ける回数
+}
+
+/* ロカルRIBの経路。peerがnilなら自分が生成した経路 */
+type bgpPath struct {
+	peer  *bgpPeer
+	attrs *bgpPathAttrs
+	route *ipv6RouteEntry // FIBに入れる経路。ネクストホップを解決したもの
+}
+
+// 自分が生成して広告するプレフィックス
+var bgpNetworks = map[ribKey]bool{}
+
+// 他の情報源から再配布している経路
+var bgpRedistributed = map[ribKey]*ipv6RouteEntry{}
+
+// プレフィックスごとの最適経路
+var bgpLocRib = map[ribKey]*bgpPath{}
+
+/* 自分が生成する経路を設定する */
+func configBgpNetwork(prefix in6Addr, prefixLen uint8) {
+	key := ribKey{prefix: in6AddrClearPrefix(prefix, prefixLen), prefixLen: prefixLen}
+	bgpNetworks[key] = true
+	configLog.Info("configure bgp network", "prefix", fmtPrefixStr(key.prefix, key.prefixLen))
+
+	bgpDecide(key)
+}
+
+func unconfigBgpNetwork(prefix in6Addr, prefixLen uint8) {
+	key := ribKey{prefix: in6AddrClearPrefix(prefix, prefixLen), prefixLen: prefixLen}
+	if !bgpNetworks[key] {
+		return
+	}
+	delete(bgpNetworks, key)
+	configLog.Info("unconfigure bgp network", "prefix", fmtPrefixStr(key.prefix, key.prefixLen))
+
+	bgpDecide(key)
+}
+
+func configBgpNeighborImportPolicy(addr in6Addr, rules []bgpPolicyRule) {
+	peer := getBgpPeer(addr)
+	if peer == nil {
+		configLog.Warn("bgp neighbor not found", "peer", addr)
+		return
+	}
+	peer.importPolicy = rules
+	configLog.Info("configure bgp import policy", "peer", peer.String())
+}
+
+func configBgpNeighborExportPolicy(addr in6Addr, rules []bgpPolicyRule) {
+	peer := getBgpPeer(addr)
+	if peer == nil {
+		configLog.Warn("bgp neighbor not found", "peer", addr)
+		return
+	}
+	peer.exportPolicy = rules
+	configLog.Info("configure bgp export policy", "peer", peer.String())
+}
+
+/* permit|deny PREFIX [ge LEN] [le LEN] [local-preference PREF] [med MED] [prepend COUNT] */
+func parseBgpPolicyRule(words []string) (*bgpPolicyRule, error) {
+	usage := fmt.Errorf("usage: permit|deny PREFIX [ge LEN] [le LEN] [local-preference PREF] [med MED] [prepend COUNT]")
+	if len(words) < 2 || len(words)%2 != 0 {
+		return nil, usage
+	}
+	rule := &bgpPolicyRule{}
+	switch words[0] {
+	case "permit":
+		rule.action = BGP_POLICY_PERMIT
+	case "deny":
+		rule.action = BGP_POLICY_DENY
+	default:
+		return nil, usage
+	}
+	_, ipNet, err := net.ParseCIDR(words[1])
+	if err != nil || ipNet.IP.To4() != nil {
+		return nil, fmt.Errorf("invalid ipv6 prefix %s", words[1])
+	}
+	prefixLen, _ := ipNet.Mask.Size()
+	rule.prefix = in6Addr(ipNet.IP.To16())
+	rule.prefixLen = uint8(prefixLen)
+
+	for i := 2; i < len(words); i += 2 {
+		value, err := strconv.ParseUint(words[i+1], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %s", words[i], words[i+1])
+		}
+		switch words[i] {
+		case "ge", "le":
+			if value < uint64(rule.prefixLen) || value > 128 {
+				return nil, fmt.Errorf("invalid %s %s", words[i], words[i+1])
+			}
+			if words[i] == "ge" {
+				rule.ge = uint8(value)
+			} else {
+				rule.le = uint8(value)
+			}
+		case "local-preference":
+			rule.setLocalPref = uint32(value)
+		case "med":
+			rule.setMed = uint32(value)
+			rule.hasSetMed = true
+		case "prepend":
+			rule.prependCount = int(value)
+		default:
+			return nil, usage
+		}
+	}
+	return rule, nil
+}
+
+/* 設定ファイルに書く形 */
+func (rule *bgpPolicyRule) String() string {
+	words := []string{"permit", fmtPrefixStr(rule.prefix, rule.prefixLen)}
+	if rule.action == BGP_POLICY_DENY {
+		words[0] = "deny"
+	}
+	if rule.ge != 0 {
+		words = append(words, "ge", strconv.Itoa(int(rule.ge)))
+	}
+	if rule.le != 0 {
+		words = append(words, "le", strconv.Itoa(int(rule.le)))
+	}
+	if rule.setLocalPref != 0 {
+		words = append(words, "local-preference", strconv.FormatUint(uint64(rule.setLocalPref), 10))
+	}
+	if rule.hasSetMed {
+		words = append(words, "med", strconv.FormatUint(uint64(rule.setMed), 10))
+	}
+	if rule.prependCount != 0 {
+		words = append(words, "prepend", strconv.Itoa(rule.prependCount))
+	}
+	return strings.Join(words, " ")
+}
+
+func (rule *bgpPolicyRule) match(key ribKey) bool {
+	return prefixRangeMatch(key, rule.prefix, rule.prefixLen, rule.ge, rule.le)
+}
+
+/* ポリシーを適用した属性のコピーを返す。拒否されたらnil */
+func bgpApplyPolicy(rules []bgpPolicyRule, key ribKey, attrs *bgpPathAttrs) (*bgpPathAttrs, *bgpPolicyRule) {
+	if len(rules) == 0 {
+		copied := *attrs
+		return &copied, nil
+	}
+	for i := range rules {
+		rule := &rules[i]
+		if !rule.match(key) {
+			continue
+		}
+		if rule.action == BGP_POLICY_DENY {
+			return nil, nil
+		}
+		copied := *attrs
+		if rule.setLocalPref != 0 {
+			copied.localPref = rule.setLocalPref
+			copied.hasLocalPref = true
+		}
+		if rule.hasSetMed {
+			copied.med = rule.setMed
+			copied.hasMed = true
+		}
+		return &copied, rule
+	}
+	return nil, nil
+}
+
+func bgpUpdateInput(peer *bgpPeer, update *bgpUpdate) {
+	changed := map[ribKey]bool{}
+
+	for _, key := range update.withdrawn {
+		if _, ok := peer.adjRibIn[key]; ok {
+			delete(peer.adjRibIn, key)
+			changed[key] = true
+		}
+	}
+
+	if len(update.nlri) > 0 {
+		attrs := update.attrs
+		// eBGPでは先頭のASが相手のASでなければならない
+		if !peer.isIbgp() && attrs.neighborAs() != peer.remoteAs {
+			bgpPeerDown(peer, &bgpError{code: BGP_ERR_UPDATE, subcode: BGP_ERR_UPDATE_MALFORMED_AS_PATH})
+			return
+		}
+		// 自ASを含む経路はループしているので取り消しとして扱う
+		loop := attrs.asPathContains(bgpLocalAs)
+		if peer.isIbgp() && !attrs.hasLocalPref {
+			attrs.localPref = BGP_DEFAULT_LOCAL_PREF
+			attrs.hasLocalPref = true
+		}
+
+		for _, key := range update.nlri {
+			var imported *bgpPathAttrs
+			if !loop {
+				imported, _ = bgpApplyPolicy(peer.importPolicy, key, attrs)
+			}
+			if imported == nil {
+				if _, ok := peer.adjRibIn[key]; ok {
+					delete(peer.adjRibIn, key)
+					changed[key] = true
+				}
+				continue
+			}
+			bgpLog.Debug("received route", "prefix", fmtPrefixStr(key.prefix, key.prefixLen), "peer", peer.String(), "asPath", imported.fmtAsPath())
+			peer.adjRibIn[key] = imported
+			changed[key] = true
+		}
+	}
+
+	for key := range changed {
+		bgpDecide(key)
+	}
+}
+
+/*
+ * ネクストホップをFIBで解決してFIBに入れる経路を作る。解決できなければnil
+ */
+func bgpResolveNextHop(peer *bgpPeer, attrs *bgpPathAttrs) *ipv6RouteEntry {
+	proto := PROTO_EBGP
+	if peer.isIbgp() {
+		proto = PROTO_IBGP
+	}
+
+	// 同じリンク上のピアがリンクローカルネクストホップを付けてきたらそれを使う
+	if peer.dev != nil && attrs.linkLocalHop != (in6Addr{}) {
+		return &ipv6RouteEntry{routeType: NETWORK, dev: peer.dev, nextHop: attrs.linkLocalHop, proto: proto}
+	}
+	if in6AddrIsLinkLocal(attrs.nextHop) {
+		if peer.dev == nil {
+			return nil
+		}
+		return &ipv6RouteEntry{routeType: NETWORK, dev: peer.dev, nextHop: attrs.nextHop, proto: proto}
+	}
+
+	node := patriciaTrieSearch(defaultVrf.fib, attrs.nextHop)
+	if node == nil || node.route == nil {
+		return nil
+	}
+	r := node.route
+	switch {
+	case r.routeType == CONNECTED:
+		return &ipv6RouteEntry{routeType: NETWORK, dev: r.dev, nextHop: attrs.nextHop, proto: proto}
+	case r.routeType == NETWORK && r.proto != PROTO_EBGP && r.proto != PROTO_IBGP:
+		// IGPや静的経路で到達できるネクストホップ
+		return &ipv6RouteEntry{routeType: NETWORK, dev: r.dev, nextHop: r.nextHop, proto: proto}
+	}
+	return nil
+}
+
+/* aがbより良い経路か */
+func bgpBetterPath(a *bgpPath, b *bgpPath) bool {
+	prefA, prefB := BGP_DEFAULT_LOCAL_PREF, BGP_DEFAULT_LOCAL_PREF
+	if a.attrs.hasLocalPref {
+		prefA = a.attrs.localPref
+	}
+	if b.attrs.hasLocalPref {
+		prefB = b.attrs.localPref
+	}
+	if prefA != prefB {
+		return prefA > prefB
+	}
+
+	// 自分で生成した経路を優先する
+	if (a.peer == nil) != (b.peer == nil) {
+		return a.peer == nil
+	}
+	if a.peer == nil {
+		return false
+	}
+
+	if a.attrs.asPathLen() != b.attrs.asPathLen() {
+		return a.attrs.asPathLen() < b.attrs.asPathLen()
+	}
+	if a.attrs.origin != b.attrs.origin {
+		return a.attrs.origin < b.attrs.origin
+	}
+	// MEDは同じ隣接ASからの経路同士でのみ比べる
+	if a.attrs.neighborAs() == b.attrs.neighborAs() && a.attrs.med != b.attrs.med {
+		return a.attrs.med < b.attrs.med
+	}
+	if a.peer.isIbgp() != b.peer.isIbgp() {
+		return !a.peer.isIbgp()
+	}
+	if a.peer.remoteId != b.peer.remoteId {
+		return a.peer.remoteId < b.peer.remoteId
+	}
+	return bytes.Compare(a.peer.addr[:], b.peer.addr[:]) < 0
+}
+
+/*
+ * プレフィックスの最適経路を選び直し、変わっていればFIBとピアに反映する。
+ */
+func bgpDecide(key ribKey) {
+	var best *bgpPath
+
+	if bgpNetworks[key] {
+		best = &bgpPath{attrs: &bgpPathAttrs{origin: BGP_ORIGIN_IGP}}
+	} else if r := bgpRedistributed[key]; r != nil {
+		best = &bgpPath{attrs: &bgpPathAttrs{origin: BGP_ORIGIN_INCOMPLETE, med: r.metric, hasMed: r.metric != 0}}
+	}
+	for _, peer := range bgpPeers {
+		if peer.state != BGP_STATE_ESTABLISHED {
+			continue
+		}
+		attrs := peer.adjRibIn[key]
+		if attrs == nil {
+			continue
+		}
+		route := bgpResolveNextHop(peer, attrs)
+		if route == nil {
+			continue
+		}
+		path := &bgpPath{peer: peer, attrs: attrs, route: route}
+		if best == nil || bgpBetterPath(path, best) {
+			best = path
+		}
+	}
+
+	old := bgpLocRib[key]
+	if old != nil && best != nil && old.peer == best.peer && old.attrs == best.attrs && reflect.DeepEqual(old.route, best.route) {
+		return
+	}
+
+	if best == nil {
+		delete(bgpLocRib, key)
+	} else {
+		bgpLocRib[key] = best
+	}
+
+	// FIBへの反映。自分で生成した経路は他の情報源から入っているので入れない
+	if old != nil && old.route != nil && (best == nil || best.route == nil || best.route.proto != old.route.proto) {
+		ribDelete(defaultVrf, key.prefix, key.prefixLen, old.route.proto)
+	}
+	if best != nil && best.route != nil {
+		ribAdd(defaultVrf, key.prefix, key.prefixLen, best.route)
+	}
+
+	for _, peer := range bgpPeers {
+		if peer.state == BGP_STATE_ESTABLISHED {
+			bgpAdvertise(peer, key)
+		}
+	}
+}
+
+/* 再配布する経路を作り直し、変わったプレフィックスの経路を選び直す */
+func bgpRedistribute() {
+	routes := redistributedRoutes(PROTO_EBGP, defaultVrf)
+
+	var changed []ribKey
+	for key, old := range bgpRedistributed {
+		if r, ok := routes[key]; !ok || r.metric != old.metric {
+			changed = append(changed, key)
+		}
+	}
+	for key := range routes {
+		if _, ok := bgpRedistributed[key]; !ok {
+			changed = append(changed, key)
+		}
+	}
+
+	bgpRedistributed = routes
+	for _, key := range changed {
+		bgpDecide(key)
+	}
+}
+
+/* 自分をネクストホップにする */
+func bgpNextHopSelf(peer *bgpPeer, attrs *bgpPathAttrs) {
+	attrs.nextHop = peer.localAddr
+	attrs.linkLocalHop = in6Addr{}
+	if peer.dev != nil {
+		// リンクローカルでピアを張っているときはグローバルにインターフェイスのアドレスを入れる
+		if in6AddrIsLinkLocal(peer.localAddr) {
+			attrs.nextHop = peer.dev.ipv6Dev.address
+		}
+		attrs.linkLocalHop = peer.dev.ipv6Dev.linkLocalAddr
+	}
+}
+
+/* ピアに広告する属性。広告しないならnil */
+func bgpExportAttrs(peer *bgpPeer, key ribKey, path *bgpPath) *bgpPathAttrs {
+	if path == nil || path.peer == peer {
+		return nil
+	}
+	// iBGPで学んだ経路は他のiBGPピアに広告しない
+	if path.peer != nil && path.peer.isIbgp() && peer.isIbgp() {
+		return nil
+	}
+
+	attrs, rule := bgpApplyPolicy(peer.exportPolicy, key, path.attrs)
+	if attrs == nil {
+		return nil
+	}
+	attrs.unknownAttrs = path.attrs.unknownAttrs
+
+	if peer.isIbgp() {
+		if !attrs.hasLocalPref {
+			attrs.localPref = BGP_DEFAULT_LOCAL_PREF
+			attrs.hasLocalPref = true
+		}
+		// リンクローカルのネクストホップは別のリンクでは使えない
+		if path.peer == nil || in6AddrIsLinkLocal(attrs.nextHop) || attrs.nextHop == (in6Addr{}) {
+			bgpNextHopSelf(peer, attrs)
+		} else {
+			attrs.linkLocalHop = in6Addr{}
+		}
+	} else {
+		prepend := 1
+		if rule != nil {
+			prepend += rule.prependCount
+		}
+		attrs.asPath = attrs.prependAs(bgpLocalAs, prepend)
+		attrs.localPref = 0
+		attrs.hasLocalPref = false
+		// 他のASから受け取ったMEDは別のASに伝えない
+		if path.peer != nil && (rule == nil || !rule.hasSetMed) {
+			attrs.med = 0
+			attrs.hasMed = false
+		}
+		bgpNextHopSelf(peer, attrs)
+	}
+	return attrs
+}
+
+/* ロカルRIBの経路とピアに広告済みの経路を比べて、違えばUPDATEを送る */
+func bgpAdvertise(peer *bgpPeer, key ribKey) {
+	if peer.conn == nil {
+		return
+	}
+
+	attrs := bgpExportAttrs(peer, key, bgpLocRib[key])
+	sent := peer.adjRibOut[key]
+
+	if attrs == nil {
+		if sent == nil {
+			return
+		}
+		delete(peer.adjRibOut, key)
+		bgpConnSend(peer.conn, bgpUpdateToPacket(bgpUpdate{withdrawn: []ribKey{key}}, peer.as4))
+		return
+	}
+
+	if sent != nil && reflect.DeepEqual(sent, attrs) {
+		return
+	}
+	peer.adjRibOut[key] = attrs
+	bgpConnSend(peer.conn, bgpUpdateToPacket(bgpUpdate{attrs: attrs, nlri: []ribKey{key}}, peer.as4))
+}
+
+/*
+ * IGPの経路が変わるとネクストホップの到達性が変わるので、定期的にすべての経路を選び直す
+ */
+func bgpScan() {
+	keys := map[ribKey]bool{}
+	for key := range bgpLocRib {
+		keys[key] = true
+	}
+	for _, peer := range bgpPeers {
+		for key := range peer.adjRibIn {
+			keys[key] = true
+		}
+	}
+	for key := range keys {
+		bgpDecide(key)
+	}
+
+	bgpScanTimer = newTimer(BGP_SCAN_INTERVAL, bgpScan)
+}
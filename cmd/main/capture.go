@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"sync/atomic"
+)
+
+/**
+ * パケットキャプチャ
+ * インターフェイスの送受信と、フォワーディングした、捨てたといったデータパスの段階でパケットを拾い、pcapngで書き出す。
+ * 書き出しはセッションごとのgoroutineがするので、ファイルやソケットへの書き込みでイベントループは止まらない。
+ * 書き出しが追いつかなければパケットを捨てて数える。
+ */
+type captureStage int
+
+const (
+	CAPTURE_RX captureStage = iota
+	CAPTURE_TX
+	CAPTURE_FORWARDED
+	CAPTURE_DROPPED
+	CAPTURE_STAGE_MAX
+)
+
+var captureStageNames = [CAPTURE_STAGE_MAX]string{
+	CAPTURE_RX:        "rx",
+	CAPTURE_TX:        "tx",
+	CAPTURE_FORWARDED: "forwarded",
+	CAPTURE_DROPPED:   "dropped",
+}
+
+func (stage captureStage) String() string {
+	return captureStageNames[stage]
+}
+
+func parseCaptureStage(name string) (captureStage, bool) {
+	for stage, stageName := range captureStageNames {
+		if stageName == name {
+			return captureStage(stage), true
+		}
+	}
+	return 0, false
+}
+
+// 書き出しを待つブロックの数
+const CAPTURE_QUEUE_LEN = 1024
+
+const CAPTURE_DEFAULT_SNAPLEN = 65535
+
+type captureInterfaceKey struct {
+	name     string
+	linkType uint16
+}
+
+type captureSession struct {
+	id         int
+	ifName     string // 空なら全てのインターフェイス
+	stages     [CAPTURE_STAGE_MAX]bool
+	filterExpr string
+	filter     captureFilter
+	snapLen    uint32
+	maxPackets uint64 // 0なら制限しない
+	maxBytes   uint64 // 0なら制限しない
+	output     string
+
+	packets    uint64
+	bytes      uint64
+	lost       uint64 // 書き出しが追いつかずに捨てた数
+	active     bool
+	stopReason string
+
+	// pcapngのInterface Description Blockの番号。初めてのインターフェイスのパケットの前に書く
+	interfaces map[captureInterfaceKey]uint32
+	queue      chan []byte
+	failed     atomic.Bool
+	done       chan struct{}
+}
+
+var captureSessions []*captureSession
+var captureNextId = 1
+
+// 動いているセッションの数。0ならデータパスではすぐに戻る
+var captureActive int
+
+/*
+ * キャプチャを始める。outは開いたファイルかソケットで、セッションが終わると閉じる。
+ * 設定の誤りはoutを開く前に確かめておくこと。
+ */
+func startCapture(s *captureSession, out io.WriteCloser) {
+	s.id = captureNextId
+	captureNextId++
+	s.active = true
+	s.interfaces = map[captureInterfaceKey]uint32{}
+	s.queue = make(chan []byte, CAPTURE_QUEUE_LEN)
+	s.done = make(chan struct{})
+	go captureWriter(s, out)
+
+	header := pcapngSectionHeader()
+	s.queue <- header
+	s.bytes += uint64(len(header))
+	captureSessions = append(captureSessions, s)
+	captureActive++
+	apiLog.Info("capture started", "id", s.id, "interface", s.ifName, "filter", s.filterExpr, "output", s.output)
+}
+
+func captureWriter(s *captureSession, out io.WriteCloser) {
+	w := bufio.NewWriter(out)
+	for block := range s.queue {
+		if s.failed.Load() {
+			continue
+		}
+		_, err := w.Write(block)
+		// 待っているものがなければ書き出しておく。ソケットの先で読んでいるときに遅れないように
+		if err == nil && len(s.queue) == 0 {
+			err = w.Flush()
+		}
+		if err != nil {
+			s.failed.Store(true)
+		}
+	}
+	w.Flush()
+	out.Close()
+	close(s.done)
+}
+
+/* セッションを止める。書き出しが終わるのは待たない */
+func stopCapture(s *captureSession, reason string) {
+	if !s.active {
+		return
+	}
+	s.active = false
+	s.stopReason = reason
+	close(s.queue)
+	captureActive--
+	apiLog.Info("capture stopped", "id", s.id, "reason", reason, "packets", s.packets, "lost", s.lost)
+}
+
+func deleteCapture(id int) bool {
+	for i, s := range captureSessions {
+		if s.id == id {
+			stopCapture(s, "stopped")
+			captureSessions = append(captureSessions[:i], captureSessions[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+/* 全てのセッションを止め、書き出しが終わるのを待つ。終了するときに使う */
+func closeCaptures() {
+	for _, s := range captureSessions {
+		stopCapture(s, "shutdown")
+		<-s.done
+	}
+	captureSessions = nil
+}
+
+/* その段階を拾うセッションがあるか。コメントを作る手間がかかるところで先に確かめる */
+func captureStageActive(stage captureStage) bool {
+	if captureActive == 0 {
+		return false
+	}
+	for _, s := range captureSessions {
+		if s.active && s.stages[stage] {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * データパスの段階でパケットを拾う。netDevは受信か送信したインターフェイスで、決まらなければnil。
+ * ethernetがtrueならdataはイーサネットのフレーム、falseならIPv6パケット。
+ */
+func capture(netDev *netDevice, stage captureStage, data []byte, ethernet bool, comment string) {
+	if captureActive == 0 {
+		return
+	}
+
+	ifName := ""
+	if netDev != nil {
+		ifName = netDev.name
+	}
+	var parsed *capturePacket
+	for _, s := range captureSessions {
+		if !s.active || !s.stages[stage] || (s.ifName != "" && s.ifName != ifName) {
+			continue
+		}
+		if s.failed.Load() {
+			stopCapture(s, "write error")
+			continue
+		}
+		if s.filter != nil {
+			if parsed == nil {
+				parsed = parseCapturePacket(data, ethernet)
+			}
+			if !s.filter(parsed) {
+				continue
+			}
+		}
+		s.write(ifName, stage, data, ethernet, comment)
+	}
+}
+
+func (s *captureSession) write(ifName string, stage captureStage, data []byte, ethernet bool, comment string) {
+	linkType := PCAPNG_LINKTYPE_IPV6
+	if ethernet {
+		linkType = PCAPNG_LINKTYPE_ETHERNET
+	}
+	key := captureInterfaceKey{name: ifName, linkType: linkType}
+	ifId, ok := s.interfaces[key]
+	var blocks []byte
+	if !ok {
+		name := ifName
+		if name == "" {
+			name = "local"
+		}
+		ifId = uint32(len(s.interfaces))
+		blocks = pcapngInterfaceDescription(linkType, s.snapLen, name)
+	}
+
+	var flags uint32
+	switch stage {
+	case CAPTURE_RX, CAPTURE_FORWARDED:
+		flags = PCAPNG_EPB_INBOUND
+	case CAPTURE_TX:
+		flags = PCAPNG_EPB_OUTBOUND
+	case CAPTURE_DROPPED:
+		if ethernet {
+			flags = PCAPNG_EPB_INBOUND
+		}
+	}
+	captured := data
+	if uint32(len(captured)) > s.snapLen {
+		captured = captured[:s.snapLen]
+	}
+	blocks = append(blocks, pcapngEnhancedPacket(ifId, timerClock.now(), captured, len(data), flags, comment)...)
+
+	if s.maxBytes > 0 && s.bytes+uint64(len(blocks)) > s.maxBytes {
+		stopCapture(s, "size limit")
+		return
+	}
+	select {
+	case s.queue <- blocks:
+		if !ok {
+			s.interfaces[key] = ifId
+		}
+		s.packets++
+		s.bytes += uint64(len(blocks))
+	default:
+		s.lost++
+	}
+	if s.maxPackets > 0 && s.packets >= s.maxPackets {
+		stopCapture(s, "packet limit")
+	}
+}
+
+func (s *captureSession) stageNames() []string {
+	var names []string
+	for stage, on := range s.stages {
+		if on {
+			names = append(names, captureStage(stage).String())
+		}
+	}
+	return names
+}
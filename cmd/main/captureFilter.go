@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+/**
+ * キャプチャのフィルタ
+ * tcpdumpの式のうち、IPv6のアドレス、プロトコル、ポートを見るものだけを扱う。
+ *   ip6, icmp6, udp, tcp, proto <n>
+ *   [src|dst] host <addr>, [src|dst] net <prefix>, [src|dst] port <n>
+ *   and(&&), or(||), not(!), 括弧
+ * IPv6でないフレームはどの式にも一致しない。
+ */
+type captureFilter func(p *capturePacket) bool
+
+/* フィルタで見るパケットの中身。フレームを1回だけ解析して使い回す */
+type capturePacket struct {
+	isIpv6  bool
+	srcAddr in6Addr
+	dstAddr in6Addr
+	nextHdr uint8 // 拡張ヘッダの後の上位層のプロトコル
+	l4      bool  // 上位層のヘッダがあるか
+	srcPort uint16
+	dstPort uint16
+}
+
+/* ethernetがtrueならイーサネットのフレーム、falseならIPv6パケット */
+func parseCapturePacket(data []byte, ethernet bool) *capturePacket {
+	p := &capturePacket{}
+	if ethernet {
+		if len(data) < 14 || byteToUint16(data[12:14]) != ETHER_TYPE_IPV6 {
+			return p
+		}
+		data = data[14:]
+	}
+	if len(data) < 40 || data[0]>>4 != 6 {
+		return p
+	}
+	p.isIpv6 = true
+	p.srcAddr = in6Addr(data[8:24])
+	p.dstAddr = in6Addr(data[24:40])
+	p.nextHdr = data[6]
+
+	nextHdr, payload, ok := ipv6UpperLayer(data)
+	if !ok {
+		return p
+	}
+	p.nextHdr = nextHdr
+	p.l4 = true
+	if (nextHdr == IPV6_PROTOCOL_NUM_UDP || nextHdr == IPV6_PROTOCOL_NUM_TCP) && len(payload) >= 4 {
+		p.srcPort = byteToUint16(payload[0:2])
+		p.dstPort = byteToUint16(payload[2:4])
+	}
+	return p
+}
+
+type captureFilterParser struct {
+	tokens []string
+	pos    int
+}
+
+/* 空の式はnilを返し、全てのパケットに一致する */
+func parseCaptureFilter(expr string) (captureFilter, error) {
+	expr = strings.NewReplacer("(", " ( ", ")", " ) ", "!", " ! ").Replace(expr)
+	parser := &captureFilterParser{tokens: strings.Fields(expr)}
+	if len(parser.tokens) == 0 {
+		return nil, nil
+	}
+	filter, err := parser.or()
+	if err != nil {
+		return nil, err
+	}
+	if parser.pos < len(parser.tokens) {
+		return nil, fmt.Errorf("unexpected %q", parser.tokens[parser.pos])
+	}
+	return filter, nil
+}
+
+func (parser *captureFilterParser) peek() string {
+	if parser.pos >= len(parser.tokens) {
+		return ""
+	}
+	return parser.tokens[parser.pos]
+}
+
+func (parser *captureFilterParser) next() (string, error) {
+	if parser.pos >= len(parser.tokens) {
+		return "", fmt.Errorf("unexpected end")
+	}
+	parser.pos++
+	return parser.tokens[parser.pos-1], nil
+}
+
+func (parser *captureFilterParser) or() (captureFilter, error) {
+	left, err := parser.and()
+	if err != nil {
+		return nil, err
+	}
+	for parser.peek() == "or" || parser.peek() == "||" {
+		parser.pos++
+		right, err := parser.and()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(p *capturePacket) bool { return l(p) || right(p) }
+	}
+	return left, nil
+}
+
+func (parser *captureFilterParser) and() (captureFilter, error) {
+	left, err := parser.unary()
+	if err != nil {
+		return nil, err
+	}
+	for parser.peek() == "and" || parser.peek() == "&&" {
+		parser.pos++
+		right, err := parser.unary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(p *capturePacket) bool { return l(p) && right(p) }
+	}
+	return left, nil
+}
+
+func (parser *captureFilterParser) unary() (captureFilter, error) {
+	token, err := parser.next()
+	if err != nil {
+		return nil, err
+	}
+	switch token {
+	case "not", "!":
+		f, err := parser.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(p *capturePacket) bool { return p.isIpv6 && !f(p) }, nil
+	case "(":
+		f, err := parser.or()
+		if err != nil {
+			return nil, err
+		}
+		if token, err = parser.next(); err != nil || token != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return f, nil
+	}
+	return parser.primitive(token)
+}
+
+func (parser *captureFilterParser) primitive(token string) (captureFilter, error) {
+	switch token {
+	case "ip6":
+		return func(p *capturePacket) bool { return p.isIpv6 }, nil
+	case "icmp6":
+		return captureFilterProto(IPV6_PROTOCOL_NUM_ICMP), nil
+	case "udp":
+		return captureFilterProto(IPV6_PROTOCOL_NUM_UDP), nil
+	case "tcp":
+		return captureFilterProto(IPV6_PROTOCOL_NUM_TCP), nil
+	case "proto":
+		arg, err := parser.next()
+		if err != nil {
+			return nil, err
+		}
+		proto, err := strconv.ParseUint(arg, 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("invalid protocol %q", arg)
+		}
+		return captureFilterProto(uint8(proto)), nil
+	}
+
+	// src/dstを省略したらどちらか
+	src, dst := true, true
+	if token == "src" || token == "dst" {
+		src, dst = token == "src", token == "dst"
+		var err error
+		if token, err = parser.next(); err != nil {
+			return nil, err
+		}
+	}
+	arg, err := parser.next()
+	if err != nil {
+		return nil, err
+	}
+
+	switch token {
+	case "host":
+		ip := net.ParseIP(arg)
+		if ip == nil || ip.To4() != nil {
+			return nil, fmt.Errorf("invalid ipv6 address %q", arg)
+		}
+		addr := in6Addr(ip.To16())
+		return func(p *capturePacket) bool {
+			return p.isIpv6 && ((src && p.srcAddr == addr) || (dst && p.dstAddr == addr))
+		}, nil
+	case "net":
+		_, ipNet, err := net.ParseCIDR(arg)
+		if err != nil || ipNet.IP.To4() != nil {
+			return nil, fmt.Errorf("invalid ipv6 prefix %q", arg)
+		}
+		prefix := in6Addr(ipNet.IP.To16())
+		prefixLen, _ := ipNet.Mask.Size()
+		return func(p *capturePacket) bool {
+			return p.isIpv6 && ((src && in6IsInNetwork(p.srcAddr, prefix, prefixLen)) || (dst && in6IsInNetwork(p.dstAddr, prefix, prefixLen)))
+		}, nil
+	case "port":
+		port, err := strconv.ParseUint(arg, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port %q", arg)
+		}
+		return func(p *capturePacket) bool {
+			if !p.l4 || (p.nextHdr != IPV6_PROTOCOL_NUM_UDP && p.nextHdr != IPV6_PROTOCOL_NUM_TCP) {
+				return false
+			}
+			return (src && p.srcPort == uint16(port)) || (dst && p.dstPort == uint16(port))
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown %q", token)
+}
+
+func captureFilterProto(proto uint8) captureFilter {
+	return func(p *capturePacket) bool { return p.l4 && p.nextHdr == proto }
+}
@@ -1,58 +1,190 @@
 package main
 
 import (
-	"fmt"
-	"os/exec"
-	"strings"
+	"net"
 )
 
+/* メインテーブルのスタティック経路。ネクストホップのインターフェイスが落ちている間はRIBから外す */
+type staticRoute struct {
+	vrf       *vrf
+	key       ribKey
+	route     *ipv6RouteEntry
+	installed bool
+}
+
+var staticRoutes []*staticRoute
+
 func configIpv6NetRoute(prefix in6Addr, prefixLen uint8, nextHop in6Addr) {
+	configVrfIpv6NetRoute(DEFAULT_VRF_NAME, prefix, prefixLen, nextHop)
+}
+
+func configVrfIpv6NetRoute(vrfName string, prefix in6Addr, prefixLen uint8, nextHop in6Addr) {
+	configTableIpv6NetRoute(vrfName, MAIN_ROUTE_TABLE_ID, prefix, prefixLen, nextHop)
+}
+
+func configTableIpv6NetRoute(vrfName string, tableId uint32, prefix in6Addr, prefixLen uint8, nextHop in6Addr) {
+	v := getVrfByName(vrfName)
+	if v == nil {
+		configLog.Warn("vrf not found", "vrf", vrfName)
+		return
+	}
+	table := v.tables[tableId]
+	if table == nil {
+		configLog.Warn("route table not found", "vrf", v.name, "table", tableId)
+		return
+	}
+
 	route := &ipv6RouteEntry{
 		routeType: NETWORK,
 		nextHop:   nextHop,
+		proto:     PROTO_STATIC,
+	}
+	if tableId == MAIN_ROUTE_TABLE_ID {
+		key := ribKey{prefix: in6AddrClearPrefix(prefix, prefixLen), prefixLen: prefixLen}
+		for i, sr := range staticRoutes {
+			if sr.vrf == v && sr.key == key {
+				staticRoutes = append(staticRoutes[:i], staticRoutes[i+1:]...)
+				break
+			}
+		}
+		staticRoutes = append(staticRoutes, &staticRoute{vrf: v, key: key, route: route})
+		staticRoutesUpdate()
+	} else {
+		patriciaTrieInsert(table, prefix, prefixLen, route)
+	}
+
+	configLog.Info("configure route", "vrf", v.name, "table", tableId, "prefix", fmtPrefixStr(prefix, prefixLen), "nexthop", nextHop)
+}
+
+/* メインテーブルのスタティック経路を消す。ポリシールーティング用のテーブルの経路は対象外 */
+func deleteVrfIpv6NetRoute(vrfName string, prefix in6Addr, prefixLen uint8) bool {
+	v := getVrfByName(vrfName)
+	if v == nil {
+		configLog.Warn("vrf not found", "vrf", vrfName)
+		return false
 	}
-	patriciaTrieInsert(prefix, prefixLen, route)
 
-	fmt.Printf("configure route to %s/%d via %s\n", fmtIpStr(prefix), prefixLen, fmtIpStr(nextHop))
+	key := ribKey{prefix: in6AddrClearPrefix(prefix, prefixLen), prefixLen: prefixLen}
+	for i, sr := range staticRoutes {
+		if sr.vrf != v || sr.key != key {
+			continue
+		}
+		staticRoutes = append(staticRoutes[:i], staticRoutes[i+1:]...)
+		if sr.installed {
+			ribDelete(v, key.prefix, key.prefixLen, PROTO_STATIC)
+		}
+		configLog.Info("delete route", "vrf", v.name, "prefix", fmtPrefixStr(key.prefix, key.prefixLen))
+		return true
+	}
+	return false
+}
+
+/* ポリシールーティング用のテーブルのスタティック経路を消す */
+func deleteTableIpv6NetRoute(vrfName string, tableId uint32, prefix in6Addr, prefixLen uint8) bool {
+	v := getVrfByName(vrfName)
+	if v == nil || v.tables[tableId] == nil {
+		return false
+	}
+	if !patriciaTrieDelete(v.tables[tableId], prefix, prefixLen) {
+		return false
+	}
+	configLog.Info("delete route", "vrf", v.name, "table", tableId, "prefix", fmtPrefixStr(prefix, prefixLen))
+	return true
 }
 
 func configIpv6Addr(netDev *netDevice, addr in6Addr, prefixLen uint8) {
 	if netDev == nil {
-		fmt.Printf("net device to configure not found\n")
+		configLog.Warn("net device to configure not found")
 		return
 	}
 
 	netDev.ipv6Dev.address = addr
 	netDev.ipv6Dev.prefixLen = prefixLen
+	netDev.ipv6Dev.configured = true
+
+	configLog.Info("configure ipv6 address", "dev", netDev.name, "addr", fmtPrefixStr(addr, prefixLen))
 
-	fmt.Printf("configure ipv6 address to %s\n", fmtIpStr(addr))
+	// リンクが落ちていれば直結経路は上がったときに入れる
+	if !netDev.up {
+		configLog.Info("link is down, directly connected route is not installed", "dev", netDev.name)
+		return
+	}
 
 	route := &ipv6RouteEntry{
 		routeType: CONNECTED,
 		dev:       netDev,
+		proto:     PROTO_CONNECTED,
+	}
+	ribAdd(netDev.vrf, addr, prefixLen, route)
+
+	staticRoutesUpdate()
+}
+
+/* アドレスの設定を外し、直結経路とネクストホップがそのネットワークにあるスタティック経路を取り下げる */
+func unconfigIpv6Addr(netDev *netDevice) {
+	ipv6Dev := netDev.ipv6Dev
+	if ipv6Dev == nil || !ipv6Dev.configured {
+		return
 	}
-	patriciaTrieInsert(addr, prefixLen, route)
 
-	fmt.Printf("configure directly connected route %s/%d. device name is %s\n", fmtIpStr(in6AddrClearPrefix(addr, prefixLen)), prefixLen, netDev.name)
+	ribDelete(netDev.vrf, ipv6Dev.address, ipv6Dev.prefixLen, PROTO_CONNECTED)
+	configLog.Info("unconfigure ipv6 address", "dev", netDev.name, "addr", fmtPrefixStr(ipv6Dev.address, ipv6Dev.prefixLen))
+
+	// 外したアドレス宛てのパケットを受け取ったりNSに答えたりしないよう消しておく
+	ipv6Dev.address = in6Addr{}
+	ipv6Dev.prefixLen = 0
+	ipv6Dev.configured = false
+	staticRoutesUpdate()
 }
 
-func getMacAddr(netns string, ifName string) [6]byte {
-	// コマンドと引数を指定
-	cmd := exec.Command("ip", "netns", "exec", netns, "bash", "-c", fmt.Sprintf(`
-		ip l show dev %s | grep -oE "([0-9a-fA-F]{2}:){5}[0-9a-fA-F]{2}" | head -n 1
-	`, ifName))
+/*
+ * 隣接ノードのMACアドレスを設定する。それ以外の隣接ノードはNS/NAで学習する。
+ * インターフェイスが所属するVRFのNDテーブルに入るので、configVrfMemberより後に呼び出すこと。
+ */
+func configStaticNeighbor(netDev *netDevice, addr in6Addr, macStr string) {
+	if netDev == nil {
+		configLog.Warn("net device to configure not found")
+		return
+	}
 
-	// 標準出力をキャプチャ
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		fmt.Errorf("error: %s", err)
+	hwAddr, err := net.ParseMAC(macStr)
+	if err != nil || len(hwAddr) != 6 {
+		configLog.Warn("invalid mac address for neighbor", "addr", addr, "mac", macStr)
+		return
 	}
 
-	macStr := strings.TrimSpace(string(output))
-	if macStr == "" {
-		fmt.Errorf("invalid mac addr format", err)
+	addStaticNDTableEntry(netDev, [6]uint8(hwAddr), addr)
+
+	configLog.Info("configure static neighbor", "dev", netDev.name, "addr", addr, "mac", macStr)
+}
+
+/*
+ * ネクストホップが直結するインターフェイスの状態に合わせてスタティック経路をRIBに出し入れする。
+ * ネクストホップがどの直結ネットワークにもなければインターフェイスに依存しないものとして常に入れる。
+ */
+func staticRoutesUpdate() {
+	for _, sr := range staticRoutes {
+		netDev := staticNextHopDev(sr.vrf, sr.route.nextHop)
+		usable := netDev == nil || netDev.up
+		if usable && !sr.installed {
+			ribAdd(sr.vrf, sr.key.prefix, sr.key.prefixLen, sr.route)
+		} else if !usable && sr.installed {
+			ribDelete(sr.vrf, sr.key.prefix, sr.key.prefixLen, PROTO_STATIC)
+			fibLog.Info("static route is down", "vrf", sr.vrf.name, "prefix", fmtPrefixStr(sr.key.prefix, sr.key.prefixLen), "nexthop", sr.route.nextHop, "dev", netDev.name)
+		}
+		sr.installed = usable
 	}
+}
 
-	// MACアドレスを[6]byte形式に変換
-	return parseMac(macStr)
+func staticNextHopDev(v *vrf, nextHop in6Addr) *netDevice {
+	for _, netDev := range netDevices {
+		ipv6Dev := netDev.ipv6Dev
+		if netDev.vrf != v || ipv6Dev == nil || !ipv6Dev.configured {
+			continue
+		}
+		if in6IsInNetwork(nextHop, ipv6Dev.address, int(ipv6Dev.prefixLen)) {
+			return netDev
+		}
+	}
+	return nil
 }
@@ -0,0 +1,2047 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * 候補設定(candidate)と運用設定(running)
+ * VRF、インターフェイスのアドレス、スタティック経路、スタティックな隣接ノード、ルーティングプロトコル、
+ * ルートマップなどの設定を1行ずつのテキストで表す。
+ *
+ *   vrf NAME
+ *   interface router1-host1
+ *    ipv6 address 2001:db8:0:1001::1/64
+ *    sflow sampling-rate 1000
+ *    vrf NAME
+ *    ripng
+ *    ospfv3 area 0.0.0.0 [network point-to-point|broadcast] [cost COST]
+ *    ospfv3 bfd
+ *    vrrp 1 [priority 100] [interval 1000] address fe80::1 2001:db8:0:1001::1
+ *    isis [network point-to-point|broadcast] [metric METRIC]
+ *   !
+ *   router ripng
+ *    redistribute connected|static [route-map NAME]
+ *   !
+ *   router ospfv3
+ *    router-id 1.1.1.1
+ *    redistribute connected|static [route-map NAME]
+ *   !
+ *   router isis
+ *    net 49.0001.0000.0000.0001.00
+ *    level 1|2
+ *    redistribute connected|static [route-map NAME]
+ *   !
+ *   router bgp 65001
+ *    router-id 1.1.1.1
+ *    neighbor 2001:db8:0:1000::2 remote-as 65002 [interface IFNAME]
+ *    neighbor 2001:db8:0:1000::2 bfd
+ *    neighbor 2001:db8:0:1000::2 import|export seq 10 permit|deny PREFIX [ge LEN] [le LEN] [local-preference PREF] [med MED] [prepend COUNT]
+ *    network 2001:db8:0:1001::/64
+ *    redistribute connected|static [route-map NAME]
+ *   !
+ *   route-map NAME permit|deny 10
+ *    match address prefix-list NAME
+ *    match next-hop prefix-list NAME
+ *    match source-protocol PROTO...
+ *    match tag TAG
+ *    set metric METRIC
+ *    set tag TAG
+ *    set next-hop ADDRESS
+ *    set distance DISTANCE
+ *   !
+ *   ipv6 route 2001:db8:0:1002::/64 2001:db8:0:1000::2 [vrf NAME]
+ *   ipv6 route 2001:db8:0:1002::/64 leak DSTVRF [vrf NAME]
+ *   ipv6 route 2001:db8:0:1002::/64 2001:db8:0:1000::2 bfd
+ *   ipv6 route-table 100 [vrf NAME]
+ *   ipv6 route 2001:db8:0:1002::/64 2001:db8:0:1000::2 table 100 [vrf NAME]
+ *   ipv6 rule 10 [from PREFIX] [iif IFNAME] [tc TC[/MASK]] [dscp DSCP] [flowlabel LABEL] [nexthdr PROTO] (table 100 | nexthop ADDRESS) [vrf NAME]
+ *   ipv6 neighbor 2001:db8:0:1001::2 router1-host1 02:00:00:00:00:02
+ *   ipv6 prefix-list NAME seq 10 permit|deny PREFIX [ge LEN] [le LEN]
+ *   ipv6 fib route-map NAME [vrf NAME]
+ *   bfd interval 300 min-rx 300 multiplier 3
+ *   ipfix collector 2001:db8::10 4739 [active SECONDS] [inactive SECONDS]
+ *   sflow collector 2001:db8::10 6343 [polling SECONDS]
+ *
+ * "interface X"や"router ospfv3"の下のインデントされた行は、見出しを前に付けた1行としても書ける。
+ *   interface router1-host1 ipv6 address 2001:db8:0:1001::1/64
+ * commitすると運用設定との差分だけをFIB、アドレス、NDテーブル、ルーティングプロトコルに反映する。
+ */
+const CONFIG_HISTORY_SIZE = 50
+
+type configRouteKey struct {
+	vrf    string
+	prefix string
+}
+
+type configTableKey struct {
+	vrf   string
+	table uint32
+}
+
+type configTableRouteKey struct {
+	vrf    string
+	table  uint32
+	prefix string
+}
+
+type configRuleKey struct {
+	vrf      string
+	priority uint32
+}
+
+type configBgpPolicyKey struct {
+	neighbor  string
+	direction string // importかexport
+	seq       uint32
+}
+
+type configVrrpKey struct {
+	ifName string
+	vrid   uint8
+}
+
+// プレフィックスリストやルートマップのエントリ
+type configSeqKey struct {
+	name string
+	seq  uint32
+}
+
+type configRouteMapClauseKey struct {
+	name   string
+	seq    uint32
+	clause string // routeMapClausesのどれか
+}
+
+type configRedistributeKey struct {
+	into string // ripng、ospfv3、isis、bgp
+	from string // connectedかstatic
+}
+
+type configNeighborKey struct {
+	ifName  string
+	address string
+}
+
+type routerConfig struct {
+	vrfs        map[string]bool                // デフォルト以外のVRF
+	vrfMembers  map[string]string              // インターフェイス名ごとの所属VRF。なければデフォルト
+	addresses   map[string]string              // インターフェイス名ごとのアドレスとプレフィックス長
+	routes      map[configRouteKey]string      // ネクストホップ
+	leaks       map[configRouteKey]string      // リーク先のVRF。同じプレフィックスのスタティック経路とは共存しない
+	tables      map[configTableKey]bool        // ポリシールーティング用のテーブル
+	tableRoutes map[configTableRouteKey]string // ポリシールーティング用のテーブルの経路のネクストホップ
+	rules       map[configRuleKey]string       // "ipv6 rule"の後ろ
+	neighbors   map[configNeighborKey]string   // MACアドレス
+	ipfix       string                         // "ipfix collector"の後ろ。空ならフローを送らない
+	sflow       string                         // "sflow collector"の後ろ。空ならサンプルを送らない
+	sflowRates  map[string]uint32              // インターフェイス名ごとのsFlowのサンプリングレート
+	ripng       map[string]bool                // RIPngを有効にしたインターフェイス
+	vrrp        map[configVrrpKey]string       // "vrrp VRID"の後ろ
+	bfd         string                         // "bfd interval"の後ろ。空ならデフォルト
+	bfdRoutes   map[string]string              // デフォルトVRFのBFDで監視するスタティック経路のネクストホップ
+
+	ospfv3RouterId   string            // 空ならOSPFv3を動かさない
+	ospfv3Interfaces map[string]string // インターフェイス名ごとの"ospfv3"の後ろ
+	ospfv3Bfd        map[string]bool   // 近隣ルータをBFDで監視するインターフェイス
+
+	isisNet        string            // 空ならIS-ISを動かさない
+	isisLevel      int               // 0ならレベル2
+	isisInterfaces map[string]string // インターフェイス名ごとの"isis"の後ろ
+
+	bgpAs        uint32                        // 0ならBGPを動かさない
+	bgpRouterId  string                        // BGPを動かすなら必須
+	bgpNeighbors map[string]string             // ピアのアドレスごとの"remote-as AS [interface IFNAME]"
+	bgpPolicies  map[configBgpPolicyKey]string // "permit|deny PREFIX ..."
+	bgpNetworks  map[string]bool               // 自分が生成して広告するプレフィックス
+	bgpBfd       map[string]bool               // BFDで監視するピア
+
+	prefixLists     map[configSeqKey]string            // "permit|deny PREFIX ..."
+	routeMaps       map[configSeqKey]string            // permitかdeny
+	routeMapClauses map[configRouteMapClauseKey]string // 条件や設定の値
+	redistributes   map[configRedistributeKey]string   // ルートマップの名前。空なら全て再配布する
+	fibRouteMaps    map[string]string                  // VRFごとのFIBのルートマップ
+}
+
+type configCommit struct {
+	config  *routerConfig
+	time    time.Time
+	comment string
+}
+
+var runningConfig = newRouterConfig()
+var candidateConfig = newRouterConfig()
+
+// 新しいものから並べたcommitの履歴。先頭は運用設定と同じ
+var configHistory []*configCommit
+
+// commit confirmedの確認待ち。期限までにcommitされなければconfigConfirmPrevに戻す
+var configConfirmTimer *timer
+var configConfirmPrev *routerConfig
+
+func newRouterConfig() *routerConfig {
+	return &routerConfig{
+		vrfs:        map[string]bool{},
+		vrfMembers:  map[string]string{},
+		addresses:   map[string]string{},
+		routes:      map[configRouteKey]string{},
+		leaks:       map[configRouteKey]string{},
+		tables:      map[configTableKey]bool{},
+		tableRoutes: map[configTableRouteKey]string{},
+		rules:       map[configRuleKey]string{},
+		neighbors:   map[configNeighborKey]string{},
+		sflowRates:  map[string]uint32{},
+		ripng:       map[string]bool{},
+		vrrp:        map[configVrrpKey]string{},
+		bfdRoutes:   map[string]string{},
+
+		ospfv3Interfaces: map[string]string{},
+		ospfv3Bfd:        map[string]bool{},
+
+		isisInterfaces: map[string]string{},
+
+		bgpNeighbors: map[string]string{},
+		bgpPolicies:  map[configBgpPolicyKey]string{},
+		bgpNetworks:  map[string]bool{},
+		bgpBfd:       map[string]bool{},
+
+		prefixLists:     map[configSeqKey]string{},
+		routeMaps:       map[configSeqKey]string{},
+		routeMapClauses: map[configRouteMapClauseKey]string{},
+		redistributes:   map[configRedistributeKey]string{},
+		fibRouteMaps:    map[string]string{},
+	}
+}
+
+func (cfg *routerConfig) clone() *routerConfig {
+	return &routerConfig{
+		vrfs:        maps.Clone(cfg.vrfs),
+		vrfMembers:  maps.Clone(cfg.vrfMembers),
+		addresses:   maps.Clone(cfg.addresses),
+		routes:      maps.Clone(cfg.routes),
+		leaks:       maps.Clone(cfg.leaks),
+		tables:      maps.Clone(cfg.tables),
+		tableRoutes: maps.Clone(cfg.tableRoutes),
+		rules:       maps.Clone(cfg.rules),
+		neighbors:   maps.Clone(cfg.neighbors),
+		ipfix:       cfg.ipfix,
+		sflow:       cfg.sflow,
+		sflowRates:  maps.Clone(cfg.sflowRates),
+		ripng:       maps.Clone(cfg.ripng),
+		vrrp:        maps.Clone(cfg.vrrp),
+		bfd:         cfg.bfd,
+		bfdRoutes:   maps.Clone(cfg.bfdRoutes),
+
+		ospfv3RouterId:   cfg.ospfv3RouterId,
+		ospfv3Interfaces: maps.Clone(cfg.ospfv3Interfaces),
+		ospfv3Bfd:        maps.Clone(cfg.ospfv3Bfd),
+
+		isisNet:        cfg.isisNet,
+		isisLevel:      cfg.isisLevel,
+		isisInterfaces: maps.Clone(cfg.isisInterfaces),
+
+		bgpAs:        cfg.bgpAs,
+		bgpRouterId:  cfg.bgpRouterId,
+		bgpNeighbors: maps.Clone(cfg.bgpNeighbors),
+		bgpPolicies:  maps.Clone(cfg.bgpPolicies),
+		bgpNetworks:  maps.Clone(cfg.bgpNetworks),
+		bgpBfd:       maps.Clone(cfg.bgpBfd),
+
+		prefixLists:     maps.Clone(cfg.prefixLists),
+		routeMaps:       maps.Clone(cfg.routeMaps),
+		routeMapClauses: maps.Clone(cfg.routeMapClauses),
+		redistributes:   maps.Clone(cfg.redistributes),
+		fibRouteMaps:    maps.Clone(cfg.fibRouteMaps),
+	}
+}
+
+/* IS-ISのレベル。指定がなければ2 */
+func (cfg *routerConfig) isisLevelOrDefault() int {
+	if cfg.isisLevel == 0 {
+		return 2
+	}
+	return cfg.isisLevel
+}
+
+/* インターフェイスが所属するVRFの名前 */
+func (cfg *routerConfig) vrfOf(ifName string) string {
+	if vrfName, ok := cfg.vrfMembers[ifName]; ok {
+		return vrfName
+	}
+	return DEFAULT_VRF_NAME
+}
+
+/*
+ * 設定のテキストを読む。"interface X"や"router ospfv3"のような見出しだけの行に続くインデントされた行は、
+ * 見出しを前に付けた1行として読む。"!"と"#"で始まる行は読み飛ばす。
+ */
+func parseRouterConfig(text string) (*routerConfig, error) {
+	cfg := newRouterConfig()
+	var block []string
+	for i, line := range strings.Split(text, "\n") {
+		words := strings.Fields(line)
+		if len(words) == 0 || strings.HasPrefix(words[0], "!") || strings.HasPrefix(words[0], "#") {
+			continue
+		}
+
+		indented := line[0] == ' ' || line[0] == '\t'
+		if !indented {
+			block = nil
+			if configBlockLen(words) == len(words) {
+				block = words
+			}
+		} else if block != nil {
+			if words[0] == "no" {
+				words = append(append([]string{"no"}, block...), words[1:]...)
+			} else {
+				words = append(append([]string{}, block...), words...)
+			}
+		}
+
+		err := cfg.edit(words, "")
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", i+1, err)
+		}
+	}
+	return cfg, nil
+}
+
+/* 行の先頭にある見出しの語数。見出しを持たない行は0 */
+func configBlockLen(words []string) int {
+	switch {
+	case len(words) >= 2 && words[0] == "interface":
+		return 2
+	case len(words) >= 3 && words[0] == "router" && words[1] == "bgp":
+		return 3
+	case len(words) >= 4 && words[0] == "route-map":
+		return 4
+	case len(words) >= 2 && words[0] == "router":
+		return 2
+	}
+	return 0
+}
+
+/*
+ * 1行分の設定を変更する。ifNameはインターフェイスの設定の中で使うときに指定する。
+ * "no"で始まれば設定を消す。
+ */
+func (cfg *routerConfig) edit(words []string, ifName string) error {
+	negate := false
+	if len(words) > 0 && words[0] == "no" {
+		negate = true
+		words = words[1:]
+	}
+
+	switch {
+	case len(words) == 2 && words[0] == "interface":
+		if negate {
+			cfg.deleteInterface(words[1])
+		}
+		return nil
+	case len(words) >= 3 && words[0] == "interface":
+		if negate {
+			return cfg.edit(append([]string{"no"}, words[2:]...), words[1])
+		}
+		return cfg.edit(words[2:], words[1])
+	case len(words) >= 2 && words[0] == "router" && words[1] == "ospfv3":
+		return cfg.editOspfv3(words[2:], negate)
+	case len(words) >= 2 && words[0] == "router" && words[1] == "bgp":
+		return cfg.editBgp(words[2:], negate)
+	case len(words) >= 2 && words[0] == "router" && words[1] == "isis":
+		return cfg.editIsis(words[2:], negate)
+	case len(words) >= 2 && words[0] == "router" && words[1] == "ripng":
+		return cfg.editRipng(words[2:], negate)
+	case len(words) >= 2 && words[0] == "route-map":
+		return cfg.editRouteMap(words[1:], negate)
+	case len(words) >= 3 && words[0] == "ipv6" && words[1] == "prefix-list":
+		return cfg.editPrefixList(words[2:], negate)
+	case len(words) >= 3 && words[0] == "ipv6" && words[1] == "fib" && words[2] == "route-map":
+		words, vrfName := configSplitVrf(words)
+		if negate {
+			delete(cfg.fibRouteMaps, vrfName)
+			return nil
+		}
+		if len(words) != 4 {
+			return fmt.Errorf("usage: ipv6 fib route-map NAME [vrf NAME]")
+		}
+		cfg.fibRouteMaps[vrfName] = words[3]
+		return nil
+	case len(words) >= 1 && words[0] == "vrf" && ifName != "":
+		if negate {
+			delete(cfg.vrfMembers, ifName)
+			return nil
+		}
+		if len(words) != 2 {
+			return fmt.Errorf("usage: vrf NAME")
+		}
+		if words[1] == DEFAULT_VRF_NAME {
+			delete(cfg.vrfMembers, ifName)
+		} else {
+			cfg.vrfMembers[ifName] = words[1]
+		}
+		return nil
+	case len(words) == 2 && words[0] == "vrf":
+		if words[1] == DEFAULT_VRF_NAME {
+			return fmt.Errorf("vrf %s can not be configured", DEFAULT_VRF_NAME)
+		}
+		if negate {
+			delete(cfg.vrfs, words[1])
+		} else {
+			cfg.vrfs[words[1]] = true
+		}
+		return nil
+	case len(words) >= 2 && words[0] == "ipv6" && words[1] == "address":
+		if ifName == "" {
+			return fmt.Errorf("ipv6 address must be configured in interface")
+		}
+		if negate {
+			delete(cfg.addresses, ifName)
+			return nil
+		}
+		if len(words) != 3 {
+			return fmt.Errorf("usage: ipv6 address ADDRESS/LEN")
+		}
+		ip, ipNet, err := net.ParseCIDR(words[2])
+		if err != nil || ip.To4() != nil {
+			return fmt.Errorf("invalid ipv6 address %s", words[2])
+		}
+		prefixLen, _ := ipNet.Mask.Size()
+		cfg.addresses[ifName] = fmt.Sprintf("%s/%d", ip, prefixLen)
+		return nil
+	case len(words) >= 3 && words[0] == "ipv6" && words[1] == "route-table":
+		words, vrfName := configSplitVrf(words)
+		if len(words) != 3 {
+			return fmt.Errorf("usage: ipv6 route-table ID [vrf NAME]")
+		}
+		tableId, err := strconv.ParseUint(words[2], 10, 32)
+		if err != nil || uint32(tableId) == MAIN_ROUTE_TABLE_ID {
+			return fmt.Errorf("invalid table id %s", words[2])
+		}
+		key := configTableKey{vrf: vrfName, table: uint32(tableId)}
+		if negate {
+			delete(cfg.tables, key)
+		} else {
+			cfg.tables[key] = true
+		}
+		return nil
+	case len(words) >= 3 && words[0] == "ipv6" && words[1] == "route":
+		words, vrfName := configSplitVrf(words)
+		_, ipNet, err := net.ParseCIDR(words[2])
+		if err != nil || ipNet.IP.To4() != nil {
+			return fmt.Errorf("invalid ipv6 prefix %s", words[2])
+		}
+		if n := len(words); n >= 2 && words[n-2] == "table" {
+			return cfg.editTableRoute(words[:n-2], words[n-1], vrfName, ipNet.String(), negate)
+		}
+		key := configRouteKey{vrf: vrfName, prefix: ipNet.String()}
+		if negate {
+			if len(words) > 5 {
+				return fmt.Errorf("usage: no ipv6 route PREFIX [NEXTHOP | leak DSTVRF] [vrf NAME]")
+			}
+			cfg.deleteRoute(key)
+			return nil
+		}
+		if len(words) == 5 && words[3] == "leak" {
+			if words[4] == vrfName {
+				return fmt.Errorf("route %s can not be leaked to the same vrf", words[2])
+			}
+			cfg.deleteRoute(key)
+			cfg.leaks[key] = words[4]
+			return nil
+		}
+		bfd := len(words) == 5 && words[4] == "bfd"
+		if len(words) != 4 && !bfd {
+			return fmt.Errorf("usage: ipv6 route PREFIX (NEXTHOP [bfd] | leak DSTVRF) [vrf NAME]")
+		}
+		nextHop := net.ParseIP(words[3])
+		if nextHop == nil || nextHop.To4() != nil {
+			return fmt.Errorf("invalid next hop %s", words[3])
+		}
+		if bfd && vrfName != DEFAULT_VRF_NAME {
+			return fmt.Errorf("route with bfd must be in vrf %s", DEFAULT_VRF_NAME)
+		}
+		cfg.deleteRoute(key)
+		if bfd {
+			cfg.bfdRoutes[key.prefix] = nextHop.String()
+		} else {
+			cfg.routes[key] = nextHop.String()
+		}
+		return nil
+	case len(words) >= 3 && words[0] == "ipv6" && words[1] == "rule":
+		words, vrfName := configSplitVrf(words)
+		priority, err := strconv.ParseUint(words[2], 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid priority %s", words[2])
+		}
+		key := configRuleKey{vrf: vrfName, priority: uint32(priority)}
+		if negate {
+			delete(cfg.rules, key)
+			return nil
+		}
+		rule, err := parsePolicyRule(words[2:])
+		if err != nil {
+			return err
+		}
+		cfg.rules[key] = rule.String()
+		return nil
+	case len(words) >= 3 && words[0] == "ipv6" && words[1] == "neighbor":
+		addr := net.ParseIP(words[2])
+		if addr == nil || addr.To4() != nil {
+			return fmt.Errorf("invalid ipv6 address %s", words[2])
+		}
+		if negate {
+			// インターフェイスを省略したらどのインターフェイスのものでも消す。設定した行のままMACアドレスを付けてもよい
+			if len(words) > 5 {
+				return fmt.Errorf("usage: no ipv6 neighbor ADDRESS [INTERFACE [MAC]]")
+			}
+			for key := range cfg.neighbors {
+				if key.address == addr.String() && (len(words) == 3 || key.ifName == words[3]) {
+					delete(cfg.neighbors, key)
+				}
+			}
+			return nil
+		}
+		if len(words) != 5 {
+			return fmt.Errorf("usage: ipv6 neighbor ADDRESS INTERFACE MAC")
+		}
+		hwAddr, err := net.ParseMAC(words[4])
+		if err != nil || len(hwAddr) != 6 {
+			return fmt.Errorf("invalid mac addr %s", words[4])
+		}
+		cfg.neighbors[configNeighborKey{ifName: words[3], address: addr.String()}] = hwAddr.String()
+		return nil
+	case len(words) >= 2 && words[0] == "bfd" && words[1] == "interval":
+		if negate {
+			cfg.bfd = ""
+			return nil
+		}
+		interval, err := parseBfdInterval(words[2:])
+		if err != nil {
+			return err
+		}
+		cfg.bfd = interval.String()
+		return nil
+	case len(words) >= 2 && words[0] == "ipfix" && words[1] == "collector":
+		if negate {
+			cfg.ipfix = ""
+			return nil
+		}
+		collector, err := parseIpfixCollector(words[2:])
+		if err != nil {
+			return err
+		}
+		cfg.ipfix = collector.String()
+		return nil
+	case len(words) >= 2 && words[0] == "sflow" && words[1] == "sampling-rate":
+		if ifName == "" {
+			return fmt.Errorf("sflow sampling-rate must be configured in interface")
+		}
+		if negate {
+			delete(cfg.sflowRates, ifName)
+			return nil
+		}
+		if len(words) != 3 {
+			return fmt.Errorf("usage: sflow sampling-rate RATE")
+		}
+		rate, err := parseSflowSamplingRate(words[2])
+		if err != nil {
+			return err
+		}
+		cfg.sflowRates[ifName] = rate
+		return nil
+	case len(words) == 1 && words[0] == "ripng":
+		if ifName == "" {
+			return fmt.Errorf("ripng must be configured in interface")
+		}
+		if negate {
+			delete(cfg.ripng, ifName)
+		} else {
+			cfg.ripng[ifName] = true
+		}
+		return nil
+	case len(words) >= 2 && words[0] == "vrrp":
+		if ifName == "" {
+			return fmt.Errorf("vrrp must be configured in interface")
+		}
+		vrid, err := strconv.ParseUint(words[1], 10, 8)
+		if err != nil || vrid == 0 {
+			return fmt.Errorf("invalid vrid %s", words[1])
+		}
+		key := configVrrpKey{ifName: ifName, vrid: uint8(vrid)}
+		if negate {
+			delete(cfg.vrrp, key)
+			return nil
+		}
+		config, err := parseVrrpConfig(words[2:])
+		if err != nil {
+			return err
+		}
+		cfg.vrrp[key] = config.String()
+		return nil
+	case len(words) >= 1 && words[0] == "isis":
+		if ifName == "" {
+			return fmt.Errorf("isis must be configured in interface")
+		}
+		if negate {
+			delete(cfg.isisInterfaces, ifName)
+			return nil
+		}
+		config, err := parseIsisInterfaceConfig(words[1:])
+		if err != nil {
+			return err
+		}
+		cfg.isisInterfaces[ifName] = config.String()
+		return nil
+	case len(words) >= 1 && words[0] == "ospfv3":
+		if ifName == "" {
+			return fmt.Errorf("ospfv3 must be configured in interface")
+		}
+		if len(words) == 2 && words[1] == "bfd" {
+			if negate {
+				delete(cfg.ospfv3Bfd, ifName)
+			} else {
+				cfg.ospfv3Bfd[ifName] = true
+			}
+			return nil
+		}
+		if negate {
+			delete(cfg.ospfv3Interfaces, ifName)
+			delete(cfg.ospfv3Bfd, ifName)
+			return nil
+		}
+		config, err := parseOspfv3InterfaceConfig(words[1:])
+		if err != nil {
+			return err
+		}
+		cfg.ospfv3Interfaces[ifName] = config.String()
+		return nil
+	case len(words) >= 2 && words[0] == "sflow" && words[1] == "collector":
+		if negate {
+			cfg.sflow = ""
+			return nil
+		}
+		collector, err := parseSflowCollector(words[2:])
+		if err != nil {
+			return err
+		}
+		cfg.sflow = collector.String()
+		return nil
+	}
+	return fmt.Errorf("unknown command: %s", strings.Join(words, " "))
+}
+
+/* 同じプレフィックスの経路を種類によらず消す */
+func (cfg *routerConfig) deleteRoute(key configRouteKey) {
+	delete(cfg.routes, key)
+	delete(cfg.leaks, key)
+	if key.vrf == DEFAULT_VRF_NAME {
+		delete(cfg.bfdRoutes, key.prefix)
+	}
+}
+
+/* インターフェイスの設定を全て消す */
+func (cfg *routerConfig) deleteInterface(ifName string) {
+	delete(cfg.vrfMembers, ifName)
+	delete(cfg.addresses, ifName)
+	delete(cfg.sflowRates, ifName)
+	delete(cfg.ripng, ifName)
+	delete(cfg.ospfv3Interfaces, ifName)
+	delete(cfg.ospfv3Bfd, ifName)
+	delete(cfg.isisInterfaces, ifName)
+	for key := range cfg.neighbors {
+		if key.ifName == ifName {
+			delete(cfg.neighbors, key)
+		}
+	}
+	for key := range cfg.vrrp {
+		if key.ifName == ifName {
+			delete(cfg.vrrp, key)
+		}
+	}
+}
+
+/* "router ospfv3"の下の設定。"no router ospfv3"はインターフェイスの設定も含めて全て消す */
+func (cfg *routerConfig) editOspfv3(words []string, negate bool) error {
+	switch {
+	case len(words) == 0:
+		if negate {
+			cfg.ospfv3RouterId = ""
+			cfg.ospfv3Interfaces = map[string]string{}
+			cfg.ospfv3Bfd = map[string]bool{}
+			cfg.deleteRedistributes("ospfv3")
+		}
+		return nil
+	case words[0] == "redistribute":
+		return cfg.editRedistribute("ospfv3", words[1:], negate)
+	case words[0] == "router-id":
+		if negate {
+			cfg.ospfv3RouterId = ""
+			return nil
+		}
+		if len(words) != 2 || net.ParseIP(words[1]).To4() == nil {
+			return fmt.Errorf("usage: router-id A.B.C.D")
+		}
+		cfg.ospfv3RouterId = net.ParseIP(words[1]).To4().String()
+		return nil
+	}
+	return fmt.Errorf("unknown command: router ospfv3 %s", strings.Join(words, " "))
+}
+
+/* "router ripng"の下の設定。"no router ripng"はインターフェイスの設定も含めて全て消す */
+func (cfg *routerConfig) editRipng(words []string, negate bool) error {
+	switch {
+	case len(words) == 0:
+		if negate {
+			cfg.ripng = map[string]bool{}
+			cfg.deleteRedistributes("ripng")
+		}
+		return nil
+	case words[0] == "redistribute":
+		return cfg.editRedistribute("ripng", words[1:], negate)
+	}
+	return fmt.Errorf("unknown command: router ripng %s", strings.Join(words, " "))
+}
+
+/* "redistribute connected|static [route-map NAME]"。intoは再配布先のプロトコル */
+func (cfg *routerConfig) editRedistribute(into string, words []string, negate bool) error {
+	if len(words) == 0 || (words[0] != "connected" && words[0] != "static") {
+		return fmt.Errorf("usage: redistribute connected|static [route-map NAME]")
+	}
+	key := configRedistributeKey{into: into, from: words[0]}
+	if negate {
+		delete(cfg.redistributes, key)
+		return nil
+	}
+	switch {
+	case len(words) == 1:
+		cfg.redistributes[key] = ""
+	case len(words) == 3 && words[1] == "route-map":
+		cfg.redistributes[key] = words[2]
+	default:
+		return fmt.Errorf("usage: redistribute connected|static [route-map NAME]")
+	}
+	return nil
+}
+
+func (cfg *routerConfig) deleteRedistributes(into string) {
+	for key := range cfg.redistributes {
+		if key.into == into {
+			delete(cfg.redistributes, key)
+		}
+	}
+}
+
+/* "ipv6 prefix-list NAME"の後ろ。"no ipv6 prefix-list NAME"はリストを全て消す */
+func (cfg *routerConfig) editPrefixList(words []string, negate bool) error {
+	name := words[0]
+	if negate && len(words) == 1 {
+		for key := range cfg.prefixLists {
+			if key.name == name {
+				delete(cfg.prefixLists, key)
+			}
+		}
+		return nil
+	}
+	if len(words) < 3 || words[1] != "seq" {
+		return fmt.Errorf("usage: ipv6 prefix-list NAME seq SEQ permit|deny PREFIX [ge LEN] [le LEN]")
+	}
+	seq, err := strconv.ParseUint(words[2], 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid seq %s", words[2])
+	}
+	key := configSeqKey{name: name, seq: uint32(seq)}
+	if negate {
+		delete(cfg.prefixLists, key)
+		return nil
+	}
+	entry, err := parsePrefixListEntry(words[3:])
+	if err != nil {
+		return err
+	}
+	cfg.prefixLists[key] = entry.String()
+	return nil
+}
+
+/*
+ * "route-map NAME permit|deny SEQ"とその下の"match ..."と"set ..."。
+ * "no route-map NAME"はルートマップを全て、"no route-map NAME permit|deny SEQ"はエントリを消す。
+ */
+func (cfg *routerConfig) editRouteMap(words []string, negate bool) error {
+	name := words[0]
+	if negate && len(words) == 1 {
+		for key := range cfg.routeMaps {
+			if key.name == name {
+				cfg.deleteRouteMapEntry(key)
+			}
+		}
+		return nil
+	}
+	if len(words) < 3 {
+		return fmt.Errorf("usage: route-map NAME permit|deny SEQ")
+	}
+	action, err := parseRouteMapAction(words[1])
+	if err != nil {
+		return err
+	}
+	seq, err := strconv.ParseUint(words[2], 10, 32)
+	if err != nil {
+		return fmt.Errorf("invalid seq %s", words[2])
+	}
+	key := configSeqKey{name: name, seq: uint32(seq)}
+	words = words[3:]
+
+	if negate {
+		if len(words) == 0 {
+			cfg.deleteRouteMapEntry(key)
+			return nil
+		}
+		clause := routeMapClauseOf(words)
+		if clause == "" {
+			return fmt.Errorf("unknown route map clause: %s", strings.Join(words, " "))
+		}
+		delete(cfg.routeMapClauses, configRouteMapClauseKey{name: name, seq: key.seq, clause: clause})
+		return nil
+	}
+	if len(words) > 0 {
+		entry := &routeMapEntry{}
+		clause, err := parseRouteMapClause(entry, words)
+		if err != nil {
+			return err
+		}
+		cfg.routeMapClauses[configRouteMapClauseKey{name: name, seq: key.seq, clause: clause}] = entry.clauseValue(clause)
+	}
+	cfg.routeMaps[key] = action.String()
+	return nil
+}
+
+func (cfg *routerConfig) deleteRouteMapEntry(key configSeqKey) {
+	delete(cfg.routeMaps, key)
+	for _, clause := range routeMapClauses {
+		delete(cfg.routeMapClauses, configRouteMapClauseKey{name: key.name, seq: key.seq, clause: clause})
+	}
+}
+
+/* ルートマップのエントリの条件と設定を、設定ファイルに書く順に並べた行 */
+func (cfg *routerConfig) routeMapEntryClauses(key configSeqKey) []string {
+	var clauses []string
+	for _, clause := range routeMapClauses {
+		if value, ok := cfg.routeMapClauses[configRouteMapClauseKey{name: key.name, seq: key.seq, clause: clause}]; ok {
+			clauses = append(clauses, clause+" "+value)
+		}
+	}
+	return clauses
+}
+
+/* 設定からルートマップのエントリを作る */
+func (cfg *routerConfig) routeMapEntry(key configSeqKey) routeMapEntry {
+	action, _ := parseRouteMapAction(cfg.routeMaps[key])
+	entry := routeMapEntry{seq: key.seq, action: action}
+	for _, clause := range cfg.routeMapEntryClauses(key) {
+		parseRouteMapClause(&entry, strings.Fields(clause))
+	}
+	return entry
+}
+
+/* 差分を取るときに使う、ルートマップのエントリの内容。エントリがなければ空 */
+func (cfg *routerConfig) routeMapEntryString(key configSeqKey) string {
+	action, ok := cfg.routeMaps[key]
+	if !ok {
+		return ""
+	}
+	return strings.Join(append([]string{action}, cfg.routeMapEntryClauses(key)...), "\n")
+}
+
+/* "router isis"の下の設定。"no router isis"はインターフェイスの設定も含めて全て消す */
+func (cfg *routerConfig) editIsis(words []string, negate bool) error {
+	switch {
+	case len(words) == 0:
+		if negate {
+			cfg.isisNet = ""
+			cfg.isisLevel = 0
+			cfg.isisInterfaces = map[string]string{}
+			cfg.deleteRedistributes("isis")
+		}
+		return nil
+	case words[0] == "redistribute":
+		return cfg.editRedistribute("isis", words[1:], negate)
+	case words[0] == "net":
+		if negate {
+			cfg.isisNet = ""
+			return nil
+		}
+		if len(words) != 2 {
+			return fmt.Errorf("usage: net NET")
+		}
+		if _, _, err := parseIsisNet(words[1]); err != nil {
+			return err
+		}
+		cfg.isisNet = strings.ToLower(words[1])
+		return nil
+	case words[0] == "level":
+		if negate {
+			cfg.isisLevel = 0
+			return nil
+		}
+		if len(words) != 2 || (words[1] != "1" && words[1] != "2") {
+			return fmt.Errorf("usage: level 1|2")
+		}
+		cfg.isisLevel, _ = strconv.Atoi(words[1])
+		return nil
+	}
+	return fmt.Errorf("unknown command: router isis %s", strings.Join(words, " "))
+}
+
+/*
+ * "router bgp AS"の下の設定。ASを変えるには"no router bgp"で一度消す。
+ * "no router bgp"はBGPの設定を全て消す。
+ */
+func (cfg *routerConfig) editBgp(words []string, negate bool) error {
+	if len(words) == 0 {
+		if !negate {
+			return fmt.Errorf("usage: router bgp AS")
+		}
+		cfg.clearBgp()
+		return nil
+	}
+	asn, err := strconv.ParseUint(words[0], 10, 32)
+	if err != nil || asn == 0 {
+		return fmt.Errorf("invalid as %s", words[0])
+	}
+	if cfg.bgpAs != 0 && cfg.bgpAs != uint32(asn) {
+		return fmt.Errorf("bgp is already configured with as %d", cfg.bgpAs)
+	}
+	words = words[1:]
+	if len(words) == 0 {
+		if negate {
+			cfg.clearBgp()
+		} else {
+			cfg.bgpAs = uint32(asn)
+		}
+		return nil
+	}
+	if !negate {
+		cfg.bgpAs = uint32(asn)
+	}
+
+	switch words[0] {
+	case "router-id":
+		if negate {
+			cfg.bgpRouterId = ""
+			return nil
+		}
+		if len(words) != 2 || net.ParseIP(words[1]).To4() == nil {
+			return fmt.Errorf("usage: router-id A.B.C.D")
+		}
+		cfg.bgpRouterId = net.ParseIP(words[1]).To4().String()
+		return nil
+	case "neighbor":
+		return cfg.editBgpNeighbor(words[1:], negate)
+	case "redistribute":
+		return cfg.editRedistribute("bgp", words[1:], negate)
+	case "network":
+		if len(words) != 2 {
+			return fmt.Errorf("usage: network PREFIX")
+		}
+		_, ipNet, err := net.ParseCIDR(words[1])
+		if err != nil || ipNet.IP.To4() != nil {
+			return fmt.Errorf("invalid ipv6 prefix %s", words[1])
+		}
+		if negate {
+			delete(cfg.bgpNetworks, ipNet.String())
+		} else {
+			cfg.bgpNetworks[ipNet.String()] = true
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown command: router bgp %d %s", asn, strings.Join(words, " "))
+}
+
+func (cfg *routerConfig) clearBgp() {
+	cfg.bgpAs = 0
+	cfg.bgpRouterId = ""
+	cfg.bgpNeighbors = map[string]string{}
+	cfg.bgpPolicies = map[configBgpPolicyKey]string{}
+	cfg.bgpNetworks = map[string]bool{}
+	cfg.bgpBfd = map[string]bool{}
+	cfg.deleteRedistributes("bgp")
+}
+
+/* "neighbor ADDRESS"の後ろ。"no neighbor ADDRESS"はそのピアの設定を全て消す */
+func (cfg *routerConfig) editBgpNeighbor(words []string, negate bool) error {
+	if len(words) == 0 {
+		return fmt.Errorf("usage: neighbor ADDRESS remote-as AS [interface IFNAME]")
+	}
+	ip := net.ParseIP(words[0])
+	if ip == nil || ip.To4() != nil {
+		return fmt.Errorf("invalid ipv6 address %s", words[0])
+	}
+	addr := ip.String()
+	words = words[1:]
+
+	if len(words) == 0 || words[0] == "remote-as" {
+		if negate {
+			delete(cfg.bgpNeighbors, addr)
+			delete(cfg.bgpBfd, addr)
+			for key := range cfg.bgpPolicies {
+				if key.neighbor == addr {
+					delete(cfg.bgpPolicies, key)
+				}
+			}
+			return nil
+		}
+		if len(words) != 2 && (len(words) != 4 || words[2] != "interface") {
+			return fmt.Errorf("usage: neighbor ADDRESS remote-as AS [interface IFNAME]")
+		}
+		remoteAs, err := strconv.ParseUint(words[1], 10, 32)
+		if err != nil || remoteAs == 0 {
+			return fmt.Errorf("invalid as %s", words[1])
+		}
+		cfg.bgpNeighbors[addr] = strings.Join(append([]string{"remote-as", strconv.FormatUint(remoteAs, 10)}, words[2:]...), " ")
+		return nil
+	}
+
+	if len(words) == 1 && words[0] == "bfd" {
+		if negate {
+			delete(cfg.bgpBfd, addr)
+		} else {
+			cfg.bgpBfd[addr] = true
+		}
+		return nil
+	}
+
+	if words[0] == "import" || words[0] == "export" {
+		direction := words[0]
+		if negate && len(words) == 1 {
+			for key := range cfg.bgpPolicies {
+				if key.neighbor == addr && key.direction == direction {
+					delete(cfg.bgpPolicies, key)
+				}
+			}
+			return nil
+		}
+		if len(words) < 3 || words[1] != "seq" {
+			return fmt.Errorf("usage: neighbor ADDRESS %s seq SEQ permit|deny PREFIX [ge LEN] [le LEN] [local-preference PREF] [med MED] [prepend COUNT]", direction)
+		}
+		seq, err := strconv.ParseUint(words[2], 10, 32)
+		if err != nil {
+			return fmt.Errorf("invalid seq %s", words[2])
+		}
+		key := configBgpPolicyKey{neighbor: addr, direction: direction, seq: uint32(seq)}
+		if negate {
+			delete(cfg.bgpPolicies, key)
+			return nil
+		}
+		rule, err := parseBgpPolicyRule(words[3:])
+		if err != nil {
+			return err
+		}
+		cfg.bgpPolicies[key] = rule.String()
+		return nil
+	}
+	return fmt.Errorf("unknown command: neighbor %s %s", addr, strings.Join(words, " "))
+}
+
+/* ピアのインポートかエクスポートのポリシー。seqの小さい順に並べる */
+func (cfg *routerConfig) bgpPolicyRules(addr string, direction string) []bgpPolicyRule {
+	var keys []configBgpPolicyKey
+	for key := range cfg.bgpPolicies {
+		if key.neighbor == addr && key.direction == direction {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].seq < keys[j].seq })
+
+	var rules []bgpPolicyRule
+	for _, key := range keys {
+		rule, _ := parseBgpPolicyRule(strings.Fields(cfg.bgpPolicies[key]))
+		rules = append(rules, *rule)
+	}
+	return rules
+}
+
+/* "ipv6 route PREFIX NEXTHOP table ID"。"table ID"とVRFは取り除いてある */
+func (cfg *routerConfig) editTableRoute(words []string, tableStr string, vrfName string, prefix string, negate bool) error {
+	tableId, err := strconv.ParseUint(tableStr, 10, 32)
+	if err != nil || uint32(tableId) == MAIN_ROUTE_TABLE_ID {
+		return fmt.Errorf("invalid table id %s", tableStr)
+	}
+	key := configTableRouteKey{vrf: vrfName, table: uint32(tableId), prefix: prefix}
+	if negate {
+		if len(words) > 4 {
+			return fmt.Errorf("usage: no ipv6 route PREFIX [NEXTHOP] table ID [vrf NAME]")
+		}
+		delete(cfg.tableRoutes, key)
+		return nil
+	}
+	if len(words) != 4 {
+		return fmt.Errorf("usage: ipv6 route PREFIX NEXTHOP table ID [vrf NAME]")
+	}
+	nextHop := net.ParseIP(words[3])
+	if nextHop == nil || nextHop.To4() != nil {
+		return fmt.Errorf("invalid next hop %s", words[3])
+	}
+	cfg.tableRoutes[key] = nextHop.String()
+	return nil
+}
+
+/* 末尾の"vrf NAME"を取り除いてVRF名を返す */
+func configSplitVrf(words []string) ([]string, string) {
+	n := len(words)
+	if n >= 2 && words[n-2] == "vrf" {
+		return words[:n-2], words[n-1]
+	}
+	return words, DEFAULT_VRF_NAME
+}
+
+/* デフォルト以外のVRFなら"vrf NAME"を付ける */
+func configWithVrf(line string, vrfName string) string {
+	if vrfName == DEFAULT_VRF_NAME {
+		return line
+	}
+	return line + " vrf " + vrfName
+}
+
+/* 1行ずつの設定。差分を取るときに使う */
+func (cfg *routerConfig) lines() []string {
+	var vrfs []string
+	for vrfName := range cfg.vrfs {
+		vrfs = append(vrfs, "vrf "+vrfName)
+	}
+	sort.Strings(vrfs)
+
+	var interfaces []string
+	for ifName, addr := range cfg.addresses {
+		interfaces = append(interfaces, fmt.Sprintf("interface %s ipv6 address %s", ifName, addr))
+	}
+	for ifName, rate := range cfg.sflowRates {
+		interfaces = append(interfaces, fmt.Sprintf("interface %s sflow sampling-rate %d", ifName, rate))
+	}
+	for ifName, vrfName := range cfg.vrfMembers {
+		interfaces = append(interfaces, fmt.Sprintf("interface %s vrf %s", ifName, vrfName))
+	}
+	for ifName := range cfg.ripng {
+		interfaces = append(interfaces, fmt.Sprintf("interface %s ripng", ifName))
+	}
+	for ifName, config := range cfg.ospfv3Interfaces {
+		interfaces = append(interfaces, fmt.Sprintf("interface %s ospfv3 %s", ifName, config))
+	}
+	for ifName := range cfg.ospfv3Bfd {
+		interfaces = append(interfaces, fmt.Sprintf("interface %s ospfv3 bfd", ifName))
+	}
+	for ifName, config := range cfg.isisInterfaces {
+		interfaces = append(interfaces, fmt.Sprintf("interface %s isis %s", ifName, config))
+	}
+	for key, config := range cfg.vrrp {
+		interfaces = append(interfaces, fmt.Sprintf("interface %s vrrp %d %s", key.ifName, key.vrid, config))
+	}
+	sort.Strings(interfaces)
+
+	var routes []string
+	for key, nextHop := range cfg.routes {
+		routes = append(routes, configWithVrf(fmt.Sprintf("ipv6 route %s %s", key.prefix, nextHop), key.vrf))
+	}
+	for key, dstVrf := range cfg.leaks {
+		routes = append(routes, configWithVrf(fmt.Sprintf("ipv6 route %s leak %s", key.prefix, dstVrf), key.vrf))
+	}
+	for prefix, nextHop := range cfg.bfdRoutes {
+		routes = append(routes, fmt.Sprintf("ipv6 route %s %s bfd", prefix, nextHop))
+	}
+	sort.Strings(routes)
+
+	var tables []string
+	for key := range cfg.tables {
+		tables = append(tables, configWithVrf(fmt.Sprintf("ipv6 route-table %d", key.table), key.vrf))
+	}
+	sort.Strings(tables)
+	var tableRoutes []string
+	for key, nextHop := range cfg.tableRoutes {
+		tableRoutes = append(tableRoutes, configWithVrf(fmt.Sprintf("ipv6 route %s %s table %d", key.prefix, nextHop, key.table), key.vrf))
+	}
+	sort.Strings(tableRoutes)
+	var rules []string
+	for key, rule := range cfg.rules {
+		rules = append(rules, configWithVrf("ipv6 rule "+rule, key.vrf))
+	}
+	sort.Strings(rules)
+	routes = append(append(append(routes, tables...), tableRoutes...), rules...)
+
+	var neighbors []string
+	for key, mac := range cfg.neighbors {
+		neighbors = append(neighbors, fmt.Sprintf("ipv6 neighbor %s %s %s", key.address, key.ifName, mac))
+	}
+	sort.Strings(neighbors)
+
+	var prefixListKeys []configSeqKey
+	for key := range cfg.prefixLists {
+		prefixListKeys = append(prefixListKeys, key)
+	}
+	sortConfigSeqKeys(prefixListKeys)
+	for _, key := range prefixListKeys {
+		neighbors = append(neighbors, fmt.Sprintf("ipv6 prefix-list %s seq %d %s", key.name, key.seq, cfg.prefixLists[key]))
+	}
+	var fibRouteMaps []string
+	for vrfName, name := range cfg.fibRouteMaps {
+		fibRouteMaps = append(fibRouteMaps, configWithVrf("ipv6 fib route-map "+name, vrfName))
+	}
+	sort.Strings(fibRouteMaps)
+	neighbors = append(neighbors, fibRouteMaps...)
+
+	lines := append(append(append(vrfs, interfaces...), routes...), neighbors...)
+	if cfg.bfd != "" {
+		lines = append(lines, "bfd interval "+cfg.bfd)
+	}
+	lines = append(lines, cfg.redistributeLines("ripng", "router ripng")...)
+	if cfg.ospfv3RouterId != "" {
+		lines = append(lines, "router ospfv3 router-id "+cfg.ospfv3RouterId)
+	}
+	lines = append(lines, cfg.redistributeLines("ospfv3", "router ospfv3")...)
+	if cfg.isisNet != "" {
+		lines = append(lines, "router isis net "+cfg.isisNet)
+	}
+	if cfg.isisLevel != 0 {
+		lines = append(lines, fmt.Sprintf("router isis level %d", cfg.isisLevel))
+	}
+	lines = append(lines, cfg.redistributeLines("isis", "router isis")...)
+	lines = append(lines, cfg.bgpLines()...)
+	lines = append(lines, cfg.routeMapLines()...)
+	if cfg.ipfix != "" {
+		lines = append(lines, "ipfix collector "+cfg.ipfix)
+	}
+	if cfg.sflow != "" {
+		lines = append(lines, "sflow collector "+cfg.sflow)
+	}
+	return lines
+}
+
+/* "router bgp AS"の下の行。ピアごとに、ピアの設定、インポート、エクスポートの順に並べる */
+func (cfg *routerConfig) bgpLines() []string {
+	if cfg.bgpAs == 0 {
+		return nil
+	}
+	router := fmt.Sprintf("router bgp %d", cfg.bgpAs)
+	lines := []string{router}
+	if cfg.bgpRouterId != "" {
+		lines = append(lines, router+" router-id "+cfg.bgpRouterId)
+	}
+
+	var addrs []string
+	for addr := range cfg.bgpNeighbors {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		lines = append(lines, fmt.Sprintf("%s neighbor %s %s", router, addr, cfg.bgpNeighbors[addr]))
+		if cfg.bgpBfd[addr] {
+			lines = append(lines, fmt.Sprintf("%s neighbor %s bfd", router, addr))
+		}
+		for _, direction := range []string{"import", "export"} {
+			var keys []configBgpPolicyKey
+			for key := range cfg.bgpPolicies {
+				if key.neighbor == addr && key.direction == direction {
+					keys = append(keys, key)
+				}
+			}
+			sort.Slice(keys, func(i, j int) bool { return keys[i].seq < keys[j].seq })
+			for _, key := range keys {
+				lines = append(lines, fmt.Sprintf("%s neighbor %s %s seq %d %s", router, addr, direction, key.seq, cfg.bgpPolicies[key]))
+			}
+		}
+	}
+
+	var networks []string
+	for prefix := range cfg.bgpNetworks {
+		networks = append(networks, fmt.Sprintf("%s network %s", router, prefix))
+	}
+	sort.Strings(networks)
+	lines = append(lines, networks...)
+	return append(lines, cfg.redistributeLines("bgp", router)...)
+}
+
+/* intoへの再配布の行。connected、staticの順に並べる */
+func (cfg *routerConfig) redistributeLines(into string, router string) []string {
+	var lines []string
+	for _, from := range []string{"connected", "static"} {
+		routeMap, ok := cfg.redistributes[configRedistributeKey{into: into, from: from}]
+		if !ok {
+			continue
+		}
+		line := fmt.Sprintf("%s redistribute %s", router, from)
+		if routeMap != "" {
+			line += " route-map " + routeMap
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+/* "route-map NAME permit|deny SEQ"の行。エントリごとに見出しの行の後に条件と設定を並べる */
+func (cfg *routerConfig) routeMapLines() []string {
+	var keys []configSeqKey
+	for key := range cfg.routeMaps {
+		keys = append(keys, key)
+	}
+	sortConfigSeqKeys(keys)
+
+	var lines []string
+	for _, key := range keys {
+		entry := fmt.Sprintf("route-map %s %s %d", key.name, cfg.routeMaps[key], key.seq)
+		lines = append(lines, entry)
+		for _, clause := range cfg.routeMapEntryClauses(key) {
+			lines = append(lines, entry+" "+clause)
+		}
+	}
+	return lines
+}
+
+/* 名前の順、同じ名前ならseqの小さい順に並べる */
+func sortConfigSeqKeys(keys []configSeqKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return keys[i].seq < keys[j].seq
+	})
+}
+
+/* 設定ファイルと同じ形式のテキスト。見出しが同じ行は見出しの下にまとめる */
+func (cfg *routerConfig) text() string {
+	var b strings.Builder
+	var block []string
+	for _, line := range cfg.lines() {
+		words := strings.Fields(line)
+		n := configBlockLen(words)
+		if block != nil && (n == 0 || !slices.Equal(words[:n], block)) {
+			b.WriteString("!\n")
+			block = nil
+		}
+		if n == 0 {
+			fmt.Fprintf(&b, "%s\n", line)
+			continue
+		}
+		if block == nil {
+			block = words[:n]
+			fmt.Fprintf(&b, "%s\n", strings.Join(block, " "))
+		}
+		if len(words) > n {
+			fmt.Fprintf(&b, " %s\n", strings.Join(words[n:], " "))
+		}
+	}
+	if block != nil {
+		b.WriteString("!\n")
+	}
+	return b.String()
+}
+
+/* oldからnewへの差分。消える行は"-"、増える行は"+"を付ける */
+func diffRouterConfig(old *routerConfig, new *routerConfig) []string {
+	oldLines := map[string]bool{}
+	for _, line := range old.lines() {
+		oldLines[line] = true
+	}
+	newLines := map[string]bool{}
+	for _, line := range new.lines() {
+		newLines[line] = true
+	}
+
+	var diff []string
+	for _, line := range old.lines() {
+		if !newLines[line] {
+			diff = append(diff, "- "+line)
+		}
+	}
+	for _, line := range new.lines() {
+		if !oldLines[line] {
+			diff = append(diff, "+ "+line)
+		}
+	}
+	return diff
+}
+
+/* 反映できない設定を見つける。インターフェイスは後から追加されることがあるので確かめない */
+func validateRouterConfig(cfg *routerConfig) error {
+	hasVrf := func(vrfName string) bool {
+		return vrfName == DEFAULT_VRF_NAME || cfg.vrfs[vrfName]
+	}
+	for ifName, vrfName := range cfg.vrfMembers {
+		if !hasVrf(vrfName) {
+			return fmt.Errorf("vrf %s of interface %s not found", vrfName, ifName)
+		}
+	}
+	for key := range cfg.routes {
+		if !hasVrf(key.vrf) {
+			return fmt.Errorf("vrf %s of route %s not found", key.vrf, key.prefix)
+		}
+	}
+	for key, dstVrf := range cfg.leaks {
+		if !hasVrf(key.vrf) || !hasVrf(dstVrf) {
+			return fmt.Errorf("vrf %s or %s of leak route %s not found", key.vrf, dstVrf, key.prefix)
+		}
+	}
+	for key := range cfg.tables {
+		if !hasVrf(key.vrf) {
+			return fmt.Errorf("vrf %s of route table %d not found", key.vrf, key.table)
+		}
+	}
+	for key := range cfg.tableRoutes {
+		if !cfg.tables[configTableKey{vrf: key.vrf, table: key.table}] {
+			return fmt.Errorf("route table %d of route %s not found in vrf %s", key.table, key.prefix, key.vrf)
+		}
+	}
+	if len(cfg.ospfv3Interfaces) > 0 && cfg.ospfv3RouterId == "" {
+		return fmt.Errorf("router-id of router ospfv3 is not configured")
+	}
+	if len(cfg.isisInterfaces) > 0 && cfg.isisNet == "" {
+		return fmt.Errorf("net of router isis is not configured")
+	}
+	for ifName := range cfg.ospfv3Bfd {
+		if _, ok := cfg.ospfv3Interfaces[ifName]; !ok {
+			return fmt.Errorf("ospfv3 is not configured on %s with bfd", ifName)
+		}
+	}
+	if cfg.bgpAs != 0 && cfg.bgpRouterId == "" {
+		return fmt.Errorf("router-id of router bgp is not configured")
+	}
+	for addr, neighbor := range cfg.bgpNeighbors {
+		if in6AddrIsLinkLocal(parseIpv6(addr)) && !strings.Contains(neighbor, " interface ") {
+			return fmt.Errorf("link local bgp neighbor %s needs interface", addr)
+		}
+	}
+	for key := range cfg.bgpPolicies {
+		if _, ok := cfg.bgpNeighbors[key.neighbor]; !ok {
+			return fmt.Errorf("bgp neighbor %s of %s policy not found", key.neighbor, key.direction)
+		}
+	}
+	for addr := range cfg.bgpBfd {
+		if _, ok := cfg.bgpNeighbors[addr]; !ok {
+			return fmt.Errorf("bgp neighbor %s of bfd not found", addr)
+		}
+	}
+	for key := range cfg.redistributes {
+		switch {
+		case key.into == "ospfv3" && cfg.ospfv3RouterId == "":
+			return fmt.Errorf("router-id of router ospfv3 is not configured")
+		case key.into == "isis" && cfg.isisNet == "":
+			return fmt.Errorf("net of router isis is not configured")
+		}
+	}
+	for vrfName := range cfg.fibRouteMaps {
+		if !hasVrf(vrfName) {
+			return fmt.Errorf("vrf %s of fib route-map not found", vrfName)
+		}
+	}
+	for key, ruleStr := range cfg.rules {
+		if !hasVrf(key.vrf) {
+			return fmt.Errorf("vrf %s of rule %d not found", key.vrf, key.priority)
+		}
+		rule, _ := parsePolicyRule(strings.Fields(ruleStr))
+		if rule.nextHop == nil && rule.table != MAIN_ROUTE_TABLE_ID && !cfg.tables[configTableKey{vrf: key.vrf, table: rule.table}] {
+			return fmt.Errorf("route table %d of rule %d not found in vrf %s", rule.table, key.priority, key.vrf)
+		}
+	}
+	return nil
+}
+
+/*
+ * oldからnewへの差分だけを反映する。先に消える設定を外してから、増えたものと変わったものを入れる。
+ * インターフェイスがなければ追加されたときにconfigApplyInterfaceで入れる。
+ */
+func applyRouterConfig(old *routerConfig, new *routerConfig) {
+	// 所属するVRFが変わるインターフェイスのアドレスと隣接ノードは入れ直す
+	moved := func(ifName string) bool {
+		return old.vrfOf(ifName) != new.vrfOf(ifName)
+	}
+
+	// アドレスかVRFが変わるインターフェイスではルーティングプロトコルを動かし直す
+	readdressed := func(ifName string) bool {
+		return moved(ifName) || old.addresses[ifName] != new.addresses[ifName]
+	}
+	ospfv3Reset := old.ospfv3RouterId != new.ospfv3RouterId
+
+	for key, routeMap := range old.redistributes {
+		if newRouteMap, ok := new.redistributes[key]; !ok || newRouteMap != routeMap {
+			unconfigRedistribute(configRedistributeProto(key.into), configRedistributeProto(key.from))
+		}
+	}
+	for vrfName, name := range old.fibRouteMaps {
+		if new.fibRouteMaps[vrfName] != name {
+			unconfigFibRouteMap(vrfName)
+		}
+	}
+	for key := range old.routeMaps {
+		if _, ok := new.routeMaps[key]; !ok {
+			unconfigRouteMap(key.name, key.seq)
+		}
+	}
+	for key := range old.prefixLists {
+		if _, ok := new.prefixLists[key]; !ok {
+			unconfigPrefixList(key.name, key.seq)
+		}
+	}
+	for ifName := range old.ripng {
+		if new.ripng[ifName] && !readdressed(ifName) {
+			continue
+		}
+		if netDev := getNetDevByName(ifName); netDev != nil {
+			unconfigRipngInterface(netDev)
+		}
+	}
+	if ospfv3Reset && old.ospfv3RouterId != "" {
+		unconfigOspfv3()
+	}
+	isisReset := old.isisNet != new.isisNet || old.isisLevel != new.isisLevel
+	if isisReset && old.isisNet != "" {
+		unconfigIsis()
+	}
+	for ifName, config := range old.isisInterfaces {
+		if new.isisInterfaces[ifName] == config && !readdressed(ifName) {
+			continue
+		}
+		if netDev := getNetDevByName(ifName); netDev != nil {
+			unconfigIsisInterface(netDev)
+		}
+	}
+	bgpReset := old.bgpAs != new.bgpAs || old.bgpRouterId != new.bgpRouterId
+	if bgpReset && old.bgpAs != 0 {
+		unconfigBgp()
+	}
+	if !bgpReset {
+		for addr, neighbor := range old.bgpNeighbors {
+			if new.bgpNeighbors[addr] != neighbor {
+				unconfigBgpNeighbor(parseIpv6(addr))
+			} else if old.bgpBfd[addr] && !new.bgpBfd[addr] {
+				unconfigBgpNeighborBfd(parseIpv6(addr))
+			}
+		}
+		for prefix := range old.bgpNetworks {
+			if !new.bgpNetworks[prefix] {
+				unconfigBgpNetwork(configParsePrefix(prefix))
+			}
+		}
+	}
+	for key, config := range old.vrrp {
+		if new.vrrp[key] == config && !readdressed(key.ifName) {
+			continue
+		}
+		if netDev := getNetDevByName(key.ifName); netDev != nil {
+			unconfigVrrp(netDev, key.vrid)
+		}
+	}
+	for ifName := range old.ospfv3Bfd {
+		if netDev := getNetDevByName(ifName); netDev != nil && !new.ospfv3Bfd[ifName] {
+			unconfigOspfv3InterfaceBfd(netDev)
+		}
+	}
+	for ifName, config := range old.ospfv3Interfaces {
+		if new.ospfv3Interfaces[ifName] == config && !readdressed(ifName) {
+			continue
+		}
+		if netDev := getNetDevByName(ifName); netDev != nil {
+			unconfigOspfv3Interface(netDev)
+		}
+	}
+
+	for key := range old.neighbors {
+		if _, ok := new.neighbors[key]; ok && !moved(key.ifName) {
+			continue
+		}
+		netDev := getNetDevByName(key.ifName)
+		if netDev != nil {
+			deleteNDTableEntry(netDev.vrf, parseIpv6(key.address))
+		}
+	}
+	for key, rule := range old.rules {
+		if new.rules[key] != rule {
+			unconfigPolicyRule(key.vrf, key.priority)
+		}
+	}
+	for key, nextHop := range old.tableRoutes {
+		if new.tableRoutes[key] != nextHop {
+			prefix, prefixLen := configParsePrefix(key.prefix)
+			deleteTableIpv6NetRoute(key.vrf, key.table, prefix, prefixLen)
+		}
+	}
+	for key := range old.tables {
+		if !new.tables[key] {
+			unconfigRouteTable(key.vrf, key.table)
+		}
+	}
+	for prefix, nextHop := range old.bfdRoutes {
+		if new.bfdRoutes[prefix] != nextHop {
+			unconfigIpv6NetRouteBfd(configParsePrefix(prefix))
+		}
+	}
+	for key := range old.routes {
+		if _, ok := new.routes[key]; !ok {
+			prefix, prefixLen := configParsePrefix(key.prefix)
+			deleteVrfIpv6NetRoute(key.vrf, prefix, prefixLen)
+		}
+	}
+	for key, dstVrf := range old.leaks {
+		if new.leaks[key] != dstVrf {
+			prefix, prefixLen := configParsePrefix(key.prefix)
+			unconfigVrfLeakRoute(key.vrf, prefix, prefixLen)
+		}
+	}
+	for ifName, addr := range old.addresses {
+		if new.addresses[ifName] == addr && !moved(ifName) {
+			continue
+		}
+		if netDev := getNetDevByName(ifName); netDev != nil {
+			unconfigIpv6Addr(netDev)
+		}
+	}
+	for ifName := range old.vrfMembers {
+		if netDev := getNetDevByName(ifName); netDev != nil && moved(ifName) {
+			flushNDTableEntries(netDev)
+			configVrfMember(netDev, DEFAULT_VRF_NAME)
+		}
+	}
+	for vrfName := range old.vrfs {
+		if !new.vrfs[vrfName] {
+			unconfigVrf(vrfName)
+		}
+	}
+
+	// これから作るBFDのセッションが使うので先に入れる
+	if old.bfd != new.bfd {
+		interval := &bfdIntervalConfig{minTx: BFD_DEFAULT_MIN_TX, minRx: BFD_DEFAULT_MIN_RX, detectMult: BFD_DEFAULT_DETECT_MULT}
+		if new.bfd != "" {
+			interval, _ = parseBfdInterval(strings.Fields(new.bfd))
+		}
+		configBfd(interval.minTx, interval.minRx, interval.detectMult)
+	}
+	for vrfName := range new.vrfs {
+		if !old.vrfs[vrfName] {
+			configVrf(vrfName)
+		}
+	}
+	for key, entryStr := range new.prefixLists {
+		if old.prefixLists[key] == entryStr {
+			continue
+		}
+		entry, _ := parsePrefixListEntry(strings.Fields(entryStr))
+		entry.seq = key.seq
+		configPrefixList(key.name, *entry)
+	}
+	for key := range new.routeMaps {
+		if old.routeMapEntryString(key) != new.routeMapEntryString(key) {
+			configRouteMap(key.name, new.routeMapEntry(key))
+		}
+	}
+	for vrfName, name := range new.fibRouteMaps {
+		if old.fibRouteMaps[vrfName] != name {
+			configFibRouteMap(vrfName, name)
+		}
+	}
+	for ifName, vrfName := range new.vrfMembers {
+		if netDev := getNetDevByName(ifName); netDev != nil && moved(ifName) {
+			flushNDTableEntries(netDev)
+			configVrfMember(netDev, vrfName)
+		}
+	}
+	for ifName, addr := range new.addresses {
+		if old.addresses[ifName] == addr && !moved(ifName) {
+			continue
+		}
+		if netDev := getNetDevByName(ifName); netDev != nil {
+			configApplyAddress(netDev, addr)
+		}
+	}
+	for key, nextHop := range new.routes {
+		if old.routes[key] == nextHop {
+			continue
+		}
+		prefix, prefixLen := configParsePrefix(key.prefix)
+		configVrfIpv6NetRoute(key.vrf, prefix, prefixLen, parseIpv6(nextHop))
+	}
+	for prefix, nextHop := range new.bfdRoutes {
+		if old.bfdRoutes[prefix] == nextHop {
+			continue
+		}
+		prefix, prefixLen := configParsePrefix(prefix)
+		configIpv6NetRouteBfd(prefix, prefixLen, parseIpv6(nextHop))
+	}
+	for key, dstVrf := range new.leaks {
+		if old.leaks[key] == dstVrf {
+			continue
+		}
+		prefix, prefixLen := configParsePrefix(key.prefix)
+		configVrfLeakRoute(key.vrf, prefix, prefixLen, dstVrf)
+	}
+	for key := range new.tables {
+		if !old.tables[key] {
+			configRouteTable(key.vrf, key.table)
+		}
+	}
+	for key, nextHop := range new.tableRoutes {
+		if old.tableRoutes[key] == nextHop {
+			continue
+		}
+		prefix, prefixLen := configParsePrefix(key.prefix)
+		configTableIpv6NetRoute(key.vrf, key.table, prefix, prefixLen, parseIpv6(nextHop))
+	}
+	for key, ruleStr := range new.rules {
+		if old.rules[key] == ruleStr {
+			continue
+		}
+		rule, _ := parsePolicyRule(strings.Fields(ruleStr))
+		configPolicyRule(key.vrf, *rule)
+	}
+	for key, mac := range new.neighbors {
+		if old.neighbors[key] == mac && !moved(key.ifName) {
+			continue
+		}
+		if netDev := getNetDevByName(key.ifName); netDev != nil {
+			configStaticNeighbor(netDev, parseIpv6(key.address), mac)
+		}
+	}
+	for key, config := range new.vrrp {
+		if old.vrrp[key] == config && !readdressed(key.ifName) {
+			continue
+		}
+		if netDev := getNetDevByName(key.ifName); netDev != nil {
+			configApplyVrrp(netDev, key.vrid, config)
+		}
+	}
+	for ifName := range new.ripng {
+		if old.ripng[ifName] && !readdressed(ifName) {
+			continue
+		}
+		if netDev := getNetDevByName(ifName); netDev != nil {
+			configRipngInterface(netDev)
+		}
+	}
+	if ospfv3Reset && new.ospfv3RouterId != "" {
+		configOspfv3RouterId(new.ospfv3RouterId)
+	}
+	for ifName, config := range new.ospfv3Interfaces {
+		netDev := getNetDevByName(ifName)
+		if netDev == nil {
+			continue
+		}
+		if ospfv3Reset || old.ospfv3Interfaces[ifName] != config || readdressed(ifName) {
+			configApplyOspfv3Interface(new, netDev)
+		} else if new.ospfv3Bfd[ifName] && !old.ospfv3Bfd[ifName] {
+			configOspfv3InterfaceBfd(netDev)
+		}
+	}
+	if isisReset && new.isisNet != "" {
+		configIsis(new.isisNet, new.isisLevelOrDefault())
+	}
+	for ifName, config := range new.isisInterfaces {
+		if !isisReset && old.isisInterfaces[ifName] == config && !readdressed(ifName) {
+			continue
+		}
+		if netDev := getNetDevByName(ifName); netDev != nil {
+			configApplyIsisInterface(netDev, config)
+		}
+	}
+	if bgpReset && new.bgpAs != 0 {
+		configBgpRouter(new.bgpAs, new.bgpRouterId)
+	}
+	for addr, neighbor := range new.bgpNeighbors {
+		if bgpReset || old.bgpNeighbors[addr] != neighbor {
+			configApplyBgpNeighbor(new, addr)
+			continue
+		}
+		// ポリシーだけが変わったピアはセッションを張り直して経路を受け取り直す
+		if !slices.Equal(old.bgpPolicyRules(addr, "import"), new.bgpPolicyRules(addr, "import")) || !slices.Equal(old.bgpPolicyRules(addr, "export"), new.bgpPolicyRules(addr, "export")) {
+			configBgpNeighborImportPolicy(parseIpv6(addr), new.bgpPolicyRules(addr, "import"))
+			configBgpNeighborExportPolicy(parseIpv6(addr), new.bgpPolicyRules(addr, "export"))
+			bgpResetNeighbor(parseIpv6(addr))
+		}
+		if new.bgpBfd[addr] && !old.bgpBfd[addr] {
+			configBgpNeighborBfd(parseIpv6(addr))
+		}
+	}
+	for prefix := range new.bgpNetworks {
+		if bgpReset || !old.bgpNetworks[prefix] {
+			configBgpNetwork(configParsePrefix(prefix))
+		}
+	}
+	for key, routeMap := range new.redistributes {
+		if oldRouteMap, ok := old.redistributes[key]; !ok || oldRouteMap != routeMap {
+			configRedistribute(configRedistributeProto(key.into), configRedistributeProto(key.from), routeMap)
+		}
+	}
+	if old.ipfix != new.ipfix {
+		if new.ipfix == "" {
+			unconfigIpfix()
+		} else {
+			collector, _ := parseIpfixCollector(strings.Fields(new.ipfix))
+			configIpfix(collector.address, collector.port, collector.activeTimeout, collector.inactiveTimeout)
+		}
+	}
+	for ifName := range old.sflowRates {
+		if _, ok := new.sflowRates[ifName]; ok {
+			continue
+		}
+		if netDev := getNetDevByName(ifName); netDev != nil {
+			unconfigSflowInterface(netDev)
+		}
+	}
+	for ifName, rate := range new.sflowRates {
+		if old.sflowRates[ifName] == rate {
+			continue
+		}
+		if netDev := getNetDevByName(ifName); netDev != nil {
+			configSflowInterface(netDev, rate)
+		}
+	}
+	if old.sflow != new.sflow {
+		if new.sflow == "" {
+			unconfigSflow()
+		} else {
+			collector, _ := parseSflowCollector(strings.Fields(new.sflow))
+			configSflow(collector.address, collector.port, collector.pollingInterval)
+		}
+	}
+}
+
+/* 再配布の設定に書くプロトコルの名前。BGPはPROTO_EBGPで表す */
+func configRedistributeProto(name string) routeProto {
+	switch name {
+	case "connected":
+		return PROTO_CONNECTED
+	case "static":
+		return PROTO_STATIC
+	case "ripng":
+		return PROTO_RIPNG
+	case "ospfv3":
+		return PROTO_OSPFV3
+	case "isis":
+		return PROTO_ISIS
+	}
+	return PROTO_EBGP
+}
+
+/* 検証済みの"PREFIX/LEN" */
+func configParsePrefix(prefixStr string) (in6Addr, uint8) {
+	_, ipNet, _ := net.ParseCIDR(prefixStr)
+	prefixLen, _ := ipNet.Mask.Size()
+	return in6Addr(ipNet.IP.To16()), uint8(prefixLen)
+}
+
+func configApplyAddress(netDev *netDevice, addr string) {
+	ip, ipNet, _ := net.ParseCIDR(addr)
+	prefixLen, _ := ipNet.Mask.Size()
+	configIpv6Addr(netDev, in6Addr(ip.To16()), uint8(prefixLen))
+}
+
+/* 追加されたインターフェイスに運用設定のVRF、アドレス、隣接ノード、VRRP、sFlowのサンプリング、ルーティングプロトコルを入れる */
+func configApplyInterface(netDev *netDevice) {
+	if vrfName, ok := runningConfig.vrfMembers[netDev.name]; ok {
+		configVrfMember(netDev, vrfName)
+	}
+	if addr, ok := runningConfig.addresses[netDev.name]; ok {
+		configApplyAddress(netDev, addr)
+	}
+	for key, mac := range runningConfig.neighbors {
+		if key.ifName == netDev.name {
+			configStaticNeighbor(netDev, parseIpv6(key.address), mac)
+		}
+	}
+	for key, config := range runningConfig.vrrp {
+		if key.ifName == netDev.name {
+			configApplyVrrp(netDev, key.vrid, config)
+		}
+	}
+	if rate, ok := runningConfig.sflowRates[netDev.name]; ok {
+		configSflowInterface(netDev, rate)
+	}
+	if runningConfig.ripng[netDev.name] {
+		configRipngInterface(netDev)
+	}
+	for prefix, nextHop := range runningConfig.bfdRoutes {
+		prefix, prefixLen := configParsePrefix(prefix)
+		key := ribKey{prefix: prefix, prefixLen: prefixLen}
+		if _, ok := bfdStaticRoutes[key]; !ok && staticNextHopDev(defaultVrf, parseIpv6(nextHop)) == netDev {
+			configIpv6NetRouteBfd(prefix, prefixLen, parseIpv6(nextHop))
+		}
+	}
+	if _, ok := runningConfig.ospfv3Interfaces[netDev.name]; ok {
+		configApplyOspfv3Interface(runningConfig, netDev)
+	}
+	if config, ok := runningConfig.isisInterfaces[netDev.name]; ok {
+		configApplyIsisInterface(netDev, config)
+	}
+	for addr, neighbor := range runningConfig.bgpNeighbors {
+		if strings.HasSuffix(neighbor, " interface "+netDev.name) && getBgpPeer(parseIpv6(addr)) == nil {
+			configApplyBgpNeighbor(runningConfig, addr)
+		}
+	}
+}
+
+/* ピアとそのポリシーを入れる。インターフェイスを指定したピアはインターフェイスが追加されたときに入れる */
+func configApplyBgpNeighbor(cfg *routerConfig, addr string) {
+	words := strings.Fields(cfg.bgpNeighbors[addr])
+	remoteAs, _ := strconv.ParseUint(words[1], 10, 32)
+	var netDev *netDevice
+	if len(words) == 4 {
+		netDev = getNetDevByName(words[3])
+		if netDev == nil {
+			configLog.Info("net device not found, configure bgp neighbor when added", "dev", words[3], "peer", addr)
+			return
+		}
+	}
+
+	configBgpNeighbor(parseIpv6(addr), uint32(remoteAs), netDev)
+	configBgpNeighborImportPolicy(parseIpv6(addr), cfg.bgpPolicyRules(addr, "import"))
+	configBgpNeighborExportPolicy(parseIpv6(addr), cfg.bgpPolicyRules(addr, "export"))
+	if cfg.bgpBfd[addr] {
+		configBgpNeighborBfd(parseIpv6(addr))
+	}
+}
+
+func configApplyIsisInterface(netDev *netDevice, configStr string) {
+	config, _ := parseIsisInterfaceConfig(strings.Fields(configStr))
+	configIsisInterface(netDev, config.circuitType, config.metric)
+}
+
+func configApplyVrrp(netDev *netDevice, vrid uint8, configStr string) {
+	config, _ := parseVrrpConfig(strings.Fields(configStr))
+	configVrrp(netDev, vrid, config.priority, config.adverInterval, config.addrs)
+}
+
+func configApplyOspfv3Interface(cfg *routerConfig, netDev *netDevice) {
+	config, _ := parseOspfv3InterfaceConfig(strings.Fields(cfg.ospfv3Interfaces[netDev.name]))
+	configOspfv3Interface(netDev, config.areaId, config.networkType, config.cost)
+	if cfg.ospfv3Bfd[netDev.name] {
+		configOspfv3InterfaceBfd(netDev)
+	}
+}
+
+/* 設定を反映して運用設定にし、履歴に残す。差分がなければ何もしない */
+func configReplaceRunning(cfg *routerConfig, comment string) error {
+	err := validateRouterConfig(cfg)
+	if err != nil {
+		return err
+	}
+	if len(diffRouterConfig(runningConfig, cfg)) == 0 {
+		return nil
+	}
+
+	applyRouterConfig(runningConfig, cfg)
+	runningConfig = cfg.clone()
+
+	configHistory = append([]*configCommit{{config: runningConfig, time: time.Now(), comment: comment}}, configHistory...)
+	if len(configHistory) > CONFIG_HISTORY_SIZE {
+		configHistory = configHistory[:CONFIG_HISTORY_SIZE]
+	}
+	configLog.Info("commit configuration", "comment", comment)
+	return nil
+}
+
+/*
+ * 候補設定をcommitする。confirmTimeoutを指定すると、その間に再びcommitされなければ元の設定に戻す。
+ * 確認待ちの間のcommitは確認になり、confirmTimeoutを指定すれば待ち時間を延ばす。
+ */
+func commitCandidateConfig(confirmTimeout time.Duration) error {
+	prev := runningConfig
+	comment := "commit"
+	if confirmTimeout > 0 {
+		comment = fmt.Sprintf("commit confirmed %s", confirmTimeout)
+	}
+	err := configReplaceRunning(candidateConfig.clone(), comment)
+	if err != nil {
+		return err
+	}
+
+	if confirmTimeout == 0 {
+		if configConfirmTimer != nil {
+			configConfirmTimer.stop()
+			configConfirmTimer = nil
+			configConfirmPrev = nil
+			configLog.Info("commit confirmed")
+		}
+		return nil
+	}
+
+	if configConfirmTimer == nil {
+		configConfirmPrev = prev
+		configConfirmTimer = newTimer(confirmTimeout, configConfirmExpired)
+	} else {
+		configConfirmTimer.reset(confirmTimeout)
+	}
+	configLog.Info("commit will be rolled back unless confirmed", "timeout", confirmTimeout)
+	return nil
+}
+
+func configConfirmExpired() {
+	prev := configConfirmPrev
+	configConfirmTimer = nil
+	configConfirmPrev = nil
+
+	configLog.Warn("commit is not confirmed, rolling back")
+	err := configReplaceRunning(prev, "rollback by commit confirmed timeout")
+	if err != nil {
+		configLog.Error("failed to roll back configuration", "err", err)
+		return
+	}
+	candidateConfig = runningConfig.clone()
+}
+
+/*
+ * テキストの設定を読み込んでcommitする。
+ * 候補設定の変更とcommit confirmedの確認待ちは捨て、読み込んだ設定を正とする。
+ */
+func configLoad(text string, comment string) error {
+	cfg, err := parseRouterConfig(text)
+	if err != nil {
+		return err
+	}
+	err = configReplaceRunning(cfg, comment)
+	if err != nil {
+		return err
+	}
+	candidateConfig = runningConfig.clone()
+
+	if configConfirmTimer != nil {
+		configConfirmTimer.stop()
+		configConfirmTimer = nil
+		configConfirmPrev = nil
+	}
+	return nil
+}
+
+/* 設定ファイルを読み込む。起動時とSIGHUPで使い、差分だけが反映される */
+func configLoadFile(path string) error {
+	text, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return configLoad(string(text), "load "+path)
+}
+
+/* n個前のcommitの設定を候補設定に読み込む。0は今の運用設定 */
+func rollbackCandidateConfig(n int) error {
+	if n < 0 || n >= len(configHistory) {
+		return fmt.Errorf("rollback %d not found, %d commits in history", n, len(configHistory))
+	}
+	candidateConfig = configHistory[n].config.clone()
+	return nil
+}
+
+/* 運用設定を直接変更する。APIで経路などを追加、削除したときに使い、候補設定にも同じ変更をする */
+func configEditRunning(line string) error {
+	words := strings.Fields(line)
+	cfg := runningConfig.clone()
+	err := cfg.edit(words, "")
+	if err != nil {
+		return err
+	}
+	err = configReplaceRunning(cfg, line)
+	if err != nil {
+		return err
+	}
+	candidateConfig.edit(words, "")
+	return nil
+}
@@ -0,0 +1,635 @@
+package main
+
+import (
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+/* 空の運用設定とデフォルトVRFだけの状態でテストを始める。テストが終われば元に戻す */
+func useEmptyConfig(t *testing.T) *fakeClock {
+	t.Helper()
+	clock := useFakeClock(t)
+	prevEpollFd := epollFd
+	if err := initEpoll(); err != nil {
+		t.Fatalf("epoll: %s", err)
+	}
+	prevRunning, prevCandidate, prevHistory := runningConfig, candidateConfig, configHistory
+	prevVrfs, prevDefaultVrf := vrfs, defaultVrf
+	runningConfig = newRouterConfig()
+	candidateConfig = newRouterConfig()
+	configHistory = nil
+	initVrfs()
+	t.Cleanup(func() {
+		configLoad("", "cleanup")
+		syscall.Close(epollFd)
+		epollFd = prevEpollFd
+		runningConfig, candidateConfig, configHistory = prevRunning, prevCandidate, prevHistory
+		vrfs, defaultVrf = prevVrfs, prevDefaultVrf
+	})
+	return clock
+}
+
+/* 全ての文を含む設定。text()が出力する順に並べてある */
+var testFullConfig = strings.Join([]string{
+	"vrf blue",
+	"interface test0",
+	" ipv6 address 2001:db8:0:1000::1/64",
+	" isis network point-to-point metric 10",
+	" ospfv3 area 0.0.0.0 network point-to-point cost 10",
+	" ospfv3 bfd",
+	" ripng",
+	" sflow sampling-rate 1000",
+	"!",
+	"interface test1",
+	" ipv6 address 2001:db8:0:1001::1/64",
+	" vrf blue",
+	" vrrp 1 priority 150 interval 1000 address fe80::1",
+	"!",
+	"ipv6 route 2001:db8:0:1002::/64 2001:db8:0:1000::2",
+	"ipv6 route 2001:db8:0:1003::/64 2001:db8:0:1000::3 bfd",
+	"ipv6 route 2001:db8:0:1004::/64 leak default vrf blue",
+	"ipv6 route-table 100",
+	"ipv6 route ::/0 2001:db8:0:1000::2 table 100",
+	"ipv6 rule 10 from 2001:db8:0:1001::/64 table 100",
+	"ipv6 neighbor 2001:db8:0:1000::2 test0 02:00:00:00:00:02",
+	"ipv6 prefix-list LOCAL seq 10 permit 2001:db8::/32 le 64",
+	"ipv6 fib route-map FIB vrf blue",
+	"bfd interval 300 min-rx 300 multiplier 3",
+	"router ripng",
+	" redistribute connected",
+	"!",
+	"router ospfv3",
+	" router-id 1.1.1.1",
+	" redistribute static route-map TO-IGP",
+	"!",
+	"router isis",
+	" net 49.0001.0000.0000.0001.00",
+	" level 1",
+	" redistribute connected route-map TO-IGP",
+	"!",
+	"router bgp 65001",
+	" router-id 1.1.1.1",
+	" neighbor 2001:db8:0:1000::2 remote-as 65002",
+	" neighbor 2001:db8:0:1000::2 bfd",
+	" neighbor 2001:db8:0:1000::2 import seq 10 permit 2001:db8::/32 le 64 local-preference 200",
+	" network 2001:db8:0:1001::/64",
+	" redistribute static",
+	"!",
+	"route-map FIB permit 10",
+	" match source-protocol static",
+	"!",
+	"route-map TO-IGP permit 10",
+	" match address prefix-list LOCAL",
+	" set metric 20",
+	"!",
+	"ipfix collector 2001:db8::10 4739 active 60 inactive 15",
+	"sflow collector 2001:db8::10 6343 polling 20",
+	"",
+}, "\n")
+
+/* リンクが上がっているインターフェイスを追加する。テストが終われば外す */
+func addTestNetDev(t *testing.T, name string) *netDevice {
+	t.Helper()
+	netDev := newNetIf(name, &ipv6Device{})
+	netDev.up = true
+	prevNetDevices := netDevices
+	netDevices = append(append([]*netDevice{}, netDevices...), netDev)
+	t.Cleanup(func() { netDevices = prevNetDevices })
+	return netDev
+}
+
+func TestConfigLoadBgp(t *testing.T) {
+	useEmptyConfig(t)
+
+	text := strings.Join([]string{
+		"router bgp 65001",
+		" router-id 1.1.1.1",
+		" neighbor 2001:db8::2 remote-as 65002",
+		" neighbor 2001:db8::2 import seq 10 permit 2001:db8:1::/48 le 64 local-preference 200",
+		" network 2001:db8:0:1001::/64",
+		"!",
+	}, "\n")
+	if err := configLoad(text, "test"); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if bgpLocalAs != 65001 || bgpRouterId != parseRouterId("1.1.1.1") {
+		t.Fatalf("as %d router id %s, want 65001 1.1.1.1", bgpLocalAs, fmtRouterIdStr(bgpRouterId))
+	}
+	peer := getBgpPeer(parseIpv6("2001:db8::2"))
+	if peer == nil || peer.remoteAs != 65002 {
+		t.Fatalf("peer %v, want remote as 65002", peer)
+	}
+	if len(peer.importPolicy) != 1 || peer.importPolicy[0].setLocalPref != 200 || peer.importPolicy[0].le != 64 {
+		t.Fatalf("import policy %+v", peer.importPolicy)
+	}
+	prefix, prefixLen := configParsePrefix("2001:db8:0:1001::/64")
+	if !bgpNetworks[ribKey{prefix: prefix, prefixLen: prefixLen}] {
+		t.Fatalf("network is not configured: %v", bgpNetworks)
+	}
+
+	// 読み込んだ設定はそのまま書き出せる
+	cfg, err := parseRouterConfig(runningConfig.text())
+	if err != nil {
+		t.Fatalf("parse text: %s", err)
+	}
+	if cfg.text() != runningConfig.text() {
+		t.Fatalf("text changed:\n%s\nwant:\n%s", cfg.text(), runningConfig.text())
+	}
+
+	// ピアを消すとポリシーも消える
+	text = "router bgp 65001\n router-id 1.1.1.1\n network 2001:db8:0:1001::/64\n"
+	if err := configLoad(text, "test"); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if getBgpPeer(parseIpv6("2001:db8::2")) != nil || len(bgpPeers) != 0 {
+		t.Fatalf("peer is not removed: %v", bgpPeers)
+	}
+
+	if err := configLoad("", "test"); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if bgpLocalAs != 0 || len(bgpNetworks) != 0 || bgpListenFd >= 0 {
+		t.Fatalf("bgp is not stopped: as %d networks %v", bgpLocalAs, bgpNetworks)
+	}
+}
+
+func TestConfigBgpInvalid(t *testing.T) {
+	useEmptyConfig(t)
+
+	for _, text := range []string{
+		"router bgp 65001 neighbor 2001:db8::2 remote-as 65002",
+		"router bgp 65001 router-id 1.1.1.1\nrouter bgp 65001 neighbor fe80::2 remote-as 65002",
+		"router bgp 65001 router-id 1.1.1.1\nrouter bgp 65002 network 2001:db8::/64",
+		"router bgp 65001 router-id 1.1.1.1\nrouter bgp 65001 neighbor 2001:db8::2 export seq 10 permit ::/0",
+	} {
+		if err := configLoad(text, "test"); err == nil {
+			t.Errorf("loaded %q", text)
+		}
+	}
+	if bgpLocalAs != 0 {
+		t.Fatalf("invalid config is applied: as %d", bgpLocalAs)
+	}
+}
+
+func TestConfigLoadBfd(t *testing.T) {
+	useEmptyConfig(t)
+	addTestNetDev(t, "test0")
+
+	text := strings.Join([]string{
+		"interface test0",
+		" ipv6 address 2001:db8:0:1000::1/64",
+		"!",
+		"ipv6 route 2001:db8:0:1002::/64 2001:db8:0:1000::2 bfd",
+		"bfd interval 100 min-rx 200 multiplier 5",
+		"router bgp 65001",
+		" router-id 1.1.1.1",
+		" neighbor 2001:db8:0:1000::2 remote-as 65002",
+		" neighbor 2001:db8:0:1000::2 bfd",
+		"!",
+	}, "\n")
+	if err := configLoad(text, "test"); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if bfdMinTx != 100*time.Millisecond || bfdMinRx != 200*time.Millisecond || bfdDetectMult != 5 {
+		t.Fatalf("bfd interval %s min-rx %s multiplier %d", bfdMinTx, bfdMinRx, bfdDetectMult)
+	}
+	prefix, prefixLen := configParsePrefix("2001:db8:0:1002::/64")
+	if bfdStaticRoutes[ribKey{prefix: prefix, prefixLen: prefixLen}] == nil || len(bfdSessions) != 1 {
+		t.Fatalf("route is not monitored by bfd: %d sessions", len(bfdSessions))
+	}
+	if peer := getBgpPeer(parseIpv6("2001:db8:0:1000::2")); peer == nil || !peer.bfd {
+		t.Fatalf("bgp neighbor is not monitored by bfd")
+	}
+
+	// 経路を普通のスタティック経路に変えるとセッションも消える
+	text = strings.Replace(text, "2001:db8:0:1000::2 bfd\n", "2001:db8:0:1000::2\n", 1)
+	text = strings.Replace(text, " neighbor 2001:db8:0:1000::2 bfd\n", "", 1)
+	text = strings.Replace(text, "bfd interval 100 min-rx 200 multiplier 5\n", "", 1)
+	if err := configLoad(text, "test"); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if len(bfdStaticRoutes) != 0 || len(bfdSessions) != 0 {
+		t.Fatalf("bfd is not removed: %d routes %d sessions", len(bfdStaticRoutes), len(bfdSessions))
+	}
+	if peer := getBgpPeer(parseIpv6("2001:db8:0:1000::2")); peer == nil || peer.bfd {
+		t.Fatalf("bgp neighbor is still monitored by bfd")
+	}
+	if bfdMinTx != BFD_DEFAULT_MIN_TX || bfdMinRx != BFD_DEFAULT_MIN_RX || bfdDetectMult != BFD_DEFAULT_DETECT_MULT {
+		t.Fatalf("bfd interval is not restored: %s min-rx %s multiplier %d", bfdMinTx, bfdMinRx, bfdDetectMult)
+	}
+
+	for _, text := range []string{
+		"ipv6 route 2001:db8:0:1002::/64 2001:db8:0:1000::2 bfd vrf blue",
+		"bfd interval 100 min-rx 200",
+		"interface test0 ospfv3 bfd",
+	} {
+		if err := configLoad(text, "test"); err == nil {
+			t.Errorf("loaded %q", text)
+		}
+	}
+}
+
+func TestConfigLoadVrrp(t *testing.T) {
+	useEmptyConfig(t)
+	netDev := addTestNetDev(t, "test0")
+
+	// インターフェイスのアドレスを仮想アドレスに含むのでアドレスオーナーになる
+	text := strings.Join([]string{
+		"interface test0",
+		" ipv6 address 2001:db8:0:1001::1/64",
+		" vrrp 1 address 2001:db8:0:1001::1",
+		" vrrp 2 priority 50 interval 500 address 2001:db8:0:1001::2",
+		"!",
+	}, "\n")
+	if err := configLoad(text, "test"); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	owner, backup := getVrrpRouter(netDev, 1), getVrrpRouter(netDev, 2)
+	if owner == nil || owner.priority != VRRP_PRIORITY_OWNER || owner.state != VRRP_STATE_MASTER {
+		t.Fatalf("vrid 1 is not the master: %+v", owner)
+	}
+	if backup == nil || backup.priority != 50 || backup.adverInterval != 500*time.Millisecond || backup.state != VRRP_STATE_BACKUP {
+		t.Fatalf("vrid 2 is not a backup: %+v", backup)
+	}
+	if got := runningConfig.vrrp[configVrrpKey{ifName: "test0", vrid: 1}]; got != "priority 100 interval 1000 address 2001:db8:0:1001::1" {
+		t.Fatalf("vrrp config %q", got)
+	}
+
+	text = "interface test0\n ipv6 address 2001:db8:0:1001::1/64\n"
+	if err := configLoad(text, "test"); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if len(vrrpRouters) != 0 {
+		t.Fatalf("%d vrrp routers left", len(vrrpRouters))
+	}
+	if _, ok := netDev.macMemberships[owner.virtualMac]; ok {
+		t.Fatalf("virtual mac is still registered")
+	}
+	if ipv6IsJoinedMcast(netDev.ipv6Dev, parseIpv6(VRRP_MCAST_ADDRESS)) {
+		t.Fatalf("vrrp multicast group is still joined")
+	}
+
+	for _, text := range []string{
+		"vrrp 1 address 2001:db8:0:1001::1",
+		"interface test0 vrrp 1 priority 255 address 2001:db8:0:1001::1",
+		"interface test0 vrrp 1 interval 15 address 2001:db8:0:1001::1",
+		"interface test0 vrrp 1",
+	} {
+		if err := configLoad(text, "test"); err == nil {
+			t.Errorf("loaded %q", text)
+		}
+	}
+}
+
+func TestConfigLoadIsis(t *testing.T) {
+	useEmptyConfig(t)
+	netDev := addTestNetDev(t, "test0")
+
+	text := strings.Join([]string{
+		"interface test0",
+		" ipv6 address 2001:db8:0:1000::1/64",
+		" isis network point-to-point metric 20",
+		"!",
+		"router isis",
+		" net 49.0001.0000.0000.0001.00",
+		" level 1",
+		"!",
+	}, "\n")
+	if err := configLoad(text, "test"); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if isisSystemIdSelf.String() != "0000.0000.0001" || isisLevel != 1 {
+		t.Fatalf("system id %s level %d", isisSystemIdSelf, isisLevel)
+	}
+	circuit := getIsisCircuit(netDev)
+	if circuit == nil || circuit.circuitType != ISIS_CIRCUIT_POINT_TO_POINT || circuit.metric != 20 {
+		t.Fatalf("circuit %+v", circuit)
+	}
+
+	// NETを変えるとサーキットも作り直す
+	text = strings.Replace(text, "0000.0001.00", "0000.0002.00", 1)
+	if err := configLoad(text, "test"); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if isisSystemIdSelf.String() != "0000.0000.0002" || len(isisCircuits) != 1 || getIsisCircuit(netDev) == circuit {
+		t.Fatalf("isis is not restarted: system id %s, %d circuits", isisSystemIdSelf, len(isisCircuits))
+	}
+
+	if err := configLoad("interface test0 ipv6 address 2001:db8:0:1000::1/64", "test"); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if len(isisCircuits) != 0 || isisSystemIdSelf != (isisSystemId{}) || isisAgingTimer != nil {
+		t.Fatalf("isis is not stopped: %d circuits", len(isisCircuits))
+	}
+	if _, ok := netDev.macMemberships[ISIS_ALL_IS_MAC]; ok {
+		t.Fatalf("isis mac address is still registered")
+	}
+
+	for _, text := range []string{
+		"interface test0 isis",
+		"router isis net 49.0001.0000.0000.0001.01",
+		"router isis level 3",
+		"router isis net 49.0001.0000.0000.0001.00\ninterface test0 isis metric 0",
+	} {
+		if err := configLoad(text, "test"); err == nil {
+			t.Errorf("loaded %q", text)
+		}
+	}
+}
+
+func TestConfigLoadRouteMap(t *testing.T) {
+	useEmptyConfig(t)
+
+	text := strings.Join([]string{
+		"vrf red",
+		"ipv6 prefix-list LOCAL seq 20 deny 2001:db8:0:2000::/52 le 64",
+		"ipv6 prefix-list LOCAL seq 10 permit 2001:db8::/32 ge 48",
+		"ipv6 fib route-map FIB vrf red",
+		"router ripng",
+		" redistribute static",
+		" redistribute connected route-map TO-RIPNG",
+		"!",
+		"route-map TO-RIPNG permit 10",
+		" set metric 3",
+		" match address prefix-list LOCAL",
+		"!",
+		"route-map FIB deny 10",
+		" match source-protocol ripng static",
+		"!",
+		"route-map FIB permit 20",
+		"!",
+	}, "\n")
+	if err := configLoad(text, "test"); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if entries := prefixLists["LOCAL"]; len(entries) != 2 || entries[0].seq != 10 || entries[0].ge != 48 || entries[1].action != ROUTE_MAP_DENY {
+		t.Fatalf("prefix list %+v", entries)
+	}
+	if entries := routeMaps["TO-RIPNG"]; len(entries) != 1 || entries[0].matchPrefixList != "LOCAL" || !entries[0].hasSetMetric || entries[0].setMetric != 3 {
+		t.Fatalf("route map %+v", entries)
+	}
+	if entries := routeMaps["FIB"]; len(entries) != 2 || len(entries[0].matchProtos) != 2 || entries[1].action != ROUTE_MAP_PERMIT {
+		t.Fatalf("route map %+v", entries)
+	}
+	if getVrfByName("red").fibRouteMap != "FIB" {
+		t.Fatalf("fib route map is not configured")
+	}
+	if rs := redistributions[PROTO_RIPNG]; len(rs) != 2 {
+		t.Fatalf("redistributions %+v", rs)
+	}
+
+	// 表示したテキストを読み直すと同じ設定になる
+	cfg, err := parseRouterConfig(runningConfig.text())
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+	if diff := diffRouterConfig(runningConfig, cfg); len(diff) != 0 {
+		t.Fatalf("diff %v", diff)
+	}
+	if !strings.Contains(runningConfig.text(), "route-map TO-RIPNG permit 10\n match address prefix-list LOCAL\n set metric 3\n!\n") {
+		t.Fatalf("text %s", runningConfig.text())
+	}
+
+	// 条件を1つ消すとエントリだけを入れ直す
+	if err := configEditRunning("no route-map TO-RIPNG permit 10 match address prefix-list LOCAL"); err != nil {
+		t.Fatalf("edit: %s", err)
+	}
+	if entries := routeMaps["TO-RIPNG"]; len(entries) != 1 || entries[0].matchPrefixList != "" || entries[0].setMetric != 3 {
+		t.Fatalf("route map %+v", entries)
+	}
+
+	if err := configLoad("vrf red", "test"); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if len(prefixLists) != 0 || len(routeMaps) != 0 || len(redistributions) != 0 || getVrfByName("red").fibRouteMap != "" {
+		t.Fatalf("route maps are not removed")
+	}
+
+	for _, text := range []string{
+		"ipv6 prefix-list LOCAL permit 2001:db8::/32",
+		"ipv6 prefix-list LOCAL seq 10 permit 2001:db8::/32 le 16",
+		"ipv6 fib route-map FIB vrf blue",
+		"route-map FIB drop 10",
+		"route-map FIB permit 10 set color 1",
+		"router ospfv3 redistribute connected",
+		"router isis redistribute static",
+		"router bgp 65001 router-id 1.1.1.1 redistribute kernel",
+	} {
+		if err := configLoad(text, "test"); err == nil {
+			t.Errorf("loaded %q", text)
+		}
+	}
+}
+
+func TestConfigTextRoundTrip(t *testing.T) {
+	cfg, err := parseRouterConfig(testFullConfig)
+	if err != nil {
+		t.Fatalf("parse: %s", err)
+	}
+	if err := validateRouterConfig(cfg); err != nil {
+		t.Fatalf("validate: %s", err)
+	}
+	if text := cfg.text(); text != testFullConfig {
+		t.Fatalf("text\n%s\nwant\n%s", text, testFullConfig)
+	}
+
+	// 見出しを付けた1行の形で読んでも同じ設定になる
+	flat, err := parseRouterConfig(strings.Join(cfg.lines(), "\n"))
+	if err != nil {
+		t.Fatalf("parse lines: %s", err)
+	}
+	if diff := diffRouterConfig(cfg, flat); len(diff) != 0 {
+		t.Fatalf("diff %v", diff)
+	}
+
+	// "no"を付けた行で全ての設定を消せる
+	for _, line := range cfg.lines() {
+		if err := flat.edit(append([]string{"no"}, strings.Fields(line)...), ""); err != nil {
+			t.Fatalf("no %s: %s", line, err)
+		}
+	}
+	if lines := flat.lines(); len(lines) != 0 {
+		t.Fatalf("lines %v", lines)
+	}
+}
+
+/* デフォルトVRFでdstにマッチする経路。なければnil */
+func testLookupRoute(dst string) *ipv6RouteEntry {
+	node, _ := vrfRouteLookup(defaultVrf, parseIpv6(dst))
+	if node == nil {
+		return nil
+	}
+	return node.route
+}
+
+func testEditCandidate(t *testing.T, line string) {
+	t.Helper()
+	if err := candidateConfig.edit(strings.Fields(line), ""); err != nil {
+		t.Fatalf("edit %s: %s", line, err)
+	}
+}
+
+func TestConfigLoadFull(t *testing.T) {
+	useEmptyConfig(t)
+	test0 := addTestNetDev(t, "test0")
+	test1 := addTestNetDev(t, "test1")
+
+	if err := configLoad(testFullConfig, "test"); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if runningConfig.text() != testFullConfig {
+		t.Fatalf("running config\n%s", runningConfig.text())
+	}
+	if test1.vrf != getVrfByName("blue") || !test0.ipv6Dev.configured {
+		t.Fatalf("interfaces are not configured")
+	}
+	if route := testLookupRoute("2001:db8:0:1002::1"); route == nil || route.nextHop != parseIpv6("2001:db8:0:1000::2") {
+		t.Fatalf("route %+v", route)
+	}
+	if bgpLocalAs != 65001 || isisLevel != 1 || getIsisCircuit(test0) == nil || getVrrpRouter(test1, 1) == nil {
+		t.Fatalf("routing protocols are not configured")
+	}
+
+	// 同じ設定を読み直しても何も変わらない
+	history := len(configHistory)
+	if err := configLoad(testFullConfig, "test"); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if len(configHistory) != history {
+		t.Fatalf("unchanged config is committed")
+	}
+
+	if err := configLoad("", "test"); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+	if len(runningConfig.lines()) != 0 || getVrfByName("blue") != nil || test1.vrf != defaultVrf || test0.ipv6Dev.configured {
+		t.Fatalf("config is not removed:\n%s", runningConfig.text())
+	}
+	if testLookupRoute("2001:db8:0:1002::1") != nil || bgpLocalAs != 0 || len(isisCircuits) != 0 || getVrrpRouter(test1, 1) != nil {
+		t.Fatalf("routes or routing protocols are not removed")
+	}
+	if len(prefixLists) != 0 || len(routeMaps) != 0 || len(redistributions) != 0 || len(staticRoutes) != 0 {
+		t.Fatalf("policies are not removed")
+	}
+}
+
+func TestConfigCommitRollback(t *testing.T) {
+	useEmptyConfig(t)
+	addTestNetDev(t, "test0")
+
+	testEditCandidate(t, "interface test0 ipv6 address 2001:db8:0:1000::1/64")
+	testEditCandidate(t, "ipv6 route 2001:db8:0:1002::/64 2001:db8:0:1000::2")
+	diff := diffRouterConfig(runningConfig, candidateConfig)
+	want := []string{
+		"+ interface test0 ipv6 address 2001:db8:0:1000::1/64",
+		"+ ipv6 route 2001:db8:0:1002::/64 2001:db8:0:1000::2",
+	}
+	if !slices.Equal(diff, want) {
+		t.Fatalf("diff %v, want %v", diff, want)
+	}
+	// commitするまでは反映しない
+	if testLookupRoute("2001:db8:0:1002::1") != nil {
+		t.Fatalf("candidate config is applied before commit")
+	}
+	if err := commitCandidateConfig(0); err != nil {
+		t.Fatalf("commit: %s", err)
+	}
+	if route := testLookupRoute("2001:db8:0:1002::1"); route == nil || route.nextHop != parseIpv6("2001:db8:0:1000::2") {
+		t.Fatalf("route %+v", route)
+	}
+
+	testEditCandidate(t, "ipv6 route 2001:db8:0:1002::/64 2001:db8:0:1000::3")
+	if err := commitCandidateConfig(0); err != nil {
+		t.Fatalf("commit: %s", err)
+	}
+	if route := testLookupRoute("2001:db8:0:1002::1"); route == nil || route.nextHop != parseIpv6("2001:db8:0:1000::3") {
+		t.Fatalf("route %+v", route)
+	}
+	diff = diffRouterConfig(configHistory[1].config, configHistory[0].config)
+	want = []string{
+		"- ipv6 route 2001:db8:0:1002::/64 2001:db8:0:1000::2",
+		"+ ipv6 route 2001:db8:0:1002::/64 2001:db8:0:1000::3",
+	}
+	if !slices.Equal(diff, want) {
+		t.Fatalf("diff %v, want %v", diff, want)
+	}
+
+	// 1つ前の設定を候補設定に読み込んでcommitすると戻る
+	if err := rollbackCandidateConfig(1); err != nil {
+		t.Fatalf("rollback: %s", err)
+	}
+	if err := commitCandidateConfig(0); err != nil {
+		t.Fatalf("commit: %s", err)
+	}
+	if route := testLookupRoute("2001:db8:0:1002::1"); route == nil || route.nextHop != parseIpv6("2001:db8:0:1000::2") {
+		t.Fatalf("route %+v", route)
+	}
+	if len(configHistory) != 3 {
+		t.Fatalf("%d commits in history, want 3", len(configHistory))
+	}
+
+	// 変更のないcommitは履歴に残さない
+	if err := commitCandidateConfig(0); err != nil {
+		t.Fatalf("commit: %s", err)
+	}
+	if len(configHistory) != 3 {
+		t.Fatalf("%d commits in history, want 3", len(configHistory))
+	}
+	if err := rollbackCandidateConfig(3); err == nil {
+		t.Fatalf("rollback beyond history")
+	}
+
+	// 反映できない候補設定はcommitできず、運用設定も変わらない
+	testEditCandidate(t, "ipv6 route 2001:db8:0:1003::/64 2001:db8:0:1000::2 vrf blue")
+	if err := commitCandidateConfig(0); err == nil {
+		t.Fatalf("committed route in unknown vrf")
+	}
+	if len(configHistory) != 3 || testLookupRoute("2001:db8:0:1003::1") != nil {
+		t.Fatalf("invalid config is applied")
+	}
+}
+
+func TestConfigCommitConfirmed(t *testing.T) {
+	clock := useEmptyConfig(t)
+	addTestNetDev(t, "test0")
+
+	if err := configLoad("interface test0 ipv6 address 2001:db8:0:1000::1/64", "test"); err != nil {
+		t.Fatalf("load: %s", err)
+	}
+
+	// 時間内にもう一度commitすれば確定する
+	testEditCandidate(t, "ipv6 route 2001:db8:0:1002::/64 2001:db8:0:1000::2")
+	if err := commitCandidateConfig(time.Minute); err != nil {
+		t.Fatalf("commit: %s", err)
+	}
+	clock.advance(30 * time.Second)
+	if err := commitCandidateConfig(0); err != nil {
+		t.Fatalf("commit: %s", err)
+	}
+	clock.advance(time.Minute)
+	if testLookupRoute("2001:db8:0:1002::1") == nil {
+		t.Fatalf("confirmed route is rolled back")
+	}
+
+	// 確認しなければ元の設定に戻る
+	testEditCandidate(t, "no ipv6 route 2001:db8:0:1002::/64")
+	if err := commitCandidateConfig(time.Minute); err != nil {
+		t.Fatalf("commit: %s", err)
+	}
+	if testLookupRoute("2001:db8:0:1002::1") != nil {
+		t.Fatalf("route is not removed")
+	}
+	clock.advance(time.Minute + time.Second)
+	if testLookupRoute("2001:db8:0:1002::1") == nil {
+		t.Fatalf("route is not rolled back")
+	}
+	if diff := diffRouterConfig(runningConfig, candidateConfig); len(diff) != 0 {
+		t.Fatalf("candidate config is not rolled back: %v", diff)
+	}
+	if configConfirmTimer != nil {
+		t.Fatalf("confirm timer is still running")
+	}
+}
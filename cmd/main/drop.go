@@ -0,0 +1,159 @@
+package main
+
+import (
+	"time"
+)
+
+/**
+ * パケットを捨てた理由
+ * データパスでパケットを捨てるところでは必ずdropPacketを呼び、理由ごと、インターフェイスごとに数える。
+ * トレースを有効にすると、捨てたパケットを理由と一緒にリングバッファに残し、APIで取り出せる。
+ */
+type dropReason int
+
+const (
+	DROP_NOT_OUR_MAC dropReason = iota
+	DROP_UNKNOWN_ETHER_TYPE
+	DROP_INVALID_LLC
+	DROP_NOT_IPV6_DEVICE
+	DROP_IPV6_TOO_SHORT
+	DROP_IPV6_BAD_VERSION
+	DROP_NO_ROUTE
+	DROP_NO_NEIGHBOR
+	DROP_UNKNOWN_NEXT_HEADER
+	DROP_ICMPV6_TOO_SHORT
+	DROP_ICMPV6_UNHANDLED_TYPE
+	DROP_NS_TARGET_NOT_OURS
+	DROP_UDP_INVALID_LENGTH
+	DROP_UDP_BAD_CHECKSUM
+	DROP_UDP_NO_LISTENER
+	DROP_LINK_DOWN
+	DROP_TX_ERROR
+	DROP_REASON_MAX
+)
+
+var dropReasonNames = [DROP_REASON_MAX]string{
+	DROP_NOT_OUR_MAC:           "not_our_mac",
+	DROP_UNKNOWN_ETHER_TYPE:    "unknown_ether_type",
+	DROP_INVALID_LLC:           "invalid_llc",
+	DROP_NOT_IPV6_DEVICE:       "not_ipv6_device",
+	DROP_IPV6_TOO_SHORT:        "ipv6_too_short",
+	DROP_IPV6_BAD_VERSION:      "ipv6_bad_version",
+	DROP_NO_ROUTE:              "no_route",
+	DROP_NO_NEIGHBOR:           "no_neighbor",
+	DROP_UNKNOWN_NEXT_HEADER:   "unknown_next_header",
+	DROP_ICMPV6_TOO_SHORT:      "icmpv6_too_short",
+	DROP_ICMPV6_UNHANDLED_TYPE: "icmpv6_unhandled_type",
+	DROP_NS_TARGET_NOT_OURS:    "ns_target_not_ours",
+	DROP_UDP_INVALID_LENGTH:    "udp_invalid_length",
+	DROP_UDP_BAD_CHECKSUM:      "udp_bad_checksum",
+	DROP_UDP_NO_LISTENER:       "udp_no_listener",
+	DROP_LINK_DOWN:             "link_down",
+	DROP_TX_ERROR:              "tx_error",
+}
+
+func (reason dropReason) String() string {
+	if reason < 0 || reason >= DROP_REASON_MAX {
+		return "unknown"
+	}
+	return dropReasonNames[reason]
+}
+
+func parseDropReason(name string) (dropReason, bool) {
+	for reason, reasonName := range dropReasonNames {
+		if reasonName == name {
+			return dropReason(reason), true
+		}
+	}
+	return 0, false
+}
+
+// トレースに残す数
+const DROP_TRACE_SIZE = 128
+
+// 理由ごとに捨てたパケットの数。インターフェイスごとの数はnetDevStatsに持つ
+var dropCounts [DROP_REASON_MAX]uint64
+
+// ルータが送ろうとしたパケットのように、インターフェイスが決まらないまま捨てたものの数
+var dropLocalCounts [DROP_REASON_MAX]uint64
+
+// 受信処理中のフレーム。受信したパケットを捨てるときはこれを残す
+var rxFrame []byte
+
+type dropTraceEntry struct {
+	time     time.Time
+	dev      string
+	reason   dropReason
+	data     []byte
+	ethernet bool // dataがイーサネットのフレームか。falseならIPv6パケット
+}
+
+var dropTrace = struct {
+	enabled bool
+	reasons map[dropReason]bool // 空なら全ての理由
+	entries []dropTraceEntry    // 古いものから上書きするリングバッファ
+	next    int
+}{}
+
+/*
+ * パケットを捨てたことを記録する。netDevは受信したか送信するはずだったインターフェイスで、決まらなければnil。
+ * packetは呼び出し元が持っているIPv6パケットで、受信処理中なら代わりに受信したフレームを残す。
+ */
+func dropPacket(netDev *netDevice, reason dropReason, packet []byte) {
+	if rxFrame != nil {
+		dropRecord(netDev, reason, rxFrame, true)
+	} else {
+		dropRecord(netDev, reason, packet, false)
+	}
+}
+
+/* 送信できずにイーサネットのフレームを捨てたことを記録する */
+func dropFrame(netDev *netDevice, reason dropReason, frame []byte) {
+	dropRecord(netDev, reason, frame, true)
+}
+
+func dropRecord(netDev *netDevice, reason dropReason, data []byte, ethernet bool) {
+	dropCounts[reason]++
+	if netDev != nil {
+		netDev.stats.drops[reason]++
+	} else {
+		dropLocalCounts[reason]++
+	}
+	if captureActive > 0 {
+		capture(netDev, CAPTURE_DROPPED, data, ethernet, "dropped: "+reason.String())
+	}
+	traceStep(packetTraceStep{node: "error-drop", decision: reason.String()})
+
+	if !dropTrace.enabled || (len(dropTrace.reasons) > 0 && !dropTrace.reasons[reason]) {
+		return
+	}
+	entry := dropTraceEntry{time: timerClock.now(), reason: reason, data: append([]byte{}, data...), ethernet: ethernet}
+	if netDev != nil {
+		entry.dev = netDev.name
+	}
+	if len(dropTrace.entries) < DROP_TRACE_SIZE {
+		dropTrace.entries = append(dropTrace.entries, entry)
+	} else {
+		dropTrace.entries[dropTrace.next] = entry
+	}
+	dropTrace.next = (dropTrace.next + 1) % DROP_TRACE_SIZE
+}
+
+/* トレースを始める。reasonsが空なら全ての理由で残す。残っていたトレースは消す */
+func configDropTrace(enabled bool, reasons []dropReason) {
+	dropTrace.enabled = enabled
+	dropTrace.reasons = map[dropReason]bool{}
+	for _, reason := range reasons {
+		dropTrace.reasons[reason] = true
+	}
+	dropTrace.entries = nil
+	dropTrace.next = 0
+}
+
+/* トレースに残っているパケットを古い順に */
+func dropTraceEntries() []dropTraceEntry {
+	if len(dropTrace.entries) < DROP_TRACE_SIZE {
+		return dropTrace.entries
+	}
+	return append(append([]dropTraceEntry{}, dropTrace.entries[dropTrace.next:]...), dropTrace.entries[:dropTrace.next]...)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// イベントループが監視するepoll
+var epollFd int
+
+// ファイルディスクリプタごとのイベントハンドラ
+var epollHandlers = map[int32]func(events uint32){}
+
+func initEpoll() error {
+	fd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	epollFd = fd
+	return nil
+}
+
+/* ファイルディスクリプタをepollの監視対象に加える */
+func epollAdd(fd int, events uint32, handler func(events uint32)) error {
+	err := syscall.EpollCtl(epollFd, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{
+		Events: events,
+		Fd:     int32(fd),
+	})
+	if err != nil {
+		return fmt.Errorf("epoll add fd %d: %s", fd, err)
+	}
+	epollHandlers[int32(fd)] = handler
+	return nil
+}
+
+/* 監視するイベントを変更する */
+func epollModify(fd int, events uint32) error {
+	return syscall.EpollCtl(epollFd, syscall.EPOLL_CTL_MOD, fd, &syscall.EpollEvent{
+		Events: events,
+		Fd:     int32(fd),
+	})
+}
+
+/* 監視対象から外す。fdを閉じる前に呼び出すこと */
+func epollDelete(fd int) {
+	syscall.EpollCtl(epollFd, syscall.EPOLL_CTL_DEL, fd, nil)
+	delete(epollHandlers, int32(fd))
+}
+
+/* epoll_waitで返ってきたイベントをハンドラに渡す */
+func epollDispatch(events []syscall.EpollEvent) {
+	for _, ev := range events {
+		// 先に処理したハンドラで監視から外されていることがある
+		handler, ok := epollHandlers[ev.Fd]
+		if !ok {
+			continue
+		}
+		handler(ev.Events)
+	}
+}
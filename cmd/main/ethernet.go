@@ -2,11 +2,11 @@ package main
 
 import (
 	"bytes"
-	"fmt"
 	"log"
 )
 
 const ETHER_TYPE_IPV6 uint16 = 0x86dd
+const ETHER_MAX_PAYLOAD_LEN = 1500
 
 var ETHER_ADDR_IPV6_MCAST_PREFIX = [2]byte{0x33, 0x33}
 var ETHERNET_ADDRESS_BROADCAST = [6]uint8{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
@@ -48,36 +48,78 @@ func setMacAddr(macAddrByte []byte) [6]uint8 {
 
 func ethernetInput(netDev *netDevice, buffer []byte) {
 	netDev.setEthHeader(newEth(buffer[0:6], buffer[6:12], buffer[12:14]))
-	dstAddrStr := fmtMacStr(netDev.ethHeader.dstAddr)
-	deviceAddrStr := fmtMacStr(netDev.macAddr)
 
-	// 自分のMACアドレス宛てかマルチキャストアドレスでなければ終了する
-	if netDev.ethHeader.dstAddr != netDev.macAddr && netDev.ethHeader.dstAddr != ETHERNET_ADDRESS_BROADCAST && !(buffer[0] == ETHER_ADDR_IPV6_MCAST_PREFIX[0] && buffer[1] == ETHER_ADDR_IPV6_MCAST_PREFIX[1]) {
-		fmt.Printf("not handle address, dstMacAddr is %s, device addr is %s\n", dstAddrStr, deviceAddrStr)
+	// 自分のMACアドレス宛てかマルチキャストアドレス、マスターになっているVRRPの仮想MACアドレス宛てでなければ終了する
+	if netDev.ethHeader.dstAddr != netDev.macAddr && netDev.ethHeader.dstAddr != ETHERNET_ADDRESS_BROADCAST && !(buffer[0] == ETHER_ADDR_IPV6_MCAST_PREFIX[0] && buffer[1] == ETHER_ADDR_IPV6_MCAST_PREFIX[1]) && vrrpMasterByMac(netDev, netDev.ethHeader.dstAddr) == nil && !isisIsMcastMac(netDev.ethHeader.dstAddr) {
+		ethLog.Debug("not our address", "dev", netDev.name, "dst", logMacAddr(netDev.ethHeader.dstAddr))
+		dropPacket(netDev, DROP_NOT_OUR_MAC, buffer)
+		return
+	}
+
+	// タイプが1500以下なら802.3の長さなので、LLCヘッダを見て振り分ける
+	if netDev.ethHeader.ethType <= ETHER_MAX_PAYLOAD_LEN {
+		traceStep(packetTraceStep{node: "ethernet-input", decision: "llc"})
+		ethernetLlcInput(netDev, buffer[14:])
 		return
 	}
 
 	switch netDev.ethHeader.ethType {
 	case ETHER_TYPE_IPV6:
-		fmt.Printf("ether type is ipv6, netDev is %+v, dstMacAddr is %s\n", netDev, dstAddrStr)
+		ethLog.Debug("received ipv6 frame", "dev", netDev.name, "src", logMacAddr(netDev.ethHeader.srcAddr), "dst", logMacAddr(netDev.ethHeader.dstAddr))
+		traceStep(packetTraceStep{node: "ethernet-input", decision: "ipv6"})
 		// Etherフレームヘッダ（宛先MAC：6byte、送信先MAC：6byte、タイプ：2byte）を除くパケットを渡す
 		ipv6Input(netDev, buffer[14:])
 	default:
-		fmt.Printf("not handle ether type, type is %d, netDev is %+v\n", netDev.ethHeader.ethType, netDev)
+		ethLog.Debug("unhandled ether type", "dev", netDev.name, "type", netDev.ethHeader.ethType)
+		dropPacket(netDev, DROP_UNKNOWN_ETHER_TYPE, buffer)
 	}
 }
 
 func ethernetEncapsulateOutput(netDev *netDevice, dstAddr [6]uint8, buffer []byte, etherType uint16) {
-	fmt.Printf("sending ethernet frame type %04x from %s to %s\n", etherType, fmtMacStr(netDev.macAddr), fmtMacStr(dstAddr))
+	ethernetEncapsulateOutputFrom(netDev, netDev.macAddr, dstAddr, buffer, etherType)
+}
+
+/* 送信元MACアドレスを指定して送信する。VRRPの仮想MACアドレスで送るときに使う */
+func ethernetEncapsulateOutputFrom(netDev *netDevice, srcAddr [6]uint8, dstAddr [6]uint8, buffer []byte, etherType uint16) {
+	ethLog.Debug("send frame", "dev", netDev.name, "type", etherType, "src", logMacAddr(srcAddr), "dst", logMacAddr(dstAddr))
+	if tracedPacket != nil {
+		traceStep(packetTraceStep{node: "ethernet-output", decision: "to " + fmtMacStr(dstAddr), outDev: netDev.name})
+	}
 
 	ethHeaderPacket := ethernetHeader{
 		dstAddr: dstAddr,
-		srcAddr: netDev.macAddr,
+		srcAddr: srcAddr,
 		ethType: etherType,
 	}.toEthPacket()
 
+	// リンクが落ちているなどで送れなければフレームを捨てる
 	err := netDev.transmit(append(ethHeaderPacket, buffer...))
 	if err != nil {
-		log.Fatalf("transmit is err : %v", err)
+		ethLog.Debug("failed to transmit", "dev", netDev.name, "err", err)
 	}
 }
+
+/* 802.3/LLCフレームの受信処理。IS-ISだけを扱う */
+func ethernetLlcInput(netDev *netDevice, buffer []byte) {
+	length := int(netDev.ethHeader.ethType)
+	if len(buffer) < length || length < LLC_HEADER_LEN {
+		ethLog.Debug("invalid 802.3 frame length", "dev", netDev.name, "len", length)
+		dropPacket(netDev, DROP_INVALID_LLC, buffer)
+		return
+	}
+	// 最小フレーム長に満たない分のパディングを除く
+	buffer = buffer[:length]
+
+	if buffer[0] != LLC_SAP_ISIS || buffer[1] != LLC_SAP_ISIS || buffer[2] != LLC_CONTROL_UI {
+		ethLog.Debug("unhandled llc sap", "dev", netDev.name, "dsap", buffer[0], "ssap", buffer[1])
+		dropPacket(netDev, DROP_INVALID_LLC, buffer)
+		return
+	}
+	isisInput(netDev, buffer[LLC_HEADER_LEN:])
+}
+
+/* LLCヘッダを付けて802.3フレームで送信する */
+func ethernetLlcOutput(netDev *netDevice, dstAddr [6]uint8, sap uint8, buffer []byte) {
+	llc := []byte{sap, sap, LLC_CONTROL_UI}
+	ethernetEncapsulateOutput(netDev, dstAddr, append(llc, buffer...), uint16(LLC_HEADER_LEN+len(buffer)))
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/atsushi-matsui/ipv6-router/api/routerpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+/**
+ * gRPCの管理API(api/routerpb/router.proto)
+ * 操作はHTTPのAPIと同じものを使う。Watch系のRPCはFIBとNDテーブルが変わるたびにイベントを送る。
+ */
+const GRPC_DEFAULT_SOCKET = "/var/run/ipv6-router-grpc.sock"
+
+// 送りきれていないイベントの上限。溢れたらそのストリームは終わらせる
+const GRPC_WATCH_QUEUE_LEN = 256
+
+/* イベントを受け取るストリーム。リストはイベントループだけが触る */
+type grpcRouteWatcher struct {
+	vrf    string // 空ならすべてのVRF
+	events chan *routerpb.RouteEvent
+}
+
+type grpcNeighborWatcher struct {
+	vrf    string
+	events chan *routerpb.NeighborEvent
+}
+
+var grpcRouteWatchers []*grpcRouteWatcher
+var grpcNeighborWatchers []*grpcNeighborWatcher
+
+type grpcRouterServer struct {
+	routerpb.UnimplementedRouterServer
+}
+
+/*
+ * gRPCのAPIを待ち受ける。networkは"unix"か"tcp"で、unixのときは残っているソケットファイルを消してから使う。
+ */
+func configGrpcApi(network string, address string) {
+	err := apiInitWakeup()
+	if err != nil {
+		apiLog.Error("failed to start grpc api", "err", err)
+		return
+	}
+
+	if network == "unix" {
+		os.Remove(address)
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		apiLog.Error("failed to listen grpc api", "network", network, "address", address, "err", err)
+		return
+	}
+
+	apiListeners = append(apiListeners, listener)
+	srv := grpc.NewServer()
+	routerpb.RegisterRouterServer(srv, &grpcRouterServer{})
+	go func() {
+		err := srv.Serve(listener)
+		apiLog.Info("grpc server is stopped", "network", network, "address", address, "err", err)
+	}()
+
+	apiLog.Info("configure grpc api", "network", network, "address", address)
+}
+
+/* 操作のエラーをgRPCのステータスに変換する */
+func grpcError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, errApiInvalid):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, errApiNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, errApiShutdown):
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func (s *grpcRouterServer) ListRoutes(ctx context.Context, req *routerpb.ListRoutesRequest) (*routerpb.ListRoutesResponse, error) {
+	routes, err := apiListRoutes(req.Vrf)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	res := &routerpb.ListRoutesResponse{}
+	for _, route := range routes {
+		res.Routes = append(res.Routes, newGrpcRoute(route, MAIN_ROUTE_TABLE_ID))
+	}
+	return res, nil
+}
+
+func (s *grpcRouterServer) LookupRoute(ctx context.Context, req *routerpb.LookupRouteRequest) (*routerpb.Route, error) {
+	route, err := apiLookupRoute(req.Vrf, req.Destination)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return newGrpcRoute(*route, MAIN_ROUTE_TABLE_ID), nil
+}
+
+func (s *grpcRouterServer) AddRoute(ctx context.Context, req *routerpb.AddRouteRequest) (*routerpb.AddRouteResponse, error) {
+	err := apiAddRoute(req.Vrf, req.Prefix, req.NextHop)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &routerpb.AddRouteResponse{}, nil
+}
+
+func (s *grpcRouterServer) DeleteRoute(ctx context.Context, req *routerpb.DeleteRouteRequest) (*routerpb.DeleteRouteResponse, error) {
+	err := apiDeleteRoute(req.Vrf, req.Prefix)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &routerpb.DeleteRouteResponse{}, nil
+}
+
+func (s *grpcRouterServer) ListNeighbors(ctx context.Context, req *routerpb.ListNeighborsRequest) (*routerpb.ListNeighborsResponse, error) {
+	neighbors, err := apiListNeighbors(req.Vrf)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	res := &routerpb.ListNeighborsResponse{}
+	for _, neighbor := range neighbors {
+		res.Neighbors = append(res.Neighbors, newGrpcNeighbor(neighbor))
+	}
+	return res, nil
+}
+
+func (s *grpcRouterServer) AddNeighbor(ctx context.Context, req *routerpb.AddNeighborRequest) (*routerpb.AddNeighborResponse, error) {
+	err := apiAddNeighbor(req.Interface, req.Address, req.Mac)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &routerpb.AddNeighborResponse{}, nil
+}
+
+func (s *grpcRouterServer) DeleteNeighbors(ctx context.Context, req *routerpb.DeleteNeighborsRequest) (*routerpb.DeleteNeighborsResponse, error) {
+	err := apiDeleteNeighbors(req.Vrf, req.Interface, req.Address)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return &routerpb.DeleteNeighborsResponse{}, nil
+}
+
+func (s *grpcRouterServer) ListInterfaces(ctx context.Context, req *routerpb.ListInterfacesRequest) (*routerpb.ListInterfacesResponse, error) {
+	interfaces, err := apiListInterfaces()
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	res := &routerpb.ListInterfacesResponse{}
+	for _, inf := range interfaces {
+		res.Interfaces = append(res.Interfaces, &routerpb.Interface{
+			Name:      inf.Name,
+			Mac:       inf.Mac,
+			Up:        inf.Up,
+			Present:   inf.Present,
+			Vrf:       inf.Vrf,
+			Address:   inf.Address,
+			LinkLocal: inf.LinkLocal,
+			Stats: &routerpb.InterfaceStats{
+				RxPackets: inf.Stats.RxPackets,
+				RxBytes:   inf.Stats.RxBytes,
+				RxErrors:  inf.Stats.RxErrors,
+				TxPackets: inf.Stats.TxPackets,
+				TxBytes:   inf.Stats.TxBytes,
+				TxErrors:  inf.Stats.TxErrors,
+			},
+		})
+	}
+	return res, nil
+}
+
+func (s *grpcRouterServer) WatchRoutes(req *routerpb.WatchRoutesRequest, stream routerpb.Router_WatchRoutesServer) error {
+	w := &grpcRouteWatcher{vrf: req.Vrf, events: make(chan *routerpb.RouteEvent, GRPC_WATCH_QUEUE_LEN)}
+	if err := apiRun(func() { grpcRouteWatchers = append(grpcRouteWatchers, w) }); err != nil {
+		return grpcError(err)
+	}
+	defer apiRun(func() { grpcRouteWatchers = grpcRemoveWatcher(grpcRouteWatchers, w) })
+
+	for {
+		select {
+		case ev, ok := <-w.events:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "route event queue overflowed")
+			}
+			err := stream.Send(ev)
+			if err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+func (s *grpcRouterServer) WatchNeighbors(req *routerpb.WatchNeighborsRequest, stream routerpb.Router_WatchNeighborsServer) error {
+	w := &grpcNeighborWatcher{vrf: req.Vrf, events: make(chan *routerpb.NeighborEvent, GRPC_WATCH_QUEUE_LEN)}
+	if err := apiRun(func() { grpcNeighborWatchers = append(grpcNeighborWatchers, w) }); err != nil {
+		return grpcError(err)
+	}
+	defer apiRun(func() { grpcNeighborWatchers = grpcRemoveWatcher(grpcNeighborWatchers, w) })
+
+	for {
+		select {
+		case ev, ok := <-w.events:
+			if !ok {
+				return status.Error(codes.ResourceExhausted, "neighbor event queue overflowed")
+			}
+			err := stream.Send(ev)
+			if err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+func grpcRemoveWatcher[T comparable](watchers []T, w T) []T {
+	for i, v := range watchers {
+		if v == w {
+			return append(watchers[:i], watchers[i+1:]...)
+		}
+	}
+	return watchers
+}
+
+/*
+ * FIBの経路が変わったことを知らせる。routeがnilなら削除。
+ * patriciaTrieはどのVRFのテーブルか知らないので、ルートノードから探す。
+ */
+func grpcNotifyRoute(root *patriciaNode, prefix in6Addr, prefixLen uint8, route *ipv6RouteEntry) {
+	if len(grpcRouteWatchers) == 0 {
+		return
+	}
+
+	for _, v := range vrfs {
+		for tableId, table := range v.tables {
+			if table != root {
+				continue
+			}
+			ev := &routerpb.RouteEvent{Type: routerpb.EventType_EVENT_TYPE_DELETED}
+			if route == nil {
+				ev.Route = &routerpb.Route{
+					Vrf:     v.name,
+					TableId: tableId,
+					Prefix:  fmt.Sprintf("%s/%d", fmtIpStr(prefix), prefixLen),
+				}
+			} else {
+				ev.Type = routerpb.EventType_EVENT_TYPE_UPDATED
+				ev.Route = newGrpcRoute(newApiRoute(v, prefix, prefixLen, route), tableId)
+			}
+
+			// 溢れたストリームは閉じてリストから外す
+			watchers := grpcRouteWatchers[:0]
+			for _, w := range grpcRouteWatchers {
+				if w.vrf != "" && w.vrf != v.name {
+					watchers = append(watchers, w)
+					continue
+				}
+				select {
+				case w.events <- ev:
+					watchers = append(watchers, w)
+				default:
+					close(w.events)
+				}
+			}
+			grpcRouteWatchers = watchers
+			return
+		}
+	}
+}
+
+/* NDテーブルのエントリが変わったことを知らせる */
+func grpcNotifyNeighbor(v *vrf, entry *ndTableEntry, deleted bool) {
+	if len(grpcNeighborWatchers) == 0 {
+		return
+	}
+
+	ev := &routerpb.NeighborEvent{Type: routerpb.EventType_EVENT_TYPE_UPDATED}
+	if deleted {
+		ev.Type = routerpb.EventType_EVENT_TYPE_DELETED
+		ev.Neighbor = &routerpb.Neighbor{
+			Vrf:       v.name,
+			Address:   fmtIpStr(entry.v6Addr),
+			Interface: entry.dev.name,
+		}
+	} else {
+		ev.Neighbor = newGrpcNeighbor(newApiNeighbor(v, entry))
+	}
+
+	watchers := grpcNeighborWatchers[:0]
+	for _, w := range grpcNeighborWatchers {
+		if w.vrf != "" && w.vrf != v.name {
+			watchers = append(watchers, w)
+			continue
+		}
+		select {
+		case w.events <- ev:
+			watchers = append(watchers, w)
+		default:
+			close(w.events)
+		}
+	}
+	grpcNeighborWatchers = watchers
+}
+
+func newGrpcRoute(route apiRoute, tableId uint32) *routerpb.Route {
+	return &routerpb.Route{
+		Vrf:       route.Vrf,
+		TableId:   tableId,
+		Prefix:    route.Prefix,
+		Type:      route.Type,
+		Proto:     route.Proto,
+		NextHop:   route.NextHop,
+		Interface: route.Interface,
+		LeakVrf:   route.LeakVrf,
+		Metric:    route.Metric,
+		Distance:  uint32(route.Distance),
+	}
+}
+
+func newGrpcNeighbor(neighbor apiNeighbor) *routerpb.Neighbor {
+	return &routerpb.Neighbor{
+		Vrf:       neighbor.Vrf,
+		Address:   neighbor.Address,
+		Mac:       neighbor.Mac,
+		Interface: neighbor.Interface,
+		Static:    neighbor.Static,
+	}
+}
@@ -2,12 +2,12 @@ package main
 
 import (
 	"bytes"
-	"fmt"
-	"net"
+	"strconv"
 	"unsafe"
 )
 
 const IPV6_MULTICAST_ADDRESS = "ff02::1:ff00:0000"
+const IPV6_ALL_NODES_ADDRESS = "ff02::1"
 
 const ICMPV6_TYPE_ECHO_REQUEST uint8 = 128
 const ICMPV6_TYPE_ECHO_REPLY uint8 = 129
@@ -15,9 +15,39 @@ const ICMPV6_TYPE_ROUTER_SOLICIATION uint8 = 133
 const ICMPV6_TYPE_NEIGHBOR_SOLICIATION uint8 = 135
 const ICMPV6_TYPE_NEIGHBOR_ADVERTISEMENT uint8 = 136
 
+const ICMPV6_NA_FLAG_ROUTER uint8 = 0b10000000
 const ICMPV6_NA_FLAG_SOLICITED uint8 = 0b01000000
 const ICMPV6_NA_FLAG_OVERRIDE uint8 = 0b00100000
 
+/* メトリクスのラベルに使う名前。知らないタイプは番号にする */
+func icmpv6TypeName(icmpType uint8) string {
+	switch icmpType {
+	case 1:
+		return "destination_unreachable"
+	case 2:
+		return "packet_too_big"
+	case 3:
+		return "time_exceeded"
+	case 4:
+		return "parameter_problem"
+	case ICMPV6_TYPE_ECHO_REQUEST:
+		return "echo_request"
+	case ICMPV6_TYPE_ECHO_REPLY:
+		return "echo_reply"
+	case ICMPV6_TYPE_ROUTER_SOLICIATION:
+		return "router_solicitation"
+	case 134:
+		return "router_advertisement"
+	case ICMPV6_TYPE_NEIGHBOR_SOLICIATION:
+		return "neighbor_solicitation"
+	case ICMPV6_TYPE_NEIGHBOR_ADVERTISEMENT:
+		return "neighbor_advertisement"
+	case 137:
+		return "redirect"
+	}
+	return strconv.Itoa(int(icmpType))
+}
+
 type icmpv6Hdr struct {
 	icmpType uint8
 	code     uint8
@@ -47,7 +77,8 @@ type icmpv6Na struct {
 /* ICMPv6パケットの受信処理 */
 func icmpv6Input(netDev *netDevice, srcAddr in6Addr, dstAddr in6Addr, icmpPacket []byte) {
 	if len(icmpPacket) < 4 {
-		fmt.Printf("received ICMP Packet is too short. size is %d", len(icmpPacket))
+		icmpv6Log.Debug("packet too short", "dev", netDev.name, "len", len(icmpPacket))
+		dropPacket(netDev, DROP_ICMPV6_TOO_SHORT, icmpPacket)
 		return
 	}
 	recIcmpHdr := icmpv6Hdr{
@@ -55,17 +86,21 @@ func icmpv6Input(netDev *netDevice, srcAddr in6Addr, dstAddr in6Addr, icmpPacket
 		code:     icmpPacket[1],
 		checksum: byteToUint16(icmpPacket[2:4]),
 	}
-	fmt.Printf("received icmpv6 code=%d, type=%d\n", recIcmpHdr.code, recIcmpHdr.icmpType)
+	icmpv6Log.Debug("received", "dev", netDev.name, "src", srcAddr, "type", recIcmpHdr.icmpType, "code", recIcmpHdr.code)
+	datapathStats.icmpv6Rx[recIcmpHdr.icmpType]++
+	if tracedPacket != nil {
+		traceStep(packetTraceStep{node: "icmpv6-input", decision: icmpv6TypeName(recIcmpHdr.icmpType)})
+	}
 
 	switch recIcmpHdr.icmpType {
 	case ICMPV6_TYPE_NEIGHBOR_SOLICIATION:
 		if len(icmpPacket) < 32 {
-			fmt.Printf("received icmpv6 NS Packet is too short. size is %d", len(icmpPacket))
+			ndLog.Debug("ns too short", "dev", netDev.name, "len", len(icmpPacket))
+			dropPacket(netDev, DROP_ICMPV6_TOO_SHORT, icmpPacket)
 			return
 		}
 		targetAddr := in6Addr(icmpPacket[8:24])
-		targetAddrStr := fmtIpStr(targetAddr)
-		fmt.Printf("icmpv6 NS packet. targetAddr is %s\n", targetAddrStr)
+		ndLog.Debug("received ns", "dev", netDev.name, "src", srcAddr, "target", targetAddr)
 
 		nsPkt := icmpv6Na{
 			hdr:        recIcmpHdr,
@@ -76,9 +111,7 @@ func icmpv6Input(netDev *netDevice, srcAddr in6Addr, dstAddr in6Addr, icmpPacket
 			optMacAddr: [6]uint8(icmpPacket[26:32]),
 		}
 
-		if netDev.ipv6Dev.address == nsPkt.targetAddr {
-			fmt.Printf("ns target match! %s\n", targetAddrStr)
-
+		if netDev.ipv6Dev.address == nsPkt.targetAddr || netDev.ipv6Dev.linkLocalAddr == nsPkt.targetAddr {
 			updateNDTableEntry(netDev, nsPkt.optMacAddr, srcAddr)
 
 			naPkt := icmpv6Na{
@@ -105,19 +138,27 @@ func icmpv6Input(netDev *netDevice, srcAddr in6Addr, dstAddr in6Addr, icmpPacket
 			psum := ^checksum16(phdr.toPseudoHeader(), 0)
 			naPkt.hdr.checksum = checksum16(naPkt.icmpv6NaToPacket(), psum)
 
+			datapathStats.icmpv6Tx[ICMPV6_TYPE_NEIGHBOR_ADVERTISEMENT]++
 			ipv6EncapDevOutput(netDev, nsPkt.optMacAddr, srcAddr, naPkt.icmpv6NaToPacket(), IPV6_PROTOCOL_NUM_ICMP)
+		} else if vr := vrrpMasterByAddr(netDev, nsPkt.targetAddr); vr != nil {
+			// VRRPの仮想アドレスは仮想MACアドレスで答える
+			ndLog.Debug("ns target is vrrp virtual address", "dev", netDev.name, "target", targetAddr)
+
+			updateNDTableEntry(netDev, nsPkt.optMacAddr, srcAddr)
+			sendNaPacket(netDev, vr.virtualMac, nsPkt.optMacAddr, srcAddr, nsPkt.targetAddr, ICMPV6_NA_FLAG_ROUTER|ICMPV6_NA_FLAG_SOLICITED|ICMPV6_NA_FLAG_OVERRIDE)
 		} else {
-			fmt.Printf("ns target not match! targetAddr is %s, ipv6-device is %s\n", targetAddrStr, fmtIpStr(netDev.ipv6Dev.address))
+			ndLog.Debug("ns target is not ours", "dev", netDev.name, "target", targetAddr)
+			dropPacket(netDev, DROP_NS_TARGET_NOT_OURS, icmpPacket)
 		}
 		break
 	case ICMPV6_TYPE_NEIGHBOR_ADVERTISEMENT:
 		if len(icmpPacket) < 32 {
-			fmt.Printf("received icmpv6 NA Packet is too short. size is %d", len(icmpPacket))
+			ndLog.Debug("na too short", "dev", netDev.name, "len", len(icmpPacket))
+			dropPacket(netDev, DROP_ICMPV6_TOO_SHORT, icmpPacket)
 			return
 		}
 		targetAddr := in6Addr(icmpPacket[8:24])
-		targetAddrStr := fmtIpStr(targetAddr)
-		fmt.Printf("icmpv6 NA packet. targetAddr is %s\n", targetAddrStr)
+		ndLog.Debug("received na", "dev", netDev.name, "src", srcAddr, "target", targetAddr)
 
 		naPkt := icmpv6Na{
 			hdr:        recIcmpHdr,
@@ -129,13 +170,12 @@ func icmpv6Input(netDev *netDevice, srcAddr in6Addr, dstAddr in6Addr, icmpPacket
 		}
 
 		updateNDTableEntry(netDev, naPkt.optMacAddr, naPkt.targetAddr)
-		fmt.Printf("updating nd entry %s => %s\n", targetAddrStr, fmtMacStr(naPkt.optMacAddr))
 
 		break
 	case ICMPV6_TYPE_ECHO_REQUEST:
 		id := byteToUint16(icmpPacket[4:6])
 		seq := byteToUint16(icmpPacket[6:8])
-		fmt.Printf("received echo request id=%d seq=%d\n", id, seq)
+		icmpv6Log.Debug("received echo request", "dev", netDev.name, "src", srcAddr, "id", id, "seq", seq)
 
 		replyIcmpv6echo := icmpv6Echo{
 			header: icmpv6Hdr{
@@ -148,8 +188,14 @@ func icmpv6Input(netDev *netDevice, srcAddr in6Addr, dstAddr in6Addr, icmpPacket
 			data: icmpPacket[8:],
 		}
 
+		// 宛てられたユニキャストアドレスから返す。VRRPの仮想アドレス宛てなら仮想アドレスになる
+		replySrcAddr := netDev.ipv6Dev.address
+		if dstAddr[0] != 0xff {
+			replySrcAddr = dstAddr
+		}
+
 		phdr := ipv6PseudoHeader{
-			srcAddr:      netDev.ipv6Dev.address,
+			srcAddr:      replySrcAddr,
 			dstAddr:      srcAddr,
 			packetLength: uint32(len(icmpPacket)),
 			zero:         [3]byte{0, 0, 0},
@@ -158,17 +204,20 @@ func icmpv6Input(netDev *netDevice, srcAddr in6Addr, dstAddr in6Addr, icmpPacket
 
 		psum := ^checksum16(phdr.toPseudoHeader(), 0)
 		replyIcmpv6echo.header.checksum = checksum16(replyIcmpv6echo.icmpv6EchoToPacket(), psum)
-		ipv6EncapOutput(srcAddr, netDev.ipv6Dev.address, replyIcmpv6echo.icmpv6EchoToPacket(), IPV6_PROTOCOL_NUM_ICMP)
+		datapathStats.icmpv6Tx[ICMPV6_TYPE_ECHO_REPLY]++
+		ipv6EncapOutput(netDev.vrf, srcAddr, replySrcAddr, replyIcmpv6echo.icmpv6EchoToPacket(), IPV6_PROTOCOL_NUM_ICMP)
 
 		break
+	default:
+		icmpv6Log.Debug("unhandled type", "dev", netDev.name, "type", recIcmpHdr.icmpType)
+		dropPacket(netDev, DROP_ICMPV6_UNHANDLED_TYPE, icmpPacket)
 	}
 }
 
 func sendNsPacket(netDev *netDevice, targetAddr in6Addr) {
 	// 要請ノードマルチキャストアドレスを生成。近隣要請パケットはマルチキャストに解決したいアドレスの下位3byteを設定したアドレス宛に送信する。
 	// ff00::1がマルチキャスト下から２番目からの4bitがフラグ、最下位の4ビットがスコープを表す
-	mcastAddr := in6Addr(net.ParseIP(IPV6_MULTICAST_ADDRESS).To16())
-	copy(mcastAddr[13:], targetAddr[13:])
+	mcastAddr := in6AddrSolicitedNode(targetAddr)
 
 	phdr := ipv6PseudoHeader{
 		srcAddr:      netDev.ipv6Dev.address,
@@ -194,9 +243,53 @@ func sendNsPacket(netDev *netDevice, targetAddr in6Addr) {
 
 	psum := ^checksum16(phdr.toPseudoHeader(), 0)
 	nsPkt.hdr.checksum = checksum16(nsPkt.icmpv6NaToPacket(), psum)
-	fmt.Printf("sending NS...\n")
+	ndLog.Debug("send ns", "dev", netDev.name, "target", targetAddr)
+	datapathStats.icmpv6Tx[ICMPV6_TYPE_NEIGHBOR_SOLICIATION]++
+
+	ipv6EncapDevMcastOutput(netDev, netDev.ipv6Dev.address, mcastAddr, nsPkt.icmpv6NaToPacket(), IPV6_PROTOCOL_NUM_ICMP)
+}
+
+/* リンクローカルアドレスからNAを送る。ターゲットのMACアドレスには送信元MACアドレスを入れる */
+func sendNaPacket(netDev *netDevice, srcMacAddr [6]uint8, dstMacAddr [6]uint8, dstAddr in6Addr, targetAddr in6Addr, flags uint8) {
+	srcAddr := netDev.ipv6Dev.linkLocalAddr
+
+	naPkt := icmpv6Na{
+		hdr: icmpv6Hdr{
+			icmpType: ICMPV6_TYPE_NEIGHBOR_ADVERTISEMENT,
+		},
+		flags:      byteToUint32([]byte{flags, 0x00, 0x00, 0x00}),
+		targetAddr: targetAddr,
+		optType:    ICMPV6_OPTION_TARGET_LINK_LAYER_ADDRESS,
+		optLength:  1,
+		optMacAddr: srcMacAddr,
+	}
+
+	phdr := ipv6PseudoHeader{
+		srcAddr:      srcAddr,
+		dstAddr:      dstAddr,
+		packetLength: uint32(unsafe.Sizeof(icmpv6Na{})),
+		nextHeader:   IPV6_PROTOCOL_NUM_ICMP,
+	}
+	psum := ^checksum16(phdr.toPseudoHeader(), 0)
+	naPkt.hdr.checksum = checksum16(naPkt.icmpv6NaToPacket(), psum)
+
+	packet := naPkt.icmpv6NaToPacket()
+	ipv6hdr := ipv6Header{
+		verTcFl:    0x60000000,
+		payloadLen: uint16(len(packet)),
+		nextHdr:    IPV6_PROTOCOL_NUM_ICMP,
+		hopLimit:   0xff,
+		srcAddr:    srcAddr,
+		dstAddr:    dstAddr,
+	}
+	datapathStats.icmpv6Tx[ICMPV6_TYPE_NEIGHBOR_ADVERTISEMENT]++
+	ethernetEncapsulateOutputFrom(netDev, srcMacAddr, dstMacAddr, append(ipv6hdr.toPacket(), packet...), ETHER_TYPE_IPV6)
+}
 
-	ipv6EncapDevMcastOutput(netDev, mcastAddr, nsPkt.icmpv6NaToPacket(), IPV6_PROTOCOL_NUM_ICMP)
+/* 全ノードマルチキャストにNAを送り、アドレスに対応するMACアドレスが変わったことを知らせる */
+func sendUnsolicitedNa(netDev *netDevice, macAddr [6]uint8, targetAddr in6Addr) {
+	allNodes := parseIpv6(IPV6_ALL_NODES_ADDRESS)
+	sendNaPacket(netDev, macAddr, ipv6McastMac(allNodes), allNodes, targetAddr, ICMPV6_NA_FLAG_ROUTER|ICMPV6_NA_FLAG_OVERRIDE)
 }
 
 func (icmpv icmpv6Na) icmpv6NaToPacket() []byte {
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+/**
+ * IPFIX(RFC 7011)によるフローのエクスポート
+ * フォワーディングしたパケットを送信元と宛先のアドレス、プロトコル、ポートの組でフローキャッシュにまとめ、
+ * 非アクティブタイムアウトかアクティブタイムアウトを過ぎたものをUDPでコレクタに送る。
+ * UDPでは届いたか分からないので、テンプレートは最初のメッセージとその後IPFIX_TEMPLATE_REFRESHごとに送り直す。
+ */
+const IPFIX_VERSION uint16 = 10
+const IPFIX_DEFAULT_PORT = 4739
+const IPFIX_DEFAULT_ACTIVE_TIMEOUT = 60 * time.Second
+const IPFIX_DEFAULT_INACTIVE_TIMEOUT = 15 * time.Second
+const IPFIX_TEMPLATE_REFRESH = 60 * time.Second
+
+// タイムアウトを調べる間隔
+const IPFIX_SCAN_INTERVAL = time.Second
+
+// フローキャッシュに入れるフローの数。超えた分は数えない
+const IPFIX_CACHE_MAX = 65536
+
+// 1つのメッセージの大きさ。IPv6の最小MTUに収まるようにする
+const IPFIX_MAX_MESSAGE_LEN = 1200
+
+const IPFIX_OBSERVATION_DOMAIN_ID uint32 = 1
+const IPFIX_SET_ID_TEMPLATE uint16 = 2
+const IPFIX_TEMPLATE_ID uint16 = 256
+const IPFIX_HEADER_LEN = 16
+const IPFIX_SET_HEADER_LEN = 4
+
+// Information Element(IANAの番号)
+const IPFIX_IE_OCTET_DELTA_COUNT uint16 = 1
+const IPFIX_IE_PACKET_DELTA_COUNT uint16 = 2
+const IPFIX_IE_PROTOCOL_IDENTIFIER uint16 = 4
+const IPFIX_IE_SOURCE_TRANSPORT_PORT uint16 = 7
+const IPFIX_IE_INGRESS_INTERFACE uint16 = 10
+const IPFIX_IE_DESTINATION_TRANSPORT_PORT uint16 = 11
+const IPFIX_IE_EGRESS_INTERFACE uint16 = 14
+const IPFIX_IE_SOURCE_IPV6_ADDRESS uint16 = 27
+const IPFIX_IE_DESTINATION_IPV6_ADDRESS uint16 = 28
+const IPFIX_IE_FLOW_END_REASON uint16 = 136
+const IPFIX_IE_FLOW_START_MILLISECONDS uint16 = 152
+const IPFIX_IE_FLOW_END_MILLISECONDS uint16 = 153
+
+// flowEndReasonの値
+const IPFIX_END_IDLE_TIMEOUT uint8 = 1
+const IPFIX_END_ACTIVE_TIMEOUT uint8 = 2
+const IPFIX_END_FORCED uint8 = 4
+
+type ipfixField struct {
+	id     uint16
+	length uint16
+}
+
+// データレコードはこの順に書く
+var ipfixTemplateFields = []ipfixField{
+	{IPFIX_IE_SOURCE_IPV6_ADDRESS, 16},
+	{IPFIX_IE_DESTINATION_IPV6_ADDRESS, 16},
+	{IPFIX_IE_PROTOCOL_IDENTIFIER, 1},
+	{IPFIX_IE_SOURCE_TRANSPORT_PORT, 2},
+	{IPFIX_IE_DESTINATION_TRANSPORT_PORT, 2},
+	{IPFIX_IE_INGRESS_INTERFACE, 4},
+	{IPFIX_IE_EGRESS_INTERFACE, 4},
+	{IPFIX_IE_PACKET_DELTA_COUNT, 8},
+	{IPFIX_IE_OCTET_DELTA_COUNT, 8},
+	{IPFIX_IE_FLOW_START_MILLISECONDS, 8},
+	{IPFIX_IE_FLOW_END_MILLISECONDS, 8},
+	{IPFIX_IE_FLOW_END_REASON, 1},
+}
+
+type flowKey struct {
+	srcAddr in6Addr
+	dstAddr in6Addr
+	proto   uint8 // 拡張ヘッダの後の上位層のプロトコル
+	srcPort uint16
+	dstPort uint16
+}
+
+type flowEntry struct {
+	key     flowKey
+	inDev   *netDevice
+	outDev  *netDevice // ネクストホップを解決できていなければnil
+	packets uint64
+	octets  uint64
+	start   time.Time
+	last    time.Time
+}
+
+var ipfixExporter = struct {
+	enabled         bool
+	collector       string // host:port
+	conn            *net.UDPConn
+	activeTimeout   time.Duration
+	inactiveTimeout time.Duration
+	flows           map[flowKey]*flowEntry
+	scanTimer       *timer
+	sequence        uint32 // これまでに送ったデータレコードの数
+	templateSent    time.Time
+
+	// 送るのを待っているデータレコード
+	records   []byte
+	nRecords  int
+	exported  uint64 // 送ったフロー
+	messages  uint64
+	errors    uint64 // 送れなかったメッセージ
+	cacheFull uint64 // キャッシュがいっぱいで数えなかったパケット
+}{}
+
+/* "ipfix collector"の設定 */
+type ipfixCollectorConfig struct {
+	address         string
+	port            int
+	activeTimeout   time.Duration
+	inactiveTimeout time.Duration
+}
+
+/* ADDRESS PORT [active SECONDS] [inactive SECONDS] */
+func parseIpfixCollector(words []string) (*ipfixCollectorConfig, error) {
+	usage := fmt.Errorf("usage: ipfix collector ADDRESS PORT [active SECONDS] [inactive SECONDS]")
+	if len(words) < 2 || len(words)%2 != 0 {
+		return nil, usage
+	}
+	addr := net.ParseIP(words[0])
+	if addr == nil {
+		return nil, fmt.Errorf("invalid collector address %s", words[0])
+	}
+	port, err := strconv.ParseUint(words[1], 10, 16)
+	if err != nil || port == 0 {
+		return nil, fmt.Errorf("invalid collector port %s", words[1])
+	}
+	collector := &ipfixCollectorConfig{
+		address:         addr.String(),
+		port:            int(port),
+		activeTimeout:   IPFIX_DEFAULT_ACTIVE_TIMEOUT,
+		inactiveTimeout: IPFIX_DEFAULT_INACTIVE_TIMEOUT,
+	}
+	for i := 2; i < len(words); i += 2 {
+		seconds, err := strconv.ParseUint(words[i+1], 10, 32)
+		if err != nil || seconds == 0 {
+			return nil, fmt.Errorf("invalid timeout %s", words[i+1])
+		}
+		switch words[i] {
+		case "active":
+			collector.activeTimeout = time.Duration(seconds) * time.Second
+		case "inactive":
+			collector.inactiveTimeout = time.Duration(seconds) * time.Second
+		default:
+			return nil, usage
+		}
+	}
+	return collector, nil
+}
+
+/* 設定ファイルに書く形。タイムアウトは省略しない */
+func (collector *ipfixCollectorConfig) String() string {
+	return fmt.Sprintf("%s %d active %d inactive %d", collector.address, collector.port, int(collector.activeTimeout.Seconds()), int(collector.inactiveTimeout.Seconds()))
+}
+
+/* コレクタへのエクスポートを始める。設定が変わったときはそれまでのフローを送ってからやり直す */
+func configIpfix(address string, port int, activeTimeout time.Duration, inactiveTimeout time.Duration) {
+	collector := net.JoinHostPort(address, strconv.Itoa(port))
+	if ipfixExporter.enabled {
+		unconfigIpfix()
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", collector)
+	if err == nil {
+		ipfixExporter.conn, err = net.DialUDP("udp", nil, addr)
+	}
+	if err != nil {
+		ipfixLog.Error("failed to open collector", "collector", collector, "err", err)
+		return
+	}
+	ipfixExporter.enabled = true
+	ipfixExporter.collector = collector
+	ipfixExporter.activeTimeout = activeTimeout
+	ipfixExporter.inactiveTimeout = inactiveTimeout
+	ipfixExporter.flows = map[flowKey]*flowEntry{}
+	ipfixExporter.templateSent = time.Time{}
+	ipfixExporter.scanTimer = newTimer(IPFIX_SCAN_INTERVAL, ipfixScan)
+	ipfixLog.Info("export flows", "collector", collector, "active", activeTimeout, "inactive", inactiveTimeout)
+}
+
+/* 残っているフローを送ってからエクスポートをやめる */
+func unconfigIpfix() {
+	if !ipfixExporter.enabled {
+		return
+	}
+	for key, flow := range ipfixExporter.flows {
+		ipfixAddRecord(flow, IPFIX_END_FORCED)
+		delete(ipfixExporter.flows, key)
+	}
+	ipfixFlush()
+	ipfixExporter.scanTimer.stop()
+	ipfixExporter.conn.Close()
+	ipfixExporter.conn = nil
+	ipfixExporter.enabled = false
+	ipfixLog.Info("stop exporting flows", "collector", ipfixExporter.collector)
+}
+
+func ipfixShutdown() {
+	unconfigIpfix()
+}
+
+/* フォワーディングするパケットをフローに数える。packetはIPv6パケット全体 */
+func ipfixCountFlow(inDev *netDevice, outDev *netDevice, packet []byte) {
+	// イーサネットの最小フレーム長に足りない分のパディングは数えない
+	if n := 40 + int(byteToUint16(packet[4:6])); n < len(packet) {
+		packet = packet[:n]
+	}
+	key := flowKey{
+		srcAddr: in6Addr(packet[8:24]),
+		dstAddr: in6Addr(packet[24:40]),
+		proto:   packet[6],
+	}
+	nextHdr, payload, ok := ipv6UpperLayer(packet)
+	if ok {
+		key.proto = nextHdr
+		if (nextHdr == IPV6_PROTOCOL_NUM_UDP || nextHdr == IPV6_PROTOCOL_NUM_TCP) && len(payload) >= 4 {
+			key.srcPort = byteToUint16(payload[0:2])
+			key.dstPort = byteToUint16(payload[2:4])
+		}
+	}
+
+	now := timerClock.now()
+	flow, ok := ipfixExporter.flows[key]
+	if !ok {
+		if len(ipfixExporter.flows) >= IPFIX_CACHE_MAX {
+			ipfixExporter.cacheFull++
+			return
+		}
+		flow = &flowEntry{key: key, inDev: inDev, start: now}
+		ipfixExporter.flows[key] = flow
+	}
+	if outDev != nil {
+		flow.outDev = outDev
+	}
+	flow.packets++
+	flow.octets += uint64(len(packet))
+	flow.last = now
+}
+
+/* 期限を過ぎたフローを送る */
+func ipfixScan() {
+	now := timerClock.now()
+	for key, flow := range ipfixExporter.flows {
+		switch {
+		case now.Sub(flow.last) >= ipfixExporter.inactiveTimeout:
+			ipfixAddRecord(flow, IPFIX_END_IDLE_TIMEOUT)
+		case now.Sub(flow.start) >= ipfixExporter.activeTimeout:
+			ipfixAddRecord(flow, IPFIX_END_ACTIVE_TIMEOUT)
+		default:
+			continue
+		}
+		delete(ipfixExporter.flows, key)
+	}
+	ipfixFlush()
+	ipfixExporter.scanTimer.reset(IPFIX_SCAN_INTERVAL)
+}
+
+func ipfixTemplateLen() int {
+	return IPFIX_SET_HEADER_LEN + 4 + 4*len(ipfixTemplateFields)
+}
+
+func ipfixRecordLen() int {
+	n := 0
+	for _, field := range ipfixTemplateFields {
+		n += int(field.length)
+	}
+	return n
+}
+
+/* データレコードを溜め、メッセージに収まらなくなったら送る */
+func ipfixAddRecord(flow *flowEntry, reason uint8) {
+	if IPFIX_HEADER_LEN+ipfixTemplateLen()+IPFIX_SET_HEADER_LEN+len(ipfixExporter.records)+ipfixRecordLen() > IPFIX_MAX_MESSAGE_LEN {
+		ipfixFlush()
+	}
+
+	b := ipfixExporter.records
+	b = append(b, flow.key.srcAddr[:]...)
+	b = append(b, flow.key.dstAddr[:]...)
+	b = append(b, flow.key.proto)
+	b = binary.BigEndian.AppendUint16(b, flow.key.srcPort)
+	b = binary.BigEndian.AppendUint16(b, flow.key.dstPort)
+	b = binary.BigEndian.AppendUint32(b, ipfixIfIndex(flow.inDev))
+	b = binary.BigEndian.AppendUint32(b, ipfixIfIndex(flow.outDev))
+	b = binary.BigEndian.AppendUint64(b, flow.packets)
+	b = binary.BigEndian.AppendUint64(b, flow.octets)
+	b = binary.BigEndian.AppendUint64(b, uint64(flow.start.UnixMilli()))
+	b = binary.BigEndian.AppendUint64(b, uint64(flow.last.UnixMilli()))
+	b = append(b, reason)
+	ipfixExporter.records = b
+	ipfixExporter.nRecords++
+}
+
+func ipfixIfIndex(netDev *netDevice) uint32 {
+	if netDev == nil {
+		return 0
+	}
+	return uint32(netDev.sockAddr.Ifindex)
+}
+
+/* 溜まっているデータレコードを1つのメッセージにして送る。テンプレートの送り直しの時期なら前に付ける */
+func ipfixFlush() {
+	now := timerClock.now()
+	withTemplate := now.Sub(ipfixExporter.templateSent) >= IPFIX_TEMPLATE_REFRESH
+	if ipfixExporter.nRecords == 0 && !withTemplate {
+		return
+	}
+
+	msg := make([]byte, IPFIX_HEADER_LEN)
+	if withTemplate {
+		msg = binary.BigEndian.AppendUint16(msg, IPFIX_SET_ID_TEMPLATE)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(ipfixTemplateLen()))
+		msg = binary.BigEndian.AppendUint16(msg, IPFIX_TEMPLATE_ID)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(len(ipfixTemplateFields)))
+		for _, field := range ipfixTemplateFields {
+			msg = binary.BigEndian.AppendUint16(msg, field.id)
+			msg = binary.BigEndian.AppendUint16(msg, field.length)
+		}
+	}
+	if ipfixExporter.nRecords > 0 {
+		msg = binary.BigEndian.AppendUint16(msg, IPFIX_TEMPLATE_ID)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(IPFIX_SET_HEADER_LEN+len(ipfixExporter.records)))
+		msg = append(msg, ipfixExporter.records...)
+	}
+
+	// シーケンス番号はこのメッセージより前に送ったデータレコードの数
+	binary.BigEndian.PutUint16(msg[0:2], IPFIX_VERSION)
+	binary.BigEndian.PutUint16(msg[2:4], uint16(len(msg)))
+	binary.BigEndian.PutUint32(msg[4:8], uint32(now.Unix()))
+	binary.BigEndian.PutUint32(msg[8:12], ipfixExporter.sequence)
+	binary.BigEndian.PutUint32(msg[12:16], IPFIX_OBSERVATION_DOMAIN_ID)
+
+	_, err := ipfixExporter.conn.Write(msg)
+	if err != nil {
+		ipfixExporter.errors++
+		ipfixLog.Debug("failed to send", "collector", ipfixExporter.collector, "err", err)
+	} else {
+		ipfixExporter.messages++
+		ipfixExporter.exported += uint64(ipfixExporter.nRecords)
+		if withTemplate {
+			ipfixExporter.templateSent = now
+		}
+	}
+	ipfixExporter.sequence += uint32(ipfixExporter.nRecords)
+	ipfixExporter.records = ipfixExporter.records[:0]
+	ipfixExporter.nRecords = 0
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+/* コレクタで受け取ったメッセージ */
+type ipfixTestMessage struct {
+	exportTime uint32
+	sequence   uint32
+	template   []ipfixField // テンプレートセットがなければnil
+	records    []ipfixTestRecord
+}
+
+type ipfixTestRecord struct {
+	src, dst         in6Addr
+	proto            uint8
+	srcPort, dstPort uint16
+	in, out          uint32
+	packets, octets  uint64
+	start, end       uint64
+	reason           uint8
+}
+
+/* [::1]の空いているポートでコレクタを開く */
+func ipfixTestCollector(t *testing.T) *net.UDPConn {
+	t.Helper()
+	conn, err := net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6loopback})
+	if err != nil {
+		t.Skipf("cannot listen on [::1]: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+/* メッセージを1つ受け取り、テンプレートセットとデータセットを読む */
+func ipfixTestReceive(t *testing.T, conn *net.UDPConn, template []ipfixField) ipfixTestMessage {
+	t.Helper()
+	buf := make([]byte, 65535)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("no message from exporter: %s", err)
+	}
+	b := buf[:n]
+
+	if v := binary.BigEndian.Uint16(b[0:2]); v != IPFIX_VERSION {
+		t.Fatalf("version %d", v)
+	}
+	if l := binary.BigEndian.Uint16(b[2:4]); int(l) != n {
+		t.Fatalf("length %d in header, received %d", l, n)
+	}
+	if d := binary.BigEndian.Uint32(b[12:16]); d != IPFIX_OBSERVATION_DOMAIN_ID {
+		t.Fatalf("observation domain %d", d)
+	}
+	msg := ipfixTestMessage{
+		exportTime: binary.BigEndian.Uint32(b[4:8]),
+		sequence:   binary.BigEndian.Uint32(b[8:12]),
+	}
+
+	for off := IPFIX_HEADER_LEN; off < n; {
+		setId := binary.BigEndian.Uint16(b[off : off+2])
+		setLen := int(binary.BigEndian.Uint16(b[off+2 : off+4]))
+		if setLen < IPFIX_SET_HEADER_LEN || off+setLen > n {
+			t.Fatalf("set %d has length %d at %d of %d", setId, setLen, off, n)
+		}
+		set := b[off+IPFIX_SET_HEADER_LEN : off+setLen]
+		off += setLen
+
+		switch setId {
+		case IPFIX_SET_ID_TEMPLATE:
+			if id := binary.BigEndian.Uint16(set[0:2]); id != IPFIX_TEMPLATE_ID {
+				t.Fatalf("template id %d", id)
+			}
+			count := int(binary.BigEndian.Uint16(set[2:4]))
+			for i := 0; i < count; i++ {
+				p := set[4+4*i:]
+				msg.template = append(msg.template, ipfixField{binary.BigEndian.Uint16(p[0:2]), binary.BigEndian.Uint16(p[2:4])})
+			}
+			template = msg.template
+		case IPFIX_TEMPLATE_ID:
+			if template == nil {
+				t.Fatalf("data set before template")
+			}
+			for len(set) > 0 {
+				var r ipfixTestRecord
+				for _, field := range template {
+					v := set[:field.length]
+					set = set[field.length:]
+					switch field.id {
+					case IPFIX_IE_SOURCE_IPV6_ADDRESS:
+						r.src = in6Addr(v)
+					case IPFIX_IE_DESTINATION_IPV6_ADDRESS:
+						r.dst = in6Addr(v)
+					case IPFIX_IE_PROTOCOL_IDENTIFIER:
+						r.proto = v[0]
+					case IPFIX_IE_SOURCE_TRANSPORT_PORT:
+						r.srcPort = binary.BigEndian.Uint16(v)
+					case IPFIX_IE_DESTINATION_TRANSPORT_PORT:
+						r.dstPort = binary.BigEndian.Uint16(v)
+					case IPFIX_IE_INGRESS_INTERFACE:
+						r.in = binary.BigEndian.Uint32(v)
+					case IPFIX_IE_EGRESS_INTERFACE:
+						r.out = binary.BigEndian.Uint32(v)
+					case IPFIX_IE_PACKET_DELTA_COUNT:
+						r.packets = binary.BigEndian.Uint64(v)
+					case IPFIX_IE_OCTET_DELTA_COUNT:
+						r.octets = binary.BigEndian.Uint64(v)
+					case IPFIX_IE_FLOW_START_MILLISECONDS:
+						r.start = binary.BigEndian.Uint64(v)
+					case IPFIX_IE_FLOW_END_MILLISECONDS:
+						r.end = binary.BigEndian.Uint64(v)
+					case IPFIX_IE_FLOW_END_REASON:
+						r.reason = v[0]
+					}
+				}
+				msg.records = append(msg.records, r)
+			}
+		default:
+			t.Fatalf("unexpected set id %d", setId)
+		}
+	}
+	return msg
+}
+
+/* 上位層のヘッダとpayloadLen分の0を付けたIPv6パケット */
+func ipfixTestPacket(src, dst in6Addr, nextHdr uint8, upper []byte, payloadLen int) []byte {
+	body := append(append([]byte{}, upper...), make([]byte, payloadLen)...)
+	h := ipv6Header{verTcFl: 0x60000000, payloadLen: uint16(len(body)), nextHdr: nextHdr, hopLimit: 64, srcAddr: src, dstAddr: dst}
+	return append(h.toPacket(), body...)
+}
+
+func TestIpfixExport(t *testing.T) {
+	c := useFakeClock(t)
+	t0 := c.now()
+	collector := ipfixTestCollector(t)
+	port := collector.LocalAddr().(*net.UDPAddr).Port
+
+	ipfixExporter.sequence = 0
+	ipfixExporter.exported, ipfixExporter.messages, ipfixExporter.errors = 0, 0, 0
+	configIpfix("::1", port, 10*time.Second, 3*time.Second)
+	t.Cleanup(unconfigIpfix)
+	if !ipfixExporter.enabled {
+		t.Fatalf("exporter not enabled")
+	}
+
+	inDev := &netDevice{name: "in0", sockAddr: syscall.SockaddrLinklayer{Ifindex: 3}}
+	outDev := &netDevice{name: "out0", sockAddr: syscall.SockaddrLinklayer{Ifindex: 4}}
+	srcA, dstA := parseIpv6("2001:db8:1::2"), parseIpv6("2001:db8:2::2")
+	srcB, dstB := parseIpv6("2001:db8:1::3"), parseIpv6("2001:db8:2::3")
+	udp := []byte{0x03, 0xe8, 0x07, 0xd0, 0, 0, 0, 0} // 1000 -> 2000
+	icmp := []byte{128, 0, 0, 0, 0, 0, 0, 0}          // echo request
+
+	// Aは最初の2パケットだけで、非アクティブタイムアウトで終わる
+	packetA := ipfixTestPacket(srcA, dstA, IPV6_PROTOCOL_NUM_UDP, udp, 12)
+	ipfixCountFlow(inDev, outDev, packetA)
+	ipfixCountFlow(inDev, outDev, append(packetA, 0, 0, 0, 0)) // イーサネットのパディングは数えない
+
+	// Bは毎秒続き、アクティブタイムアウトで区切られる
+	packetB := ipfixTestPacket(srcB, dstB, IPV6_PROTOCOL_NUM_ICMP, icmp, 32)
+	for i := 0; i < 12; i++ {
+		ipfixCountFlow(inDev, nil, packetB)
+		c.advance(time.Second)
+	}
+
+	ms := func(d time.Duration) uint64 { return uint64(t0.Add(d).UnixMilli()) }
+
+	// 最初の走査でテンプレートだけを送る
+	msg := ipfixTestReceive(t, collector, nil)
+	if !reflect.DeepEqual(msg.template, ipfixTemplateFields) {
+		t.Fatalf("template %v, want %v", msg.template, ipfixTemplateFields)
+	}
+	if msg.sequence != 0 || len(msg.records) != 0 || msg.exportTime != uint32(t0.Add(time.Second).Unix()) {
+		t.Fatalf("first message sequence %d, %d records, export time %d", msg.sequence, len(msg.records), msg.exportTime)
+	}
+	template := msg.template
+
+	msg = ipfixTestReceive(t, collector, template)
+	want := []ipfixTestRecord{{
+		src: srcA, dst: dstA, proto: IPV6_PROTOCOL_NUM_UDP, srcPort: 1000, dstPort: 2000, in: 3, out: 4,
+		packets: 2, octets: 2 * 60, start: ms(0), end: ms(0), reason: IPFIX_END_IDLE_TIMEOUT,
+	}}
+	if msg.sequence != 0 || msg.template != nil || !reflect.DeepEqual(msg.records, want) {
+		t.Fatalf("inactive timeout: sequence %d, template %v, records %+v, want %+v", msg.sequence, msg.template, msg.records, want)
+	}
+
+	msg = ipfixTestReceive(t, collector, template)
+	want = []ipfixTestRecord{{
+		src: srcB, dst: dstB, proto: IPV6_PROTOCOL_NUM_ICMP, in: 3,
+		packets: 10, octets: 10 * 80, start: ms(0), end: ms(9 * time.Second), reason: IPFIX_END_ACTIVE_TIMEOUT,
+	}}
+	if msg.sequence != 1 || !reflect.DeepEqual(msg.records, want) {
+		t.Fatalf("active timeout: sequence %d, records %+v, want %+v", msg.sequence, msg.records, want)
+	}
+
+	// 止めるとキャッシュに残っているフローを送る
+	unconfigIpfix()
+	msg = ipfixTestReceive(t, collector, template)
+	want = []ipfixTestRecord{{
+		src: srcB, dst: dstB, proto: IPV6_PROTOCOL_NUM_ICMP, in: 3,
+		packets: 2, octets: 2 * 80, start: ms(10 * time.Second), end: ms(11 * time.Second), reason: IPFIX_END_FORCED,
+	}}
+	if msg.sequence != 2 || !reflect.DeepEqual(msg.records, want) {
+		t.Fatalf("forced end: sequence %d, records %+v, want %+v", msg.sequence, msg.records, want)
+	}
+	if ipfixExporter.exported != 3 || ipfixExporter.messages != 4 || ipfixExporter.errors != 0 {
+		t.Fatalf("exported %d in %d messages with %d errors", ipfixExporter.exported, ipfixExporter.messages, ipfixExporter.errors)
+	}
+}
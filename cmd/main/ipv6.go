@@ -9,6 +9,13 @@ import (
 
 const IPV6_PROTOCOL_NUM_ICMP uint8 = 0x3a
 
+// 拡張ヘッダ
+const IPV6_EXT_HOP_BY_HOP uint8 = 0
+const IPV6_EXT_ROUTING uint8 = 43
+const IPV6_EXT_FRAGMENT uint8 = 44
+const IPV6_EXT_AH uint8 = 51
+const IPV6_EXT_DEST_OPTS uint8 = 60
+
 const ICMPV6_OPTION_SOURCE_LINK_LAYER_ADDRESS uint8 = 1
 const ICMPV6_OPTION_TARGET_LINK_LAYER_ADDRESS uint8 = 2
 
@@ -17,14 +24,30 @@ type ipv6RouteType int
 const (
 	CONNECTED ipv6RouteType = iota
 	NETWORK
+	VRF_LEAK
 )
 
+func (routeType ipv6RouteType) String() string {
+	switch routeType {
+	case CONNECTED:
+		return "connected"
+	case NETWORK:
+		return "network"
+	case VRF_LEAK:
+		return "vrf-leak"
+	}
+	return "unknown"
+}
+
 type in6Addr [16]byte
 
 type ipv6Device struct {
-	address   in6Addr // IPv6アドレス
-	prefixLen uint8   // プレフィックス長(0~128)
-	scope     uint8   // スコープ
+	address       in6Addr   // IPv6アドレス
+	prefixLen     uint8     // プレフィックス長(0~128)
+	scope         uint8     // スコープ
+	linkLocalAddr in6Addr   // リンクローカルアドレス(fe80::/64)
+	mcastGroups   []in6Addr // 参加しているマルチキャストグループ
+	configured    bool      // アドレスを設定して直結経路を入れる
 }
 
 type ipv6Header struct {
@@ -46,8 +69,13 @@ type ipv6PseudoHeader struct {
 
 type ipv6RouteEntry struct {
 	routeType ipv6RouteType
-	dev       *netDevice
+	dev       *netDevice // NETWORKのときはネクストホップがリンクローカルアドレスの場合に出力するインターフェイス
 	nextHop   in6Addr
+	vrf       *vrf // VRF_LEAKのときのリーク先
+	proto     routeProto
+	metric    uint32
+	tag       uint32 // ルートマップで比較や設定をするタグ
+	distance  uint8  // ルートマップで設定した管理距離。0なら情報源の管理距離を使う
 }
 
 func newIpv6(addr in6Addr, prefixLen uint8) *ipv6Device {
@@ -59,11 +87,13 @@ func newIpv6(addr in6Addr, prefixLen uint8) *ipv6Device {
 
 func ipv6Input(netDev *netDevice, buffer []byte) {
 	if netDev.ipv6Dev == nil {
-		fmt.Printf("received ipv6 packet from non ipv6 device %s\n", netDev.name)
+		ipv6Log.Debug("received packet on non ipv6 device", "dev", netDev.name)
+		dropPacket(netDev, DROP_NOT_IPV6_DEVICE, buffer)
 		return
 	}
 	if len(buffer) < 40 {
-		fmt.Printf("received ipv6 packet too short from %s\n", netDev.name)
+		ipv6Log.Debug("packet too short", "dev", netDev.name, "len", len(buffer))
+		dropPacket(netDev, DROP_IPV6_TOO_SHORT, buffer)
 		return
 	}
 
@@ -78,62 +108,129 @@ func ipv6Input(netDev *netDevice, buffer []byte) {
 
 	version := (ipv6header.verTcFl >> 28) & 0x0F
 	if version != 6 {
-		fmt.Printf("ip header version is %d\n", version)
+		ipv6Log.Debug("invalid ip version", "dev", netDev.name, "version", version)
+		dropPacket(netDev, DROP_IPV6_BAD_VERSION, buffer)
 		return
 	}
 
 	// マルチキャストアドレスの判定
 	if ipv6header.dstAddr[0] == 0xff { // ff00::/8の範囲だったら
-		if reflect.DeepEqual(netDev.ipv6Dev.address[13:16], ipv6header.dstAddr[13:16]) {
-			fmt.Printf("multicast. ip is %s\n", fmtIpStr(ipv6header.dstAddr))
+		if reflect.DeepEqual(netDev.ipv6Dev.address[13:16], ipv6header.dstAddr[13:16]) || ipv6IsJoinedMcast(netDev.ipv6Dev, ipv6header.dstAddr) {
+			ipv6Log.Debug("received multicast", "dev", netDev.name, "dst", ipv6header.dstAddr)
+			if tracedPacket != nil {
+				decision := "multicast, joined group"
+				if !ipv6IsJoinedMcast(netDev.ipv6Dev, ipv6header.dstAddr) {
+					decision = "multicast, low 24 bits match our address"
+				}
+				traceStep(packetTraceStep{node: "ipv6-input", decision: decision})
+			}
 			ipv6InputToOurs(netDev, &ipv6header, buffer[40:])
 			return
 		}
 	}
 
-	// 宛先IPアドレスをルータが持ってるか調べる
+	// 受信したインターフェイスのリンクローカルアドレス宛てか調べる
+	if netDev.ipv6Dev.linkLocalAddr == ipv6header.dstAddr {
+		traceStep(packetTraceStep{node: "ipv6-input", decision: "to our link-local address"})
+		ipv6InputToOurs(netDev, &ipv6header, buffer[40:])
+		return
+	}
+
+	// マスターになっているVRRPの仮想アドレス宛てか調べる
+	if vrrpMasterByAddr(netDev, ipv6header.dstAddr) != nil {
+		traceStep(packetTraceStep{node: "ipv6-input", decision: "to vrrp virtual address"})
+		ipv6InputToOurs(netDev, &ipv6header, buffer[40:])
+		return
+	}
+
+	// 宛先IPアドレスを同じVRFのインターフェイスが持ってるか調べる
 	for _, netDevice := range netDevices {
-		if netDevice.ipv6Dev.address == ipv6header.dstAddr {
-			fmt.Printf("router know ip. device ip is %s\n", fmtIpStr(ipv6header.dstAddr))
+		if netDevice.vrf == netDev.vrf && netDevice.ipv6Dev.address == ipv6header.dstAddr {
+			ipv6Log.Debug("received packet to our address", "dev", netDev.name, "dst", ipv6header.dstAddr)
+			if tracedPacket != nil {
+				traceStep(packetTraceStep{node: "ipv6-input", decision: "to our address on " + netDevice.name})
+			}
 			ipv6InputToOurs(netDev, &ipv6header, buffer[40:])
 			return
 		}
 	}
 
 	// 宛先IPアドレスがルータの持っているIPアドレスでない場合はフォワーディングを行う
-	fmt.Printf("start forwarding!\n")
-	resNode := patriciaTrieSearch(ipv6header.dstAddr)
+	ipv6Log.Debug("forward", "dev", netDev.name, "vrf", netDev.vrf.name, "src", ipv6header.srcAddr, "dst", ipv6header.dstAddr)
+	if tracedPacket != nil {
+		traceStep(packetTraceStep{node: "ipv6-input", decision: "forward in vrf " + netDev.vrf.name})
+	}
+	route, outVrf := policyRouteLookup(netDev, &ipv6header)
 
-	if resNode == nil {
-		fmt.Printf("no route to %s\n", fmtIpStr(ipv6header.dstAddr))
+	if route == nil {
+		ipv6Log.Debug("no route", "vrf", netDev.vrf.name, "dst", ipv6header.dstAddr)
+		dropPacket(netDev, DROP_NO_ROUTE, buffer)
 		return
 	}
+	netDev.stats.forwarded++
+	if ipfixExporter.enabled {
+		ipfixCountFlow(netDev, routeOutDev(outVrf, route), buffer)
+	}
+	if rxFrame != nil && captureStageActive(CAPTURE_FORWARDED) {
+		comment := "forwarded"
+		if outDev := routeOutDev(outVrf, route); outDev != nil {
+			comment += " to " + outDev.name
+		}
+		capture(netDev, CAPTURE_FORWARDED, rxFrame, true, comment)
+	}
 
 	ipv6header.hopLimit--
+	if tracedPacket != nil {
+		traceStep(packetTraceStep{node: "ipv6-forward", decision: fmt.Sprintf("hop limit %d", ipv6header.hopLimit)})
+	}
 
 	outedPacket := ipv6header.toPacket()
 	outedPacket = append(outedPacket, buffer[40:]...)
 
-	switch resNode.route.routeType {
+	switch route.routeType {
 	case CONNECTED:
-		fmt.Printf("forwarding ipv6 packet to host\n")
-		ipv6OutputToHost(resNode.route.dev, ipv6header.dstAddr, ipv6header.srcAddr, outedPacket)
+		ipv6Log.Debug("forward to host", "dev", route.dev.name)
+		ipv6OutputToHost(route.dev, ipv6header.dstAddr, ipv6header.srcAddr, outedPacket)
 	case NETWORK:
-		fmt.Printf("forwarding ipv6 packet to network\n")
-		ipv6OutputToNextHop(resNode.route.nextHop, outedPacket)
+		ipv6Log.Debug("forward to next hop", "nexthop", route.nextHop)
+		ipv6OutputToNextHop(outVrf, route.dev, route.nextHop, outedPacket)
 	}
 }
 
+/* 経路の出力インターフェイス。ネクストホップしかなければNDテーブルで解決できているものを使う */
+func routeOutDev(v *vrf, route *ipv6RouteEntry) *netDevice {
+	if route.dev != nil || route.routeType != NETWORK {
+		return route.dev
+	}
+	if entry := searchNDTableEntry(v, route.nextHop); entry != nil {
+		return entry.dev
+	}
+	return nil
+}
+
 func ipv6InputToOurs(netDev *netDevice, ipv6header *ipv6Header, buffer []byte) {
+	netDev.stats.delivered++
+	if tracedPacket != nil {
+		traceStep(packetTraceStep{node: "ipv6-local", decision: traceProtoName(ipv6header.nextHdr)})
+	}
 	switch ipv6header.nextHdr {
 	case IPV6_PROTOCOL_NUM_ICMP:
 		icmpv6Input(netDev, ipv6header.srcAddr, ipv6header.dstAddr, buffer)
+	case IPV6_PROTOCOL_NUM_UDP:
+		udpInput(netDev, ipv6header, buffer)
+	case IPV6_PROTOCOL_NUM_OSPF:
+		ospfv3Input(netDev, ipv6header, buffer)
+	case IPV6_PROTOCOL_NUM_VRRP:
+		vrrpInput(netDev, ipv6header, buffer)
+	case IPV6_PROTOCOL_NUM_TCP:
+		// TCPはカーネルが処理する
 	default:
-		fmt.Printf("unhandled next header : %d\n", ipv6header.nextHdr)
+		ipv6Log.Debug("unhandled next header", "dev", netDev.name, "nexthdr", ipv6header.nextHdr)
+		dropPacket(netDev, DROP_UNKNOWN_NEXT_HEADER, buffer)
 	}
 }
 
-func ipv6EncapOutput(dstAddr in6Addr, srcAddr in6Addr, buffer []byte, nextHdrNum uint8) {
+func ipv6EncapOutput(v *vrf, dstAddr in6Addr, srcAddr in6Addr, buffer []byte, nextHdrNum uint8) {
 	ipv6header := ipv6Header{
 		verTcFl:    0x60000000,
 		payloadLen: uint16(len(buffer)),
@@ -161,17 +258,59 @@ func ipv6EncapOutput(dstAddr in6Addr, srcAddr in6Addr, buffer []byte, nextHdrNum
 	//	}
 	//}
 
-	resNode := patriciaTrieSearch(dstAddr)
+	resNode, outVrf := vrfRouteLookup(v, dstAddr)
 
 	if resNode != nil && resNode.route != nil {
 		switch resNode.route.routeType {
 		case CONNECTED:
 			ipv6OutputToHost(resNode.route.dev, dstAddr, resNode.route.dev.ipv6Dev.address, packet)
 		case NETWORK:
-			ipv6OutputToNextHop(resNode.route.nextHop, packet)
+			ipv6OutputToNextHop(outVrf, resNode.route.dev, resNode.route.nextHop, packet)
 		}
 	} else {
-		fmt.Printf("not found dst addr in forwarding table. addr is %s\n", fmtIpStr(dstAddr))
+		ipv6Log.Debug("no route", "vrf", v.name, "dst", dstAddr)
+		dropPacket(nil, DROP_NO_ROUTE, packet)
+	}
+}
+
+/*
+ * 拡張ヘッダを読み飛ばし、上位層のプロトコル番号とそのヘッダからのデータを返す。
+ * 先頭でないフラグメントは上位層のヘッダを持たないのでokはfalseになる。
+ */
+func ipv6UpperLayer(packet []byte) (nextHdr uint8, payload []byte, ok bool) {
+	if len(packet) < 40 {
+		return 0, nil, false
+	}
+	nextHdr = packet[6]
+	payload = packet[40:]
+	for {
+		switch nextHdr {
+		case IPV6_EXT_HOP_BY_HOP, IPV6_EXT_ROUTING, IPV6_EXT_DEST_OPTS:
+			if len(payload) < 8 {
+				return 0, nil, false
+			}
+			extLen := (int(payload[1]) + 1) * 8
+			if len(payload) < extLen {
+				return 0, nil, false
+			}
+			nextHdr, payload = payload[0], payload[extLen:]
+		case IPV6_EXT_FRAGMENT:
+			if len(payload) < 8 || byteToUint16(payload[2:4])&0xfff8 != 0 {
+				return 0, nil, false
+			}
+			nextHdr, payload = payload[0], payload[8:]
+		case IPV6_EXT_AH:
+			if len(payload) < 8 {
+				return 0, nil, false
+			}
+			extLen := (int(payload[1]) + 2) * 4
+			if len(payload) < extLen {
+				return 0, nil, false
+			}
+			nextHdr, payload = payload[0], payload[extLen:]
+		default:
+			return nextHdr, payload, true
+		}
 	}
 }
 
@@ -192,31 +331,53 @@ func in6IsInNetwork(address in6Addr, prefix in6Addr, prefixLen int) bool {
  * ipv6ではNS/NAを利用したアドレス解決を利用。NSはARPリクエストに相当し、NAはARPリプライに相当。
  */
 func ipv6OutputToHost(netDev *netDevice, dstAddr in6Addr, srcAddr in6Addr, buffer []byte) {
-	nde := searchNDTableEntry(dstAddr)
+	nde := searchNDTableEntry(netDev.vrf, dstAddr)
+	countNdLookup(nde != nil)
 	if nde == nil { // ARPエントリが無かったら
-		fmt.Printf("trying ipv6 output to host, but no nd record to %s\n", fmtIpStr(dstAddr))
+		ipv6Log.Debug("no nd entry, send ns", "dev", netDev.name, "dst", dstAddr)
+		if tracedPacket != nil {
+			traceStep(packetTraceStep{node: "nd-lookup", decision: "unresolved " + fmtIpStr(dstAddr) + ", send ns", outDev: netDev.name})
+		}
+		dropPacket(netDev, DROP_NO_NEIGHBOR, buffer)
 		sendNsPacket(netDev, dstAddr)
 	} else {
+		if tracedPacket != nil {
+			traceStep(packetTraceStep{node: "nd-lookup", decision: "resolved", neighbor: traceNeighborStr(nde), outDev: nde.dev.name})
+		}
 		// イーサネットでカプセル化して送信
-		fmt.Printf("trying ipv6 output to host, find nd record to %s\n", fmtIpStr(dstAddr))
 		ethernetEncapsulateOutput(nde.dev, nde.macAddr, buffer, ETHER_TYPE_IPV6)
 	}
 }
 
-func ipv6OutputToNextHop(dstAddr in6Addr, buffer []byte) {
-	ndTableEntry := searchNDTableEntry(dstAddr)
+/* netDevが指定されていればネクストホップはそのインターフェイスの先にあるものとしてアドレス解決する */
+func ipv6OutputToNextHop(v *vrf, netDev *netDevice, dstAddr in6Addr, buffer []byte) {
+	ndTableEntry := searchNDTableEntry(v, dstAddr)
+	countNdLookup(ndTableEntry != nil)
 
 	if ndTableEntry == nil {
-		resNode := patriciaTrieSearch(dstAddr)
+		if tracedPacket != nil {
+			traceStep(packetTraceStep{node: "nd-lookup", decision: "unresolved next hop " + fmtIpStr(dstAddr) + ", send ns"})
+		}
+		// アドレス解決を始め、パケットは捨てる。インターフェイスが決まってから1度だけ数える
+		if netDev != nil {
+			dropPacket(netDev, DROP_NO_NEIGHBOR, buffer)
+			sendNsPacket(netDev, dstAddr)
+			return
+		}
 
-		if resNode != nil && resNode.route != nil {
-			if resNode.route.routeType == CONNECTED {
-				sendNsPacket(resNode.route.dev, dstAddr)
-				return
-			}
+		resNode := patriciaTrieSearch(v.fib, dstAddr)
+
+		if resNode != nil && resNode.route != nil && resNode.route.routeType == CONNECTED {
+			dropPacket(resNode.route.dev, DROP_NO_NEIGHBOR, buffer)
+			sendNsPacket(resNode.route.dev, dstAddr)
+			return
 		}
+		dropPacket(nil, DROP_NO_NEIGHBOR, buffer)
 	} else {
-		fmt.Printf("found nd entry to next hop!\n")
+		ipv6Log.Debug("found nd entry of next hop", "nexthop", dstAddr, "mac", logMacAddr(ndTableEntry.macAddr))
+		if tracedPacket != nil {
+			traceStep(packetTraceStep{node: "nd-lookup", decision: "resolved next hop", neighbor: traceNeighborStr(ndTableEntry), outDev: ndTableEntry.dev.name})
+		}
 		ethernetEncapsulateOutput(ndTableEntry.dev, ndTableEntry.macAddr, buffer, ETHER_TYPE_IPV6)
 	}
 }
@@ -239,7 +400,24 @@ func ipv6EncapDevOutput(netDev *netDevice, dstMacAddr [6]uint8, dstAddr in6Addr,
 	ethernetEncapsulateOutput(netDev, dstMacAddr, v6hMybuf, ETHER_TYPE_IPV6)
 }
 
-func ipv6EncapDevMcastOutput(netDev *netDevice, dstAddr in6Addr, buffer []byte, nextHdrNum uint8) {
+/* インターフェイスから送信元アドレスを指定してユニキャストで送信する */
+func ipv6EncapDevUnicastOutput(netDev *netDevice, srcAddr in6Addr, dstAddr in6Addr, buffer []byte, nextHdrNum uint8) {
+	ipv6hdr := ipv6Header{
+		verTcFl:    0x60000000,
+		payloadLen: uint16(len(buffer)),
+		nextHdr:    nextHdrNum,
+		hopLimit:   0xff,
+		srcAddr:    srcAddr,
+		dstAddr:    dstAddr,
+	}
+
+	packet := ipv6hdr.toPacket()
+	packet = append(packet, buffer...)
+
+	ipv6OutputToHost(netDev, dstAddr, srcAddr, packet)
+}
+
+func ipv6EncapDevMcastOutput(netDev *netDevice, srcAddr in6Addr, dstAddr in6Addr, buffer []byte, nextHdrNum uint8) {
 	var v6hMybuf []byte
 
 	ipv6hdr := ipv6Header{
@@ -247,7 +425,7 @@ func ipv6EncapDevMcastOutput(netDev *netDevice, dstAddr in6Addr, buffer []byte,
 		payloadLen: uint16(len(buffer)),
 		nextHdr:    nextHdrNum,
 		hopLimit:   0xff,
-		srcAddr:    netDev.ipv6Dev.address,
+		srcAddr:    srcAddr,
 		dstAddr:    dstAddr,
 	}
 
@@ -255,12 +433,7 @@ func ipv6EncapDevMcastOutput(netDev *netDevice, dstAddr in6Addr, buffer []byte,
 	v6hMybuf = append(v6hMybuf, buffer...)
 
 	// マルチキャストアドレスを指定
-	var dstMacAddr [6]uint8
-	dstMacAddr[0] = 0x33
-	dstMacAddr[1] = 0x33
-	copy(dstMacAddr[2:6], dstAddr[12:16])
-
-	ethernetEncapsulateOutput(netDev, dstMacAddr, v6hMybuf, ETHER_TYPE_IPV6)
+	ethernetEncapsulateOutput(netDev, ipv6McastMac(dstAddr), v6hMybuf, ETHER_TYPE_IPV6)
 }
 
 func (ipv6header ipv6Header) toPacket() []byte {
@@ -288,12 +461,13 @@ func (pHdr ipv6PseudoHeader) toPseudoHeader() []byte {
 	return b.Bytes()
 }
 
-func getIpv6Device(addrs []net.Addr) *in6Addr {
+/* 最初のIPv6アドレスとそのプレフィックス長 */
+func getIpv6Device(addrs []net.Addr) (*in6Addr, uint8) {
 	for _, addr := range addrs {
 
-		ip, _, err := net.ParseCIDR(addr.String())
+		ip, ipNet, err := net.ParseCIDR(addr.String())
 		if err != nil {
-			fmt.Printf("Error parsing address %s: %v\n", addr, err)
+			linkLog.Warn("failed to parse address", "addr", addr, "err", err)
 			continue
 		}
 		// IPv6アドレスの場合のみ処理
@@ -301,11 +475,73 @@ func getIpv6Device(addrs []net.Addr) *in6Addr {
 			ipv6Addr := ip.To16()
 			result := &in6Addr{}
 			copy(result[:], ipv6Addr)
-			return result
+			prefixLen, _ := ipNet.Mask.Size()
+			return result, uint8(prefixLen)
 		}
 	}
 
-	return nil
+	return nil, 0
+}
+
+/* MACアドレスからEUI-64形式のリンクローカルアドレスを作る */
+func in6AddrLinkLocal(macAddr [6]uint8) in6Addr {
+	var addr in6Addr
+	addr[0] = 0xfe
+	addr[1] = 0x80
+	addr[8] = macAddr[0] ^ 0x02
+	addr[9] = macAddr[1]
+	addr[10] = macAddr[2]
+	addr[11] = 0xff
+	addr[12] = 0xfe
+	addr[13] = macAddr[3]
+	addr[14] = macAddr[4]
+	addr[15] = macAddr[5]
+	return addr
+}
+
+/* マルチキャストアドレスに対応するMACアドレス(33:33 + 下位32bit) */
+func ipv6McastMac(addr in6Addr) [6]uint8 {
+	var macAddr [6]uint8
+	macAddr[0] = ETHER_ADDR_IPV6_MCAST_PREFIX[0]
+	macAddr[1] = ETHER_ADDR_IPV6_MCAST_PREFIX[1]
+	copy(macAddr[2:6], addr[12:16])
+	return macAddr
+}
+
+/* 要請ノードマルチキャストアドレス(ff02::1:ff00:0/104 + 下位24bit) */
+func in6AddrSolicitedNode(addr in6Addr) in6Addr {
+	mcastAddr := parseIpv6(IPV6_MULTICAST_ADDRESS)
+	copy(mcastAddr[13:], addr[13:])
+	return mcastAddr
+}
+
+func in6AddrIsLinkLocal(addr in6Addr) bool {
+	return addr[0] == 0xfe && addr[1]&0xc0 == 0x80
+}
+
+func ipv6JoinMcast(ipv6Dev *ipv6Device, group in6Addr) {
+	if ipv6IsJoinedMcast(ipv6Dev, group) {
+		return
+	}
+	ipv6Dev.mcastGroups = append(ipv6Dev.mcastGroups, group)
+}
+
+func ipv6LeaveMcast(ipv6Dev *ipv6Device, group in6Addr) {
+	for i, g := range ipv6Dev.mcastGroups {
+		if g == group {
+			ipv6Dev.mcastGroups = append(ipv6Dev.mcastGroups[:i], ipv6Dev.mcastGroups[i+1:]...)
+			return
+		}
+	}
+}
+
+func ipv6IsJoinedMcast(ipv6Dev *ipv6Device, group in6Addr) bool {
+	for _, g := range ipv6Dev.mcastGroups {
+		if g == group {
+			return true
+		}
+	}
+	return false
 }
 
 func in6AddrSum(addr in6Addr) uint32 {
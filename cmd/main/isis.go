@@ -0,0 +1,770 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * IPv6のIS-IS(ISO 10589, RFC 5308)
+ * IS-ISはIPではなくLLC(802.2)で直接イーサネットに載せる。
+ * インターフェイスと隣接関係、Helloの送受信を扱う。単一のレベル(1か2)で動かす
+ */
+const LLC_SAP_ISIS uint8 = 0xfe
+const LLC_CONTROL_UI uint8 = 0x03
+const LLC_HEADER_LEN = 3
+
+var ISIS_ALL_L1_IS_MAC = [6]uint8{0x01, 0x80, 0xc2, 0x00, 0x00, 0x14}
+var ISIS_ALL_L2_IS_MAC = [6]uint8{0x01, 0x80, 0xc2, 0x00, 0x00, 0x15}
+var ISIS_ALL_IS_MAC = [6]uint8{0x09, 0x00, 0x2b, 0x00, 0x00, 0x05}
+
+const ISIS_IRPD uint8 = 0x83
+const ISIS_VERSION uint8 = 1
+const ISIS_SYSTEM_ID_LEN = 6
+const ISIS_COMMON_HEADER_LEN = 8
+
+// LLCヘッダを除いたイーサネットのペイロードの最大長
+const ISIS_MTU = 1497
+
+const (
+	ISIS_PDU_L1_LAN_HELLO uint8 = 15
+	ISIS_PDU_L2_LAN_HELLO uint8 = 16
+	ISIS_PDU_P2P_HELLO    uint8 = 17
+	ISIS_PDU_L1_LSP       uint8 = 18
+	ISIS_PDU_L2_LSP       uint8 = 20
+	ISIS_PDU_L1_CSNP      uint8 = 24
+	ISIS_PDU_L2_CSNP      uint8 = 25
+	ISIS_PDU_L1_PSNP      uint8 = 26
+	ISIS_PDU_L2_PSNP      uint8 = 27
+)
+
+const (
+	ISIS_TLV_AREA_ADDRESSES    uint8 = 1
+	ISIS_TLV_IS_NEIGHBORS      uint8 = 6
+	ISIS_TLV_PADDING           uint8 = 8
+	ISIS_TLV_LSP_ENTRIES       uint8 = 9
+	ISIS_TLV_EXTENDED_IS_REACH uint8 = 22
+	ISIS_TLV_PROTOCOLS         uint8 = 129
+	ISIS_TLV_IPV6_INTERFACE    uint8 = 232
+	ISIS_TLV_IPV6_REACHABILITY uint8 = 236
+	ISIS_TLV_P2P_THREE_WAY_ADJ uint8 = 240
+	ISIS_NLPID_IPV6            uint8 = 0x8e
+	ISIS_LAN_HELLO_HEADER_LEN        = 27
+	ISIS_P2P_HELLO_HEADER_LEN        = 20
+)
+
+const ISIS_HELLO_INTERVAL = 3 * time.Second
+const ISIS_HOLD_MULTIPLIER = 10
+const ISIS_DEFAULT_PRIORITY uint8 = 64
+const ISIS_DEFAULT_METRIC uint32 = 10
+
+type isisCircuitType int
+
+const (
+	ISIS_CIRCUIT_BROADCAST isisCircuitType = iota
+	ISIS_CIRCUIT_POINT_TO_POINT
+)
+
+type isisAdjState int
+
+const (
+	ISIS_ADJ_INIT isisAdjState = iota
+	ISIS_ADJ_UP
+)
+
+// 3-wayハンドシェイクの状態(RFC 5303)
+const (
+	ISIS_P2P_STATE_UP uint8 = iota
+	ISIS_P2P_STATE_INIT
+	ISIS_P2P_STATE_DOWN
+)
+
+type isisSystemId [ISIS_SYSTEM_ID_LEN]byte
+
+// システムID + 疑似ノードID
+type isisNodeId [ISIS_SYSTEM_ID_LEN + 1]byte
+
+type isisCircuit struct {
+	dev         *netDevice
+	circuitType isisCircuitType
+	metric      uint32
+	priority    uint8
+	circuitId   uint8 // 疑似ノードIDに使う
+	adjs        map[isisSystemId]*isisAdjacency
+	isDis       bool
+	lanId       isisNodeId // DISのシステムID + 疑似ノードID
+
+	srm        map[isisLspId]bool // ポイントツーポイントで確認応答待ちのLSP
+	ssn        map[isisLspId]bool // PSNPで確認応答や要求をするLSP
+	helloTimer *timer
+	csnpTimer  *timer
+	psnpTimer  *timer
+	rxmtTimer  *timer
+}
+
+type isisAdjacency struct {
+	circuit   *isisCircuit
+	systemId  isisSystemId
+	snpa      [6]uint8 // 隣接ルータのMACアドレス
+	state     isisAdjState
+	priority  uint8
+	lanId     isisNodeId
+	addr      in6Addr // 隣接ルータのリンクローカルアドレス
+	holdTimer *timer
+}
+
+var isisSystemIdSelf isisSystemId
+var isisAreaAddrs [][]byte
+var isisLevel = 2
+var isisCircuits []*isisCircuit
+
+/* インターフェイスの"isis"の後ろの設定 */
+type isisInterfaceConfig struct {
+	circuitType isisCircuitType
+	metric      uint32
+}
+
+/* [network point-to-point|broadcast] [metric METRIC] */
+func parseIsisInterfaceConfig(words []string) (*isisInterfaceConfig, error) {
+	usage := fmt.Errorf("usage: isis [network point-to-point|broadcast] [metric METRIC]")
+	if len(words)%2 != 0 {
+		return nil, usage
+	}
+	config := &isisInterfaceConfig{
+		circuitType: ISIS_CIRCUIT_BROADCAST,
+		metric:      ISIS_DEFAULT_METRIC,
+	}
+	for i := 0; i < len(words); i += 2 {
+		switch words[i] {
+		case "network":
+			switch words[i+1] {
+			case "point-to-point":
+				config.circuitType = ISIS_CIRCUIT_POINT_TO_POINT
+			case "broadcast":
+				config.circuitType = ISIS_CIRCUIT_BROADCAST
+			default:
+				return nil, fmt.Errorf("invalid network type %s", words[i+1])
+			}
+		case "metric":
+			// ワイドメトリックは24ビット
+			metric, err := strconv.ParseUint(words[i+1], 10, 24)
+			if err != nil || metric == 0 {
+				return nil, fmt.Errorf("invalid metric %s", words[i+1])
+			}
+			config.metric = uint32(metric)
+		default:
+			return nil, usage
+		}
+	}
+	return config, nil
+}
+
+/* 設定ファイルに書く形。ネットワークタイプとメトリックは省略しない */
+func (config *isisInterfaceConfig) String() string {
+	network := "broadcast"
+	if config.circuitType == ISIS_CIRCUIT_POINT_TO_POINT {
+		network = "point-to-point"
+	}
+	return fmt.Sprintf("network %s metric %d", network, config.metric)
+}
+
+func (state isisAdjState) String() string {
+	return [...]string{"Init", "Up"}[state]
+}
+
+func (id isisSystemId) String() string {
+	h := hex.EncodeToString(id[:])
+	return h[0:4] + "." + h[4:8] + "." + h[8:12]
+}
+
+func (id isisNodeId) String() string {
+	return fmt.Sprintf("%s.%02x", isisSystemId(id[:ISIS_SYSTEM_ID_LEN]), id[ISIS_SYSTEM_ID_LEN])
+}
+
+/* NETをエリアアドレスとシステムIDに分ける。NSELは0でなければならない */
+func parseIsisNet(net string) ([]byte, isisSystemId, error) {
+	var systemId isisSystemId
+	b, err := hex.DecodeString(strings.ReplaceAll(net, ".", ""))
+	if err != nil || len(b) < ISIS_SYSTEM_ID_LEN+2 || b[len(b)-1] != 0 {
+		return nil, systemId, fmt.Errorf("invalid isis net %s", net)
+	}
+	copy(systemId[:], b[len(b)-7:len(b)-1])
+	return b[:len(b)-7], systemId, nil
+}
+
+/*
+ * IS-ISを有効にする。netはNET(例: 49.0001.1921.6800.1001.00)で、エリアアドレスとシステムIDを含む。
+ */
+func configIsis(net string, level int) {
+	area, systemId, err := parseIsisNet(net)
+	if err != nil {
+		configLog.Warn("invalid isis net", "net", net)
+		return
+	}
+	if level != 1 && level != 2 {
+		configLog.Warn("invalid isis level", "level", level)
+		return
+	}
+
+	isisSystemIdSelf = systemId
+	isisAreaAddrs = [][]byte{area}
+	isisLevel = level
+	configLog.Info("configure isis", "systemId", isisSystemIdSelf.String(), "level", level)
+
+	isisStartAging()
+}
+
+func configIsisInterface(netDev *netDevice, circuitType isisCircuitType, metric uint32) {
+	if netDev == nil {
+		isisLog.Warn("net device to configure not found")
+		return
+	}
+	if isisSystemIdSelf == (isisSystemId{}) {
+		configLog.Warn("isis is not configured")
+		return
+	}
+
+	circuit := &isisCircuit{
+		dev:         netDev,
+		circuitType: circuitType,
+		metric:      metric,
+		priority:    ISIS_DEFAULT_PRIORITY,
+		circuitId:   isisNewCircuitId(),
+		adjs:        make(map[isisSystemId]*isisAdjacency),
+		srm:         make(map[isisLspId]bool),
+		ssn:         make(map[isisLspId]bool),
+	}
+	isisCircuits = append(isisCircuits, circuit)
+
+	netDev.addMacMembership(ISIS_ALL_L1_IS_MAC)
+	netDev.addMacMembership(ISIS_ALL_L2_IS_MAC)
+	netDev.addMacMembership(ISIS_ALL_IS_MAC)
+	configLog.Info("configure isis", "dev", netDev.name)
+
+	circuit.helloTimer = newTimer(0, func() {
+		isisSendHello(circuit)
+		circuit.helloTimer.reset(ISIS_HELLO_INTERVAL)
+	})
+	if circuitType == ISIS_CIRCUIT_BROADCAST {
+		isisElectDis(circuit)
+	}
+	isisScheduleOriginate()
+}
+
+/* 疑似ノードIDに使う、他のサーキットが使っていない一番小さい番号 */
+func isisNewCircuitId() uint8 {
+	for id := uint8(1); ; id++ {
+		if !slices.ContainsFunc(isisCircuits, func(c *isisCircuit) bool { return c.circuitId == id }) {
+			return id
+		}
+	}
+}
+
+/* サーキットを消す。隣接を載せないHelloを送って相手にすぐ隣接を落とさせる */
+func unconfigIsisInterface(netDev *netDevice) {
+	circuit := getIsisCircuit(netDev)
+	if circuit == nil {
+		return
+	}
+
+	circuit.helloTimer.stop()
+	circuit.csnpTimer.stop()
+	circuit.psnpTimer.stop()
+	circuit.rxmtTimer.stop()
+	for _, adj := range circuit.adjs {
+		adj.holdTimer.stop()
+	}
+	circuit.adjs = make(map[isisSystemId]*isisAdjacency)
+	isisSendHello(circuit)
+
+	for i := range isisCircuits {
+		if isisCircuits[i] == circuit {
+			isisCircuits = append(isisCircuits[:i], isisCircuits[i+1:]...)
+			break
+		}
+	}
+	netDev.dropMacMembership(ISIS_ALL_L1_IS_MAC)
+	netDev.dropMacMembership(ISIS_ALL_L2_IS_MAC)
+	netDev.dropMacMembership(ISIS_ALL_IS_MAC)
+	configLog.Info("unconfigure isis", "dev", netDev.name)
+
+	isisScheduleOriginate()
+	isisScheduleSpf()
+}
+
+/*
+ * NETやレベルを変えるときや設定を消すときにIS-ISを全て止める。
+ * 自分のLSPをパージしてからサーキットを消し、LSDBと学習した経路を捨てる。
+ */
+func unconfigIsis() {
+	for _, lsp := range isisLsdb {
+		if lsp.id.isOwn() && lsp.currentLifetime() != 0 {
+			isisPurge(lsp)
+		}
+	}
+	for len(isisCircuits) > 0 {
+		unconfigIsisInterface(isisCircuits[0].dev)
+	}
+
+	isisOriginateTimer.stop()
+	isisSpfTimer.stop()
+	isisAgingTimer.stop()
+	isisAgingTimer = nil
+	isisLsdb = map[isisLspId]*isisLsp{}
+	isisInstallRoutes(map[ribKey]*isisRoute{})
+
+	isisSystemIdSelf = isisSystemId{}
+	isisAreaAddrs = nil
+	isisLevel = 2
+	configLog.Info("unconfigure isis")
+}
+
+func getIsisCircuit(netDev *netDevice) *isisCircuit {
+	for _, circuit := range isisCircuits {
+		if circuit.dev == netDev {
+			return circuit
+		}
+	}
+	return nil
+}
+
+func isisIsMcastMac(macAddr [6]uint8) bool {
+	return macAddr == ISIS_ALL_L1_IS_MAC || macAddr == ISIS_ALL_L2_IS_MAC || macAddr == ISIS_ALL_IS_MAC
+}
+
+func isisLevelMac() [6]uint8 {
+	if isisLevel == 1 {
+		return ISIS_ALL_L1_IS_MAC
+	}
+	return ISIS_ALL_L2_IS_MAC
+}
+
+func isisPduType(l1 uint8, l2 uint8) uint8 {
+	if isisLevel == 1 {
+		return l1
+	}
+	return l2
+}
+
+/* IS-ISのPDUの受信処理。bufferはLLCヘッダを除いたもの */
+func isisInput(netDev *netDevice, buffer []byte) {
+	circuit := getIsisCircuit(netDev)
+	if circuit == nil {
+		return
+	}
+	if len(buffer) < ISIS_COMMON_HEADER_LEN {
+		isisLog.Debug("received pdu is too short", "dev", netDev.name, "size", len(buffer))
+		return
+	}
+	if buffer[0] != ISIS_IRPD || buffer[2] != 1 || buffer[5] != ISIS_VERSION || (buffer[3] != 0 && buffer[3] != ISIS_SYSTEM_ID_LEN) {
+		isisLog.Debug("invalid common header", "dev", netDev.name)
+		return
+	}
+	// 最大エリアアドレス数は0(=3)か3しか扱わない
+	if buffer[7] != 0 && buffer[7] != 3 {
+		return
+	}
+
+	pduType := buffer[4] & 0x1f
+	switch pduType {
+	case ISIS_PDU_L1_LAN_HELLO, ISIS_PDU_L2_LAN_HELLO:
+		if pduType != isisPduType(ISIS_PDU_L1_LAN_HELLO, ISIS_PDU_L2_LAN_HELLO) || circuit.circuitType != ISIS_CIRCUIT_BROADCAST {
+			return
+		}
+		isisLanHelloInput(circuit, buffer)
+	case ISIS_PDU_P2P_HELLO:
+		if circuit.circuitType != ISIS_CIRCUIT_POINT_TO_POINT {
+			return
+		}
+		isisP2pHelloInput(circuit, buffer)
+	case ISIS_PDU_L1_LSP, ISIS_PDU_L2_LSP:
+		if pduType == isisPduType(ISIS_PDU_L1_LSP, ISIS_PDU_L2_LSP) {
+			isisLspInput(circuit, buffer)
+		}
+	case ISIS_PDU_L1_CSNP, ISIS_PDU_L2_CSNP:
+		if pduType == isisPduType(ISIS_PDU_L1_CSNP, ISIS_PDU_L2_CSNP) {
+			isisCsnpInput(circuit, buffer)
+		}
+	case ISIS_PDU_L1_PSNP, ISIS_PDU_L2_PSNP:
+		if pduType == isisPduType(ISIS_PDU_L1_PSNP, ISIS_PDU_L2_PSNP) {
+			isisPsnpInput(circuit, buffer)
+		}
+	default:
+		isisLog.Debug("unknown pdu type", "dev", netDev.name, "type", pduType)
+	}
+}
+
+/* TLVを順に取り出す。壊れていればfalse */
+func isisWalkTlvs(buffer []byte, fn func(tlvType uint8, value []byte)) bool {
+	for len(buffer) > 0 {
+		if len(buffer) < 2 || len(buffer) < 2+int(buffer[1]) {
+			return false
+		}
+		fn(buffer[0], buffer[2:2+int(buffer[1])])
+		buffer = buffer[2+int(buffer[1]):]
+	}
+	return true
+}
+
+func isisTlv(tlvType uint8, value []byte) []byte {
+	return append([]byte{tlvType, uint8(len(value))}, value...)
+}
+
+/* 値を255byteごとに分けて複数のTLVにする。entryLenは1エントリの長さ */
+func isisTlvs(tlvType uint8, entries []byte, entryLen int) []byte {
+	var b []byte
+	maxLen := 255 / entryLen * entryLen
+	for len(entries) > 0 {
+		n := len(entries)
+		if n > maxLen {
+			n = maxLen
+		}
+		b = append(b, isisTlv(tlvType, entries[:n])...)
+		entries = entries[n:]
+	}
+	return b
+}
+
+func isisAreaAddrsTlv() []byte {
+	var value []byte
+	for _, area := range isisAreaAddrs {
+		value = append(value, uint8(len(area)))
+		value = append(value, area...)
+	}
+	return isisTlv(ISIS_TLV_AREA_ADDRESSES, value)
+}
+
+/* 相手のエリアアドレスに自分のものが含まれるか */
+func isisAreaMatch(value []byte) bool {
+	for len(value) > 0 {
+		n := int(value[0])
+		if len(value) < 1+n {
+			return false
+		}
+		for _, area := range isisAreaAddrs {
+			if bytes.Equal(area, value[1:1+n]) {
+				return true
+			}
+		}
+		value = value[1+n:]
+	}
+	return false
+}
+
+func isisCommonHeader(pduType uint8, headerLen int) []byte {
+	return []byte{ISIS_IRPD, uint8(headerLen), 1, 0, pduType, ISIS_VERSION, 0, 0}
+}
+
+/* HelloをMTUまでパディングする(ISO 10589 8.2.3) */
+func isisPad(pdu []byte) []byte {
+	for len(pdu)+2 <= ISIS_MTU {
+		n := ISIS_MTU - len(pdu) - 2
+		if n > 255 {
+			n = 255
+		}
+		pdu = append(pdu, isisTlv(ISIS_TLV_PADDING, make([]byte, n))...)
+	}
+	return pdu
+}
+
+/*
+ * 停止するときは隣接を載せないHelloを送り、相手にすぐ隣接を落とさせる。
+ * ポイントツーポイントでは3-wayの状態がDownになる。
+ */
+func isisShutdown() {
+	for _, circuit := range isisCircuits {
+		circuit.helloTimer.stop()
+		circuit.csnpTimer.stop()
+		circuit.psnpTimer.stop()
+		circuit.rxmtTimer.stop()
+		for _, adj := range circuit.adjs {
+			adj.holdTimer.stop()
+		}
+		circuit.adjs = make(map[isisSystemId]*isisAdjacency)
+		isisSendHello(circuit)
+	}
+}
+
+func isisSendHello(circuit *isisCircuit) {
+	holdTime := uint16(ISIS_HELLO_INTERVAL / time.Second * ISIS_HOLD_MULTIPLIER)
+
+	var pdu []byte
+	if circuit.circuitType == ISIS_CIRCUIT_BROADCAST {
+		pdu = isisCommonHeader(isisPduType(ISIS_PDU_L1_LAN_HELLO, ISIS_PDU_L2_LAN_HELLO), ISIS_LAN_HELLO_HEADER_LEN)
+		pdu = append(pdu, uint8(isisLevel))
+		pdu = append(pdu, isisSystemIdSelf[:]...)
+		pdu = append(pdu, uint16ToByte(holdTime)...)
+		pdu = append(pdu, 0, 0) // PDU長は後で入れる
+		pdu = append(pdu, circuit.priority)
+		pdu = append(pdu, circuit.lanId[:]...)
+	} else {
+		pdu = isisCommonHeader(ISIS_PDU_P2P_HELLO, ISIS_P2P_HELLO_HEADER_LEN)
+		pdu = append(pdu, uint8(isisLevel))
+		pdu = append(pdu, isisSystemIdSelf[:]...)
+		pdu = append(pdu, uint16ToByte(holdTime)...)
+		pdu = append(pdu, 0, 0)
+		pdu = append(pdu, circuit.circuitId)
+	}
+
+	pdu = append(pdu, isisAreaAddrsTlv()...)
+	pdu = append(pdu, isisTlv(ISIS_TLV_PROTOCOLS, []byte{ISIS_NLPID_IPV6})...)
+	pdu = append(pdu, isisTlv(ISIS_TLV_IPV6_INTERFACE, circuit.dev.ipv6Dev.linkLocalAddr[:])...)
+
+	if circuit.circuitType == ISIS_CIRCUIT_BROADCAST {
+		var snpas []byte
+		for _, adj := range circuit.adjs {
+			snpas = append(snpas, adj.snpa[:]...)
+		}
+		if len(snpas) > 0 {
+			pdu = append(pdu, isisTlvs(ISIS_TLV_IS_NEIGHBORS, snpas, 6)...)
+		}
+	} else {
+		// 3-wayハンドシェイク(RFC 5303)
+		value := []byte{ISIS_P2P_STATE_DOWN}
+		value = append(value, uint32ToByte(uint32(circuit.circuitId))...)
+		for _, adj := range circuit.adjs {
+			value[0] = ISIS_P2P_STATE_INIT
+			if adj.state == ISIS_ADJ_UP {
+				value[0] = ISIS_P2P_STATE_UP
+			}
+			value = append(value, adj.systemId[:]...)
+			value = append(value, uint32ToByte(uint32(adj.lanId[ISIS_SYSTEM_ID_LEN]))...)
+		}
+		pdu = append(pdu, isisTlv(ISIS_TLV_P2P_THREE_WAY_ADJ, value)...)
+	}
+
+	pdu = isisPad(pdu)
+	copy(pdu[17:19], uint16ToByte(uint16(len(pdu))))
+
+	dstMac := isisLevelMac()
+	if circuit.circuitType == ISIS_CIRCUIT_POINT_TO_POINT {
+		dstMac = ISIS_ALL_IS_MAC
+	}
+	ethernetLlcOutput(circuit.dev, dstMac, LLC_SAP_ISIS, pdu)
+}
+
+/* PDUを送る。ブロードキャストではレベルのマルチキャストアドレス宛てにする */
+func isisSendPdu(circuit *isisCircuit, pdu []byte) {
+	dstMac := isisLevelMac()
+	if circuit.circuitType == ISIS_CIRCUIT_POINT_TO_POINT {
+		dstMac = ISIS_ALL_IS_MAC
+	}
+	ethernetLlcOutput(circuit.dev, dstMac, LLC_SAP_ISIS, pdu)
+}
+
+/* Helloに共通するTLVの処理。エリアが合わなければfalse */
+func isisHelloTlvs(adjAddr *in6Addr, tlvs []byte, onTlv func(tlvType uint8, value []byte)) bool {
+	areaOk := isisLevel == 2
+	ipv6 := false
+	ok := isisWalkTlvs(tlvs, func(tlvType uint8, value []byte) {
+		switch tlvType {
+		case ISIS_TLV_AREA_ADDRESSES:
+			if isisAreaMatch(value) {
+				areaOk = true
+			}
+		case ISIS_TLV_PROTOCOLS:
+			ipv6 = bytes.IndexByte(value, ISIS_NLPID_IPV6) >= 0
+		case ISIS_TLV_IPV6_INTERFACE:
+			for i := 0; i+16 <= len(value); i += 16 {
+				if in6AddrIsLinkLocal(in6Addr(value[i : i+16])) {
+					*adjAddr = in6Addr(value[i : i+16])
+				}
+			}
+		default:
+			onTlv(tlvType, value)
+		}
+	})
+	return ok && areaOk && ipv6
+}
+
+func isisLanHelloInput(circuit *isisCircuit, buffer []byte) {
+	if len(buffer) < ISIS_LAN_HELLO_HEADER_LEN {
+		return
+	}
+	systemId := isisSystemId(buffer[9:15])
+	holdTime := time.Duration(byteToUint16(buffer[15:17])) * time.Second
+	pduLen := int(byteToUint16(buffer[17:19]))
+	priority := buffer[19] & 0x7f
+	lanId := isisNodeId(buffer[20:27])
+	if systemId == isisSystemIdSelf || pduLen > len(buffer) || pduLen < ISIS_LAN_HELLO_HEADER_LEN {
+		return
+	}
+
+	var addr in6Addr
+	seesUs := false
+	ok := isisHelloTlvs(&addr, buffer[ISIS_LAN_HELLO_HEADER_LEN:pduLen], func(tlvType uint8, value []byte) {
+		if tlvType != ISIS_TLV_IS_NEIGHBORS {
+			return
+		}
+		for i := 0; i+6 <= len(value); i += 6 {
+			if [6]uint8(value[i:i+6]) == circuit.dev.macAddr {
+				seesUs = true
+			}
+		}
+	})
+	if !ok || addr == (in6Addr{}) {
+		return
+	}
+
+	adj := isisGetAdjacency(circuit, systemId)
+	adj.snpa = circuit.dev.ethHeader.srcAddr
+	adj.addr = addr
+	changed := adj.priority != priority || adj.lanId != lanId
+	adj.priority = priority
+	adj.lanId = lanId
+	isisRestartHoldTimer(adj, holdTime)
+
+	// 隣接ルータへの転送のためにHelloの送信元からNDテーブルを更新しておく
+	updateNDTableEntry(circuit.dev, adj.snpa, addr)
+
+	if seesUs && adj.state != ISIS_ADJ_UP {
+		isisSetAdjState(adj, ISIS_ADJ_UP)
+		changed = true
+	} else if !seesUs && adj.state == ISIS_ADJ_UP {
+		isisSetAdjState(adj, ISIS_ADJ_INIT)
+		changed = true
+	}
+
+	if changed {
+		isisElectDis(circuit)
+	}
+}
+
+func isisP2pHelloInput(circuit *isisCircuit, buffer []byte) {
+	if len(buffer) < ISIS_P2P_HELLO_HEADER_LEN {
+		return
+	}
+	systemId := isisSystemId(buffer[9:15])
+	holdTime := time.Duration(byteToUint16(buffer[15:17])) * time.Second
+	pduLen := int(byteToUint16(buffer[17:19]))
+	localCircuitId := buffer[19]
+	if systemId == isisSystemIdSelf || pduLen > len(buffer) || pduLen < ISIS_P2P_HELLO_HEADER_LEN {
+		return
+	}
+
+	var addr in6Addr
+	threeWay := false
+	seesUs := false
+	ok := isisHelloTlvs(&addr, buffer[ISIS_P2P_HELLO_HEADER_LEN:pduLen], func(tlvType uint8, value []byte) {
+		if tlvType != ISIS_TLV_P2P_THREE_WAY_ADJ || len(value) < 1 {
+			return
+		}
+		threeWay = true
+		if len(value) >= 11 && isisSystemId(value[5:11]) == isisSystemIdSelf {
+			seesUs = true
+		}
+	})
+	if !ok || addr == (in6Addr{}) {
+		return
+	}
+
+	// ポイントツーポイントの隣接ルータは1つだけ
+	for id, other := range circuit.adjs {
+		if id != systemId {
+			isisDeleteAdjacency(other)
+		}
+	}
+
+	adj := isisGetAdjacency(circuit, systemId)
+	adj.snpa = circuit.dev.ethHeader.srcAddr
+	adj.addr = addr
+	adj.lanId = isisNodeId{}
+	adj.lanId[ISIS_SYSTEM_ID_LEN] = localCircuitId
+	isisRestartHoldTimer(adj, holdTime)
+	updateNDTableEntry(circuit.dev, adj.snpa, addr)
+
+	// 3-way TLVがなければ従来の2-wayで上げる
+	if (!threeWay || seesUs) && adj.state != ISIS_ADJ_UP {
+		isisSetAdjState(adj, ISIS_ADJ_UP)
+		// 隣接関係が上がったらCSNPでLSDBを同期する
+		isisSendCsnp(circuit)
+	} else if threeWay && !seesUs && adj.state == ISIS_ADJ_UP {
+		isisSetAdjState(adj, ISIS_ADJ_INIT)
+	}
+}
+
+func isisGetAdjacency(circuit *isisCircuit, systemId isisSystemId) *isisAdjacency {
+	adj := circuit.adjs[systemId]
+	if adj == nil {
+		adj = &isisAdjacency{circuit: circuit, systemId: systemId, state: ISIS_ADJ_INIT}
+		circuit.adjs[systemId] = adj
+		isisLog.Info("new adjacency", "systemId", systemId.String(), "dev", circuit.dev.name)
+	}
+	return adj
+}
+
+func isisRestartHoldTimer(adj *isisAdjacency, holdTime time.Duration) {
+	if adj.holdTimer == nil {
+		adj.holdTimer = newTimer(holdTime, func() {
+			isisLog.Info("adjacency hold timer expired", "systemId", adj.systemId.String(), "dev", adj.circuit.dev.name)
+			isisDeleteAdjacency(adj)
+		})
+	} else {
+		adj.holdTimer.reset(holdTime)
+	}
+}
+
+func isisSetAdjState(adj *isisAdjacency, state isisAdjState) {
+	isisLog.Info("adjacency state changed", "systemId", adj.systemId.String(), "dev", adj.circuit.dev.name, "prev", adj.state.String(), "state", state.String())
+	adj.state = state
+	isisScheduleOriginate()
+	isisScheduleSpf()
+}
+
+func isisDeleteAdjacency(adj *isisAdjacency) {
+	circuit := adj.circuit
+	adj.holdTimer.stop()
+	delete(circuit.adjs, adj.systemId)
+	isisLog.Info("adjacency deleted", "systemId", adj.systemId.String(), "dev", circuit.dev.name)
+
+	if circuit.circuitType == ISIS_CIRCUIT_BROADCAST {
+		isisElectDis(circuit)
+	} else {
+		circuit.srm = make(map[isisLspId]bool)
+	}
+	isisScheduleOriginate()
+	isisScheduleSpf()
+}
+
+/*
+ * DISの選出(ISO 10589 8.4.5)。優先度が高く、同じならMACアドレスが大きいものがDISになる
+ */
+func isisElectDis(circuit *isisCircuit) {
+	disPriority := circuit.priority
+	disMac := circuit.dev.macAddr
+	lanId := isisNodeId{}
+	copy(lanId[:], isisSystemIdSelf[:])
+	lanId[ISIS_SYSTEM_ID_LEN] = circuit.circuitId
+	isDis := true
+
+	for _, adj := range circuit.adjs {
+		if adj.state != ISIS_ADJ_UP {
+			continue
+		}
+		if adj.priority > disPriority || (adj.priority == disPriority && bytes.Compare(adj.snpa[:], disMac[:]) > 0) {
+			disPriority = adj.priority
+			disMac = adj.snpa
+			lanId = adj.lanId
+			isDis = false
+		}
+	}
+
+	if circuit.isDis == isDis && circuit.lanId == lanId {
+		return
+	}
+	isisLog.Info("dis elected", "dev", circuit.dev.name, "lanId", lanId.String())
+	circuit.isDis = isDis
+	circuit.lanId = lanId
+
+	circuit.csnpTimer.stop()
+	if isDis {
+		circuit.csnpTimer = newTimer(ISIS_CSNP_INTERVAL, func() { isisCsnpTimerExpired(circuit) })
+	}
+	isisScheduleOriginate()
+	isisScheduleSpf()
+}
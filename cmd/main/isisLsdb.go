@@ -0,0 +1,689 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"time"
+)
+
+/**
+ * IS-ISのLSPデータベースとフラッディング、CSNP/PSNPによる同期(ISO 10589 7.3.15, 7.3.16)
+ */
+const ISIS_LSP_HEADER_LEN = 27
+const ISIS_CSNP_HEADER_LEN = 33
+const ISIS_PSNP_HEADER_LEN = 17
+const ISIS_LSP_ENTRY_LEN = 16
+
+const ISIS_MAX_LIFETIME uint16 = 1200
+const ISIS_REFRESH_INTERVAL uint16 = 900
+const ISIS_ZERO_AGE_LIFETIME = 60 * time.Second
+
+const ISIS_CSNP_INTERVAL = 10 * time.Second
+const ISIS_PSNP_DELAY = 500 * time.Millisecond
+const ISIS_LSP_RXMT_INTERVAL = 5 * time.Second
+const ISIS_AGING_INTERVAL = 5 * time.Second
+
+const ISIS_LSP_IS_TYPE_L1 uint8 = 0x01
+const ISIS_LSP_IS_TYPE_L2 uint8 = 0x03
+
+// システムID + 疑似ノードID + フラグメント番号
+type isisLspId [ISIS_SYSTEM_ID_LEN + 2]byte
+
+type isisLsp struct {
+	id        isisLspId
+	seq       uint32
+	checksum  uint16
+	lifetime  uint16 // 受信したときの残り寿命
+	installed time.Time
+	raw       []byte // 共通ヘッダからのPDU
+}
+
+var isisLsdb = map[isisLspId]*isisLsp{}
+
+var isisOriginateTimer *timer
+var isisAgingTimer *timer
+
+func (id isisLspId) String() string {
+	return fmt.Sprintf("%s-%02x", isisNodeId(id[:ISIS_SYSTEM_ID_LEN+1]), id[ISIS_SYSTEM_ID_LEN+1])
+}
+
+func (id isisLspId) nodeId() isisNodeId {
+	return isisNodeId(id[:ISIS_SYSTEM_ID_LEN+1])
+}
+
+func (id isisLspId) isOwn() bool {
+	return isisSystemId(id[:ISIS_SYSTEM_ID_LEN]) == isisSystemIdSelf
+}
+
+/* 現在の残り寿命 */
+func (lsp *isisLsp) currentLifetime() uint16 {
+	elapsed := uint16(timerClock.now().Sub(lsp.installed) / time.Second)
+	if elapsed >= lsp.lifetime {
+		return 0
+	}
+	return lsp.lifetime - elapsed
+}
+
+func (lsp *isisLsp) tlvs() []byte {
+	return lsp.raw[ISIS_LSP_HEADER_LEN:]
+}
+
+/* 残り寿命を今の値にしたPDU。残り寿命はチェックサムの対象外 */
+func (lsp *isisLsp) toPacket() []byte {
+	pdu := append([]byte{}, lsp.raw...)
+	copy(pdu[10:12], uint16ToByte(lsp.currentLifetime()))
+	return pdu
+}
+
+func (lsp *isisLsp) entry() []byte {
+	var b bytes.Buffer
+	b.Write(uint16ToByte(lsp.currentLifetime()))
+	b.Write(lsp.id[:])
+	b.Write(uint32ToByte(lsp.seq))
+	b.Write(uint16ToByte(lsp.checksum))
+	return b.Bytes()
+}
+
+/* aの方が新しければ正、古ければ負を返す(ISO 10589 7.3.16) */
+func isisLspCompare(seqA uint32, lifetimeA uint16, seqB uint32, lifetimeB uint16) int {
+	if seqA != seqB {
+		if seqA > seqB {
+			return 1
+		}
+		return -1
+	}
+	// 同じシーケンス番号なら寿命が0のもの(パージ)を新しいとみなす
+	if (lifetimeA == 0) != (lifetimeB == 0) {
+		if lifetimeA == 0 {
+			return 1
+		}
+		return -1
+	}
+	return 0
+}
+
+/* 受信したPDUの送信元が隣接関係がUpの隣接ルータか */
+func isisAdjacencyUp(circuit *isisCircuit) bool {
+	for _, adj := range circuit.adjs {
+		if adj.state != ISIS_ADJ_UP {
+			continue
+		}
+		if circuit.circuitType == ISIS_CIRCUIT_POINT_TO_POINT || adj.snpa == circuit.dev.ethHeader.srcAddr {
+			return true
+		}
+	}
+	return false
+}
+
+func isisHasUpAdjacency(circuit *isisCircuit) bool {
+	for _, adj := range circuit.adjs {
+		if adj.state == ISIS_ADJ_UP {
+			return true
+		}
+	}
+	return false
+}
+
+func isisLspInput(circuit *isisCircuit, buffer []byte) {
+	if len(buffer) < ISIS_LSP_HEADER_LEN {
+		return
+	}
+	pduLen := int(byteToUint16(buffer[8:10]))
+	if pduLen > len(buffer) || pduLen < ISIS_LSP_HEADER_LEN {
+		isisLog.Debug("invalid lsp length", "length", pduLen)
+		return
+	}
+	buffer = buffer[:pduLen]
+	if !isisAdjacencyUp(circuit) {
+		return
+	}
+
+	lifetime := byteToUint16(buffer[10:12])
+	id := isisLspId(buffer[12:20])
+	seq := byteToUint32(buffer[20:24])
+	checksum := byteToUint16(buffer[24:26])
+	if lifetime != 0 && !fletcherChecksumValid(buffer[12:]) {
+		isisLog.Debug("invalid lsp checksum", "lspId", id.String())
+		return
+	}
+
+	current := isisLsdb[id]
+	cmp := 1
+	if current != nil {
+		cmp = isisLspCompare(seq, lifetime, current.seq, current.currentLifetime())
+	}
+
+	// 自分のLSPより新しいものを受け取ったらシーケンス番号を上げて生成し直すかパージする
+	if id.isOwn() && cmp > 0 {
+		isisSetSsn(circuit, id)
+		if current != nil && current.currentLifetime() != 0 {
+			current.seq = seq
+			isisOriginate(id, current.tlvs(), true)
+		} else {
+			isisPurge(&isisLsp{id: id, seq: seq})
+		}
+		return
+	}
+
+	switch {
+	case cmp > 0:
+		// 持っていないLSPのパージは確認応答だけ返す
+		if current == nil && lifetime == 0 {
+			isisSetSsn(circuit, id)
+			return
+		}
+		lsp := &isisLsp{
+			id:        id,
+			seq:       seq,
+			checksum:  checksum,
+			lifetime:  lifetime,
+			installed: timerClock.now(),
+			raw:       append([]byte{}, buffer...),
+		}
+		isisLog.Debug("received lsp", "lspId", id.String(), "seq", seq, "lifetime", lifetime)
+		isisInstallLsp(lsp)
+		isisFlood(lsp, circuit)
+		delete(circuit.srm, id)
+		isisSetSsn(circuit, id)
+	case cmp == 0:
+		delete(circuit.srm, id)
+		isisSetSsn(circuit, id)
+	default:
+		// 自分の方が新しいので送り返す
+		isisSendLsp(circuit, current)
+	}
+}
+
+func isisInstallLsp(lsp *isisLsp) {
+	old := isisLsdb[lsp.id]
+	isisLsdb[lsp.id] = lsp
+
+	if old == nil || !bytes.Equal(old.tlvs(), lsp.tlvs()) || (old.currentLifetime() == 0) != (lsp.currentLifetime() == 0) {
+		isisScheduleSpf()
+	}
+}
+
+/* LSPをfrom以外の隣接ルータがいるサーキットに送る */
+func isisFlood(lsp *isisLsp, from *isisCircuit) {
+	for _, circuit := range isisCircuits {
+		if circuit == from || !isisHasUpAdjacency(circuit) {
+			continue
+		}
+		isisSendLsp(circuit, lsp)
+	}
+}
+
+/* ポイントツーポイントでは確認応答があるまで再送する */
+func isisSendLsp(circuit *isisCircuit, lsp *isisLsp) {
+	if circuit.circuitType == ISIS_CIRCUIT_POINT_TO_POINT {
+		circuit.srm[lsp.id] = true
+		if circuit.rxmtTimer == nil || !circuit.rxmtTimer.active {
+			circuit.rxmtTimer = newTimer(ISIS_LSP_RXMT_INTERVAL, func() { isisRetransmit(circuit) })
+		}
+	}
+	isisSendPdu(circuit, lsp.toPacket())
+}
+
+func isisRetransmit(circuit *isisCircuit) {
+	for id := range circuit.srm {
+		lsp := isisLsdb[id]
+		if lsp == nil {
+			delete(circuit.srm, id)
+			continue
+		}
+		isisLog.Debug("retransmit lsp", "lspId", id.String(), "dev", circuit.dev.name)
+		isisSendPdu(circuit, lsp.toPacket())
+	}
+	if len(circuit.srm) > 0 {
+		circuit.rxmtTimer.reset(ISIS_LSP_RXMT_INTERVAL)
+	}
+}
+
+/* PSNPで確認応答か要求をする。ブロードキャストでは確認応答は不要 */
+func isisSetSsn(circuit *isisCircuit, id isisLspId) {
+	if circuit.circuitType == ISIS_CIRCUIT_BROADCAST {
+		return
+	}
+	isisRequestLsp(circuit, id)
+}
+
+func isisRequestLsp(circuit *isisCircuit, id isisLspId) {
+	circuit.ssn[id] = true
+	if circuit.psnpTimer != nil && circuit.psnpTimer.active {
+		return
+	}
+	circuit.psnpTimer = newTimer(ISIS_PSNP_DELAY, func() { isisSendPsnp(circuit) })
+}
+
+func isisSendPsnp(circuit *isisCircuit) {
+	var entries []byte
+	for id := range circuit.ssn {
+		if lsp := isisLsdb[id]; lsp != nil {
+			entries = append(entries, lsp.entry()...)
+		} else {
+			// 持っていないLSPはシーケンス番号0で要求する
+			entry := make([]byte, ISIS_LSP_ENTRY_LEN)
+			copy(entry[2:10], id[:])
+			entries = append(entries, entry...)
+		}
+	}
+	circuit.ssn = make(map[isisLspId]bool)
+
+	maxEntries := (ISIS_MTU - ISIS_PSNP_HEADER_LEN) / (2 + 15*ISIS_LSP_ENTRY_LEN) * 15
+	for len(entries) > 0 {
+		n := len(entries)
+		if n > maxEntries*ISIS_LSP_ENTRY_LEN {
+			n = maxEntries * ISIS_LSP_ENTRY_LEN
+		}
+		pdu := isisCommonHeader(isisPduType(ISIS_PDU_L1_PSNP, ISIS_PDU_L2_PSNP), ISIS_PSNP_HEADER_LEN)
+		pdu = append(pdu, 0, 0)
+		pdu = append(pdu, isisSystemIdSelf[:]...)
+		pdu = append(pdu, 0)
+		pdu = append(pdu, isisTlvs(ISIS_TLV_LSP_ENTRIES, entries[:n], ISIS_LSP_ENTRY_LEN)...)
+		copy(pdu[8:10], uint16ToByte(uint16(len(pdu))))
+		isisSendPdu(circuit, pdu)
+		entries = entries[n:]
+	}
+}
+
+func isisSortedLsps() []*isisLsp {
+	lsps := make([]*isisLsp, 0, len(isisLsdb))
+	for _, lsp := range isisLsdb {
+		lsps = append(lsps, lsp)
+	}
+	sort.Slice(lsps, func(i, j int) bool {
+		return bytes.Compare(lsps[i].id[:], lsps[j].id[:]) < 0
+	})
+	return lsps
+}
+
+func isisCsnpTimerExpired(circuit *isisCircuit) {
+	if isisHasUpAdjacency(circuit) {
+		isisSendCsnp(circuit)
+	}
+	circuit.csnpTimer.reset(ISIS_CSNP_INTERVAL)
+}
+
+/* LSPデータベースの全エントリをCSNPで送る。1つに入らなければ範囲を分けて送る */
+func isisSendCsnp(circuit *isisCircuit) {
+	lsps := isisSortedLsps()
+	maxEntries := (ISIS_MTU - ISIS_CSNP_HEADER_LEN) / (2 + 15*ISIS_LSP_ENTRY_LEN) * 15
+
+	for i := 0; i == 0 || i < len(lsps); i += maxEntries {
+		chunk := lsps[i:]
+		if len(chunk) > maxEntries {
+			chunk = chunk[:maxEntries]
+		}
+		startId := isisLspId{}
+		endId := isisLspId{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+		if i > 0 {
+			startId = chunk[0].id
+		}
+		if i+len(chunk) < len(lsps) {
+			endId = chunk[len(chunk)-1].id
+		}
+
+		var entries []byte
+		for _, lsp := range chunk {
+			entries = append(entries, lsp.entry()...)
+		}
+
+		pdu := isisCommonHeader(isisPduType(ISIS_PDU_L1_CSNP, ISIS_PDU_L2_CSNP), ISIS_CSNP_HEADER_LEN)
+		pdu = append(pdu, 0, 0)
+		pdu = append(pdu, isisSystemIdSelf[:]...)
+		pdu = append(pdu, 0)
+		pdu = append(pdu, startId[:]...)
+		pdu = append(pdu, endId[:]...)
+		pdu = append(pdu, isisTlvs(ISIS_TLV_LSP_ENTRIES, entries, ISIS_LSP_ENTRY_LEN)...)
+		copy(pdu[8:10], uint16ToByte(uint16(len(pdu))))
+		isisSendPdu(circuit, pdu)
+	}
+}
+
+type isisLspEntry struct {
+	id       isisLspId
+	seq      uint32
+	lifetime uint16
+}
+
+func isisParseLspEntries(tlvs []byte) ([]isisLspEntry, bool) {
+	var entries []isisLspEntry
+	ok := isisWalkTlvs(tlvs, func(tlvType uint8, value []byte) {
+		if tlvType != ISIS_TLV_LSP_ENTRIES {
+			return
+		}
+		for i := 0; i+ISIS_LSP_ENTRY_LEN <= len(value); i += ISIS_LSP_ENTRY_LEN {
+			entries = append(entries, isisLspEntry{
+				lifetime: byteToUint16(value[i : i+2]),
+				id:       isisLspId(value[i+2 : i+10]),
+				seq:      byteToUint32(value[i+10 : i+14]),
+			})
+		}
+	})
+	return entries, ok
+}
+
+/* SNPのエントリと自分のLSPデータベースを比べる(ISO 10589 7.3.15.2) */
+func isisSnpEntryInput(circuit *isisCircuit, entry isisLspEntry) {
+	lsp := isisLsdb[entry.id]
+	if lsp == nil {
+		if entry.lifetime != 0 && entry.seq != 0 {
+			isisRequestLsp(circuit, entry.id)
+		}
+		return
+	}
+
+	switch cmp := isisLspCompare(entry.seq, entry.lifetime, lsp.seq, lsp.currentLifetime()); {
+	case cmp == 0:
+		delete(circuit.srm, entry.id)
+	case cmp < 0:
+		isisSendLsp(circuit, lsp)
+	default:
+		isisRequestLsp(circuit, entry.id)
+	}
+}
+
+func isisCsnpInput(circuit *isisCircuit, buffer []byte) {
+	if len(buffer) < ISIS_CSNP_HEADER_LEN || !isisAdjacencyUp(circuit) {
+		return
+	}
+	pduLen := int(byteToUint16(buffer[8:10]))
+	if pduLen > len(buffer) || pduLen < ISIS_CSNP_HEADER_LEN {
+		return
+	}
+	startId := buffer[17:25]
+	endId := buffer[25:33]
+
+	entries, ok := isisParseLspEntries(buffer[ISIS_CSNP_HEADER_LEN:pduLen])
+	if !ok {
+		return
+	}
+
+	seen := map[isisLspId]bool{}
+	for _, entry := range entries {
+		seen[entry.id] = true
+		isisSnpEntryInput(circuit, entry)
+	}
+
+	// 範囲内で相手が持っていないLSPを送る
+	for id, lsp := range isisLsdb {
+		if seen[id] || lsp.currentLifetime() == 0 {
+			continue
+		}
+		if bytes.Compare(id[:], startId) >= 0 && bytes.Compare(id[:], endId) <= 0 {
+			isisSendLsp(circuit, lsp)
+		}
+	}
+}
+
+func isisPsnpInput(circuit *isisCircuit, buffer []byte) {
+	if len(buffer) < ISIS_PSNP_HEADER_LEN || !isisAdjacencyUp(circuit) {
+		return
+	}
+	// ブロードキャストではDISだけがPSNPに応える
+	if circuit.circuitType == ISIS_CIRCUIT_BROADCAST && !circuit.isDis {
+		return
+	}
+	pduLen := int(byteToUint16(buffer[8:10]))
+	if pduLen > len(buffer) || pduLen < ISIS_PSNP_HEADER_LEN {
+		return
+	}
+
+	entries, ok := isisParseLspEntries(buffer[ISIS_PSNP_HEADER_LEN:pduLen])
+	if !ok {
+		return
+	}
+	for _, entry := range entries {
+		isisSnpEntryInput(circuit, entry)
+	}
+}
+
+/* 寿命が尽きたLSPをパージし、パージしたものは一定時間後に消す。自分のLSPは定期的に生成し直す */
+func isisStartAging() {
+	if isisAgingTimer != nil {
+		return
+	}
+	isisAgingTimer = newTimer(ISIS_AGING_INTERVAL, func() {
+		refresh := false
+		for id, lsp := range isisLsdb {
+			if lsp.lifetime == 0 {
+				if timerClock.now().Sub(lsp.installed) >= ISIS_ZERO_AGE_LIFETIME {
+					delete(isisLsdb, id)
+				}
+				continue
+			}
+			lifetime := lsp.currentLifetime()
+			if lifetime == 0 {
+				isisLog.Info("lsp expired", "lspId", id.String())
+				isisPurge(lsp)
+			} else if id.isOwn() && lifetime <= ISIS_MAX_LIFETIME-ISIS_REFRESH_INTERVAL {
+				refresh = true
+			}
+		}
+
+		if refresh {
+			isisOriginateAll(true)
+		}
+		isisAgingTimer.reset(ISIS_AGING_INTERVAL)
+	})
+}
+
+/* 状態の変化が続いても一度にまとめて生成する */
+func isisScheduleOriginate() {
+	if isisOriginateTimer != nil && isisOriginateTimer.active {
+		return
+	}
+	isisOriginateTimer = newTimer(0, func() {
+		isisOriginateAll(false)
+	})
+}
+
+/*
+ * 自分のLSPと、DISになっているサーキットの疑似ノードLSPを作る。
+ * 内容が変わったものだけ新しいシーケンス番号でフラッディングし、不要になったものはパージする。
+ */
+func isisOriginateAll(refresh bool) {
+	wanted := map[isisLspId]bool{}
+
+	originate := func(pseudonodeId uint8, tlvs [][]byte) {
+		for i, body := range isisFragment(tlvs) {
+			id := isisLspId{}
+			copy(id[:], isisSystemIdSelf[:])
+			id[ISIS_SYSTEM_ID_LEN] = pseudonodeId
+			id[ISIS_SYSTEM_ID_LEN+1] = uint8(i)
+			wanted[id] = true
+			isisOriginate(id, body, refresh)
+		}
+	}
+
+	originate(0, isisOwnLspTlvs())
+	for _, circuit := range isisCircuits {
+		if circuit.circuitType == ISIS_CIRCUIT_BROADCAST && circuit.isDis && isisHasUpAdjacency(circuit) {
+			originate(circuit.circuitId, isisPseudonodeLspTlvs(circuit))
+		}
+	}
+
+	for id, lsp := range isisLsdb {
+		if id.isOwn() && !wanted[id] && lsp.currentLifetime() != 0 {
+			isisPurge(lsp)
+		}
+	}
+}
+
+/* TLVを1つのLSPに入る大きさごとにまとめる */
+func isisFragment(tlvs [][]byte) [][]byte {
+	fragments := [][]byte{nil}
+	for _, tlv := range tlvs {
+		last := len(fragments) - 1
+		if ISIS_LSP_HEADER_LEN+len(fragments[last])+len(tlv) > ISIS_MTU {
+			fragments = append(fragments, nil)
+			last++
+		}
+		fragments[last] = append(fragments[last], tlv...)
+	}
+	return fragments
+}
+
+func isisOriginate(id isisLspId, body []byte, refresh bool) {
+	current := isisLsdb[id]
+
+	seq := uint32(1)
+	if current != nil {
+		if !refresh && current.currentLifetime() != 0 && bytes.Equal(current.tlvs(), body) {
+			return
+		}
+		seq = current.seq + 1
+	}
+
+	isType := ISIS_LSP_IS_TYPE_L2
+	if isisLevel == 1 {
+		isType = ISIS_LSP_IS_TYPE_L1
+	}
+	pdu := isisCommonHeader(isisPduType(ISIS_PDU_L1_LSP, ISIS_PDU_L2_LSP), ISIS_LSP_HEADER_LEN)
+	pdu = append(pdu, uint16ToByte(uint16(ISIS_LSP_HEADER_LEN+len(body)))...)
+	pdu = append(pdu, uint16ToByte(ISIS_MAX_LIFETIME)...)
+	pdu = append(pdu, id[:]...)
+	pdu = append(pdu, uint32ToByte(seq)...)
+	pdu = append(pdu, 0, 0) // チェックサム
+	pdu = append(pdu, isType)
+	pdu = append(pdu, body...)
+	// チェックサムはLSP IDから最後まで
+	checksum := fletcherChecksum(pdu[12:], 12)
+	copy(pdu[24:26], uint16ToByte(checksum))
+
+	lsp := &isisLsp{
+		id:        id,
+		seq:       seq,
+		checksum:  checksum,
+		lifetime:  ISIS_MAX_LIFETIME,
+		installed: timerClock.now(),
+		raw:       pdu,
+	}
+	isisLog.Debug("originate lsp", "lspId", id.String(), "seq", seq)
+	isisInstallLsp(lsp)
+	isisFlood(lsp, nil)
+}
+
+/* 残り寿命を0にし、ヘッダだけにしてフラッディングする */
+func isisPurge(lsp *isisLsp) {
+	pdu := isisCommonHeader(isisPduType(ISIS_PDU_L1_LSP, ISIS_PDU_L2_LSP), ISIS_LSP_HEADER_LEN)
+	pdu = append(pdu, uint16ToByte(ISIS_LSP_HEADER_LEN)...)
+	pdu = append(pdu, 0, 0)
+	pdu = append(pdu, lsp.id[:]...)
+	pdu = append(pdu, uint32ToByte(lsp.seq)...)
+	pdu = append(pdu, 0, 0, 0)
+
+	purged := &isisLsp{
+		id:        lsp.id,
+		seq:       lsp.seq,
+		installed: timerClock.now(),
+		raw:       pdu,
+	}
+	isisLog.Info("purge lsp", "lspId", lsp.id.String())
+	isisInstallLsp(purged)
+	isisFlood(purged, nil)
+}
+
+func isisExtIsReachEntry(nbrId isisNodeId, metric uint32) []byte {
+	entry := append([]byte{}, nbrId[:]...)
+	entry = append(entry, uint32ToByte(metric)[1:]...)
+	return append(entry, 0)
+}
+
+func isisOwnLspTlvs() [][]byte {
+	tlvs := [][]byte{
+		isisAreaAddrsTlv(),
+		isisTlv(ISIS_TLV_PROTOCOLS, []byte{ISIS_NLPID_IPV6}),
+	}
+
+	var addrs []byte
+	var isReach []byte
+	var prefixes [][]byte
+	advertised := map[ribKey]bool{}
+	addPrefix := func(key ribKey, metric uint32, flags uint8) {
+		p := append(uint32ToByte(metric), flags, key.prefixLen)
+		p = append(p, key.prefix[:(key.prefixLen+7)/8]...)
+		prefixes = append(prefixes, p)
+		advertised[key] = true
+	}
+
+	for _, circuit := range isisCircuits {
+		ipv6Dev := circuit.dev.ipv6Dev
+		if ipv6Dev.address != (in6Addr{}) {
+			addrs = append(addrs, ipv6Dev.address[:]...)
+			addPrefix(ribKey{in6AddrClearPrefix(ipv6Dev.address, ipv6Dev.prefixLen), ipv6Dev.prefixLen}, circuit.metric, 0)
+		}
+
+		if circuit.circuitType == ISIS_CIRCUIT_BROADCAST {
+			if isisDisAdjacencyUp(circuit) {
+				isReach = append(isReach, isisExtIsReachEntry(circuit.lanId, circuit.metric)...)
+			}
+			continue
+		}
+		for _, adj := range circuit.adjs {
+			if adj.state == ISIS_ADJ_UP {
+				var nbrId isisNodeId
+				copy(nbrId[:], adj.systemId[:])
+				isReach = append(isReach, isisExtIsReachEntry(nbrId, circuit.metric)...)
+			}
+		}
+	}
+
+	// 再配布した経路は外部経路として広告する
+	for key, r := range redistributedRoutes(PROTO_ISIS, defaultVrf) {
+		if advertised[key] {
+			continue
+		}
+		metric := r.metric
+		if metric == 0 {
+			metric = ISIS_DEFAULT_METRIC
+		}
+		addPrefix(key, metric, ISIS_IPV6_REACH_FLAG_EXTERNAL)
+	}
+
+	if len(addrs) > 0 {
+		tlvs = append(tlvs, isisTlvs(ISIS_TLV_IPV6_INTERFACE, addrs, 16))
+	}
+	if len(isReach) > 0 {
+		tlvs = append(tlvs, isisTlvs(ISIS_TLV_EXTENDED_IS_REACH, isReach, 11))
+	}
+
+	// IPv6到達可能性はエントリの長さが可変なので255byteに収まるように詰める
+	var value []byte
+	for _, p := range prefixes {
+		if len(value)+len(p) > 255 {
+			tlvs = append(tlvs, isisTlv(ISIS_TLV_IPV6_REACHABILITY, value))
+			value = nil
+		}
+		value = append(value, p...)
+	}
+	if len(value) > 0 {
+		tlvs = append(tlvs, isisTlv(ISIS_TLV_IPV6_REACHABILITY, value))
+	}
+	return tlvs
+}
+
+/* ブロードキャストのサーキットで、DISとの隣接関係がある(自分がDISなら隣接ルータがいる) */
+func isisDisAdjacencyUp(circuit *isisCircuit) bool {
+	if circuit.isDis {
+		return isisHasUpAdjacency(circuit)
+	}
+	adj := circuit.adjs[isisSystemId(circuit.lanId[:ISIS_SYSTEM_ID_LEN])]
+	return adj != nil && adj.state == ISIS_ADJ_UP
+}
+
+/* 疑似ノードLSPにはLAN上の全てのルータをコスト0で入れる */
+func isisPseudonodeLspTlvs(circuit *isisCircuit) [][]byte {
+	var selfId isisNodeId
+	copy(selfId[:], isisSystemIdSelf[:])
+	isReach := isisExtIsReachEntry(selfId, 0)
+	for _, adj := range circuit.adjs {
+		if adj.state == ISIS_ADJ_UP {
+			var nbrId isisNodeId
+			copy(nbrId[:], adj.systemId[:])
+			isReach = append(isReach, isisExtIsReachEntry(nbrId, 0)...)
+		}
+	}
+	return [][]byte{isisTlvs(ISIS_TLV_EXTENDED_IS_REACH, isReach, 11)}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"time"
+)
+
+/**
+ * IS-ISのSPF計算と経路のインストール(ISO 10589 附属書C, RFC 5308)
+ */
+const ISIS_SPF_DELAY = 200 * time.Millisecond
+
+const ISIS_IPV6_REACH_FLAG_EXTERNAL uint8 = 0x40
+const ISIS_IPV6_REACH_FLAG_SUBTLV uint8 = 0x20
+
+type isisNextHop struct {
+	dev  *netDevice
+	addr in6Addr // 直結のLANの場合はゼロ
+}
+
+type isisVertex struct {
+	id       isisNodeId
+	dist     uint32
+	nextHop  *isisNextHop // 自分自身の場合はnil
+	finished bool
+}
+
+type isisRoute struct {
+	vrf      *vrf
+	nextHop  isisNextHop
+	cost     uint32
+	external bool // 再配布された経路
+}
+
+// RIBにインストールしたIS-ISの経路
+var isisRoutes = map[ribKey]*isisRoute{}
+
+var isisSpfTimer *timer
+
+func isisScheduleSpf() {
+	if isisSpfTimer != nil && isisSpfTimer.active {
+		return
+	}
+	isisSpfTimer = newTimer(ISIS_SPF_DELAY, isisRunSpf)
+}
+
+func isisRunSpf() {
+	vertices := isisDijkstra()
+	routes := map[ribKey]*isisRoute{}
+
+	for _, v := range vertices {
+		// 自分のプレフィックスは直結経路があるのでインストールしない
+		if !v.finished || v.nextHop == nil || v.id[ISIS_SYSTEM_ID_LEN] != 0 {
+			continue
+		}
+		isisNodeTlvs(v.id, func(tlvType uint8, value []byte) {
+			if tlvType != ISIS_TLV_IPV6_REACHABILITY {
+				return
+			}
+			for len(value) >= 6 {
+				metric := byteToUint32(value[0:4])
+				flags := value[4]
+				prefixLen := value[5]
+				n := 6 + int(prefixLen+7)/8
+				if prefixLen > 128 || len(value) < n {
+					return
+				}
+				var prefix in6Addr
+				copy(prefix[:], value[6:n])
+				if flags&ISIS_IPV6_REACH_FLAG_SUBTLV != 0 {
+					if len(value) < n+1 || len(value) < n+1+int(value[n]) {
+						return
+					}
+					n += 1 + int(value[n])
+				}
+				value = value[n:]
+
+				key := ribKey{in6AddrClearPrefix(prefix, prefixLen), prefixLen}
+				cost := v.dist + metric
+				external := flags&ISIS_IPV6_REACH_FLAG_EXTERNAL != 0
+				// 内部経路はコストに関わらず外部経路より優先する
+				if r, ok := routes[key]; !ok || (r.external && !external) || (r.external == external && cost < r.cost) {
+					routes[key] = &isisRoute{vrf: v.nextHop.dev.vrf, nextHop: *v.nextHop, cost: cost, external: external}
+				}
+			}
+		})
+	}
+
+	isisInstallRoutes(routes)
+}
+
+/*
+ * ノードのLSPのTLVを順に渡す。フラグメント0がないノードは使わない
+ */
+func isisNodeTlvs(nodeId isisNodeId, fn func(tlvType uint8, value []byte)) bool {
+	var id isisLspId
+	copy(id[:], nodeId[:])
+	if lsp := isisLsdb[id]; lsp == nil || lsp.currentLifetime() == 0 {
+		return false
+	}
+	for frag := 0; frag < 256; frag++ {
+		id[ISIS_SYSTEM_ID_LEN+1] = uint8(frag)
+		lsp := isisLsdb[id]
+		if lsp == nil || lsp.currentLifetime() == 0 {
+			continue
+		}
+		isisWalkTlvs(lsp.tlvs(), fn)
+	}
+	return true
+}
+
+type isisIsReach struct {
+	nbrId  isisNodeId
+	metric uint32
+}
+
+func isisNodeIsReach(nodeId isisNodeId) ([]isisIsReach, bool) {
+	var reach []isisIsReach
+	ok := isisNodeTlvs(nodeId, func(tlvType uint8, value []byte) {
+		if tlvType != ISIS_TLV_EXTENDED_IS_REACH {
+			return
+		}
+		for len(value) >= 11 {
+			n := 11 + int(value[10])
+			if len(value) < n {
+				return
+			}
+			reach = append(reach, isisIsReach{
+				nbrId:  isisNodeId(value[0:7]),
+				metric: uint32(value[7])<<16 | uint32(value[8])<<8 | uint32(value[9]),
+			})
+			value = value[n:]
+		}
+	})
+	return reach, ok
+}
+
+/* 双方向の確認。相手のLSPにも自分へのリンクがあるか */
+func isisLinksBack(nodeId isisNodeId, to isisNodeId) bool {
+	reach, _ := isisNodeIsReach(nodeId)
+	for _, r := range reach {
+		if r.nbrId == to {
+			return true
+		}
+	}
+	return false
+}
+
+/* ダイクストラ法で最短経路木を作る */
+func isisDijkstra() map[isisNodeId]*isisVertex {
+	vertices := map[isisNodeId]*isisVertex{}
+
+	var rootId isisNodeId
+	copy(rootId[:], isisSystemIdSelf[:])
+	root := &isisVertex{id: rootId}
+	vertices[rootId] = root
+
+	for v := root; v != nil; v = isisNextCandidate(vertices) {
+		v.finished = true
+
+		reach, ok := isisNodeIsReach(v.id)
+		if !ok {
+			continue
+		}
+		for _, r := range reach {
+			if r.nbrId == v.id || !isisLinksBack(r.nbrId, v.id) {
+				continue
+			}
+			isisRelax(vertices, v, r.nbrId, v.dist+r.metric)
+		}
+	}
+
+	return vertices
+}
+
+func isisRelax(vertices map[isisNodeId]*isisVertex, parent *isisVertex, wid isisNodeId, dist uint32) {
+	w := vertices[wid]
+	if w != nil && (w.finished || w.dist <= dist) {
+		return
+	}
+
+	nextHop := isisCalcNextHop(parent, wid)
+	if nextHop == nil {
+		return
+	}
+	if w == nil {
+		w = &isisVertex{id: wid}
+		vertices[wid] = w
+	}
+	w.dist = dist
+	w.nextHop = nextHop
+}
+
+/*
+ * ネクストホップの計算
+ * 自分に直結している頂点はサーキットと隣接ルータのリンクローカルアドレスを使い、それ以外は親から引き継ぐ
+ */
+func isisCalcNextHop(parent *isisVertex, wid isisNodeId) *isisNextHop {
+	systemId := isisSystemId(wid[:ISIS_SYSTEM_ID_LEN])
+
+	if parent.nextHop == nil {
+		// 親が自分自身
+		for _, circuit := range isisCircuits {
+			if wid[ISIS_SYSTEM_ID_LEN] != 0 {
+				if circuit.circuitType == ISIS_CIRCUIT_BROADCAST && circuit.lanId == wid {
+					return &isisNextHop{dev: circuit.dev}
+				}
+				continue
+			}
+			if circuit.circuitType != ISIS_CIRCUIT_POINT_TO_POINT {
+				continue
+			}
+			if adj := circuit.adjs[systemId]; adj != nil && adj.state == ISIS_ADJ_UP {
+				return &isisNextHop{dev: circuit.dev, addr: adj.addr}
+			}
+		}
+		return nil
+	}
+
+	if parent.id[ISIS_SYSTEM_ID_LEN] != 0 && parent.nextHop.addr == (in6Addr{}) {
+		// 親が直結のLANの疑似ノード
+		circuit := getIsisCircuit(parent.nextHop.dev)
+		if circuit == nil {
+			return nil
+		}
+		adj := circuit.adjs[systemId]
+		if adj == nil || adj.state != ISIS_ADJ_UP {
+			return nil
+		}
+		return &isisNextHop{dev: circuit.dev, addr: adj.addr}
+	}
+
+	nextHop := *parent.nextHop
+	return &nextHop
+}
+
+func isisNextCandidate(vertices map[isisNodeId]*isisVertex) *isisVertex {
+	var next *isisVertex
+	for _, v := range vertices {
+		if v.finished {
+			continue
+		}
+		// 同じコストなら疑似ノードを先に処理する
+		if next == nil || v.dist < next.dist || (v.dist == next.dist && v.id[ISIS_SYSTEM_ID_LEN] != 0 && next.id[ISIS_SYSTEM_ID_LEN] == 0) {
+			next = v
+		}
+	}
+	return next
+}
+
+/* 計算結果との差分だけRIBに反映する */
+func isisInstallRoutes(routes map[ribKey]*isisRoute) {
+	for key, old := range isisRoutes {
+		if _, ok := routes[key]; !ok {
+			ribDelete(old.vrf, key.prefix, key.prefixLen, PROTO_ISIS)
+		}
+	}
+
+	for key, r := range routes {
+		if old, ok := isisRoutes[key]; ok && *old == *r {
+			continue
+		}
+		if old, ok := isisRoutes[key]; ok && old.vrf != r.vrf {
+			ribDelete(old.vrf, key.prefix, key.prefixLen, PROTO_ISIS)
+		}
+
+		route := &ipv6RouteEntry{
+			routeType: NETWORK,
+			dev:       r.nextHop.dev,
+			nextHop:   r.nextHop.addr,
+			proto:     PROTO_ISIS,
+			metric:    r.cost,
+		}
+		if r.nextHop.addr == (in6Addr{}) {
+			route.routeType = CONNECTED
+		}
+		ribAdd(r.vrf, key.prefix, key.prefixLen, route)
+		isisLog.Debug("install route", "prefix", fmtPrefixStr(key.prefix, key.prefixLen), "nexthop", r.nextHop.addr, "dev", r.nextHop.dev.name, "cost", r.cost)
+	}
+
+	isisRoutes = routes
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+/**
+ * インターフェイスの状態監視
+ * netlinkのRTM_NEWLINKを受け取り、リンクが落ちたら直結経路とそれに依存するスタティック経路を取り下げる。
+ * 起動後に追加されたインターフェイスはソケットを開いて使い始め、削除されたらソケットを閉じる。
+ * 起動時と同じくIPv6アドレスのないインターフェイスは使わず、RTM_NEWADDRでアドレスが付いたときに使い始める。
+ */
+const NETLINK_RECV_BUFFER_LEN = 8192
+
+// syscallパッケージに定義がない
+const RTMGRP_LINK = 0x1
+const RTMGRP_IPV6_IFADDR = 0x100
+
+var netlinkFd int
+
+func initLinkMonitor() error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return fmt.Errorf("open netlink socket: %s", err)
+	}
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: RTMGRP_LINK | RTMGRP_IPV6_IFADDR,
+	})
+	if err != nil {
+		syscall.Close(fd)
+		return fmt.Errorf("bind netlink socket: %s", err)
+	}
+	netlinkFd = fd
+
+	return epollAdd(fd, syscall.EPOLLIN, func(events uint32) {
+		netlinkInput()
+	})
+}
+
+func closeLinkMonitor() {
+	epollDelete(netlinkFd)
+	syscall.Close(netlinkFd)
+}
+
+func netlinkInput() {
+	buffer := make([]byte, NETLINK_RECV_BUFFER_LEN)
+	for {
+		n, _, err := syscall.Recvfrom(netlinkFd, buffer, 0)
+		if err != nil {
+			if err != syscall.EAGAIN {
+				linkLog.Warn("failed to receive netlink message", "err", err)
+			}
+			return
+		}
+
+		msgs, err := syscall.ParseNetlinkMessage(buffer[:n])
+		if err != nil {
+			linkLog.Warn("invalid netlink message", "err", err)
+			continue
+		}
+		for _, msg := range msgs {
+			if msg.Header.Type == syscall.RTM_NEWADDR {
+				netlinkNewAddr(msg)
+				continue
+			}
+			if msg.Header.Type != syscall.RTM_NEWLINK && msg.Header.Type != syscall.RTM_DELLINK {
+				continue
+			}
+			if len(msg.Data) < syscall.SizeofIfInfomsg {
+				continue
+			}
+			ifi := (*syscall.IfInfomsg)(unsafe.Pointer(&msg.Data[0]))
+			netDev := getNetDevByIndex(int(ifi.Index))
+			if msg.Header.Type == syscall.RTM_DELLINK {
+				if netDev != nil {
+					linkRemove(netDev)
+				}
+				continue
+			}
+			if netDev == nil {
+				netDev = linkAdd(int(ifi.Index))
+				if netDev == nil {
+					continue
+				}
+			}
+			// IFF_RUNNINGはキャリアを含めた運用状態を表す
+			linkSetState(netDev, ifi.Flags&syscall.IFF_RUNNING != 0)
+		}
+	}
+}
+
+/* まだ使っていないインターフェイスにIPv6アドレスが付いたら使い始める */
+func netlinkNewAddr(msg syscall.NetlinkMessage) {
+	if len(msg.Data) < syscall.SizeofIfAddrmsg {
+		return
+	}
+	ifa := (*syscall.IfAddrmsg)(unsafe.Pointer(&msg.Data[0]))
+	if ifa.Family != syscall.AF_INET6 || getNetDevByIndex(int(ifa.Index)) != nil {
+		return
+	}
+	netDev := linkAdd(int(ifa.Index))
+	if netDev == nil {
+		return
+	}
+	inf, err := net.InterfaceByIndex(int(ifa.Index))
+	if err == nil {
+		linkSetState(netDev, inf.Flags&net.FlagRunning != 0)
+	}
+}
+
+/*
+ * 追加されたインターフェイスを使い始める。同じ名前で消えていたものは設定とプロトコルの状態をそのまま引き継ぎ、
+ * 初めてのものはIPv6アドレスがあれば設定を適用する。リンクの状態は呼び出し元で反映する。
+ */
+func linkAdd(index int) *netDevice {
+	inf, err := net.InterfaceByIndex(index)
+	if err != nil {
+		linkLog.Warn("interface not found", "ifindex", index, "err", err)
+		return nil
+	}
+	if isIgnoreIf(inf.Name) {
+		return nil
+	}
+
+	netDev := getNetDevByName(inf.Name)
+	if netDev != nil {
+		// 削除の通知より先に作り直されていたら古いソケットを閉じる
+		linkRemove(netDev)
+		err = netDev.open(*inf)
+		if err != nil {
+			linkLog.Error("failed to open device", "dev", inf.Name, "err", err)
+			return nil
+		}
+		linkLog.Info("interface is back", "dev", netDev.name)
+		return netDev
+	}
+
+	// アドレスは設定で上書きされるまでインターフェイスのものを使う
+	netAddrs, err := inf.Addrs()
+	if err != nil {
+		linkLog.Warn("failed to get addresses", "dev", inf.Name, "err", err)
+		return nil
+	}
+	ipv6Addr, prefixLen := getIpv6Device(netAddrs)
+	if ipv6Addr == nil {
+		linkLog.Debug("interface has no ipv6 address", "dev", inf.Name)
+		return nil
+	}
+	netDev = newNetIf(inf.Name, newIpv6(*ipv6Addr, prefixLen))
+	err = netDev.open(*inf)
+	if err != nil {
+		linkLog.Error("failed to open device", "dev", inf.Name, "err", err)
+		return nil
+	}
+	netDevices = append(netDevices, netDev)
+	linkLog.Info("interface is added", "dev", netDev.name)
+
+	configApplyInterface(netDev)
+	return netDev
+}
+
+/* 削除されたインターフェイスの経路を取り下げてソケットを閉じる */
+func linkRemove(netDev *netDevice) {
+	if netDev.socketFd < 0 {
+		return
+	}
+	linkSetState(netDev, false)
+	netDev.close()
+	linkLog.Info("interface is removed", "dev", netDev.name)
+}
+
+func getNetDevByIndex(index int) *netDevice {
+	for _, netDev := range netDevices {
+		if netDev.sockAddr.Ifindex == index {
+			return netDev
+		}
+	}
+	return nil
+}
+
+func linkSetState(netDev *netDevice, up bool) {
+	if netDev.up == up {
+		return
+	}
+	netDev.up = up
+
+	if up {
+		linkLog.Info("link is up", "dev", netDev.name)
+		linkUp(netDev)
+	} else {
+		linkLog.Info("link is down", "dev", netDev.name)
+		linkDown(netDev)
+	}
+}
+
+/* 直結経路を戻し、取り下げていたスタティック経路を入れ直す */
+func linkUp(netDev *netDevice) {
+	ipv6Dev := netDev.ipv6Dev
+	if ipv6Dev != nil && ipv6Dev.configured {
+		ribAdd(netDev.vrf, ipv6Dev.address, ipv6Dev.prefixLen, &ipv6RouteEntry{
+			routeType: CONNECTED,
+			dev:       netDev,
+			proto:     PROTO_CONNECTED,
+		})
+	}
+	staticRoutesUpdate()
+}
+
+/* 直結経路とネクストホップがそのインターフェイスにあるスタティック経路を取り下げ、NDのエントリを消す */
+func linkDown(netDev *netDevice) {
+	ipv6Dev := netDev.ipv6Dev
+	if ipv6Dev != nil && ipv6Dev.configured {
+		ribDelete(netDev.vrf, ipv6Dev.address, ipv6Dev.prefixLen, PROTO_CONNECTED)
+	}
+	staticRoutesUpdate()
+	flushNDTableEntries(netDev)
+}
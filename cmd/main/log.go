@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+/**
+ * ログ
+ * log/slogで構造化したログを出す。サブシステムごとにロガーを持ち、"subsys"の属性を付ける。
+ * パケットごとのログはデバッグレベルなので、ログレベルを下げるかサブシステムのデバッグを有効にしたときだけ出る。
+ * レベルとデバッグの切り替えは管理APIからいつでもできる。
+ */
+const (
+	LOG_SUBSYS_SYSTEM   = "system"
+	LOG_SUBSYS_LINK     = "link"
+	LOG_SUBSYS_ETHERNET = "ethernet"
+	LOG_SUBSYS_IPV6     = "ipv6"
+	LOG_SUBSYS_ICMPV6   = "icmpv6"
+	LOG_SUBSYS_ND       = "nd"
+	LOG_SUBSYS_UDP      = "udp"
+	LOG_SUBSYS_FIB      = "fib"
+	LOG_SUBSYS_CONFIG   = "config"
+	LOG_SUBSYS_API      = "api"
+	LOG_SUBSYS_RIPNG    = "ripng"
+	LOG_SUBSYS_OSPFV3   = "ospfv3"
+	LOG_SUBSYS_ISIS     = "isis"
+	LOG_SUBSYS_BGP      = "bgp"
+	LOG_SUBSYS_BFD      = "bfd"
+	LOG_SUBSYS_VRRP     = "vrrp"
+	LOG_SUBSYS_IPFIX    = "ipfix"
+	LOG_SUBSYS_SFLOW    = "sflow"
+)
+
+// 全体のログレベル
+var logLevel = new(slog.LevelVar)
+
+// デバッグログを出すサブシステム。キーは起動時に決まり、値だけを切り替える
+var logDebug = map[string]*atomic.Bool{}
+
+// 出力先。起動時にconfigLogFormatで決め、レベルでは絞らない
+var logOutput slog.Handler = slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})
+
+var sysLog = newLogger(LOG_SUBSYS_SYSTEM)
+var linkLog = newLogger(LOG_SUBSYS_LINK)
+var ethLog = newLogger(LOG_SUBSYS_ETHERNET)
+var ipv6Log = newLogger(LOG_SUBSYS_IPV6)
+var icmpv6Log = newLogger(LOG_SUBSYS_ICMPV6)
+var ndLog = newLogger(LOG_SUBSYS_ND)
+var udpLog = newLogger(LOG_SUBSYS_UDP)
+var fibLog = newLogger(LOG_SUBSYS_FIB)
+var configLog = newLogger(LOG_SUBSYS_CONFIG)
+var apiLog = newLogger(LOG_SUBSYS_API)
+var ripngLog = newLogger(LOG_SUBSYS_RIPNG)
+var ospfv3Log = newLogger(LOG_SUBSYS_OSPFV3)
+var isisLog = newLogger(LOG_SUBSYS_ISIS)
+var bgpLog = newLogger(LOG_SUBSYS_BGP)
+var bfdLog = newLogger(LOG_SUBSYS_BFD)
+var vrrpLog = newLogger(LOG_SUBSYS_VRRP)
+var ipfixLog = newLogger(LOG_SUBSYS_IPFIX)
+var sflowLog = newLogger(LOG_SUBSYS_SFLOW)
+
+/* サブシステムのデバッグが有効なら、全体のレベルより低くてもデバッグログを出すハンドラ */
+type logHandler struct {
+	subsys string
+	debug  *atomic.Bool
+	attrs  []slog.Attr
+}
+
+func newLogger(subsys string) *slog.Logger {
+	debug := &atomic.Bool{}
+	logDebug[subsys] = debug
+	return slog.New(&logHandler{subsys: subsys, debug: debug})
+}
+
+func (h *logHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	if level >= logLevel.Level() {
+		return true
+	}
+	return level >= slog.LevelDebug && h.debug.Load()
+}
+
+func (h *logHandler) Handle(ctx context.Context, r slog.Record) error {
+	r.AddAttrs(slog.String("subsys", h.subsys))
+	r.AddAttrs(h.attrs...)
+	return logOutput.Handle(ctx, r)
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &logHandler{subsys: h.subsys, debug: h.debug, attrs: append(append([]slog.Attr{}, h.attrs...), attrs...)}
+}
+
+// グループは使わない
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	return h
+}
+
+/* 出力形式を"text"か"json"にする。ログを出す前に呼ぶ */
+func configLogFormat(format string) error {
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+	switch format {
+	case "text":
+		logOutput = slog.NewTextHandler(os.Stdout, opts)
+	case "json":
+		logOutput = slog.NewJSONHandler(os.Stdout, opts)
+	default:
+		return fmt.Errorf("unknown log format %s", format)
+	}
+	return nil
+}
+
+func configLogLevel(levelStr string) error {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(levelStr))
+	if err != nil {
+		return fmt.Errorf("unknown log level %s", levelStr)
+	}
+	logLevel.Set(level)
+	return nil
+}
+
+func configLogDebug(subsys string, on bool) error {
+	debug, ok := logDebug[subsys]
+	if !ok {
+		return fmt.Errorf("unknown log subsystem %s", subsys)
+	}
+	debug.Store(on)
+	return nil
+}
+
+/* "nd,fib"のようにカンマ区切りで指定したサブシステムのデバッグを有効にする。起動時のフラグで使う */
+func configLogDebugList(list string) error {
+	for _, subsys := range strings.Split(list, ",") {
+		subsys = strings.TrimSpace(subsys)
+		if subsys == "" {
+			continue
+		}
+		err := configLogDebug(subsys, true)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func logSubsystems() []string {
+	var names []string
+	for subsys := range logDebug {
+		names = append(names, subsys)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/* アドレスはログを出すときだけ文字列にする。パケットごとのデバッグログを出さないときの負荷を減らす */
+func (addr in6Addr) LogValue() slog.Value {
+	return slog.StringValue(fmtIpStr(addr))
+}
+
+type logMacAddr [6]uint8
+
+func (mac logMacAddr) LogValue() slog.Value {
+	return slog.StringValue(fmtMacStr(mac))
+}
+
+type logHex []byte
+
+func (b logHex) LogValue() slog.Value {
+	return slog.StringValue(hex.EncodeToString(b))
+}
@@ -1,116 +1,136 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"net"
 	"syscall"
 )
 
+const DEFAULT_CONFIG_FILE = "/etc/ipv6-router.conf"
+
 // ネットワーク内のNICのリスト
 var netDevices []*netDevice
 
+// 起動時とSIGHUPで読み込む設定ファイル
+var configFilePath string
+
 func main() {
+	flag.StringVar(&configFilePath, "config", DEFAULT_CONFIG_FILE, "path of the configuration file")
+	logFormat := flag.String("log-format", "text", "log format, text or json")
+	logLevelStr := flag.String("log-level", "info", "log level, debug, info, warn or error")
+	debugList := flag.String("debug", "", "comma separated subsystems to log debug messages, e.g. nd,fib")
+	flag.Parse()
+
+	// ログは他の初期化より先に決める
+	err := configLogFormat(*logFormat)
+	if err == nil {
+		err = configLogLevel(*logLevelStr)
+	}
+	if err == nil {
+		err = configLogDebugList(*debugList)
+	}
+	if err != nil {
+		log.Fatalf("Invalid log option : %s\n", err)
+	}
+
+	runRouter(configure)
+}
 
+/*
+ * インターフェイスを開いてconfigureFnで設定を入れ、SIGTERMかSIGINTを受け取るまでイベントループを回す。
+ * 統合テストでは別の設定を入れたルータをネットワーク名前空間ごとに動かす。
+ */
+func runRouter(configureFn func()) {
 	// インターフェイスを取得する
 	interfaces, err := net.Interfaces()
 	if err != nil {
 		log.Fatalf("Not found interfaces : %s\n", err)
 	}
-	fmt.Printf("interfaces: %+v\n", interfaces)
+	sysLog.Debug("interfaces", "interfaces", fmt.Sprintf("%+v", interfaces))
+
+	// VRFの初期化。インターフェイスはまずデフォルトのVRFに所属する
+	initVrfs()
 
 	// epollを作成する
 	events := make([]syscall.EpollEvent, 10)
-	epollFd, err := syscall.EpollCreate1(0)
+	err = initEpoll()
 	if err != nil {
 		log.Fatalf("Failed create epoll : %s\n", err)
 	}
 
+	// タイマーの期限もepollで受け取る
+	err = initTimers()
+	if err != nil {
+		log.Fatalf("Failed create timer : %s\n", err)
+	}
+
+	// インターフェイスの状態変化と追加・削除を監視する
+	// 一覧を取った後に追加されたものを取りこぼさないよう先に始める
+	err = initLinkMonitor()
+	if err != nil {
+		log.Fatalf("Failed start link monitor : %s\n", err)
+	}
+
 	for _, inf := range interfaces {
 		// 必要なもの以外無視する
 		if isIgnoreIf(inf.Name) {
 			continue
 		}
 
-		// ソケットAPIをオープンする
-		protocol := htons(syscall.ETH_P_ALL)
-		sockFd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(protocol))
-		if err != nil {
-			log.Fatalf("Failed open socket: %s\n", err)
-		}
-
-		fmt.Printf("socket file descriptor: %d\n", sockFd)
-
-		// ソケットをインターフェイスにbindする
-		socketAddr := syscall.SockaddrLinklayer{
-			Protocol: htons(syscall.ETH_P_ALL),
-			Ifindex:  inf.Index,
-		}
-		err = syscall.Bind(sockFd, &socketAddr)
-		if err != nil {
-			log.Fatalf("Failed bind socket: %s\n", err)
-		}
-		fmt.Printf("bind nic: %+v\n", inf)
-
-		// epollにソケットを監視させる
-		err = syscall.EpollCtl(epollFd, syscall.EPOLL_CTL_ADD, sockFd, &syscall.EpollEvent{
-			Events: syscall.EPOLLIN,
-			Fd:     int32(sockFd),
-		})
-		if err != nil {
-			log.Fatalf("Failed epollCtl: %s\n", err)
-		}
-
 		netAddrs, err := inf.Addrs()
 		if err != nil {
 			log.Fatalf("get ip addr from nic interface is err : %s\n", err)
 		}
 
-		ipv6Addr := getIpv6Device(netAddrs)
+		ipv6Addr, prefixLen := getIpv6Device(netAddrs)
 		if ipv6Addr == nil {
 			continue
 		}
 
-		ipv6Dev := newIpv6(*ipv6Addr, 64)
-		netDev := newNetIf(inf.Name, inf.HardwareAddr, sockFd, socketAddr, ipv6Dev)
+		netDev := newNetIf(inf.Name, newIpv6(*ipv6Addr, prefixLen))
+		netDev.up = inf.Flags&net.FlagRunning != 0
+		err = netDev.open(inf)
+		if err != nil {
+			log.Fatalf("Failed open %s: %s\n", inf.Name, err)
+		}
 
 		netDevices = append(netDevices, netDev)
-		fmt.Printf("effective netDevice, name is %s, socketFd is %d\n", netDev.name, netDev.socketFd)
+		linkLog.Info("effective device", "dev", netDev.name, "addr", *ipv6Addr)
 	}
 
-	// 有効なインターフェイスがなければ処理を終了する
+	// 有効なインターフェイスがなくても、追加されるのを待つ
 	if len(netDevices) == 0 {
-		log.Fatalf("No interface is enabled!\n")
+		sysLog.Warn("no interface is enabled, waiting for interfaces")
 	}
 
-	// ndテーブルの初期化
-	initNdTable()
-
-	createPatriciaNode(in6Addr{0x00}, 0, false, nil)
+	// SIGHUPとSIGTERMもイベントループで受け取る
+	err = initSignals()
+	if err != nil {
+		log.Fatalf("Failed handle signals : %s\n", err)
+	}
 
 	// ネットワーク設定の投入
-	configure()
+	configureFn()
 
-	// epollでソケットの受信状況を確認する
-	for {
-		// epoll_waitでパケットの受信を待つ
+	// epollでソケットの受信状況を確認する。SIGTERMかSIGINTを受け取ったら抜ける
+	for !shutdownRequested {
+		// epoll_waitでパケットの受信とタイマーの期限を待つ
 		nfDs, err := syscall.EpollWait(epollFd, events, -1)
 		if err != nil {
-			log.Fatalf("epoll wait err : %s", err)
-		}
-		for i := 0; i < nfDs; i++ {
-			// デバイスから通信を受信
-			for _, netDev := range netDevices {
-				// イベントがあったソケットとマッチしたらパケットを読み込む処理を実行
-				if events[i].Fd == int32(netDev.socketFd) {
-					err := netDev.poll()
-					if err != nil {
-						log.Fatal(err)
-					}
-				}
+			if err == syscall.EINTR {
+				continue
 			}
+			log.Fatalf("epoll wait err : %s", err)
 		}
+		// デバイスからの受信やTCPセッション、タイマーのイベントを処理する
+		epollDispatch(events[:nfDs])
 	}
+
+	shutdown()
 }
 
 func getNetDevByName(name string) *netDevice {
@@ -123,13 +143,16 @@ func getNetDevByName(name string) *netDevice {
 	return nil
 }
 
+/* アドレス、スタティック経路、スタティックな隣接ノードは設定ファイルから読み込み、commitで変更できる */
 func configure() {
-	ipv6Fib = createPatriciaNode(in6Addr{}, 0, false, nil)
-
-	configIpv6Addr(getNetDevByName("router1-host1"), parseIpv6("2001:db8:0:1001::1"), 64)
-	configIpv6Addr(getNetDevByName("router1-router2"), parseIpv6("2001:db8:0:1000::1"), 64)
-
-	configIpv6NetRoute(parseIpv6("2001:db8:0:1002::"), 64, parseIpv6("2001:db8:0:1000::2"))
+	// 設定ファイルがなければ空の設定で起動し、APIやSIGHUPで後から入れる
+	err := configLoadFile(configFilePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		sysLog.Warn("config file not found, starting with empty config", "path", configFilePath)
+	} else if err != nil {
+		log.Fatalf("Failed load config : %s\n", err)
+	}
 
-	updateNDTableEntry(getNetDevByName("router1-host1"), getMacAddr("host1", "host1-router1"), parseIpv6("2001:db8:0:1001::2"))
+	configApi("unix", API_DEFAULT_SOCKET)
+	configGrpcApi("unix", GRPC_DEFAULT_SOCKET)
 }
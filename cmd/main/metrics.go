@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+/**
+ * Prometheusのメトリクス
+ * カウンタはイベントループの中でだけ更新し、/metricsを読むときにapiRunでテキスト形式に書き出す。
+ * インターフェイスごとのカウンタはnetDevStatsに、インターフェイスに属さないものはdatapathStatsに持つ。
+ */
+const METRICS_PREFIX = "ipv6_router_"
+
+// インターフェイスに属さないデータパスのカウンタ
+var datapathStats = struct {
+	icmpv6Rx   [256]uint64 // タイプごとの受信したICMPv6
+	icmpv6Tx   [256]uint64 // タイプごとの送信したICMPv6
+	ndLookups  uint64      // 送信するときにNDテーブルを引いた回数
+	ndFailures uint64      // NDテーブルになくて捨てたパケット。NSを送ってアドレス解決を始める
+}{}
+
+/* 送信するときのNDテーブルの検索。見つからなければアドレス解決の失敗として数える */
+func countNdLookup(found bool) {
+	datapathStats.ndLookups++
+	if !found {
+		datapathStats.ndFailures++
+	}
+}
+
+type metricsWriter struct {
+	b bytes.Buffer
+}
+
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+/* メトリクスのHELPとTYPEを書く。サンプルはこの後に続ける */
+func (w *metricsWriter) metric(name string, typ string, help string) {
+	fmt.Fprintf(&w.b, "# HELP %s%s %s\n", METRICS_PREFIX, name, help)
+	fmt.Fprintf(&w.b, "# TYPE %s%s %s\n", METRICS_PREFIX, name, typ)
+}
+
+/* ラベルは名前と値を交互に並べる */
+func (w *metricsWriter) sample(name string, value uint64, labels ...string) {
+	w.b.WriteString(METRICS_PREFIX + name)
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i == 0 {
+			w.b.WriteByte('{')
+		} else {
+			w.b.WriteByte(',')
+		}
+		fmt.Fprintf(&w.b, "%s=\"%s\"", labels[i], metricsLabelEscaper.Replace(labels[i+1]))
+	}
+	if len(labels) > 1 {
+		w.b.WriteByte('}')
+	}
+	fmt.Fprintf(&w.b, " %d\n", value)
+}
+
+/* 状態ごとの数のように、ラベルの値ごとに数えたものを値の順に書く */
+func (w *metricsWriter) samples(name string, label string, counts map[string]uint64) {
+	var keys []string
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		w.sample(name, counts[k], label, k)
+	}
+}
+
+/* 全てのメトリクスをテキスト形式で書き出す。イベントループの中で呼ぶ */
+func writeMetrics() []byte {
+	w := &metricsWriter{}
+	writeInterfaceMetrics(w)
+	writeDatapathMetrics(w)
+	writeFibMetrics(w)
+	writeProtocolMetrics(w)
+	return w.b.Bytes()
+}
+
+func writeInterfaceMetrics(w *metricsWriter) {
+	counters := []struct {
+		name  string
+		help  string
+		value func(s *netDevStats) uint64
+	}{
+		{"interface_rx_packets_total", "Frames received on the interface.", func(s *netDevStats) uint64 { return s.rxPackets }},
+		{"interface_rx_bytes_total", "Bytes received on the interface.", func(s *netDevStats) uint64 { return s.rxBytes }},
+		{"interface_rx_errors_total", "Receive errors on the interface.", func(s *netDevStats) uint64 { return s.rxErrors }},
+		{"interface_tx_packets_total", "Frames sent on the interface.", func(s *netDevStats) uint64 { return s.txPackets }},
+		{"interface_tx_bytes_total", "Bytes sent on the interface.", func(s *netDevStats) uint64 { return s.txBytes }},
+		{"interface_tx_errors_total", "Send errors on the interface.", func(s *netDevStats) uint64 { return s.txErrors }},
+		{"ipv6_forwarded_packets_total", "IPv6 packets received on the interface and forwarded.", func(s *netDevStats) uint64 { return s.forwarded }},
+		{"ipv6_delivered_packets_total", "IPv6 packets received on the interface and delivered to the router.", func(s *netDevStats) uint64 { return s.delivered }},
+	}
+	for _, c := range counters {
+		w.metric(c.name, "counter", c.help)
+		for _, netDev := range netDevices {
+			w.sample(c.name, c.value(&netDev.stats), "interface", netDev.name, "vrf", netDev.vrf.name)
+		}
+	}
+
+	w.metric("interface_up", "gauge", "Whether the link of the interface is up.")
+	for _, netDev := range netDevices {
+		up := uint64(0)
+		if netDev.up {
+			up = 1
+		}
+		w.sample("interface_up", up, "interface", netDev.name, "vrf", netDev.vrf.name)
+	}
+}
+
+func writeDatapathMetrics(w *metricsWriter) {
+	// インターフェイスが決まらないまま捨てたものはinterfaceのラベルを空にする
+	w.metric("dropped_packets_total", "counter", "Packets dropped by the interface and the reason.")
+	for _, netDev := range netDevices {
+		for reason, n := range netDev.stats.drops {
+			if n > 0 {
+				w.sample("dropped_packets_total", n, "interface", netDev.name, "reason", dropReason(reason).String())
+			}
+		}
+	}
+	for reason, n := range dropLocalCounts {
+		if n > 0 {
+			w.sample("dropped_packets_total", n, "interface", "", "reason", dropReason(reason).String())
+		}
+	}
+
+	w.metric("icmpv6_messages_total", "counter", "ICMPv6 messages by the direction and the type.")
+	for typ, n := range datapathStats.icmpv6Rx {
+		if n > 0 {
+			w.sample("icmpv6_messages_total", n, "direction", "rx", "type", icmpv6TypeName(uint8(typ)))
+		}
+	}
+	for typ, n := range datapathStats.icmpv6Tx {
+		if n > 0 {
+			w.sample("icmpv6_messages_total", n, "direction", "tx", "type", icmpv6TypeName(uint8(typ)))
+		}
+	}
+
+	w.metric("nd_lookups_total", "counter", "Neighbor table lookups to send packets.")
+	w.sample("nd_lookups_total", datapathStats.ndLookups)
+	w.metric("nd_resolution_failures_total", "counter", "Packets dropped because the neighbor was not resolved.")
+	w.sample("nd_resolution_failures_total", datapathStats.ndFailures)
+
+	w.metric("nd_entries", "gauge", "Entries in the neighbor table.")
+	for _, v := range vrfs {
+		counts := map[string]uint64{"dynamic": 0, "static": 0}
+		for _, entry := range v.ndTable {
+			for ; entry != nil; entry = entry.next {
+				if entry.static {
+					counts["static"]++
+				} else {
+					counts["dynamic"]++
+				}
+			}
+		}
+		w.sample("nd_entries", counts["dynamic"], "vrf", v.name, "type", "dynamic")
+		w.sample("nd_entries", counts["static"], "vrf", v.name, "type", "static")
+	}
+}
+
+func writeFibMetrics(w *metricsWriter) {
+	w.metric("fib_routes", "gauge", "Routes in the FIB by the type and the protocol.")
+	for _, v := range vrfs {
+		counts := map[[2]string]uint64{}
+		patriciaTrieWalk(v.fib, func(prefix in6Addr, prefixLen uint8, route *ipv6RouteEntry) {
+			counts[[2]string{route.routeType.String(), route.proto.String()}]++
+		})
+		var keys [][2]string
+		for k := range counts {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i][0] != keys[j][0] {
+				return keys[i][0] < keys[j][0]
+			}
+			return keys[i][1] < keys[j][1]
+		})
+		for _, k := range keys {
+			w.sample("fib_routes", counts[k], "vrf", v.name, "type", k[0], "proto", k[1])
+		}
+	}
+}
+
+/* プロトコルの近隣の数を状態ごとに */
+func writeProtocolMetrics(w *metricsWriter) {
+	counts := map[string]uint64{}
+	for _, peer := range bgpPeers {
+		counts[peer.state.String()]++
+	}
+	w.metric("bgp_peers", "gauge", "BGP peers by the state.")
+	w.samples("bgp_peers", "state", counts)
+
+	counts = map[string]uint64{}
+	for _, iface := range ospfv3Interfaces {
+		for _, nbr := range iface.neighbors {
+			counts[nbr.state.String()]++
+		}
+	}
+	w.metric("ospfv3_neighbors", "gauge", "OSPFv3 neighbors by the state.")
+	w.samples("ospfv3_neighbors", "state", counts)
+
+	counts = map[string]uint64{}
+	for _, circuit := range isisCircuits {
+		for _, adj := range circuit.adjs {
+			counts[adj.state.String()]++
+		}
+	}
+	w.metric("isis_adjacencies", "gauge", "IS-IS adjacencies by the state.")
+	w.samples("isis_adjacencies", "state", counts)
+
+	counts = map[string]uint64{}
+	for _, s := range bfdSessions {
+		counts[s.state.String()]++
+	}
+	w.metric("bfd_sessions", "gauge", "BFD sessions by the state.")
+	w.samples("bfd_sessions", "state", counts)
+
+	counts = map[string]uint64{}
+	for _, vr := range vrrpRouters {
+		counts[vr.state.String()]++
+	}
+	w.metric("vrrp_routers", "gauge", "VRRP virtual routers by the state.")
+	w.samples("vrrp_routers", "state", counts)
+
+	w.metric("ripng_routes", "gauge", "Routes learned by RIPng.")
+	w.sample("ripng_routes", uint64(len(ripngRoutes)))
+}
@@ -2,36 +2,49 @@ package main
 
 import (
 	"bytes"
-	"fmt"
 )
 
 const ND_TABLE_SIZE = 1111
 
-var ndTable map[uint32]*ndTableEntry
-
 type ndTableEntry struct {
 	macAddr [6]uint8
 	v6Addr  in6Addr
 	dev     *netDevice
-	next    *ndTableEntry
+	// 設定で入れたエントリ。NS/NAで学習した内容で上書きせず、リンクが落ちても消さない
+	static bool
+	next   *ndTableEntry
 }
 
-func initNdTable() {
-	ndTable = make(map[uint32]*ndTableEntry)
+/* NDテーブルはインターフェイスが所属するVRFのものを更新する */
+func updateNDTableEntry(netDev *netDevice, macAddr [6]uint8, v6Addr in6Addr) {
+	ndTableEntryUpdate(netDev, macAddr, v6Addr, false)
 }
 
-func updateNDTableEntry(netDev *netDevice, macAddr [6]uint8, v6Addr in6Addr) {
+/* スタティックなエントリを入れる。同じアドレスの学習済みのエントリは置き換える */
+func addStaticNDTableEntry(netDev *netDevice, macAddr [6]uint8, v6Addr in6Addr) {
+	ndTableEntryUpdate(netDev, macAddr, v6Addr, true)
+}
+
+func ndTableEntryUpdate(netDev *netDevice, macAddr [6]uint8, v6Addr in6Addr, static bool) {
+	ndTable := netDev.vrf.ndTable
 	candidate := ndTable[in6AddrSum(v6Addr)%ND_TABLE_SIZE]
-	macStr := fmtMacStr(macAddr)
-	ipv6Str := fmtIpStr(v6Addr)
 
 	for candidate != nil {
 		if v6Addr == candidate.v6Addr {
+			if candidate.static && !static {
+				ndLog.Debug("entry is static, ignore learned mac", "dev", netDev.name, "addr", v6Addr, "mac", logMacAddr(macAddr))
+				return
+			}
+			changed := candidate.macAddr != macAddr || candidate.dev != netDev || candidate.static != static
+			candidate.static = static
 			candidate.macAddr = macAddr
 			candidate.v6Addr = v6Addr
 			candidate.dev = netDev
+			if changed {
+				grpcNotifyNeighbor(netDev.vrf, candidate, false)
+			}
 
-			fmt.Printf("update ND table. macAddr is %s, ipAddr is %s\n", macStr, ipv6Str)
+			ndLog.Debug("update entry", "dev", netDev.name, "addr", v6Addr, "mac", logMacAddr(macAddr), "static", static)
 			return
 		}
 		candidate = candidate.next
@@ -42,12 +55,15 @@ func updateNDTableEntry(netDev *netDevice, macAddr [6]uint8, v6Addr in6Addr) {
 		macAddr: macAddr,
 		v6Addr:  v6Addr,
 		dev:     netDev,
+		static:  static,
+		next:    ndTable[in6AddrSum(v6Addr)%ND_TABLE_SIZE],
 	}
-	fmt.Printf("insert ND table. macAddr is %s, ipAddr is %s\n", macStr, ipv6Str)
+	grpcNotifyNeighbor(netDev.vrf, ndTable[in6AddrSum(v6Addr)%ND_TABLE_SIZE], false)
+	ndLog.Debug("add entry", "dev", netDev.name, "addr", v6Addr, "mac", logMacAddr(macAddr), "static", static)
 }
 
-func searchNDTableEntry(v6Addr in6Addr) *ndTableEntry {
-	candidate := ndTable[in6AddrSum(v6Addr)%ND_TABLE_SIZE]
+func searchNDTableEntry(v *vrf, v6Addr in6Addr) *ndTableEntry {
+	candidate := v.ndTable[in6AddrSum(v6Addr)%ND_TABLE_SIZE]
 
 	for candidate != nil {
 		if bytes.Equal(v6Addr[:], candidate.v6Addr[:]) {
@@ -58,3 +74,55 @@ func searchNDTableEntry(v6Addr in6Addr) *ndTableEntry {
 
 	return nil
 }
+
+/* エントリを1つ消す。スタティックなエントリも消す */
+func deleteNDTableEntry(v *vrf, v6Addr in6Addr) bool {
+	hash := in6AddrSum(v6Addr) % ND_TABLE_SIZE
+	var prev *ndTableEntry
+	for entry := v.ndTable[hash]; entry != nil; entry = entry.next {
+		if entry.v6Addr != v6Addr {
+			prev = entry
+			continue
+		}
+		if prev == nil {
+			v.ndTable[hash] = entry.next
+		} else {
+			prev.next = entry.next
+		}
+		if v.ndTable[hash] == nil {
+			delete(v.ndTable, hash)
+		}
+		ndLog.Debug("delete entry", "dev", entry.dev.name, "addr", entry.v6Addr, "mac", logMacAddr(entry.macAddr))
+		grpcNotifyNeighbor(v, entry, true)
+		return true
+	}
+	return false
+}
+
+/* インターフェイスで学習したエントリを全て消す。リンクが落ちたときに使う。スタティックなエントリは残す */
+func flushNDTableEntries(netDev *netDevice) {
+	ndTable := netDev.vrf.ndTable
+	for hash, entry := range ndTable {
+		var head *ndTableEntry
+		var tail *ndTableEntry
+		for ; entry != nil; entry = entry.next {
+			if entry.dev == netDev && !entry.static {
+				ndLog.Debug("flush entry", "dev", netDev.name, "addr", entry.v6Addr, "mac", logMacAddr(entry.macAddr))
+				grpcNotifyNeighbor(netDev.vrf, entry, true)
+				continue
+			}
+			if tail == nil {
+				head = entry
+			} else {
+				tail.next = entry
+			}
+			tail = entry
+		}
+		if tail == nil {
+			delete(ndTable, hash)
+			continue
+		}
+		tail.next = nil
+		ndTable[hash] = head
+	}
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"encoding/binary"
 	"fmt"
 	"net"
 	"syscall"
+	"unsafe"
 )
 
+// syscallパッケージに定義がない
+const PACKET_MR_UNICAST = 3
+
 var ignoreIfNames = []string{"lo", "bond0", "dummy0", "tunl0", "sit0"}
 
 type netDevice struct {
@@ -15,53 +20,196 @@ type netDevice struct {
 	sockAddr  syscall.SockaddrLinklayer
 	ethHeader *ethernetHeader
 	ipv6Dev   *ipv6Device
+	vrf       *vrf          // 所属するVRF
+	sflow     *sflowSampler // sFlowのサンプリング。設定していなければnil
+	up        bool          // リンクの運用状態
+	stats     netDevStats
+
+	// 登録したMACアドレスと登録した回数。ソケットを開き直したときに登録し直す
+	macMemberships map[[6]uint8]int
+}
+
+/* 送受信したフレームの数。インターフェイスが消えて戻ってきても引き継ぐ */
+type netDevStats struct {
+	rxPackets uint64
+	rxBytes   uint64
+	rxErrors  uint64
+	txPackets uint64
+	txBytes   uint64
+	txErrors  uint64
+	forwarded uint64 // 受信してフォワーディングしたIPv6パケット
+	delivered uint64 // 受信してルータ宛てだったIPv6パケット
+	drops     [DROP_REASON_MAX]uint64
 }
 
-func newNetIf(
-	name string,
-	macAddr net.HardwareAddr,
-	socketFd int,
-	sockAddr syscall.SockaddrLinklayer,
-	ipv6Dev *ipv6Device) *netDevice {
+func newNetIf(name string, ipv6Dev *ipv6Device) *netDevice {
 	return &netDevice{
-		name:     name,
-		macAddr:  setMacAddr(macAddr),
-		socketFd: socketFd,
-		sockAddr: sockAddr,
-		ipv6Dev:  ipv6Dev,
+		name:           name,
+		socketFd:       -1,
+		ipv6Dev:        ipv6Dev,
+		vrf:            defaultVrf,
+		macMemberships: map[[6]uint8]int{},
+	}
+}
+
+/*
+ * インターフェイスのソケットを開いてbindし、epollに登録する。
+ * 一度消えたインターフェイスが戻ってきたときにも使い、MACアドレスの登録をやり直す。
+ */
+func (netDev *netDevice) open(inf net.Interface) error {
+	// ソケットAPIをオープンする
+	protocol := htons(syscall.ETH_P_ALL)
+	sockFd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(protocol))
+	if err != nil {
+		return fmt.Errorf("open socket: %s", err)
+	}
+
+	// ソケットをインターフェイスにbindする
+	socketAddr := syscall.SockaddrLinklayer{
+		Protocol: htons(syscall.ETH_P_ALL),
+		Ifindex:  inf.Index,
+	}
+	err = syscall.Bind(sockFd, &socketAddr)
+	if err != nil {
+		syscall.Close(sockFd)
+		return fmt.Errorf("bind socket: %s", err)
+	}
+
+	// epollにソケットを監視させる
+	err = epollAdd(sockFd, syscall.EPOLLIN, func(events uint32) {
+		// リンクが落ちたときなどの受信エラーはパケットを捨てて続ける
+		err := netDev.poll()
+		if err != nil {
+			linkLog.Debug("failed to receive", "dev", netDev.name, "err", err)
+		}
+	})
+	if err != nil {
+		syscall.Close(sockFd)
+		return err
+	}
+
+	netDev.socketFd = sockFd
+	netDev.sockAddr = socketAddr
+	netDev.macAddr = setMacAddr(inf.HardwareAddr)
+	if netDev.ipv6Dev != nil {
+		netDev.ipv6Dev.linkLocalAddr = in6AddrLinkLocal(netDev.macAddr)
+	}
+	for macAddr, count := range netDev.macMemberships {
+		for i := 0; i < count; i++ {
+			netDev.setMacMembership(syscall.PACKET_ADD_MEMBERSHIP, macAddr)
+		}
 	}
+
+	linkLog.Info("open device", "dev", netDev.name, "fd", netDev.socketFd, "ifindex", inf.Index)
+	return nil
+}
+
+/* ソケットを閉じる。設定やプロトコルの状態は残しておき、インターフェイスが戻ってきたら使う */
+func (netDev *netDevice) close() {
+	if netDev.socketFd < 0 {
+		return
+	}
+	epollDelete(netDev.socketFd)
+	syscall.Close(netDev.socketFd)
+	linkLog.Info("close device", "dev", netDev.name, "fd", netDev.socketFd)
+
+	netDev.socketFd = -1
+	netDev.sockAddr = syscall.SockaddrLinklayer{}
 }
 
 /* ネットデバイスの送信処理 */
-func (netDev netDevice) transmit(buffer []uint8) error {
+func (netDev *netDevice) transmit(buffer []uint8) error {
+	if !netDev.up {
+		netDev.stats.txErrors++
+		dropFrame(netDev, DROP_LINK_DOWN, buffer)
+		return fmt.Errorf("link %s is down", netDev.name)
+	}
 	err := syscall.Sendto(netDev.socketFd, buffer, 0, &netDev.sockAddr)
 	if err != nil {
+		netDev.stats.txErrors++
+		dropFrame(netDev, DROP_TX_ERROR, buffer)
 		return err
 	}
+	netDev.stats.txPackets++
+	netDev.stats.txBytes += uint64(len(buffer))
+	capture(netDev, CAPTURE_TX, buffer, true, "")
+	traceStep(packetTraceStep{node: "interface-output", decision: "sent", outDev: netDev.name})
 	return nil
 }
 
 /* ネットワークデバイスの受信処理 */
 func (netDev *netDevice) poll() error {
-	recvBuffer := make([]byte, 1500)
+	// イーサネットヘッダの分も含めて最大のフレームを受け取れるようにする
+	recvBuffer := make([]byte, 14+ETHER_MAX_PAYLOAD_LEN)
 	n, _, err := syscall.Recvfrom(netDev.socketFd, recvBuffer, 0)
 	if err != nil {
 		if n == -1 {
 			return nil
 		} else {
+			netDev.stats.rxErrors++
 			return fmt.Errorf("recv err, n is %d, device is %s, err is %s", n, netDev.name, err)
 		}
 	}
 
-	// 受信したデータを表示してみる
-	fmt.Printf("Received %d bytes from %s: %x\n", n, netDev.name, recvBuffer[:n])
+	netDev.stats.rxPackets++
+	netDev.stats.rxBytes += uint64(n)
+
+	ethLog.Debug("received frame", "dev", netDev.name, "len", n, "frame", logHex(recvBuffer[:n]))
 
 	// 受信したデータをイーサネットに送る
+	rxFrame = recvBuffer[:n]
+	capture(netDev, CAPTURE_RX, rxFrame, true, "")
+	if netDev.sflow != nil && sflowAgent.enabled {
+		sflowSample(netDev, rxFrame)
+	}
+	traceBegin(netDev, rxFrame)
 	ethernetInput(netDev, recvBuffer[:n])
+	traceEnd()
+	rxFrame = nil
 
 	return nil
 }
 
+/*
+ * MACアドレス宛てのフレームをNICで受け取れるようにする(packet_mreq)。
+ * 仮想MACアドレスや参加したマルチキャストグループのMACアドレスを登録する。
+ */
+func (netDev *netDevice) addMacMembership(macAddr [6]uint8) {
+	netDev.macMemberships[macAddr]++
+	netDev.setMacMembership(syscall.PACKET_ADD_MEMBERSHIP, macAddr)
+}
+
+func (netDev *netDevice) dropMacMembership(macAddr [6]uint8) {
+	if netDev.macMemberships[macAddr] <= 1 {
+		delete(netDev.macMemberships, macAddr)
+	} else {
+		netDev.macMemberships[macAddr]--
+	}
+	netDev.setMacMembership(syscall.PACKET_DROP_MEMBERSHIP, macAddr)
+}
+
+func (netDev *netDevice) setMacMembership(opt int, macAddr [6]uint8) {
+	// ソケットがなければ開いたときに登録する
+	if netDev.socketFd < 0 {
+		return
+	}
+	mrType := uint16(PACKET_MR_UNICAST)
+	if macAddr[0]&0x01 != 0 {
+		mrType = syscall.PACKET_MR_MULTICAST
+	}
+
+	var mreq [16]byte
+	binary.NativeEndian.PutUint32(mreq[0:4], uint32(netDev.sockAddr.Ifindex))
+	binary.NativeEndian.PutUint16(mreq[4:6], mrType)
+	binary.NativeEndian.PutUint16(mreq[6:8], 6)
+	copy(mreq[8:14], macAddr[:])
+
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETSOCKOPT, uintptr(netDev.socketFd), syscall.SOL_PACKET, uintptr(opt), uintptr(unsafe.Pointer(&mreq[0])), uintptr(len(mreq)), 0)
+	if errno != 0 {
+		linkLog.Warn("failed to set mac membership", "dev", netDev.name, "mac", logMacAddr(macAddr), "err", errno)
+	}
+}
+
 func (netDev *netDevice) setEthHeader(ethHeader *ethernetHeader) {
 	netDev.ethHeader = ethHeader
 }
@@ -0,0 +1,848 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+)
+
+/**
+ * OSPFv3(RFC 5340)
+ * https://datatracker.ietf.org/doc/html/rfc5340
+ * インターフェイスと近隣ルータの状態遷移、パケットの送受信を扱う
+ */
+const IPV6_PROTOCOL_NUM_OSPF uint8 = 89
+
+const OSPFV3_ALL_SPF_ROUTERS = "ff02::5"
+const OSPFV3_ALL_D_ROUTERS = "ff02::6"
+
+const OSPFV3_VERSION uint8 = 3
+const OSPFV3_HEADER_LEN = 16
+
+const (
+	OSPFV3_TYPE_HELLO uint8 = iota + 1
+	OSPFV3_TYPE_DD
+	OSPFV3_TYPE_LSR
+	OSPFV3_TYPE_LSU
+	OSPFV3_TYPE_LSACK
+)
+
+// V6, E, Rビット
+const OSPFV3_OPTIONS uint32 = 0x000013
+const OSPFV3_OPTION_E uint32 = 0x000002
+
+const OSPFV3_DD_FLAG_MS uint8 = 0x01
+const OSPFV3_DD_FLAG_M uint8 = 0x02
+const OSPFV3_DD_FLAG_I uint8 = 0x04
+
+const OSPFV3_INTERFACE_MTU = 1500
+
+const OSPFV3_HELLO_INTERVAL = 10 * time.Second
+const OSPFV3_DEAD_INTERVAL = 40 * time.Second
+const OSPFV3_RXMT_INTERVAL = 5 * time.Second
+const OSPFV3_DEFAULT_PRIORITY uint8 = 1
+const OSPFV3_DEFAULT_COST uint16 = 10
+
+type ospfv3NetworkType int
+
+const (
+	OSPFV3_NETWORK_BROADCAST ospfv3NetworkType = iota
+	OSPFV3_NETWORK_POINT_TO_POINT
+)
+
+type ospfv3IfState int
+
+const (
+	OSPFV3_IF_DOWN ospfv3IfState = iota
+	OSPFV3_IF_WAITING
+	OSPFV3_IF_POINT_TO_POINT
+	OSPFV3_IF_DROTHER
+	OSPFV3_IF_BACKUP
+	OSPFV3_IF_DR
+)
+
+type ospfv3NbrState int
+
+const (
+	OSPFV3_NBR_DOWN ospfv3NbrState = iota
+	OSPFV3_NBR_INIT
+	OSPFV3_NBR_TWO_WAY
+	OSPFV3_NBR_EXSTART
+	OSPFV3_NBR_EXCHANGE
+	OSPFV3_NBR_LOADING
+	OSPFV3_NBR_FULL
+)
+
+type ospfv3Area struct {
+	id         uint32
+	lsdb       map[ospfv3LsaKey]*ospfv3Lsa // エリアスコープのLSA
+	interfaces []*ospfv3Interface
+}
+
+type ospfv3Interface struct {
+	dev         *netDevice
+	area        *ospfv3Area
+	networkType ospfv3NetworkType
+	cost        uint16
+	priority    uint8
+	interfaceId uint32
+	state       ospfv3IfState
+	dr          uint32 // DRのルータID
+	bdr         uint32 // BDRのルータID
+	neighbors   map[uint32]*ospfv3Neighbor
+	linkLsdb    map[ospfv3LsaKey]*ospfv3Lsa // リンクスコープのLSA
+	helloTimer  *timer
+	waitTimer   *timer
+	bfd         bool // 近隣ルータをBFDで監視する
+}
+
+type ospfv3Neighbor struct {
+	iface       *ospfv3Interface
+	routerId    uint32
+	addr        in6Addr // 近隣ルータのリンクローカルアドレス
+	priority    uint8
+	interfaceId uint32
+	dr          uint32 // 近隣ルータが宣言しているDR
+	bdr         uint32 // 近隣ルータが宣言しているBDR
+	state       ospfv3NbrState
+
+	master      bool // 自分がマスターか
+	ddSeq       uint32
+	lastRecvDd  []byte
+	lastSentDd  []byte
+	summaryList []ospfv3LsaHeader
+	requestList map[ospfv3LsaKey]ospfv3LsaHeader
+	retransList map[ospfv3LsaKey]*ospfv3Lsa
+
+	inactivityTimer *timer
+	rxmtTimer       *timer
+	bfdClient       *bfdClient
+}
+
+/* 設定ファイルの"interface X ospfv3"の後ろ */
+type ospfv3InterfaceConfig struct {
+	areaId      string
+	networkType ospfv3NetworkType
+	cost        uint16
+}
+
+var ospfv3RouterId uint32
+var ospfv3Areas = map[uint32]*ospfv3Area{}
+var ospfv3Interfaces []*ospfv3Interface
+
+func (state ospfv3NbrState) String() string {
+	return [...]string{"Down", "Init", "2-Way", "ExStart", "Exchange", "Loading", "Full"}[state]
+}
+
+func (state ospfv3IfState) String() string {
+	return [...]string{"Down", "Waiting", "PointToPoint", "DROther", "Backup", "DR"}[state]
+}
+
+/* area AREA [network point-to-point|broadcast] [cost COST]。エリアは整数でも書ける */
+func parseOspfv3InterfaceConfig(words []string) (*ospfv3InterfaceConfig, error) {
+	usage := fmt.Errorf("usage: ospfv3 area AREA [network point-to-point|broadcast] [cost COST]")
+	if len(words) < 2 || len(words)%2 != 0 || words[0] != "area" {
+		return nil, usage
+	}
+	config := &ospfv3InterfaceConfig{
+		networkType: OSPFV3_NETWORK_BROADCAST,
+		cost:        OSPFV3_DEFAULT_COST,
+	}
+	if ip := net.ParseIP(words[1]).To4(); ip != nil {
+		config.areaId = ip.String()
+	} else if id, err := strconv.ParseUint(words[1], 10, 32); err == nil {
+		config.areaId = fmtRouterIdStr(uint32(id))
+	} else {
+		return nil, fmt.Errorf("invalid area %s", words[1])
+	}
+	for i := 2; i < len(words); i += 2 {
+		switch words[i] {
+		case "network":
+			switch words[i+1] {
+			case "point-to-point":
+				config.networkType = OSPFV3_NETWORK_POINT_TO_POINT
+			case "broadcast":
+				config.networkType = OSPFV3_NETWORK_BROADCAST
+			default:
+				return nil, fmt.Errorf("invalid network type %s", words[i+1])
+			}
+		case "cost":
+			cost, err := strconv.ParseUint(words[i+1], 10, 16)
+			if err != nil || cost == 0 {
+				return nil, fmt.Errorf("invalid cost %s", words[i+1])
+			}
+			config.cost = uint16(cost)
+		default:
+			return nil, usage
+		}
+	}
+	return config, nil
+}
+
+/* 設定ファイルに書く形。ネットワークタイプとコストは省略しない */
+func (config *ospfv3InterfaceConfig) String() string {
+	network := "broadcast"
+	if config.networkType == OSPFV3_NETWORK_POINT_TO_POINT {
+		network = "point-to-point"
+	}
+	return fmt.Sprintf("area %s network %s cost %d", config.areaId, network, config.cost)
+}
+
+func configOspfv3RouterId(routerId string) {
+	ospfv3RouterId = parseRouterId(routerId)
+	configLog.Info("configure ospfv3", "routerId", fmtRouterIdStr(ospfv3RouterId))
+}
+
+func configOspfv3Interface(netDev *netDevice, areaId string, networkType ospfv3NetworkType, cost uint16) {
+	if netDev == nil {
+		ospfv3Log.Warn("net device to configure not found")
+		return
+	}
+	if ospfv3RouterId == 0 {
+		configLog.Warn("ospfv3 router id is not configured")
+		return
+	}
+
+	area := ospfv3Areas[parseRouterId(areaId)]
+	if area == nil {
+		area = &ospfv3Area{
+			id:   parseRouterId(areaId),
+			lsdb: make(map[ospfv3LsaKey]*ospfv3Lsa),
+		}
+		ospfv3Areas[area.id] = area
+	}
+
+	ospfv3StartAging()
+
+	iface := &ospfv3Interface{
+		dev:         netDev,
+		area:        area,
+		networkType: networkType,
+		cost:        cost,
+		priority:    OSPFV3_DEFAULT_PRIORITY,
+		interfaceId: uint32(netDev.sockAddr.Ifindex),
+		neighbors:   make(map[uint32]*ospfv3Neighbor),
+		linkLsdb:    make(map[ospfv3LsaKey]*ospfv3Lsa),
+	}
+	area.interfaces = append(area.interfaces, iface)
+	ospfv3Interfaces = append(ospfv3Interfaces, iface)
+
+	ipv6JoinMcast(netDev.ipv6Dev, parseIpv6(OSPFV3_ALL_SPF_ROUTERS))
+	configLog.Info("configure ospfv3", "dev", netDev.name, "area", fmtRouterIdStr(area.id))
+
+	ospfv3InterfaceUp(iface)
+}
+
+/*
+ * インターフェイスのOSPFv3を止める。近隣ルータを載せないHelloを送って隣接を落とさせ、
+ * 残ったインターフェイスでLSAと経路を作り直す。インターフェイスがなくなったエリアは捨てる。
+ */
+func unconfigOspfv3Interface(netDev *netDevice) {
+	iface := getOspfv3Interface(netDev)
+	if iface == nil {
+		return
+	}
+
+	iface.helloTimer.stop()
+	iface.waitTimer.stop()
+	for _, nbr := range iface.neighbors {
+		ospfv3KillNeighbor(nbr)
+	}
+	if iface.state != OSPFV3_IF_DOWN {
+		ospfv3SendHello(iface)
+	}
+	ospfv3SetInterfaceState(iface, OSPFV3_IF_DOWN)
+
+	area := iface.area
+	for i := range area.interfaces {
+		if area.interfaces[i] == iface {
+			area.interfaces = append(area.interfaces[:i], area.interfaces[i+1:]...)
+			break
+		}
+	}
+	if len(area.interfaces) == 0 {
+		delete(ospfv3Areas, area.id)
+	}
+	for i := range ospfv3Interfaces {
+		if ospfv3Interfaces[i] == iface {
+			ospfv3Interfaces = append(ospfv3Interfaces[:i], ospfv3Interfaces[i+1:]...)
+			break
+		}
+	}
+
+	ipv6LeaveMcast(netDev.ipv6Dev, parseIpv6(OSPFV3_ALL_SPF_ROUTERS))
+	ipv6LeaveMcast(netDev.ipv6Dev, parseIpv6(OSPFV3_ALL_D_ROUTERS))
+	configLog.Info("unconfigure ospfv3", "dev", netDev.name)
+
+	ospfv3ScheduleSpf()
+}
+
+/* ルータIDを変えるときや設定を消すときにOSPFv3を全て止め、LSDBと学習した経路を捨てる */
+func unconfigOspfv3() {
+	for len(ospfv3Interfaces) > 0 {
+		unconfigOspfv3Interface(ospfv3Interfaces[0].dev)
+	}
+
+	ospfv3OriginateTimer.stop()
+	ospfv3SpfTimer.stop()
+	ospfv3AgingTimer.stop()
+	ospfv3AgingTimer = nil
+	ospfv3Areas = map[uint32]*ospfv3Area{}
+	ospfv3AsLsdb = map[ospfv3LsaKey]*ospfv3Lsa{}
+	ospfv3SummaryLsIds = map[ribKey]uint32{}
+	ospfv3ExternalLsIds = map[ribKey]uint32{}
+	ospfv3IntraAreaCosts = map[uint32]map[ribKey]uint32{}
+	ospfv3InstallRoutes(map[ribKey]*ospfv3Route{})
+
+	ospfv3RouterId = 0
+	configLog.Info("unconfigure ospfv3")
+}
+
+/* インターフェイスの近隣ルータをBFDで監視し、BFDのセッションが落ちたら近隣ルータを落とす */
+func configOspfv3InterfaceBfd(netDev *netDevice) {
+	iface := getOspfv3Interface(netDev)
+	if iface == nil {
+		configLog.Warn("ospfv3 is not configured on the device", "dev", netDev.name)
+		return
+	}
+	iface.bfd = true
+	configLog.Info("configure ospfv3 bfd", "dev", netDev.name)
+
+	for _, nbr := range iface.neighbors {
+		if nbr.state >= OSPFV3_NBR_TWO_WAY {
+			ospfv3StartNeighborBfd(nbr)
+		}
+	}
+}
+
+/* 近隣ルータのBFDでの監視をやめる。近隣ルータはそのまま */
+func unconfigOspfv3InterfaceBfd(netDev *netDevice) {
+	iface := getOspfv3Interface(netDev)
+	if iface == nil || !iface.bfd {
+		return
+	}
+	iface.bfd = false
+	for _, nbr := range iface.neighbors {
+		bfdUnregister(nbr.bfdClient)
+		nbr.bfdClient = nil
+	}
+	configLog.Info("unconfigure ospfv3 bfd", "dev", netDev.name)
+}
+
+func getOspfv3Interface(netDev *netDevice) *ospfv3Interface {
+	for _, iface := range ospfv3Interfaces {
+		if iface.dev == netDev {
+			return iface
+		}
+	}
+	return nil
+}
+
+func ospfv3InterfaceUp(iface *ospfv3Interface) {
+	iface.helloTimer = newTimer(0, func() {
+		ospfv3SendHello(iface)
+		iface.helloTimer.reset(OSPFV3_HELLO_INTERVAL)
+	})
+
+	if iface.networkType == OSPFV3_NETWORK_POINT_TO_POINT {
+		ospfv3SetInterfaceState(iface, OSPFV3_IF_POINT_TO_POINT)
+		return
+	}
+
+	// ブロードキャストではDRを選ぶ前にデッドインターバルの間だけ既存のDRを待つ
+	ospfv3SetInterfaceState(iface, OSPFV3_IF_WAITING)
+	iface.waitTimer = newTimer(OSPFV3_DEAD_INTERVAL, func() {
+		ospfv3ElectDr(iface)
+	})
+}
+
+func ospfv3SetInterfaceState(iface *ospfv3Interface, state ospfv3IfState) {
+	if iface.state == state {
+		return
+	}
+	ospfv3Log.Info("interface state changed", "dev", iface.dev.name, "prev", iface.state.String(), "state", state.String())
+	iface.state = state
+
+	if state == OSPFV3_IF_DR || state == OSPFV3_IF_BACKUP {
+		ipv6JoinMcast(iface.dev.ipv6Dev, parseIpv6(OSPFV3_ALL_D_ROUTERS))
+	}
+
+	ospfv3ScheduleOriginate()
+}
+
+/* OSPFv3パケットの受信処理 */
+func ospfv3Input(netDev *netDevice, ipv6header *ipv6Header, buffer []byte) {
+	iface := getOspfv3Interface(netDev)
+	if iface == nil || iface.state == OSPFV3_IF_DOWN {
+		return
+	}
+	if len(buffer) < OSPFV3_HEADER_LEN {
+		ospfv3Log.Debug("received packet is too short", "size", len(buffer))
+		return
+	}
+
+	version := buffer[0]
+	pktType := buffer[1]
+	pktLen := byteToUint16(buffer[2:4])
+	routerId := byteToUint32(buffer[4:8])
+	areaId := byteToUint32(buffer[8:12])
+	instanceId := buffer[14]
+
+	if version != OSPFV3_VERSION || int(pktLen) > len(buffer) || pktLen < OSPFV3_HEADER_LEN {
+		ospfv3Log.Debug("invalid packet", "version", version, "length", pktLen)
+		return
+	}
+	buffer = buffer[:pktLen]
+
+	phdr := ipv6PseudoHeader{
+		srcAddr:      ipv6header.srcAddr,
+		dstAddr:      ipv6header.dstAddr,
+		packetLength: uint32(pktLen),
+		nextHeader:   IPV6_PROTOCOL_NUM_OSPF,
+	}
+	if checksum16(buffer, ^checksum16(phdr.toPseudoHeader(), 0)) != 0 {
+		ospfv3Log.Debug("invalid checksum", "src", ipv6header.srcAddr)
+		return
+	}
+
+	if areaId != iface.area.id || instanceId != 0 || routerId == ospfv3RouterId {
+		return
+	}
+	// AllDRoutersへのパケットはDRとBDRだけが受け取る
+	if ipv6header.dstAddr == parseIpv6(OSPFV3_ALL_D_ROUTERS) && iface.state != OSPFV3_IF_DR && iface.state != OSPFV3_IF_BACKUP {
+		return
+	}
+
+	body := buffer[OSPFV3_HEADER_LEN:]
+	if pktType == OSPFV3_TYPE_HELLO {
+		ospfv3HelloInput(iface, ipv6header.srcAddr, routerId, body)
+		return
+	}
+
+	nbr := iface.neighbors[routerId]
+	if nbr == nil {
+		ospfv3Log.Debug("packet from unknown neighbor", "type", pktType, "routerId", fmtRouterIdStr(routerId))
+		return
+	}
+
+	switch pktType {
+	case OSPFV3_TYPE_DD:
+		ospfv3DdInput(nbr, body)
+	case OSPFV3_TYPE_LSR:
+		ospfv3LsrInput(nbr, body)
+	case OSPFV3_TYPE_LSU:
+		ospfv3LsuInput(nbr, body)
+	case OSPFV3_TYPE_LSACK:
+		ospfv3LsAckInput(nbr, body)
+	default:
+		ospfv3Log.Debug("unknown packet type", "type", pktType)
+	}
+}
+
+func ospfv3HelloInput(iface *ospfv3Interface, srcAddr in6Addr, routerId uint32, body []byte) {
+	if len(body) < 20 || (len(body)-20)%4 != 0 {
+		ospfv3Log.Debug("invalid hello size", "size", len(body))
+		return
+	}
+	if !in6AddrIsLinkLocal(srcAddr) {
+		return
+	}
+
+	interfaceId := byteToUint32(body[0:4])
+	priority := body[4]
+	options := byteToUint32(append([]byte{0}, body[5:8]...))
+	helloInterval := byteToUint16(body[8:10])
+	deadInterval := byteToUint16(body[10:12])
+	dr := byteToUint32(body[12:16])
+	bdr := byteToUint32(body[16:20])
+
+	if time.Duration(helloInterval)*time.Second != OSPFV3_HELLO_INTERVAL || time.Duration(deadInterval)*time.Second != OSPFV3_DEAD_INTERVAL {
+		ospfv3Log.Warn("hello interval mismatch", "routerId", fmtRouterIdStr(routerId), "dev", iface.dev.name)
+		return
+	}
+	if options&OSPFV3_OPTION_E != OSPFV3_OPTIONS&OSPFV3_OPTION_E {
+		ospfv3Log.Warn("hello option mismatch", "routerId", fmtRouterIdStr(routerId), "dev", iface.dev.name)
+		return
+	}
+
+	nbr := iface.neighbors[routerId]
+	if nbr == nil {
+		nbr = &ospfv3Neighbor{
+			iface:       iface,
+			routerId:    routerId,
+			requestList: make(map[ospfv3LsaKey]ospfv3LsaHeader),
+			retransList: make(map[ospfv3LsaKey]*ospfv3Lsa),
+		}
+		iface.neighbors[routerId] = nbr
+		ospfv3Log.Info("new neighbor", "routerId", fmtRouterIdStr(routerId), "dev", iface.dev.name)
+	}
+
+	// 近隣ルータへのユニキャストに備えて、NDテーブルになければアドレス解決を始めておく
+	if searchNDTableEntry(iface.dev.vrf, srcAddr) == nil {
+		sendNsPacket(iface.dev, srcAddr)
+	}
+
+	prevPriority, prevDr, prevBdr := nbr.priority, nbr.dr, nbr.bdr
+	nbr.addr = srcAddr
+	nbr.interfaceId = interfaceId
+	nbr.priority = priority
+	nbr.dr = dr
+	nbr.bdr = bdr
+
+	// HelloReceived
+	if nbr.state == OSPFV3_NBR_DOWN {
+		ospfv3SetNeighborState(nbr, OSPFV3_NBR_INIT)
+	}
+	if nbr.inactivityTimer == nil {
+		nbr.inactivityTimer = newTimer(OSPFV3_DEAD_INTERVAL, func() {
+			ospfv3Log.Info("neighbor inactivity timer expired", "routerId", fmtRouterIdStr(nbr.routerId))
+			ospfv3KillNeighbor(nbr)
+		})
+	} else {
+		nbr.inactivityTimer.reset(OSPFV3_DEAD_INTERVAL)
+	}
+
+	// 自分のルータIDが近隣リストにあれば双方向
+	twoWay := false
+	for i := 20; i < len(body); i += 4 {
+		if byteToUint32(body[i:i+4]) == ospfv3RouterId {
+			twoWay = true
+			break
+		}
+	}
+
+	if !twoWay {
+		// 1-WayReceived
+		if nbr.state >= OSPFV3_NBR_TWO_WAY {
+			ospfv3ResetNeighbor(nbr)
+			ospfv3SetNeighborState(nbr, OSPFV3_NBR_INIT)
+			ospfv3NeighborChange(iface)
+		}
+		return
+	}
+
+	// 2-WayReceived
+	if nbr.state == OSPFV3_NBR_INIT {
+		if ospfv3ShouldBeAdjacent(nbr) {
+			ospfv3StartExchange(nbr)
+		} else {
+			ospfv3SetNeighborState(nbr, OSPFV3_NBR_TWO_WAY)
+		}
+		ospfv3NeighborChange(iface)
+	}
+
+	if iface.networkType != OSPFV3_NETWORK_BROADCAST {
+		return
+	}
+
+	if iface.state == OSPFV3_IF_WAITING {
+		// BackupSeen
+		if (bdr == routerId) || (dr == routerId && bdr == 0) {
+			iface.waitTimer.stop()
+			ospfv3ElectDr(iface)
+		}
+		return
+	}
+
+	if prevPriority != priority || (prevDr == routerId) != (dr == routerId) || (prevBdr == routerId) != (bdr == routerId) {
+		ospfv3NeighborChange(iface)
+	}
+}
+
+/* ブロードキャストでは自分か近隣ルータがDRかBDRのときだけ隣接関係を作る */
+func ospfv3ShouldBeAdjacent(nbr *ospfv3Neighbor) bool {
+	iface := nbr.iface
+	if iface.networkType == OSPFV3_NETWORK_POINT_TO_POINT {
+		return true
+	}
+	if iface.state == OSPFV3_IF_WAITING {
+		return false
+	}
+	return iface.dr == ospfv3RouterId || iface.bdr == ospfv3RouterId || iface.dr == nbr.routerId || iface.bdr == nbr.routerId
+}
+
+func ospfv3NeighborChange(iface *ospfv3Interface) {
+	if iface.networkType == OSPFV3_NETWORK_BROADCAST && iface.state >= OSPFV3_IF_DROTHER {
+		ospfv3ElectDr(iface)
+	}
+}
+
+func ospfv3SetNeighborState(nbr *ospfv3Neighbor, state ospfv3NbrState) {
+	if nbr.state == state {
+		return
+	}
+	ospfv3Log.Info("neighbor state changed", "routerId", fmtRouterIdStr(nbr.routerId), "dev", nbr.iface.dev.name, "prev", nbr.state.String(), "state", state.String())
+
+	wasFull := nbr.state == OSPFV3_NBR_FULL
+	nbr.state = state
+	if wasFull || state == OSPFV3_NBR_FULL {
+		ospfv3ScheduleOriginate()
+	}
+
+	if state == OSPFV3_NBR_DOWN {
+		bfdUnregister(nbr.bfdClient)
+		nbr.bfdClient = nil
+	} else if state >= OSPFV3_NBR_TWO_WAY && nbr.iface.bfd {
+		ospfv3StartNeighborBfd(nbr)
+	}
+}
+
+func ospfv3StartNeighborBfd(nbr *ospfv3Neighbor) {
+	if nbr.bfdClient != nil {
+		return
+	}
+	nbr.bfdClient = bfdRegister(nbr.iface.dev, nbr.addr, func(up bool) {
+		if !up && nbr.iface.neighbors[nbr.routerId] == nbr {
+			ospfv3Log.Info("neighbor bfd session down", "routerId", fmtRouterIdStr(nbr.routerId))
+			ospfv3KillNeighbor(nbr)
+		}
+	})
+}
+
+func ospfv3ResetNeighbor(nbr *ospfv3Neighbor) {
+	nbr.summaryList = nil
+	nbr.requestList = make(map[ospfv3LsaKey]ospfv3LsaHeader)
+	nbr.retransList = make(map[ospfv3LsaKey]*ospfv3Lsa)
+	nbr.lastRecvDd = nil
+	nbr.lastSentDd = nil
+	nbr.rxmtTimer.stop()
+	nbr.rxmtTimer = nil
+}
+
+func ospfv3KillNeighbor(nbr *ospfv3Neighbor) {
+	ospfv3ResetNeighbor(nbr)
+	nbr.inactivityTimer.stop()
+	ospfv3SetNeighborState(nbr, OSPFV3_NBR_DOWN)
+	delete(nbr.iface.neighbors, nbr.routerId)
+	ospfv3NeighborChange(nbr.iface)
+}
+
+/*
+ * DR/BDRの選出(RFC 2328 9.4)
+ */
+func ospfv3ElectDr(iface *ospfv3Interface) {
+	type candidate struct {
+		routerId uint32
+		priority uint8
+		dr       uint32
+		bdr      uint32
+	}
+
+	elect := func(self candidate) (uint32, uint32) {
+		candidates := []candidate{}
+		if self.priority > 0 {
+			candidates = append(candidates, self)
+		}
+		for _, nbr := range iface.neighbors {
+			if nbr.state >= OSPFV3_NBR_TWO_WAY && nbr.priority > 0 {
+				candidates = append(candidates, candidate{nbr.routerId, nbr.priority, nbr.dr, nbr.bdr})
+			}
+		}
+		better := func(a, b *candidate) bool {
+			return b == nil || a.priority > b.priority || (a.priority == b.priority && a.routerId > b.routerId)
+		}
+
+		// BDRはDRを宣言していないルータから選ぶ
+		var bdr, bdrAny *candidate
+		for i := range candidates {
+			c := &candidates[i]
+			if c.dr == c.routerId {
+				continue
+			}
+			if c.bdr == c.routerId && better(c, bdr) {
+				bdr = c
+			}
+			if better(c, bdrAny) {
+				bdrAny = c
+			}
+		}
+		if bdr == nil {
+			bdr = bdrAny
+		}
+
+		var dr *candidate
+		for i := range candidates {
+			c := &candidates[i]
+			if c.dr == c.routerId && better(c, dr) {
+				dr = c
+			}
+		}
+		if dr == nil {
+			dr = bdr
+		}
+
+		var drId, bdrId uint32
+		if dr != nil {
+			drId = dr.routerId
+		}
+		if bdr != nil && bdr != dr {
+			bdrId = bdr.routerId
+		}
+		return drId, bdrId
+	}
+
+	self := candidate{ospfv3RouterId, iface.priority, iface.dr, iface.bdr}
+	dr, bdr := elect(self)
+
+	// 自分がDR/BDRになったか外れた場合はもう一度選び直す
+	if (dr == ospfv3RouterId) != (iface.dr == ospfv3RouterId) || (bdr == ospfv3RouterId) != (iface.bdr == ospfv3RouterId) {
+		self.dr, self.bdr = dr, bdr
+		dr, bdr = elect(self)
+	}
+
+	changed := dr != iface.dr || bdr != iface.bdr
+	iface.dr, iface.bdr = dr, bdr
+
+	switch ospfv3RouterId {
+	case dr:
+		ospfv3SetInterfaceState(iface, OSPFV3_IF_DR)
+	case bdr:
+		ospfv3SetInterfaceState(iface, OSPFV3_IF_BACKUP)
+	default:
+		ospfv3SetInterfaceState(iface, OSPFV3_IF_DROTHER)
+	}
+
+	if !changed {
+		return
+	}
+	ospfv3Log.Info("dr elected", "dev", iface.dev.name, "dr", fmtRouterIdStr(dr), "bdr", fmtRouterIdStr(bdr))
+
+	// AdjOK?
+	for _, nbr := range iface.neighbors {
+		if nbr.state == OSPFV3_NBR_TWO_WAY && ospfv3ShouldBeAdjacent(nbr) {
+			ospfv3StartExchange(nbr)
+		} else if nbr.state >= OSPFV3_NBR_EXSTART && !ospfv3ShouldBeAdjacent(nbr) {
+			ospfv3ResetNeighbor(nbr)
+			ospfv3SetNeighborState(nbr, OSPFV3_NBR_TWO_WAY)
+		}
+	}
+	ospfv3ScheduleOriginate()
+}
+
+/* 停止するときは近隣ルータを載せないHelloを送り、相手にすぐ隣接を落とさせる(1-WayReceived) */
+func ospfv3Shutdown() {
+	for _, iface := range ospfv3Interfaces {
+		iface.helloTimer.stop()
+		iface.waitTimer.stop()
+		for _, nbr := range iface.neighbors {
+			nbr.inactivityTimer.stop()
+			nbr.rxmtTimer.stop()
+		}
+		iface.neighbors = make(map[uint32]*ospfv3Neighbor)
+		if iface.state != OSPFV3_IF_DOWN {
+			ospfv3SendHello(iface)
+		}
+	}
+}
+
+func ospfv3SendHello(iface *ospfv3Interface) {
+	var b bytes.Buffer
+
+	b.Write(uint32ToByte(iface.interfaceId))
+	b.Write(uint8ToByte(iface.priority))
+	b.Write(uint32ToByte(OSPFV3_OPTIONS)[1:4])
+	b.Write(uint16ToByte(uint16(OSPFV3_HELLO_INTERVAL / time.Second)))
+	b.Write(uint16ToByte(uint16(OSPFV3_DEAD_INTERVAL / time.Second)))
+	b.Write(uint32ToByte(iface.dr))
+	b.Write(uint32ToByte(iface.bdr))
+
+	routerIds := make([]uint32, 0, len(iface.neighbors))
+	for routerId, nbr := range iface.neighbors {
+		if nbr.state >= OSPFV3_NBR_INIT {
+			routerIds = append(routerIds, routerId)
+		}
+	}
+	sort.Slice(routerIds, func(i, j int) bool { return routerIds[i] < routerIds[j] })
+	for _, routerId := range routerIds {
+		b.Write(uint32ToByte(routerId))
+	}
+
+	ospfv3SendMcast(iface, parseIpv6(OSPFV3_ALL_SPF_ROUTERS), OSPFV3_TYPE_HELLO, b.Bytes())
+}
+
+func ospfv3ToPacket(iface *ospfv3Interface, srcAddr in6Addr, dstAddr in6Addr, pktType uint8, body []byte) []byte {
+	var b bytes.Buffer
+
+	b.Write(uint8ToByte(OSPFV3_VERSION))
+	b.Write(uint8ToByte(pktType))
+	b.Write(uint16ToByte(uint16(OSPFV3_HEADER_LEN + len(body))))
+	b.Write(uint32ToByte(ospfv3RouterId))
+	b.Write(uint32ToByte(iface.area.id))
+	b.Write(uint16ToByte(0)) // checksum
+	b.Write(uint8ToByte(0))  // instance id
+	b.Write(uint8ToByte(0))
+	b.Write(body)
+	packet := b.Bytes()
+
+	phdr := ipv6PseudoHeader{
+		srcAddr:      srcAddr,
+		dstAddr:      dstAddr,
+		packetLength: uint32(len(packet)),
+		nextHeader:   IPV6_PROTOCOL_NUM_OSPF,
+	}
+	copy(packet[12:14], uint16ToByte(checksum16(packet, ^checksum16(phdr.toPseudoHeader(), 0))))
+
+	return packet
+}
+
+func ospfv3SendMcast(iface *ospfv3Interface, dstAddr in6Addr, pktType uint8, body []byte) {
+	srcAddr := iface.dev.ipv6Dev.linkLocalAddr
+	packet := ospfv3ToPacket(iface, srcAddr, dstAddr, pktType, body)
+	ipv6EncapDevMcastOutput(iface.dev, srcAddr, dstAddr, packet, IPV6_PROTOCOL_NUM_OSPF)
+}
+
+func ospfv3SendUnicast(nbr *ospfv3Neighbor, pktType uint8, body []byte) {
+	srcAddr := nbr.iface.dev.ipv6Dev.linkLocalAddr
+	packet := ospfv3ToPacket(nbr.iface, srcAddr, nbr.addr, pktType, body)
+	ipv6EncapDevUnicastOutput(nbr.iface.dev, srcAddr, nbr.addr, packet, IPV6_PROTOCOL_NUM_OSPF)
+}
+
+/*
+ * ExStartに入りマスター/スレーブを決めるための最初のDDを送る
+ */
+func ospfv3StartExchange(nbr *ospfv3Neighbor) {
+	ospfv3ResetNeighbor(nbr)
+	ospfv3SetNeighborState(nbr, OSPFV3_NBR_EXSTART)
+
+	if nbr.ddSeq == 0 {
+		nbr.ddSeq = rand.Uint32()
+	} else {
+		nbr.ddSeq++
+	}
+	nbr.master = true
+	ospfv3SendDd(nbr, OSPFV3_DD_FLAG_I|OSPFV3_DD_FLAG_M|OSPFV3_DD_FLAG_MS, nil)
+	ospfv3StartRetransmit(nbr)
+}
+
+/* 再送タイマー。DD、LSR、未確認のLSAを再送する */
+func ospfv3StartRetransmit(nbr *ospfv3Neighbor) {
+	if nbr.rxmtTimer != nil && nbr.rxmtTimer.active {
+		return
+	}
+	var rxmtTimer *timer
+	rxmtTimer = newTimer(OSPFV3_RXMT_INTERVAL, func() {
+		switch {
+		case nbr.state == OSPFV3_NBR_EXSTART || (nbr.state == OSPFV3_NBR_EXCHANGE && nbr.master):
+			if nbr.lastSentDd != nil {
+				ospfv3SendUnicast(nbr, OSPFV3_TYPE_DD, nbr.lastSentDd)
+			}
+		case nbr.state == OSPFV3_NBR_LOADING:
+			ospfv3SendLsr(nbr)
+		}
+		if nbr.state >= OSPFV3_NBR_EXCHANGE && len(nbr.retransList) > 0 {
+			var lsas []*ospfv3Lsa
+			for _, lsa := range nbr.retransList {
+				lsas = append(lsas, lsa)
+			}
+			ospfv3SendLsu(nbr, lsas)
+		}
+		if nbr.state >= OSPFV3_NBR_EXSTART && nbr.rxmtTimer == rxmtTimer {
+			rxmtTimer.reset(OSPFV3_RXMT_INTERVAL)
+		}
+	})
+	nbr.rxmtTimer = rxmtTimer
+}
@@ -0,0 +1,279 @@
+//go:build integration
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+/**
+ * OSPFv3の統合テスト。rootで実行する
+ *   go test -tags integration -run TestOspfv3Integration -v ./cmd/main
+ * ネットワーク名前空間にルータを3台並べ、vethでつなぐ。ルータはこのテストのバイナリを
+ * 名前空間の中で起動し直したもので、TestOspfv3IntegrationRouterが環境変数で指定されたルータとして動く。
+ * ルータは自分の近隣ルータとFIBを調べてファイルに書き、親のテストはそれを待つ。
+ *
+ *   h1 -- r1 -- r2 -- r3 -- h3
+ */
+const OSPFV3_TEST_NETNS_PREFIX = "ospf3t-"
+const OSPFV3_TEST_TIMEOUT = 90 * time.Second
+const OSPFV3_TEST_REPORT_INTERVAL = 200 * time.Millisecond
+
+// 状態ファイルに書く、すべて揃ったときの内容
+const OSPFV3_TEST_STATUS_OK = "ok"
+
+type ospfv3TestRouter struct {
+	name       string
+	routerId   string
+	interfaces map[string]string // インターフェイス名とアドレス
+	neighbors  int               // Fullになる近隣ルータの数
+	routes     map[string]string // OSPFv3で入るはずの経路と出力インターフェイス
+}
+
+var ospfv3TestRouters = []*ospfv3TestRouter{
+	{
+		name: "r1", routerId: "1.1.1.1", neighbors: 1,
+		interfaces: map[string]string{"r1-h1": "2001:db8:1::1/64", "r1-r2": "2001:db8:12::1/64"},
+		routes:     map[string]string{"2001:db8:23::/64": "r1-r2", "2001:db8:3::/64": "r1-r2"},
+	},
+	{
+		name: "r2", routerId: "2.2.2.2", neighbors: 2,
+		interfaces: map[string]string{"r2-r1": "2001:db8:12::2/64", "r2-r3": "2001:db8:23::2/64"},
+		routes:     map[string]string{"2001:db8:1::/64": "r2-r1", "2001:db8:3::/64": "r2-r3"},
+	},
+	{
+		name: "r3", routerId: "3.3.3.3", neighbors: 1,
+		interfaces: map[string]string{"r3-r2": "2001:db8:23::3/64", "r3-h3": "2001:db8:3::1/64"},
+		routes:     map[string]string{"2001:db8:12::/64": "r3-r2", "2001:db8:1::/64": "r3-r2"},
+	},
+}
+
+// vethの両端。名前空間の名前はOSPFV3_TEST_NETNS_PREFIXを除いたもの
+var ospfv3TestLinks = [][4]string{
+	{"h1", "h1-r1", "r1", "r1-h1"},
+	{"r1", "r1-r2", "r2", "r2-r1"},
+	{"r2", "r2-r3", "r3", "r3-r2"},
+	{"r3", "r3-h3", "h3", "h3-r3"},
+}
+
+/* 名前空間の中で起動されたときにルータとして動く */
+func TestOspfv3IntegrationRouter(t *testing.T) {
+	name := os.Getenv("OSPFV3_TEST_ROUTER")
+	if name == "" {
+		t.Skip("started by TestOspfv3Integration")
+	}
+	var r *ospfv3TestRouter
+	for _, router := range ospfv3TestRouters {
+		if router.name == name {
+			r = router
+		}
+	}
+	if r == nil {
+		t.Fatalf("unknown router %s", name)
+	}
+	statusPath := os.Getenv("OSPFV3_TEST_STATUS")
+
+	runRouter(func() {
+		err := configLoad(ospfv3TestConfig(r), "ospfv3 integration test")
+		if err != nil {
+			t.Fatalf("failed to load config: %s", err)
+		}
+
+		// 状態はイベントループの中で調べる
+		var report *timer
+		report = newTimer(0, func() {
+			ospfv3TestWriteStatus(statusPath, r)
+			report.reset(OSPFV3_TEST_REPORT_INTERVAL)
+		})
+	})
+}
+
+/* ルータの設定ファイルと同じ形式のテキスト */
+func ospfv3TestConfig(r *ospfv3TestRouter) string {
+	var b strings.Builder
+	for ifName, addr := range r.interfaces {
+		fmt.Fprintf(&b, "interface %s\n ipv6 address %s\n ospfv3 area 0.0.0.0 network point-to-point cost 10\n!\n", ifName, addr)
+	}
+	fmt.Fprintf(&b, "router ospfv3\n router-id %s\n!\n", r.routerId)
+	return b.String()
+}
+
+func TestOspfv3Integration(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("needs root to create network namespaces")
+	}
+	if _, err := exec.LookPath("ip"); err != nil {
+		t.Skip("needs the ip command")
+	}
+	dir := t.TempDir()
+	ospfv3TestTopology(t)
+
+	for _, r := range ospfv3TestRouters {
+		ospfv3TestStartRouter(t, dir, r)
+	}
+
+	deadline := time.Now().Add(OSPFV3_TEST_TIMEOUT)
+	for _, r := range ospfv3TestRouters {
+		ospfv3TestWait(t, r, deadline, filepath.Join(dir, r.name+".status"))
+	}
+}
+
+/* 名前空間とvethを作る。テストが終われば名前空間ごと消す */
+func ospfv3TestTopology(t *testing.T) {
+	t.Helper()
+	namespaces := []string{"h1", "r1", "r2", "r3", "h3"}
+	for _, ns := range namespaces {
+		ns := OSPFV3_TEST_NETNS_PREFIX + ns
+		exec.Command("ip", "netns", "del", ns).Run()
+		ospfv3TestRun(t, "ip", "netns", "add", ns)
+		t.Cleanup(func() { exec.Command("ip", "netns", "del", ns).Run() })
+		ospfv3TestRun(t, "ip", "-n", ns, "link", "set", "lo", "up")
+	}
+	for _, link := range ospfv3TestLinks {
+		ns1, ns2 := OSPFV3_TEST_NETNS_PREFIX+link[0], OSPFV3_TEST_NETNS_PREFIX+link[2]
+		ospfv3TestRun(t, "ip", "link", "add", link[1], "netns", ns1, "type", "veth", "peer", "name", link[3], "netns", ns2)
+		ospfv3TestRun(t, "ip", "-n", ns1, "link", "set", link[1], "up")
+		ospfv3TestRun(t, "ip", "-n", ns2, "link", "set", link[3], "up")
+	}
+
+	// ルータは起動時にIPv6アドレスのあるインターフェイスを開くので、リンクローカルアドレスが付くのを待つ
+	deadline := time.Now().Add(10 * time.Second)
+	for _, r := range ospfv3TestRouters {
+		for name := range r.interfaces {
+			for {
+				out, _ := exec.Command("ip", "-n", OSPFV3_TEST_NETNS_PREFIX+r.name, "-6", "addr", "show", "dev", name).Output()
+				if strings.Contains(string(out), "inet6 fe80::") {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("no link-local address on %s in %s", name, r.name)
+				}
+				time.Sleep(100 * time.Millisecond)
+			}
+		}
+	}
+}
+
+/* このテストのバイナリを名前空間の中でルータとして起動する */
+func ospfv3TestStartRouter(t *testing.T, dir string, r *ospfv3TestRouter) {
+	t.Helper()
+	logPath := filepath.Join(dir, r.name+".log")
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command("ip", "netns", "exec", OSPFV3_TEST_NETNS_PREFIX+r.name, os.Args[0], "-test.run=^TestOspfv3IntegrationRouter$")
+	cmd.Env = append(os.Environ(),
+		"OSPFV3_TEST_ROUTER="+r.name,
+		"OSPFV3_TEST_STATUS="+filepath.Join(dir, r.name+".status"),
+	)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start %s: %s", r.name, err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Signal(syscall.SIGTERM)
+		done := make(chan struct{})
+		go func() {
+			cmd.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			cmd.Process.Kill()
+			<-done
+		}
+		logFile.Close()
+		if t.Failed() {
+			out, _ := os.ReadFile(logPath)
+			t.Logf("log of %s:\n%s", r.name, out)
+		}
+	})
+}
+
+func ospfv3TestRun(t *testing.T, name string, args ...string) {
+	t.Helper()
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s %s: %s: %s", name, strings.Join(args, " "), err, out)
+	}
+}
+
+/* ルータが状態ファイルにokと書くまで待つ。期限を過ぎたら最後の状態で失敗する */
+func ospfv3TestWait(t *testing.T, r *ospfv3TestRouter, deadline time.Time, statusPath string) {
+	t.Helper()
+	for {
+		status, err := os.ReadFile(statusPath)
+		state := string(status)
+		if err != nil {
+			state = err.Error()
+		}
+		if state == OSPFV3_TEST_STATUS_OK {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: timed out waiting for full adjacencies and ospfv3 routes: %s", r.name, state)
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+/* 調べた結果を書く。親が書きかけを読まないよう、別の名前で書いてから置き換える */
+func ospfv3TestWriteStatus(path string, r *ospfv3TestRouter) {
+	state := OSPFV3_TEST_STATUS_OK
+	if ok, why := ospfv3TestCheck(r); !ok {
+		state = why
+	}
+	if err := os.WriteFile(path+".tmp", []byte(state), 0644); err == nil {
+		os.Rename(path+".tmp", path)
+	}
+}
+
+/*
+ * 近隣ルータがすべてFullになり、OSPFv3の経路が近隣ルータのリンクローカルアドレスを
+ * ネクストホップにしてFIBに入っているか。揃っていなければ足りないものを返す
+ */
+func ospfv3TestCheck(r *ospfv3TestRouter) (bool, string) {
+	full := 0
+	for _, iface := range ospfv3Interfaces {
+		for _, nbr := range iface.neighbors {
+			if nbr.state == OSPFV3_NBR_FULL {
+				full++
+			}
+		}
+	}
+	if full != r.neighbors {
+		return false, fmt.Sprintf("%d neighbors Full, want %d", full, r.neighbors)
+	}
+
+	found := map[string]*ipv6RouteEntry{}
+	patriciaTrieWalk(defaultVrf.fib, func(prefix in6Addr, prefixLen uint8, route *ipv6RouteEntry) {
+		if route.proto == PROTO_OSPFV3 {
+			found[fmt.Sprintf("%s/%d", fmtIpStr(prefix), prefixLen)] = route
+		}
+	})
+	for prefix, ifName := range r.routes {
+		route, ok := found[prefix]
+		if !ok {
+			return false, fmt.Sprintf("no ospfv3 route to %s in fib", prefix)
+		}
+		if route.dev == nil || route.dev.name != ifName {
+			return false, fmt.Sprintf("route to %s does not go out %s", prefix, ifName)
+		}
+		if !net.IP(route.nextHop[:]).IsLinkLocalUnicast() {
+			return false, fmt.Sprintf("route to %s has next hop %s, want a link-local address", prefix, fmtIpStr(route.nextHop))
+		}
+	}
+	return true, ""
+}
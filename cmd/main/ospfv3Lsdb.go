@@ -0,0 +1,1097 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+/**
+ * OSPFv3のLSAとLSDB
+ * DBの交換(DD/LSR)、フラッディング(LSU/LSAck)、自分のLSAの生成を扱う
+ */
+const OSPFV3_LSA_HEADER_LEN = 20
+
+const (
+	OSPFV3_LSA_ROUTER            uint16 = 0x2001
+	OSPFV3_LSA_NETWORK           uint16 = 0x2002
+	OSPFV3_LSA_INTER_AREA_PREFIX uint16 = 0x2003
+	OSPFV3_LSA_LINK              uint16 = 0x0008
+	OSPFV3_LSA_INTRA_AREA_PREFIX uint16 = 0x2009
+	OSPFV3_LSA_AS_EXTERNAL       uint16 = 0x4005
+)
+
+// フラッディングの範囲(LSタイプのS1/S2ビット)
+const (
+	OSPFV3_SCOPE_LINK uint16 = iota
+	OSPFV3_SCOPE_AREA
+	OSPFV3_SCOPE_AS
+)
+
+const OSPFV3_ROUTER_LINK_P2P uint8 = 1
+const OSPFV3_ROUTER_LINK_TRANSIT uint8 = 2
+
+const OSPFV3_ROUTER_FLAG_B uint8 = 0x01
+const OSPFV3_ROUTER_FLAG_E uint8 = 0x02
+
+// AS外部LSAのフラグ
+const OSPFV3_EXTERNAL_FLAG_E uint8 = 0x04 // タイプ2の外部メトリック
+const OSPFV3_EXTERNAL_FLAG_F uint8 = 0x02 // 転送アドレスがある
+const OSPFV3_EXTERNAL_FLAG_T uint8 = 0x01 // 外部経路タグがある
+
+const OSPFV3_DEFAULT_EXTERNAL_METRIC uint32 = 20
+
+const OSPFV3_PREFIX_OPTION_NU uint8 = 0x01
+
+const OSPFV3_MAX_AGE uint16 = 3600
+const OSPFV3_MAX_AGE_DIFF uint16 = 900
+const OSPFV3_LS_REFRESH_TIME uint16 = 1800
+const OSPFV3_INITIAL_SEQ uint32 = 0x80000001
+const OSPFV3_MAX_SEQ uint32 = 0x7fffffff
+
+const OSPFV3_AGING_INTERVAL = 5 * time.Second
+
+// LSUやDDに詰めるLSAの大きさの上限
+const OSPFV3_MAX_PAYLOAD = OSPFV3_INTERFACE_MTU - 40 - OSPFV3_HEADER_LEN - 100
+
+type ospfv3LsaKey struct {
+	lsType    uint16
+	lsId      uint32
+	advRouter uint32
+}
+
+type ospfv3LsaHeader struct {
+	age       uint16
+	lsType    uint16
+	lsId      uint32
+	advRouter uint32
+	seq       uint32
+	checksum  uint16
+	length    uint16
+}
+
+type ospfv3Lsa struct {
+	header    ospfv3LsaHeader
+	body      []byte    // LSAヘッダを除いた部分
+	installed time.Time // ageを数え始めた時刻
+}
+
+// AS全体にフラッディングするLSA
+var ospfv3AsLsdb = map[ospfv3LsaKey]*ospfv3Lsa{}
+
+// ABRがエリア間プレフィックスLSAに割り当てたLSID
+var ospfv3SummaryLsIds = map[ribKey]uint32{}
+
+// AS外部LSAのリンクステートIDに使う番号
+var ospfv3ExternalLsIds = map[ribKey]uint32{}
+
+var ospfv3OriginateTimer *timer
+var ospfv3AgingTimer *timer
+
+func (header ospfv3LsaHeader) key() ospfv3LsaKey {
+	return ospfv3LsaKey{header.lsType, header.lsId, header.advRouter}
+}
+
+func (header ospfv3LsaHeader) scope() uint16 {
+	return (header.lsType >> 13) & 0x03
+}
+
+func (header ospfv3LsaHeader) toPacket() []byte {
+	var b bytes.Buffer
+
+	b.Write(uint16ToByte(header.age))
+	b.Write(uint16ToByte(header.lsType))
+	b.Write(uint32ToByte(header.lsId))
+	b.Write(uint32ToByte(header.advRouter))
+	b.Write(uint32ToByte(header.seq))
+	b.Write(uint16ToByte(header.checksum))
+	b.Write(uint16ToByte(header.length))
+
+	return b.Bytes()
+}
+
+func parseOspfv3LsaHeader(buffer []byte) ospfv3LsaHeader {
+	return ospfv3LsaHeader{
+		age:       byteToUint16(buffer[0:2]),
+		lsType:    byteToUint16(buffer[2:4]),
+		lsId:      byteToUint32(buffer[4:8]),
+		advRouter: byteToUint32(buffer[8:12]),
+		seq:       byteToUint32(buffer[12:16]),
+		checksum:  byteToUint16(buffer[16:18]),
+		length:    byteToUint16(buffer[18:20]),
+	}
+}
+
+/* 現在のageを入れたヘッダ */
+func (lsa *ospfv3Lsa) currentHeader() ospfv3LsaHeader {
+	header := lsa.header
+	age := uint32(header.age) + uint32(timerClock.now().Sub(lsa.installed)/time.Second)
+	if age > uint32(OSPFV3_MAX_AGE) {
+		age = uint32(OSPFV3_MAX_AGE)
+	}
+	header.age = uint16(age)
+	return header
+}
+
+func (lsa *ospfv3Lsa) toPacket() []byte {
+	return append(lsa.currentHeader().toPacket(), lsa.body...)
+}
+
+/*
+ * LSAの新しさを比べる(RFC 2328 13.1)。aが新しければ正、bが新しければ負を返す。
+ */
+func ospfv3LsaCompare(a ospfv3LsaHeader, b ospfv3LsaHeader) int {
+	if a.seq != b.seq {
+		if int32(a.seq) > int32(b.seq) {
+			return 1
+		}
+		return -1
+	}
+	if a.checksum != b.checksum {
+		if a.checksum > b.checksum {
+			return 1
+		}
+		return -1
+	}
+	if (a.age == OSPFV3_MAX_AGE) != (b.age == OSPFV3_MAX_AGE) {
+		if a.age == OSPFV3_MAX_AGE {
+			return 1
+		}
+		return -1
+	}
+	if a.age > b.age && a.age-b.age > OSPFV3_MAX_AGE_DIFF {
+		return -1
+	}
+	if b.age > a.age && b.age-a.age > OSPFV3_MAX_AGE_DIFF {
+		return 1
+	}
+	return 0
+}
+
+/* LSAのスコープに対応するLSDB */
+func ospfv3Lsdb(iface *ospfv3Interface, lsType uint16) map[ospfv3LsaKey]*ospfv3Lsa {
+	switch (ospfv3LsaHeader{lsType: lsType}).scope() {
+	case OSPFV3_SCOPE_LINK:
+		return iface.linkLsdb
+	case OSPFV3_SCOPE_AREA:
+		return iface.area.lsdb
+	}
+	return ospfv3AsLsdb
+}
+
+/* LSAをフラッディングするインターフェイス */
+func ospfv3FloodInterfaces(iface *ospfv3Interface, lsType uint16) []*ospfv3Interface {
+	switch (ospfv3LsaHeader{lsType: lsType}).scope() {
+	case OSPFV3_SCOPE_LINK:
+		return []*ospfv3Interface{iface}
+	case OSPFV3_SCOPE_AREA:
+		return iface.area.interfaces
+	}
+	return ospfv3Interfaces
+}
+
+/* DDパケットの受信処理(RFC 2328 10.6) */
+func ospfv3DdInput(nbr *ospfv3Neighbor, body []byte) {
+	if len(body) < 12 || (len(body)-12)%OSPFV3_LSA_HEADER_LEN != 0 {
+		ospfv3Log.Debug("invalid dd size", "size", len(body))
+		return
+	}
+	mtu := byteToUint16(body[4:6])
+	flags := body[7]
+	seq := byteToUint32(body[8:12])
+	if mtu > OSPFV3_INTERFACE_MTU {
+		ospfv3Log.Warn("dd mtu mismatch", "routerId", fmtRouterIdStr(nbr.routerId), "mtu", mtu)
+		return
+	}
+
+	var headers []ospfv3LsaHeader
+	for i := 12; i < len(body); i += OSPFV3_LSA_HEADER_LEN {
+		headers = append(headers, parseOspfv3LsaHeader(body[i:i+OSPFV3_LSA_HEADER_LEN]))
+	}
+
+	duplicate := nbr.lastRecvDd != nil && nbr.lastRecvDd[7] == flags && byteToUint32(nbr.lastRecvDd[8:12]) == seq
+
+	switch nbr.state {
+	case OSPFV3_NBR_DOWN, OSPFV3_NBR_TWO_WAY:
+		return
+	case OSPFV3_NBR_INIT:
+		if !ospfv3ShouldBeAdjacent(nbr) {
+			ospfv3SetNeighborState(nbr, OSPFV3_NBR_TWO_WAY)
+			return
+		}
+		ospfv3StartExchange(nbr)
+	case OSPFV3_NBR_LOADING, OSPFV3_NBR_FULL:
+		if duplicate && !nbr.master {
+			ospfv3SendUnicast(nbr, OSPFV3_TYPE_DD, nbr.lastSentDd)
+		} else if !duplicate {
+			ospfv3DdSeqMismatch(nbr)
+		}
+		return
+	}
+
+	if nbr.state == OSPFV3_NBR_EXSTART {
+		if flags&(OSPFV3_DD_FLAG_I|OSPFV3_DD_FLAG_M|OSPFV3_DD_FLAG_MS) == OSPFV3_DD_FLAG_I|OSPFV3_DD_FLAG_M|OSPFV3_DD_FLAG_MS && len(headers) == 0 && nbr.routerId > ospfv3RouterId {
+			// 相手がマスター
+			nbr.master = false
+			nbr.ddSeq = seq
+		} else if flags&(OSPFV3_DD_FLAG_I|OSPFV3_DD_FLAG_MS) == 0 && seq == nbr.ddSeq && nbr.routerId < ospfv3RouterId {
+			// 自分がマスター
+			nbr.master = true
+		} else {
+			return
+		}
+
+		// NegotiationDone
+		ospfv3SetNeighborState(nbr, OSPFV3_NBR_EXCHANGE)
+		nbr.summaryList = ospfv3SummaryList(nbr.iface)
+		if !nbr.master {
+			nbr.lastRecvDd = append([]byte{}, body...)
+			ospfv3SendNextDd(nbr)
+			return
+		}
+	} else {
+		// Exchange
+		if duplicate {
+			if !nbr.master {
+				ospfv3SendUnicast(nbr, OSPFV3_TYPE_DD, nbr.lastSentDd)
+			}
+			return
+		}
+		if (flags&OSPFV3_DD_FLAG_MS != 0) == nbr.master || flags&OSPFV3_DD_FLAG_I != 0 {
+			ospfv3DdSeqMismatch(nbr)
+			return
+		}
+		if (nbr.master && seq != nbr.ddSeq) || (!nbr.master && seq != nbr.ddSeq+1) {
+			ospfv3DdSeqMismatch(nbr)
+			return
+		}
+	}
+
+	nbr.lastRecvDd = append([]byte{}, body...)
+
+	// 持っていないか古いLSAを要求リストに入れる
+	for _, header := range headers {
+		lsa := ospfv3Lsdb(nbr.iface, header.lsType)[header.key()]
+		if lsa == nil || ospfv3LsaCompare(header, lsa.currentHeader()) > 0 {
+			nbr.requestList[header.key()] = header
+		}
+	}
+
+	if nbr.master {
+		nbr.ddSeq++
+		sentMore := nbr.lastSentDd[7]&OSPFV3_DD_FLAG_M != 0
+		if len(nbr.summaryList) == 0 && !sentMore && flags&OSPFV3_DD_FLAG_M == 0 {
+			ospfv3ExchangeDone(nbr)
+			return
+		}
+		ospfv3SendNextDd(nbr)
+	} else {
+		nbr.ddSeq = seq
+		ospfv3SendNextDd(nbr)
+		if len(nbr.summaryList) == 0 && flags&OSPFV3_DD_FLAG_M == 0 {
+			ospfv3ExchangeDone(nbr)
+		}
+	}
+}
+
+func ospfv3DdSeqMismatch(nbr *ospfv3Neighbor) {
+	ospfv3Log.Info("dd sequence mismatch", "routerId", fmtRouterIdStr(nbr.routerId))
+	ospfv3StartExchange(nbr)
+}
+
+func ospfv3ExchangeDone(nbr *ospfv3Neighbor) {
+	if len(nbr.requestList) == 0 {
+		ospfv3SetNeighborState(nbr, OSPFV3_NBR_FULL)
+		return
+	}
+	ospfv3SetNeighborState(nbr, OSPFV3_NBR_LOADING)
+	ospfv3SendLsr(nbr)
+}
+
+/* 近隣ルータに送るLSDBのサマリ */
+func ospfv3SummaryList(iface *ospfv3Interface) []ospfv3LsaHeader {
+	var headers []ospfv3LsaHeader
+	for _, lsdb := range []map[ospfv3LsaKey]*ospfv3Lsa{iface.linkLsdb, iface.area.lsdb, ospfv3AsLsdb} {
+		for _, lsa := range lsdb {
+			headers = append(headers, lsa.currentHeader())
+		}
+	}
+	return headers
+}
+
+func ospfv3SendNextDd(nbr *ospfv3Neighbor) {
+	n := min(len(nbr.summaryList), (OSPFV3_MAX_PAYLOAD-12)/OSPFV3_LSA_HEADER_LEN)
+	headers := nbr.summaryList[:n]
+	nbr.summaryList = nbr.summaryList[n:]
+
+	var flags uint8
+	if len(nbr.summaryList) > 0 {
+		flags |= OSPFV3_DD_FLAG_M
+	}
+	if nbr.master {
+		flags |= OSPFV3_DD_FLAG_MS
+	}
+	ospfv3SendDd(nbr, flags, headers)
+}
+
+func ospfv3SendDd(nbr *ospfv3Neighbor, flags uint8, headers []ospfv3LsaHeader) {
+	var b bytes.Buffer
+
+	b.Write(uint8ToByte(0))
+	b.Write(uint32ToByte(OSPFV3_OPTIONS)[1:4])
+	b.Write(uint16ToByte(OSPFV3_INTERFACE_MTU))
+	b.Write(uint8ToByte(0))
+	b.Write(uint8ToByte(flags))
+	b.Write(uint32ToByte(nbr.ddSeq))
+	for _, header := range headers {
+		b.Write(header.toPacket())
+	}
+
+	nbr.lastSentDd = b.Bytes()
+	ospfv3SendUnicast(nbr, OSPFV3_TYPE_DD, nbr.lastSentDd)
+}
+
+func ospfv3SendLsr(nbr *ospfv3Neighbor) {
+	var b bytes.Buffer
+
+	for key := range nbr.requestList {
+		if b.Len()+12 > OSPFV3_MAX_PAYLOAD {
+			break
+		}
+		b.Write(uint16ToByte(0))
+		b.Write(uint16ToByte(key.lsType))
+		b.Write(uint32ToByte(key.lsId))
+		b.Write(uint32ToByte(key.advRouter))
+	}
+
+	ospfv3SendUnicast(nbr, OSPFV3_TYPE_LSR, b.Bytes())
+}
+
+/* LSRの受信処理。要求されたLSAをLSUで返す */
+func ospfv3LsrInput(nbr *ospfv3Neighbor, body []byte) {
+	if nbr.state < OSPFV3_NBR_EXCHANGE {
+		return
+	}
+
+	var lsas []*ospfv3Lsa
+	for i := 0; i+12 <= len(body); i += 12 {
+		key := ospfv3LsaKey{
+			lsType:    byteToUint16(body[i+2 : i+4]),
+			lsId:      byteToUint32(body[i+4 : i+8]),
+			advRouter: byteToUint32(body[i+8 : i+12]),
+		}
+		lsa := ospfv3Lsdb(nbr.iface, key.lsType)[key]
+		if lsa == nil {
+			// BadLSReq
+			ospfv3Log.Info("bad ls request", "routerId", fmtRouterIdStr(nbr.routerId))
+			ospfv3StartExchange(nbr)
+			return
+		}
+		lsas = append(lsas, lsa)
+	}
+
+	ospfv3SendLsu(nbr, lsas)
+}
+
+func ospfv3LsuBodies(lsas []*ospfv3Lsa) [][]byte {
+	var bodies [][]byte
+	var b bytes.Buffer
+	count := 0
+
+	flush := func() {
+		if count == 0 {
+			return
+		}
+		bodies = append(bodies, append(uint32ToByte(uint32(count)), b.Bytes()...))
+		b.Reset()
+		count = 0
+	}
+	for _, lsa := range lsas {
+		packet := lsa.toPacket()
+		if b.Len()+len(packet) > OSPFV3_MAX_PAYLOAD {
+			flush()
+		}
+		b.Write(packet)
+		count++
+	}
+	flush()
+
+	return bodies
+}
+
+func ospfv3SendLsu(nbr *ospfv3Neighbor, lsas []*ospfv3Lsa) {
+	for _, body := range ospfv3LsuBodies(lsas) {
+		ospfv3SendUnicast(nbr, OSPFV3_TYPE_LSU, body)
+	}
+}
+
+func ospfv3SendLsAck(nbr *ospfv3Neighbor, headers []ospfv3LsaHeader) {
+	var b bytes.Buffer
+	for _, header := range headers {
+		b.Write(header.toPacket())
+	}
+	ospfv3SendUnicast(nbr, OSPFV3_TYPE_LSACK, b.Bytes())
+}
+
+/* LSUの受信処理(RFC 2328 13) */
+func ospfv3LsuInput(nbr *ospfv3Neighbor, body []byte) {
+	if nbr.state < OSPFV3_NBR_EXCHANGE || len(body) < 4 {
+		return
+	}
+
+	var acks []ospfv3LsaHeader
+	count := byteToUint32(body[0:4])
+	buffer := body[4:]
+
+	for i := uint32(0); i < count && len(buffer) >= OSPFV3_LSA_HEADER_LEN; i++ {
+		header := parseOspfv3LsaHeader(buffer)
+		if int(header.length) < OSPFV3_LSA_HEADER_LEN || int(header.length) > len(buffer) {
+			ospfv3Log.Debug("invalid lsa length", "length", header.length)
+			return
+		}
+		raw := buffer[:header.length]
+		buffer = buffer[header.length:]
+
+		if !fletcherChecksumValid(raw[2:]) {
+			ospfv3Log.Debug("invalid lsa checksum", "lsType", fmt.Sprintf("%04x", header.lsType), "advRouter", fmtRouterIdStr(header.advRouter))
+			continue
+		}
+
+		lsdb := ospfv3Lsdb(nbr.iface, header.lsType)
+		key := header.key()
+		current := lsdb[key]
+
+		if header.age == OSPFV3_MAX_AGE && current == nil && !ospfv3AnyNeighborExchanging() {
+			acks = append(acks, header)
+			continue
+		}
+
+		cmp := 1
+		if current != nil {
+			cmp = ospfv3LsaCompare(header, current.currentHeader())
+		}
+
+		if cmp > 0 {
+			lsa := &ospfv3Lsa{
+				header:    header,
+				body:      append([]byte{}, raw[OSPFV3_LSA_HEADER_LEN:]...),
+				installed: timerClock.now(),
+			}
+			floodedBack := ospfv3Flood(lsa, nbr.iface, nbr)
+			ospfv3InstallLsa(lsdb, lsa)
+			delete(nbr.requestList, key)
+			if !floodedBack {
+				acks = append(acks, header)
+			}
+
+			// 自分が生成したLSAの古いインスタンスを受け取ったら生成し直す
+			if header.advRouter == ospfv3RouterId {
+				ospfv3ScheduleOriginate()
+			}
+			continue
+		}
+
+		if _, ok := nbr.requestList[key]; ok {
+			// BadLSReq
+			ospfv3StartExchange(nbr)
+			return
+		}
+
+		if cmp == 0 {
+			if _, ok := nbr.retransList[key]; ok {
+				// 暗黙の確認応答
+				delete(nbr.retransList, key)
+			} else {
+				acks = append(acks, header)
+			}
+			continue
+		}
+
+		// 自分の方が新しければ送り返す
+		currentHeader := current.currentHeader()
+		if currentHeader.age != OSPFV3_MAX_AGE || currentHeader.seq != OSPFV3_MAX_SEQ {
+			ospfv3SendLsu(nbr, []*ospfv3Lsa{current})
+		}
+	}
+
+	if len(acks) > 0 {
+		ospfv3SendLsAck(nbr, acks)
+	}
+
+	if nbr.state == OSPFV3_NBR_LOADING {
+		if len(nbr.requestList) == 0 {
+			ospfv3SetNeighborState(nbr, OSPFV3_NBR_FULL)
+		} else {
+			ospfv3SendLsr(nbr)
+		}
+	}
+}
+
+func ospfv3LsAckInput(nbr *ospfv3Neighbor, body []byte) {
+	if nbr.state < OSPFV3_NBR_EXCHANGE {
+		return
+	}
+
+	for i := 0; i+OSPFV3_LSA_HEADER_LEN <= len(body); i += OSPFV3_LSA_HEADER_LEN {
+		header := parseOspfv3LsaHeader(body[i : i+OSPFV3_LSA_HEADER_LEN])
+		lsa, ok := nbr.retransList[header.key()]
+		if ok && ospfv3LsaCompare(header, lsa.currentHeader()) == 0 {
+			delete(nbr.retransList, header.key())
+		}
+	}
+}
+
+func ospfv3AnyNeighborExchanging() bool {
+	for _, iface := range ospfv3Interfaces {
+		for _, nbr := range iface.neighbors {
+			if nbr.state == OSPFV3_NBR_EXCHANGE || nbr.state == OSPFV3_NBR_LOADING {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+ * LSAをフラッディングする(RFC 2328 13.3)。
+ * 受信したインターフェイスに送り返した場合はtrueを返す。
+ */
+func ospfv3Flood(lsa *ospfv3Lsa, recvIface *ospfv3Interface, from *ospfv3Neighbor) bool {
+	floodedBack := false
+	key := lsa.header.key()
+
+	for _, iface := range ospfv3FloodInterfaces(recvIface, lsa.header.lsType) {
+		added := false
+		for _, nbr := range iface.neighbors {
+			if nbr.state < OSPFV3_NBR_EXCHANGE {
+				continue
+			}
+			if req, ok := nbr.requestList[key]; ok {
+				cmp := ospfv3LsaCompare(lsa.header, req)
+				if cmp < 0 {
+					continue
+				}
+				delete(nbr.requestList, key)
+				if cmp == 0 {
+					continue
+				}
+			}
+			if nbr == from {
+				continue
+			}
+			nbr.retransList[key] = lsa
+			ospfv3StartRetransmit(nbr)
+			added = true
+		}
+		if !added {
+			continue
+		}
+
+		if from != nil && iface == from.iface {
+			// DR/BDRから受け取ったものや自分がBDRの場合は送り返さない
+			if from.routerId == iface.dr || from.routerId == iface.bdr || iface.state == OSPFV3_IF_BACKUP {
+				continue
+			}
+			floodedBack = true
+		}
+
+		dstAddr := parseIpv6(OSPFV3_ALL_SPF_ROUTERS)
+		if iface.state == OSPFV3_IF_DROTHER {
+			dstAddr = parseIpv6(OSPFV3_ALL_D_ROUTERS)
+		}
+		for _, body := range ospfv3LsuBodies([]*ospfv3Lsa{lsa}) {
+			ospfv3SendMcast(iface, dstAddr, OSPFV3_TYPE_LSU, body)
+		}
+	}
+
+	return floodedBack
+}
+
+func ospfv3InstallLsa(lsdb map[ospfv3LsaKey]*ospfv3Lsa, lsa *ospfv3Lsa) {
+	key := lsa.header.key()
+	old := lsdb[key]
+
+	// 古いインスタンスは再送リストから外す
+	if old != nil {
+		for _, iface := range ospfv3Interfaces {
+			for _, nbr := range iface.neighbors {
+				if nbr.retransList[key] == old {
+					delete(nbr.retransList, key)
+				}
+			}
+		}
+	}
+	lsdb[key] = lsa
+
+	if old == nil || !bytes.Equal(old.body, lsa.body) || (old.header.age == OSPFV3_MAX_AGE) != (lsa.header.age == OSPFV3_MAX_AGE) {
+		ospfv3ScheduleSpf()
+	}
+}
+
+/* ageがMaxAgeになったLSAを消し、自分のLSAは定期的に生成し直す。既に動いていれば何もしない */
+func ospfv3StartAging() {
+	if ospfv3AgingTimer != nil {
+		return
+	}
+	ospfv3AgingTimer = newTimer(OSPFV3_AGING_INTERVAL, func() {
+		refresh := false
+		lsdbs := []map[ospfv3LsaKey]*ospfv3Lsa{ospfv3AsLsdb}
+		for _, area := range ospfv3Areas {
+			lsdbs = append(lsdbs, area.lsdb)
+		}
+		for _, iface := range ospfv3Interfaces {
+			lsdbs = append(lsdbs, iface.linkLsdb)
+		}
+
+		for _, lsdb := range lsdbs {
+			for key, lsa := range lsdb {
+				age := lsa.currentHeader().age
+				if age >= OSPFV3_MAX_AGE && !ospfv3InRetransList(key) {
+					delete(lsdb, key)
+					ospfv3ScheduleSpf()
+				} else if key.advRouter == ospfv3RouterId && age >= OSPFV3_LS_REFRESH_TIME && age < OSPFV3_MAX_AGE {
+					refresh = true
+				}
+			}
+		}
+
+		if refresh {
+			ospfv3OriginateAll(true)
+		}
+		ospfv3AgingTimer.reset(OSPFV3_AGING_INTERVAL)
+	})
+}
+
+func ospfv3InRetransList(key ospfv3LsaKey) bool {
+	for _, iface := range ospfv3Interfaces {
+		for _, nbr := range iface.neighbors {
+			if _, ok := nbr.retransList[key]; ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/* 状態の変化が続いても一度にまとめて生成する */
+func ospfv3ScheduleOriginate() {
+	if ospfv3OriginateTimer != nil && ospfv3OriginateTimer.active {
+		return
+	}
+	ospfv3OriginateTimer = newTimer(0, func() {
+		ospfv3OriginateAll(false)
+	})
+}
+
+type ospfv3OwnLsa struct {
+	iface  *ospfv3Interface // LSAを生成するインターフェイス(スコープの決定に使う)
+	lsType uint16
+	lsId   uint32
+	body   []byte
+}
+
+/*
+ * 自分が生成するべきLSAを全て作り、内容が変わったものだけ新しいシーケンス番号でフラッディングする。
+ * 不要になった自分のLSAはMaxAgeにして取り除く。
+ */
+func ospfv3OriginateAll(refresh bool) {
+	for _, area := range ospfv3Areas {
+		if len(area.interfaces) == 0 {
+			continue
+		}
+		var own []ospfv3OwnLsa
+		anyIface := area.interfaces[0]
+
+		own = append(own, ospfv3OwnLsa{anyIface, OSPFV3_LSA_ROUTER, 0, ospfv3RouterLsaBody(area)})
+		if body := ospfv3IntraAreaPrefixBody(OSPFV3_LSA_ROUTER, 0, ospfv3StubPrefixes(area)); body != nil {
+			own = append(own, ospfv3OwnLsa{anyIface, OSPFV3_LSA_INTRA_AREA_PREFIX, 0, body})
+		}
+
+		for _, iface := range area.interfaces {
+			if iface.state == OSPFV3_IF_DOWN {
+				continue
+			}
+			own = append(own, ospfv3OwnLsa{iface, OSPFV3_LSA_LINK, iface.interfaceId, ospfv3LinkLsaBody(iface)})
+
+			if iface.state == OSPFV3_IF_DR && ospfv3HasFullNeighbor(iface) {
+				own = append(own, ospfv3OwnLsa{iface, OSPFV3_LSA_NETWORK, iface.interfaceId, ospfv3NetworkLsaBody(iface)})
+				if body := ospfv3IntraAreaPrefixBody(OSPFV3_LSA_NETWORK, iface.interfaceId, ospfv3TransitPrefixes(iface)); body != nil {
+					own = append(own, ospfv3OwnLsa{iface, OSPFV3_LSA_INTRA_AREA_PREFIX, iface.interfaceId, body})
+				}
+			}
+		}
+
+		own = append(own, ospfv3InterAreaPrefixLsas(area)...)
+
+		wanted := map[ospfv3LsaKey]bool{}
+		for _, o := range own {
+			key := ospfv3LsaKey{o.lsType, o.lsId, ospfv3RouterId}
+			wanted[key] = true
+			ospfv3Originate(o.iface, key, o.body, refresh)
+		}
+
+		// 不要になったLSAを取り除く
+		for _, iface := range area.interfaces {
+			for _, lsdb := range []map[ospfv3LsaKey]*ospfv3Lsa{area.lsdb, iface.linkLsdb} {
+				for key, lsa := range lsdb {
+					if key.advRouter == ospfv3RouterId && !wanted[key] && lsa.currentHeader().age != OSPFV3_MAX_AGE {
+						ospfv3FlushLsa(iface, lsa)
+					}
+				}
+			}
+		}
+	}
+
+	ospfv3OriginateExternal(refresh)
+}
+
+/* 再配布する経路をASBRとしてAS外部LSAで広告する */
+func ospfv3OriginateExternal(refresh bool) {
+	if len(ospfv3Interfaces) == 0 {
+		return
+	}
+	anyIface := ospfv3Interfaces[0]
+
+	wanted := map[ospfv3LsaKey]bool{}
+	for rkey, r := range redistributedRoutes(PROTO_OSPFV3, defaultVrf) {
+		lsId, ok := ospfv3ExternalLsIds[rkey]
+		if !ok {
+			lsId = uint32(len(ospfv3ExternalLsIds) + 1)
+			ospfv3ExternalLsIds[rkey] = lsId
+		}
+		key := ospfv3LsaKey{OSPFV3_LSA_AS_EXTERNAL, lsId, ospfv3RouterId}
+		wanted[key] = true
+		ospfv3Originate(anyIface, key, ospfv3AsExternalBody(rkey, r), refresh)
+	}
+
+	for key, lsa := range ospfv3AsLsdb {
+		if key.lsType == OSPFV3_LSA_AS_EXTERNAL && key.advRouter == ospfv3RouterId && !wanted[key] && lsa.currentHeader().age != OSPFV3_MAX_AGE {
+			ospfv3FlushLsa(anyIface, lsa)
+		}
+	}
+}
+
+/* タイプ2の外部メトリックで作る。転送アドレスは使わない */
+func ospfv3AsExternalBody(key ribKey, route *ipv6RouteEntry) []byte {
+	var b bytes.Buffer
+
+	flags := OSPFV3_EXTERNAL_FLAG_E
+	if route.tag != 0 {
+		flags |= OSPFV3_EXTERNAL_FLAG_T
+	}
+	metric := route.metric
+	if metric == 0 {
+		metric = OSPFV3_DEFAULT_EXTERNAL_METRIC
+	}
+	b.Write(uint32ToByte(uint32(flags)<<24 | metric&0x00ffffff))
+	b.Write(uint8ToByte(key.prefixLen))
+	b.Write(uint8ToByte(0))
+	b.Write(uint16ToByte(0))
+	b.Write(ospfv3PrefixBytes(key.prefix, key.prefixLen))
+	if route.tag != 0 {
+		b.Write(uint32ToByte(route.tag))
+	}
+
+	return b.Bytes()
+}
+
+func ospfv3Originate(iface *ospfv3Interface, key ospfv3LsaKey, body []byte, refresh bool) {
+	lsdb := ospfv3Lsdb(iface, key.lsType)
+	current := lsdb[key]
+
+	seq := OSPFV3_INITIAL_SEQ
+	if current != nil {
+		currentHeader := current.currentHeader()
+		if !refresh && currentHeader.age < OSPFV3_MAX_AGE && bytes.Equal(current.body, body) {
+			return
+		}
+		seq = currentHeader.seq + 1
+	}
+
+	lsa := &ospfv3Lsa{
+		header: ospfv3LsaHeader{
+			lsType:    key.lsType,
+			lsId:      key.lsId,
+			advRouter: key.advRouter,
+			seq:       seq,
+			length:    uint16(OSPFV3_LSA_HEADER_LEN + len(body)),
+		},
+		body:      body,
+		installed: timerClock.now(),
+	}
+	raw := lsa.toPacket()
+	lsa.header.checksum = fletcherChecksum(raw[2:], 14)
+
+	ospfv3Log.Debug("originate lsa", "lsType", fmt.Sprintf("%04x", key.lsType), "lsId", key.lsId, "seq", seq)
+	ospfv3InstallLsa(lsdb, lsa)
+	ospfv3Flood(lsa, iface, nil)
+}
+
+func ospfv3FlushLsa(iface *ospfv3Interface, lsa *ospfv3Lsa) {
+	flushed := &ospfv3Lsa{
+		header:    lsa.header,
+		body:      lsa.body,
+		installed: timerClock.now(),
+	}
+	flushed.header.age = OSPFV3_MAX_AGE
+
+	ospfv3Log.Info("flush lsa", "lsType", fmt.Sprintf("%04x", lsa.header.lsType), "lsId", lsa.header.lsId)
+	ospfv3InstallLsa(ospfv3Lsdb(iface, lsa.header.lsType), flushed)
+	ospfv3Flood(flushed, iface, nil)
+}
+
+func ospfv3HasFullNeighbor(iface *ospfv3Interface) bool {
+	for _, nbr := range iface.neighbors {
+		if nbr.state == OSPFV3_NBR_FULL {
+			return true
+		}
+	}
+	return false
+}
+
+/* ブロードキャストのリンクがトランジットネットワークか(DRと隣接関係がある) */
+func ospfv3IsTransit(iface *ospfv3Interface) bool {
+	if iface.networkType != OSPFV3_NETWORK_BROADCAST || iface.state < OSPFV3_IF_DROTHER {
+		return false
+	}
+	if iface.dr == ospfv3RouterId {
+		return ospfv3HasFullNeighbor(iface)
+	}
+	dr := iface.neighbors[iface.dr]
+	return dr != nil && dr.state == OSPFV3_NBR_FULL
+}
+
+func ospfv3RouterLsaBody(area *ospfv3Area) []byte {
+	var b bytes.Buffer
+
+	var flags uint8
+	if len(ospfv3Areas) > 1 {
+		flags |= OSPFV3_ROUTER_FLAG_B
+	}
+	if len(redistributions[PROTO_OSPFV3]) > 0 {
+		flags |= OSPFV3_ROUTER_FLAG_E
+	}
+	b.Write(uint8ToByte(flags))
+	b.Write(uint32ToByte(OSPFV3_OPTIONS)[1:4])
+
+	writeLink := func(linkType uint8, cost uint16, interfaceId uint32, nbrInterfaceId uint32, nbrRouterId uint32) {
+		b.Write(uint8ToByte(linkType))
+		b.Write(uint8ToByte(0))
+		b.Write(uint16ToByte(cost))
+		b.Write(uint32ToByte(interfaceId))
+		b.Write(uint32ToByte(nbrInterfaceId))
+		b.Write(uint32ToByte(nbrRouterId))
+	}
+
+	for _, iface := range area.interfaces {
+		switch {
+		case iface.state == OSPFV3_IF_POINT_TO_POINT:
+			for _, nbr := range iface.neighbors {
+				if nbr.state == OSPFV3_NBR_FULL {
+					writeLink(OSPFV3_ROUTER_LINK_P2P, iface.cost, iface.interfaceId, nbr.interfaceId, nbr.routerId)
+				}
+			}
+		case ospfv3IsTransit(iface):
+			if iface.dr == ospfv3RouterId {
+				writeLink(OSPFV3_ROUTER_LINK_TRANSIT, iface.cost, iface.interfaceId, iface.interfaceId, ospfv3RouterId)
+			} else {
+				dr := iface.neighbors[iface.dr]
+				writeLink(OSPFV3_ROUTER_LINK_TRANSIT, iface.cost, iface.interfaceId, dr.interfaceId, dr.routerId)
+			}
+		}
+	}
+
+	return b.Bytes()
+}
+
+func ospfv3NetworkLsaBody(iface *ospfv3Interface) []byte {
+	var b bytes.Buffer
+
+	b.Write(uint8ToByte(0))
+	b.Write(uint32ToByte(OSPFV3_OPTIONS)[1:4])
+	b.Write(uint32ToByte(ospfv3RouterId))
+	for _, nbr := range iface.neighbors {
+		if nbr.state == OSPFV3_NBR_FULL {
+			b.Write(uint32ToByte(nbr.routerId))
+		}
+	}
+
+	return b.Bytes()
+}
+
+type ospfv3Prefix struct {
+	prefix    in6Addr
+	prefixLen uint8
+	options   uint8
+	metric    uint16
+}
+
+func ospfv3InterfacePrefix(iface *ospfv3Interface) *ospfv3Prefix {
+	ipv6Dev := iface.dev.ipv6Dev
+	if ipv6Dev.prefixLen == 0 || in6AddrIsLinkLocal(ipv6Dev.address) {
+		return nil
+	}
+	return &ospfv3Prefix{
+		prefix:    in6AddrClearPrefix(ipv6Dev.address, ipv6Dev.prefixLen),
+		prefixLen: ipv6Dev.prefixLen,
+		metric:    iface.cost,
+	}
+}
+
+/* トランジットネットワーク以外のインターフェイスのプレフィックス */
+func ospfv3StubPrefixes(area *ospfv3Area) []ospfv3Prefix {
+	var prefixes []ospfv3Prefix
+	for _, iface := range area.interfaces {
+		if iface.state == OSPFV3_IF_DOWN || ospfv3IsTransit(iface) {
+			continue
+		}
+		if p := ospfv3InterfacePrefix(iface); p != nil {
+			prefixes = append(prefixes, *p)
+		}
+	}
+	return prefixes
+}
+
+/* DRとしてトランジットネットワークのプレフィックスをリンク上のLink-LSAから集める */
+func ospfv3TransitPrefixes(iface *ospfv3Interface) []ospfv3Prefix {
+	seen := map[ribKey]bool{}
+	var prefixes []ospfv3Prefix
+
+	add := func(p ospfv3Prefix) {
+		key := ribKey{p.prefix, p.prefixLen}
+		if seen[key] || p.options&OSPFV3_PREFIX_OPTION_NU != 0 {
+			return
+		}
+		seen[key] = true
+		p.metric = 0
+		prefixes = append(prefixes, p)
+	}
+
+	if p := ospfv3InterfacePrefix(iface); p != nil {
+		add(*p)
+	}
+	for key, lsa := range iface.linkLsdb {
+		nbr := iface.neighbors[key.advRouter]
+		if key.lsType != OSPFV3_LSA_LINK || nbr == nil || nbr.state != OSPFV3_NBR_FULL {
+			continue
+		}
+		for _, p := range parseOspfv3LinkLsaPrefixes(lsa.body) {
+			add(p)
+		}
+	}
+
+	return prefixes
+}
+
+func ospfv3LinkLsaBody(iface *ospfv3Interface) []byte {
+	var b bytes.Buffer
+
+	b.Write(uint8ToByte(iface.priority))
+	b.Write(uint32ToByte(OSPFV3_OPTIONS)[1:4])
+	b.Write(iface.dev.ipv6Dev.linkLocalAddr[:])
+
+	p := ospfv3InterfacePrefix(iface)
+	if p == nil {
+		b.Write(uint32ToByte(0))
+		return b.Bytes()
+	}
+	b.Write(uint32ToByte(1))
+	b.Write(uint8ToByte(p.prefixLen))
+	b.Write(uint8ToByte(p.options))
+	b.Write(uint16ToByte(0))
+	b.Write(ospfv3PrefixBytes(p.prefix, p.prefixLen))
+
+	return b.Bytes()
+}
+
+func parseOspfv3LinkLsaPrefixes(body []byte) []ospfv3Prefix {
+	if len(body) < 24 {
+		return nil
+	}
+	count := byteToUint32(body[20:24])
+	prefixes, _ := parseOspfv3Prefixes(body[24:], int(count))
+	return prefixes
+}
+
+func ospfv3IntraAreaPrefixBody(refType uint16, refLsId uint32, prefixes []ospfv3Prefix) []byte {
+	if len(prefixes) == 0 {
+		return nil
+	}
+
+	var b bytes.Buffer
+	b.Write(uint16ToByte(uint16(len(prefixes))))
+	b.Write(uint16ToByte(refType))
+	b.Write(uint32ToByte(refLsId))
+	b.Write(uint32ToByte(ospfv3RouterId))
+	for _, p := range prefixes {
+		b.Write(uint8ToByte(p.prefixLen))
+		b.Write(uint8ToByte(p.options))
+		b.Write(uint16ToByte(p.metric))
+		b.Write(ospfv3PrefixBytes(p.prefix, p.prefixLen))
+	}
+
+	return b.Bytes()
+}
+
+/*
+ * ABRは他のエリアのエリア内経路をエリア間プレフィックスLSAとして広告する
+ */
+func ospfv3InterAreaPrefixLsas(area *ospfv3Area) []ospfv3OwnLsa {
+	if len(ospfv3Areas) < 2 {
+		return nil
+	}
+
+	var own []ospfv3OwnLsa
+	for _, other := range ospfv3Areas {
+		if other == area {
+			continue
+		}
+		for key, cost := range ospfv3IntraAreaCosts[other.id] {
+			lsId, ok := ospfv3SummaryLsIds[key]
+			if !ok {
+				lsId = uint32(len(ospfv3SummaryLsIds) + 1)
+				ospfv3SummaryLsIds[key] = lsId
+			}
+
+			var b bytes.Buffer
+			b.Write(uint32ToByte(cost & 0x00ffffff))
+			b.Write(uint8ToByte(key.prefixLen))
+			b.Write(uint8ToByte(0))
+			b.Write(uint16ToByte(0))
+			b.Write(ospfv3PrefixBytes(key.prefix, key.prefixLen))
+			own = append(own, ospfv3OwnLsa{area.interfaces[0], OSPFV3_LSA_INTER_AREA_PREFIX, lsId, b.Bytes()})
+		}
+	}
+
+	return own
+}
+
+/* プレフィックスは32bit単位に切り上げた長さで表す */
+func ospfv3PrefixBytes(prefix in6Addr, prefixLen uint8) []byte {
+	n := (int(prefixLen) + 31) / 32 * 4
+	return append([]byte{}, prefix[:n]...)
+}
+
+/* プレフィックス(長さ、オプション、メトリック、アドレス)を指定数だけ読む */
+func parseOspfv3Prefixes(buffer []byte, count int) ([]ospfv3Prefix, bool) {
+	var prefixes []ospfv3Prefix
+	for i := 0; i < count; i++ {
+		if len(buffer) < 4 {
+			return prefixes, false
+		}
+		p := ospfv3Prefix{
+			prefixLen: buffer[0],
+			options:   buffer[1],
+			metric:    byteToUint16(buffer[2:4]),
+		}
+		n := (int(p.prefixLen) + 31) / 32 * 4
+		if p.prefixLen > 128 || len(buffer) < 4+n {
+			return prefixes, false
+		}
+		copy(p.prefix[:], buffer[4:4+n])
+		p.prefix = in6AddrClearPrefix(p.prefix, p.prefixLen)
+		prefixes = append(prefixes, p)
+		buffer = buffer[4+n:]
+	}
+	return prefixes, true
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"time"
+)
+
+/**
+ * OSPFv3のSPF計算と経路のインストール
+ */
+const OSPFV3_SPF_DELAY = 200 * time.Millisecond
+
+const OSPFV3_INFINITY uint32 = 0xffffff
+
+type ospfv3VertexKey struct {
+	isNetwork bool
+	routerId  uint32
+	lsId      uint32 // ネットワークの場合はDRのインターフェイスID
+}
+
+type ospfv3NextHop struct {
+	dev  *netDevice
+	addr in6Addr // 直結ネットワークの場合はゼロ
+}
+
+type ospfv3Vertex struct {
+	key      ospfv3VertexKey
+	lsa      *ospfv3Lsa
+	dist     uint32
+	nextHop  *ospfv3NextHop // 自分自身の場合はnil
+	isAbr    bool
+	isAsbr   bool
+	finished bool
+}
+
+type ospfv3Route struct {
+	vrf     *vrf
+	nextHop ospfv3NextHop
+	cost    uint32
+	tag     uint32
+}
+
+// エリアごとのエリア内経路のコスト。ABRがエリア間プレフィックスLSAを作るのに使う
+var ospfv3IntraAreaCosts = map[uint32]map[ribKey]uint32{}
+
+// RIBにインストールしたOSPFv3の経路
+var ospfv3Routes = map[ribKey]*ospfv3Route{}
+
+var ospfv3SpfTimer *timer
+
+func ospfv3ScheduleSpf() {
+	if ospfv3SpfTimer != nil && ospfv3SpfTimer.active {
+		return
+	}
+	ospfv3SpfTimer = newTimer(OSPFV3_SPF_DELAY, ospfv3RunSpf)
+}
+
+func ospfv3RunSpf() {
+	intraRoutes := map[ribKey]*ospfv3Route{}
+	interRoutes := map[ribKey]*ospfv3Route{}
+	intraCosts := map[uint32]map[ribKey]uint32{}
+	asbrs := map[uint32]*ospfv3Vertex{}
+
+	for _, area := range ospfv3Areas {
+		vertices := ospfv3Dijkstra(area)
+		intraCosts[area.id] = map[ribKey]uint32{}
+
+		for key, v := range vertices {
+			if !key.isNetwork && v.finished && v.isAsbr && v.nextHop != nil {
+				if a, ok := asbrs[key.routerId]; !ok || v.dist < a.dist {
+					asbrs[key.routerId] = v
+				}
+			}
+		}
+
+		// エリア内経路
+		for key, lsa := range area.lsdb {
+			if key.lsType != OSPFV3_LSA_INTRA_AREA_PREFIX || lsa.currentHeader().age == OSPFV3_MAX_AGE || len(lsa.body) < 12 {
+				continue
+			}
+			refType := byteToUint16(lsa.body[2:4])
+			refLsId := byteToUint32(lsa.body[4:8])
+			refAdvRouter := byteToUint32(lsa.body[8:12])
+
+			vkey := ospfv3VertexKey{routerId: refAdvRouter}
+			if refType == OSPFV3_LSA_NETWORK {
+				vkey = ospfv3VertexKey{isNetwork: true, routerId: refAdvRouter, lsId: refLsId}
+			}
+			v := vertices[vkey]
+			if v == nil || !v.finished {
+				continue
+			}
+
+			prefixes, _ := parseOspfv3Prefixes(lsa.body[12:], int(byteToUint16(lsa.body[0:2])))
+			for _, p := range prefixes {
+				if p.options&OSPFV3_PREFIX_OPTION_NU != 0 {
+					continue
+				}
+				rkey := ribKey{p.prefix, p.prefixLen}
+				cost := v.dist + uint32(p.metric)
+				if c, ok := intraCosts[area.id][rkey]; !ok || cost < c {
+					intraCosts[area.id][rkey] = cost
+				}
+				// 自分のプレフィックスは直結経路があるのでインストールしない
+				if v.nextHop == nil {
+					continue
+				}
+				if r, ok := intraRoutes[rkey]; !ok || cost < r.cost {
+					intraRoutes[rkey] = &ospfv3Route{vrf: v.nextHop.dev.vrf, nextHop: *v.nextHop, cost: cost}
+				}
+			}
+		}
+
+		// エリア間経路。ABRはバックボーンのものだけを使う
+		if len(ospfv3Areas) > 1 && area.id != 0 {
+			continue
+		}
+		for key, lsa := range area.lsdb {
+			if key.lsType != OSPFV3_LSA_INTER_AREA_PREFIX || key.advRouter == ospfv3RouterId || lsa.currentHeader().age == OSPFV3_MAX_AGE || len(lsa.body) < 8 {
+				continue
+			}
+			abr := vertices[ospfv3VertexKey{routerId: key.advRouter}]
+			if abr == nil || !abr.finished || !abr.isAbr || abr.nextHop == nil {
+				continue
+			}
+			metric := byteToUint32(lsa.body[0:4]) & 0x00ffffff
+			if metric == OSPFV3_INFINITY {
+				continue
+			}
+			prefixes, ok := parseOspfv3Prefixes(lsa.body[4:], 1)
+			if !ok {
+				continue
+			}
+			rkey := ribKey{prefixes[0].prefix, prefixes[0].prefixLen}
+			cost := abr.dist + metric
+			if r, ok := interRoutes[rkey]; !ok || cost < r.cost {
+				interRoutes[rkey] = &ospfv3Route{vrf: abr.nextHop.dev.vrf, nextHop: *abr.nextHop, cost: cost}
+			}
+		}
+	}
+
+	// エリア内経路、エリア間経路、AS外部経路の順にコストに関わらず優先する
+	routes := ospfv3ExternalRoutes(asbrs)
+	for key, r := range interRoutes {
+		routes[key] = r
+	}
+	for key, r := range intraRoutes {
+		routes[key] = r
+	}
+	ospfv3InstallRoutes(routes)
+
+	summariesChanged := len(intraCosts) != len(ospfv3IntraAreaCosts)
+	for areaId, costs := range intraCosts {
+		old := ospfv3IntraAreaCosts[areaId]
+		if len(old) != len(costs) {
+			summariesChanged = true
+			break
+		}
+		for k, c := range costs {
+			if oc, ok := old[k]; !ok || oc != c {
+				summariesChanged = true
+				break
+			}
+		}
+	}
+	ospfv3IntraAreaCosts = intraCosts
+	if summariesChanged && len(ospfv3Areas) > 1 {
+		ospfv3ScheduleOriginate()
+	}
+}
+
+/*
+ * AS外部経路の計算(RFC 2328 16.4)。ASBRは同じエリアから到達できるものだけを使い、転送アドレスは無視する。
+ * タイプ1の経路はタイプ2より優先し、タイプ2同士は外部メトリック、同じならASBRまでのコストで比べる。
+ */
+func ospfv3ExternalRoutes(asbrs map[uint32]*ospfv3Vertex) map[ribKey]*ospfv3Route {
+	type candidate struct {
+		route *ospfv3Route
+		type2 bool
+		dist  uint32 // ASBRまでのコスト
+	}
+	candidates := map[ribKey]*candidate{}
+
+	for key, lsa := range ospfv3AsLsdb {
+		if key.lsType != OSPFV3_LSA_AS_EXTERNAL || key.advRouter == ospfv3RouterId || lsa.currentHeader().age == OSPFV3_MAX_AGE || len(lsa.body) < 8 {
+			continue
+		}
+		asbr := asbrs[key.advRouter]
+		if asbr == nil {
+			continue
+		}
+		flags := lsa.body[0]
+		metric := byteToUint32(lsa.body[0:4]) & 0x00ffffff
+		if metric == OSPFV3_INFINITY {
+			continue
+		}
+		prefixes, ok := parseOspfv3Prefixes(lsa.body[4:], 1)
+		if !ok || prefixes[0].options&OSPFV3_PREFIX_OPTION_NU != 0 {
+			continue
+		}
+		p := prefixes[0]
+
+		var tag uint32
+		if flags&OSPFV3_EXTERNAL_FLAG_T != 0 {
+			offset := 8 + len(ospfv3PrefixBytes(p.prefix, p.prefixLen))
+			if flags&OSPFV3_EXTERNAL_FLAG_F != 0 {
+				offset += 16
+			}
+			if len(lsa.body) >= offset+4 {
+				tag = byteToUint32(lsa.body[offset : offset+4])
+			}
+		}
+
+		c := &candidate{type2: flags&OSPFV3_EXTERNAL_FLAG_E != 0, dist: asbr.dist}
+		cost := metric
+		if !c.type2 {
+			cost += asbr.dist
+		}
+		c.route = &ospfv3Route{vrf: asbr.nextHop.dev.vrf, nextHop: *asbr.nextHop, cost: cost, tag: tag}
+
+		rkey := ribKey{p.prefix, p.prefixLen}
+		old, ok := candidates[rkey]
+		if !ok || (old.type2 && !c.type2) || (old.type2 == c.type2 && (cost < old.route.cost || (cost == old.route.cost && c.dist < old.dist))) {
+			candidates[rkey] = c
+		}
+	}
+
+	routes := map[ribKey]*ospfv3Route{}
+	for key, c := range candidates {
+		routes[key] = c.route
+	}
+	return routes
+}
+
+/*
+ * ダイクストラ法でエリア内の最短経路木を作る(RFC 2328 16.1)
+ */
+func ospfv3Dijkstra(area *ospfv3Area) map[ospfv3VertexKey]*ospfv3Vertex {
+	vertices := map[ospfv3VertexKey]*ospfv3Vertex{}
+
+	rootLsa := area.lsdb[ospfv3LsaKey{OSPFV3_LSA_ROUTER, 0, ospfv3RouterId}]
+	if rootLsa == nil {
+		return vertices
+	}
+	root := &ospfv3Vertex{key: ospfv3VertexKey{routerId: ospfv3RouterId}, lsa: rootLsa}
+	vertices[root.key] = root
+
+	for v := root; v != nil; v = ospfv3NextCandidate(vertices) {
+		v.finished = true
+
+		if !v.key.isNetwork {
+			body := v.lsa.body
+			if len(body) < 4 {
+				continue
+			}
+			v.isAbr = body[0]&OSPFV3_ROUTER_FLAG_B != 0
+			v.isAsbr = body[0]&OSPFV3_ROUTER_FLAG_E != 0
+			for i := 4; i+16 <= len(body); i += 16 {
+				linkType := body[i]
+				metric := uint32(byteToUint16(body[i+2 : i+4]))
+				interfaceId := byteToUint32(body[i+4 : i+8])
+				nbrInterfaceId := byteToUint32(body[i+8 : i+12])
+				nbrRouterId := byteToUint32(body[i+12 : i+16])
+
+				var wkey ospfv3VertexKey
+				var wlsa *ospfv3Lsa
+				switch linkType {
+				case OSPFV3_ROUTER_LINK_P2P:
+					wkey = ospfv3VertexKey{routerId: nbrRouterId}
+					wlsa = ospfv3RouterLsa(area, nbrRouterId)
+					if wlsa == nil || !ospfv3RouterLinksBack(wlsa, OSPFV3_ROUTER_LINK_P2P, v.key.routerId, 0) {
+						continue
+					}
+				case OSPFV3_ROUTER_LINK_TRANSIT:
+					wkey = ospfv3VertexKey{isNetwork: true, routerId: nbrRouterId, lsId: nbrInterfaceId}
+					wlsa = area.lsdb[ospfv3LsaKey{OSPFV3_LSA_NETWORK, nbrInterfaceId, nbrRouterId}]
+					if wlsa == nil || wlsa.currentHeader().age == OSPFV3_MAX_AGE || !ospfv3NetworkAttached(wlsa, v.key.routerId) {
+						continue
+					}
+				default:
+					continue
+				}
+				ospfv3Relax(vertices, v, wkey, wlsa, v.dist+metric, interfaceId, nbrRouterId)
+			}
+			continue
+		}
+
+		// ネットワークから接続しているルータへのコストは0
+		body := v.lsa.body
+		for i := 4; i+4 <= len(body); i += 4 {
+			routerId := byteToUint32(body[i : i+4])
+			wlsa := ospfv3RouterLsa(area, routerId)
+			if wlsa == nil || !ospfv3RouterLinksBack(wlsa, OSPFV3_ROUTER_LINK_TRANSIT, v.key.routerId, v.key.lsId) {
+				continue
+			}
+			ospfv3Relax(vertices, v, ospfv3VertexKey{routerId: routerId}, wlsa, v.dist, 0, routerId)
+		}
+	}
+
+	return vertices
+}
+
+func ospfv3RouterLsa(area *ospfv3Area, routerId uint32) *ospfv3Lsa {
+	lsa := area.lsdb[ospfv3LsaKey{OSPFV3_LSA_ROUTER, 0, routerId}]
+	if lsa == nil || lsa.currentHeader().age == OSPFV3_MAX_AGE {
+		return nil
+	}
+	return lsa
+}
+
+/* Router-LSAに逆向きのリンクがあるか */
+func ospfv3RouterLinksBack(lsa *ospfv3Lsa, linkType uint8, routerId uint32, interfaceId uint32) bool {
+	body := lsa.body
+	for i := 4; i+16 <= len(body); i += 16 {
+		if body[i] != linkType || byteToUint32(body[i+12:i+16]) != routerId {
+			continue
+		}
+		if linkType == OSPFV3_ROUTER_LINK_P2P || byteToUint32(body[i+8:i+12]) == interfaceId {
+			return true
+		}
+	}
+	return false
+}
+
+func ospfv3NetworkAttached(lsa *ospfv3Lsa, routerId uint32) bool {
+	body := lsa.body
+	for i := 4; i+4 <= len(body); i += 4 {
+		if byteToUint32(body[i:i+4]) == routerId {
+			return true
+		}
+	}
+	return false
+}
+
+func ospfv3Relax(vertices map[ospfv3VertexKey]*ospfv3Vertex, parent *ospfv3Vertex, wkey ospfv3VertexKey, wlsa *ospfv3Lsa, dist uint32, interfaceId uint32, nbrRouterId uint32) {
+	w := vertices[wkey]
+	if w != nil && (w.finished || w.dist <= dist) {
+		return
+	}
+
+	nextHop := ospfv3CalcNextHop(parent, wkey, interfaceId, nbrRouterId)
+	if nextHop == nil {
+		return
+	}
+	if w == nil {
+		w = &ospfv3Vertex{key: wkey}
+		vertices[wkey] = w
+	}
+	w.lsa = wlsa
+	w.dist = dist
+	w.nextHop = nextHop
+}
+
+/*
+ * ネクストホップの計算(RFC 2328 16.1.1)
+ * 自分に直結している頂点はインターフェイスと近隣ルータのリンクローカルアドレスを使い、それ以外は親から引き継ぐ
+ */
+func ospfv3CalcNextHop(parent *ospfv3Vertex, wkey ospfv3VertexKey, interfaceId uint32, nbrRouterId uint32) *ospfv3NextHop {
+	if parent.nextHop == nil {
+		// 親が自分自身
+		iface := ospfv3InterfaceById(interfaceId)
+		if iface == nil {
+			return nil
+		}
+		if wkey.isNetwork {
+			return &ospfv3NextHop{dev: iface.dev}
+		}
+		nbr := iface.neighbors[nbrRouterId]
+		if nbr == nil {
+			return nil
+		}
+		return &ospfv3NextHop{dev: iface.dev, addr: nbr.addr}
+	}
+
+	if parent.key.isNetwork && parent.nextHop.addr == (in6Addr{}) {
+		// 親が直結ネットワーク
+		iface := getOspfv3Interface(parent.nextHop.dev)
+		if iface == nil {
+			return nil
+		}
+		nbr := iface.neighbors[nbrRouterId]
+		if nbr == nil {
+			return nil
+		}
+		return &ospfv3NextHop{dev: iface.dev, addr: nbr.addr}
+	}
+
+	nextHop := *parent.nextHop
+	return &nextHop
+}
+
+func ospfv3InterfaceById(interfaceId uint32) *ospfv3Interface {
+	for _, iface := range ospfv3Interfaces {
+		if iface.interfaceId == interfaceId {
+			return iface
+		}
+	}
+	return nil
+}
+
+func ospfv3NextCandidate(vertices map[ospfv3VertexKey]*ospfv3Vertex) *ospfv3Vertex {
+	var next *ospfv3Vertex
+	for _, v := range vertices {
+		if v.finished {
+			continue
+		}
+		// 同じコストならネットワークを先に処理する
+		if next == nil || v.dist < next.dist || (v.dist == next.dist && v.key.isNetwork && !next.key.isNetwork) {
+			next = v
+		}
+	}
+	return next
+}
+
+/* 計算結果との差分だけRIBに反映する */
+func ospfv3InstallRoutes(routes map[ribKey]*ospfv3Route) {
+	for key, old := range ospfv3Routes {
+		if _, ok := routes[key]; !ok {
+			ribDelete(old.vrf, key.prefix, key.prefixLen, PROTO_OSPFV3)
+		}
+	}
+
+	for key, r := range routes {
+		if old, ok := ospfv3Routes[key]; ok && *old == *r {
+			continue
+		}
+		if old, ok := ospfv3Routes[key]; ok && old.vrf != r.vrf {
+			ribDelete(old.vrf, key.prefix, key.prefixLen, PROTO_OSPFV3)
+		}
+
+		route := &ipv6RouteEntry{
+			routeType: NETWORK,
+			dev:       r.nextHop.dev,
+			nextHop:   r.nextHop.addr,
+			proto:     PROTO_OSPFV3,
+			metric:    r.cost,
+			tag:       r.tag,
+		}
+		if r.nextHop.addr == (in6Addr{}) {
+			route.routeType = CONNECTED
+		}
+		ribAdd(r.vrf, key.prefix, key.prefixLen, route)
+		ospfv3Log.Debug("install route", "prefix", fmtPrefixStr(key.prefix, key.prefixLen), "nexthop", r.nextHop.addr, "dev", r.nextHop.dev.name, "cost", r.cost)
+	}
+
+	ospfv3Routes = routes
+}
@@ -1,12 +1,5 @@
 package main
 
-import "fmt"
-
-/**
- * IPv6ルーティングテーブルのルートノード
- */
-var ipv6Fib *patriciaNode
-
 type patriciaNode struct {
 	left     *patriciaNode
 	right    *patriciaNode
@@ -19,7 +12,7 @@ type patriciaNode struct {
 
 func in6AddrGetBit(address in6Addr, bit uint8) uint8 {
 	if bit > 128 {
-		fmt.Errorf("bit length is within 128. actual length is %d\n", bit)
+		fibLog.Error("bit length exceeds 128", "bit", bit)
 	}
 	byteIndex := bit / 8
 	bitIndex := 7 - (bit % 8)
@@ -72,13 +65,21 @@ func createPatriciaNode(addr in6Addr, bitsLen uint8, isPrefix bool, parent *patr
 	return node
 }
 
-func patriciaTrieInsert(address in6Addr, prefixLen uint8, route *ipv6RouteEntry) {
+func patriciaTrieInsert(root *patriciaNode, address in6Addr, prefixLen uint8, route *ipv6RouteEntry) {
 	var currentBitsLen uint8 = 0
-	currentNode := ipv6Fib
+	currentNode := root
 	var nextNode *patriciaNode
 
 	// 引数で渡されたプレフィックスをきれいにする
 	address = in6AddrClearPrefix(address, prefixLen)
+	defer grpcNotifyRoute(root, address, prefixLen, route)
+
+	// デフォルトルート(::/0)はルートノード自身が持つ
+	if prefixLen == 0 {
+		root.isPrefix = true
+		root.route = route
+		return
+	}
 
 	// 枝を辿る
 	for {
@@ -100,9 +101,15 @@ func patriciaTrieInsert(address in6Addr, prefixLen uint8, route *ipv6RouteEntry)
 			}
 		}
 
-		matchLen := in6AddrGetMatchBitsLen(address, nextNode.addr, currentBitsLen+nextNode.bitsLen-1)
+		// 比較するのは挿入するプレフィックス長までにする
+		nextBitsLen := currentBitsLen + nextNode.bitsLen
+		compareBitsLen := nextBitsLen
+		if prefixLen < compareBitsLen {
+			compareBitsLen = prefixLen
+		}
+		matchLen := in6AddrGetMatchBitsLen(address, nextNode.addr, compareBitsLen-1)
 
-		if matchLen == currentBitsLen+nextNode.bitsLen {
+		if matchLen == nextBitsLen {
 			// 次のノードと全マッチ
 			currentBitsLen += nextNode.bitsLen
 			currentNode = nextNode
@@ -130,13 +137,17 @@ func patriciaTrieInsert(address in6Addr, prefixLen uint8, route *ipv6RouteEntry)
 			nextNode.bitsLen -= midBitLen
 			nextNode.parent = midNode
 
-			fmt.Printf("Separated %d & %d\n", midBitLen, nextNode.bitsLen)
-
-			//if prefixLen == currentBitsLen+matchLen {
-			//	nextNode.isPrefix = true
-			//	nextNode.route = route
-			//	break
-			//}
+			// 挿入するプレフィックスが次のノードの途中で終わる場合は中間ノードが目標になる
+			if matchLen == prefixLen {
+				midNode.isPrefix = true
+				midNode.route = route
+				if in6AddrGetBit(nextNode.addr, matchLen) == 0 {
+					midNode.left = nextNode
+				} else {
+					midNode.right = nextNode
+				}
+				break
+			}
 
 			diffNextToMidLen := prefixLen - matchLen
 			diffNextToMidNode := createPatriciaNode(address, diffNextToMidLen, true, midNode)
@@ -155,12 +166,16 @@ func patriciaTrieInsert(address in6Addr, prefixLen uint8, route *ipv6RouteEntry)
 	}
 }
 
-func patriciaTrieSearch(address in6Addr) *patriciaNode {
+func patriciaTrieSearch(root *patriciaNode, address in6Addr) *patriciaNode {
 	var currentBitsLen uint8 = 0
-	currentNode := ipv6Fib
+	currentNode := root
 	var nextNode *patriciaNode
 	var lastMatched *patriciaNode
 
+	if root.isPrefix {
+		lastMatched = root
+	}
+
 	for currentBitsLen < 128 { // 最後までたどり着いてない間は進める
 		// 進めるノードの選択
 		if in6AddrGetBit(address, currentBitsLen) == 0 {
@@ -175,26 +190,134 @@ func patriciaTrieSearch(address in6Addr) *patriciaNode {
 
 		matchLen := in6AddrGetMatchBitsLen(address, nextNode.addr, currentBitsLen+nextNode.bitsLen-1)
 
+		// ノードのビットが全て一致したときだけプレフィックスにマッチしたとみなす
+		if matchLen != currentBitsLen+nextNode.bitsLen {
+			break
+		}
+
 		if nextNode.isPrefix {
 			lastMatched = nextNode
 		}
 
+		currentNode = nextNode
+		currentBitsLen += nextNode.bitsLen
+	}
+
+	if lastMatched != nil && lastMatched.route != nil {
+		fibLog.Debug("lookup", "dst", address, "prefixlen", lastMatched.prefixLen(), "type", lastMatched.route.routeType.String())
+	}
+
+	return lastMatched
+}
+
+/* プレフィックスと完全に一致するノードを探す */
+func patriciaTrieLookup(root *patriciaNode, address in6Addr, prefixLen uint8) *patriciaNode {
+	var currentBitsLen uint8 = 0
+	currentNode := root
+	var nextNode *patriciaNode
+
+	address = in6AddrClearPrefix(address, prefixLen)
+
+	for currentBitsLen < prefixLen {
+		if in6AddrGetBit(address, currentBitsLen) == 0 {
+			nextNode = currentNode.left
+		} else {
+			nextNode = currentNode.right
+		}
+
+		if nextNode == nil || currentBitsLen+nextNode.bitsLen > prefixLen {
+			return nil
+		}
+
+		matchLen := in6AddrGetMatchBitsLen(address, nextNode.addr, currentBitsLen+nextNode.bitsLen-1)
 		if matchLen != currentBitsLen+nextNode.bitsLen {
-			break
+			return nil
 		}
 
 		currentNode = nextNode
 		currentBitsLen += nextNode.bitsLen
 	}
 
-	if lastMatched != nil && lastMatched.route != nil {
-		switch lastMatched.route.routeType {
-		case CONNECTED:
-			fmt.Printf("find to host node. address id %s\n", fmtIpStr(lastMatched.route.dev.ipv6Dev.address))
-		case NETWORK:
-			fmt.Printf("find to next hop node. address id %s\n", fmtIpStr(lastMatched.route.nextHop))
+	if !currentNode.isPrefix {
+		return nil
+	}
+
+	return currentNode
+}
+
+/*
+ * プレフィックスの経路を削除する。
+ * 子を持たなくなったノードは取り除き、子が1つだけの中間ノードは子とまとめる。
+ */
+func patriciaTrieDelete(root *patriciaNode, address in6Addr, prefixLen uint8) bool {
+	node := patriciaTrieLookup(root, address, prefixLen)
+	if node == nil {
+		return false
+	}
+
+	node.isPrefix = false
+	node.route = nil
+	grpcNotifyRoute(root, in6AddrClearPrefix(address, prefixLen), prefixLen, nil)
+
+	for node != root && !node.isPrefix {
+		parent := node.parent
+		if node.left == nil && node.right == nil {
+			// 葉を取り除く
+			if parent.left == node {
+				parent.left = nil
+			} else {
+				parent.right = nil
+			}
+		} else if node.left == nil || node.right == nil {
+			// 中間ノードを子とまとめる
+			child := node.left
+			if child == nil {
+				child = node.right
+			}
+			child.bitsLen += node.bitsLen
+			child.parent = parent
+			if parent.left == node {
+				parent.left = child
+			} else {
+				parent.right = child
+			}
+		} else {
+			break
 		}
+		node = parent
 	}
 
-	return lastMatched
+	return true
+}
+
+/* 経路を持つ全てのノードをプレフィックスとともに辿る */
+func patriciaTrieWalk(root *patriciaNode, fn func(prefix in6Addr, prefixLen uint8, route *ipv6RouteEntry)) {
+	var walk func(node *patriciaNode, bitsLen uint8)
+	walk = func(node *patriciaNode, bitsLen uint8) {
+		if node == nil {
+			return
+		}
+		if node.isPrefix && node.route != nil {
+			fn(in6AddrClearPrefix(node.addr, bitsLen), bitsLen, node.route)
+		}
+		walk(node.left, bitsLen+node.left.bitsLenOrZero())
+		walk(node.right, bitsLen+node.right.bitsLenOrZero())
+	}
+	walk(root, 0)
+}
+
+/* ルートノードからのビット数の合計がノードのプレフィックス長になる */
+func (node *patriciaNode) prefixLen() uint8 {
+	var prefixLen uint8
+	for ; node != nil; node = node.parent {
+		prefixLen += node.bitsLen
+	}
+	return prefixLen
+}
+
+func (node *patriciaNode) bitsLenOrZero() uint8 {
+	if node == nil {
+		return 0
+	}
+	return node.bitsLen
 }
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/binary"
+	"time"
+)
+
+/**
+ * pcapngのブロック
+ * https://www.ietf.org/archive/id/draft-ietf-opsawg-pcapng-01.html
+ * バイトオーダーはリトルエンディアンで書く。読む側はSection Header Blockのマジックで判断する。
+ */
+const PCAPNG_BLOCK_SECTION_HEADER uint32 = 0x0a0d0d0a
+const PCAPNG_BLOCK_INTERFACE_DESCRIPTION uint32 = 1
+const PCAPNG_BLOCK_ENHANCED_PACKET uint32 = 6
+const PCAPNG_BYTE_ORDER_MAGIC uint32 = 0x1a2b3c4d
+
+const PCAPNG_OPT_END uint16 = 0
+const PCAPNG_OPT_COMMENT uint16 = 1
+const PCAPNG_OPT_IF_NAME uint16 = 2
+const PCAPNG_OPT_EPB_FLAGS uint16 = 2
+
+// epb_flagsの下位2ビットが向き
+const PCAPNG_EPB_INBOUND uint32 = 1
+const PCAPNG_EPB_OUTBOUND uint32 = 2
+
+// リンク層のタイプ
+const PCAPNG_LINKTYPE_ETHERNET uint16 = 1
+const PCAPNG_LINKTYPE_IPV6 uint16 = 229
+
+type pcapngBlock struct {
+	body []byte
+}
+
+func (b *pcapngBlock) u16(v uint16) {
+	b.body = binary.LittleEndian.AppendUint16(b.body, v)
+}
+
+func (b *pcapngBlock) u32(v uint32) {
+	b.body = binary.LittleEndian.AppendUint32(b.body, v)
+}
+
+/* 4バイト境界まで0で埋める */
+func (b *pcapngBlock) bytes(data []byte) {
+	b.body = append(b.body, data...)
+	for len(b.body)%4 != 0 {
+		b.body = append(b.body, 0)
+	}
+}
+
+func (b *pcapngBlock) option(code uint16, value []byte) {
+	b.u16(code)
+	b.u16(uint16(len(value)))
+	b.bytes(value)
+}
+
+/* 前後にブロックの長さを付けて完成させる */
+func (b *pcapngBlock) finish(blockType uint32) []byte {
+	total := uint32(12 + len(b.body))
+	res := binary.LittleEndian.AppendUint32(nil, blockType)
+	res = binary.LittleEndian.AppendUint32(res, total)
+	res = append(res, b.body...)
+	return binary.LittleEndian.AppendUint32(res, total)
+}
+
+func pcapngSectionHeader() []byte {
+	var b pcapngBlock
+	b.u32(PCAPNG_BYTE_ORDER_MAGIC)
+	b.u16(1) // major
+	b.u16(0) // minor
+	// セクションの長さは書かない(-1)
+	b.u32(0xffffffff)
+	b.u32(0xffffffff)
+	return b.finish(PCAPNG_BLOCK_SECTION_HEADER)
+}
+
+/* タイムスタンプの分解能は既定のマイクロ秒 */
+func pcapngInterfaceDescription(linkType uint16, snapLen uint32, name string) []byte {
+	var b pcapngBlock
+	b.u16(linkType)
+	b.u16(0)
+	b.u32(snapLen)
+	if name != "" {
+		b.option(PCAPNG_OPT_IF_NAME, []byte(name))
+	}
+	b.u32(0) // opt_endofopt
+	return b.finish(PCAPNG_BLOCK_INTERFACE_DESCRIPTION)
+}
+
+/* dataはsnapLenで切り詰めたもの、origLenは元の長さ */
+func pcapngEnhancedPacket(ifId uint32, ts time.Time, data []byte, origLen int, flags uint32, comment string) []byte {
+	var b pcapngBlock
+	usec := uint64(ts.UnixMicro())
+	b.u32(ifId)
+	b.u32(uint32(usec >> 32))
+	b.u32(uint32(usec))
+	b.u32(uint32(len(data)))
+	b.u32(uint32(origLen))
+	b.bytes(data)
+	if flags != 0 {
+		b.option(PCAPNG_OPT_EPB_FLAGS, binary.LittleEndian.AppendUint32(nil, flags))
+	}
+	if comment != "" {
+		b.option(PCAPNG_OPT_COMMENT, []byte(comment))
+	}
+	if flags != 0 || comment != "" {
+		b.u32(0) // opt_endofopt
+	}
+	return b.finish(PCAPNG_BLOCK_ENHANCED_PACKET)
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// VRFのメインテーブルのID(ip -6 ruleのmainと同じ)
+const MAIN_ROUTE_TABLE_ID uint32 = 254
+
+// トラフィッククラスのうちDSCPだけを比較するときのマスク
+const TRAFFIC_CLASS_DSCP_MASK uint8 = 0xfc
+
+/**
+ * ポリシールーティングのルール(ip -6 ruleに相当)
+ * 条件は指定したものだけを比較し、全てにマッチしたらtableを検索するかnextHopへ転送する
+ */
+type policyRule struct {
+	priority       uint32 // 小さい順に評価する
+	srcPrefix      in6Addr
+	srcPrefixLen   uint8  // 0なら全ての送信元にマッチ
+	inDevName      string // 空なら全ての受信インターフェイスにマッチ
+	matchTc        bool
+	tc             uint8
+	tcMask         uint8 // 0ならトラフィッククラス全体を比較する
+	matchFlowLabel bool
+	flowLabel      uint32
+	matchNextHdr   bool
+	nextHdr        uint8
+	table          uint32   // 検索するルーティングテーブルのID
+	nextHop        *in6Addr // 指定されていればテーブルを検索せずこのネクストホップへ転送する
+}
+
+func (ipv6header ipv6Header) trafficClass() uint8 {
+	return uint8(ipv6header.verTcFl >> 20)
+}
+
+func (ipv6header ipv6Header) flowLabel() uint32 {
+	return ipv6header.verTcFl & 0x000fffff
+}
+
+func (rule *policyRule) match(netDev *netDevice, ipv6header *ipv6Header) bool {
+	if rule.srcPrefixLen != 0 && !in6IsInNetwork(ipv6header.srcAddr, rule.srcPrefix, int(rule.srcPrefixLen)) {
+		return false
+	}
+	if rule.inDevName != "" && rule.inDevName != netDev.name {
+		return false
+	}
+	if rule.matchTc {
+		mask := rule.tcMask
+		if mask == 0 {
+			mask = 0xff
+		}
+		if ipv6header.trafficClass()&mask != rule.tc&mask {
+			return false
+		}
+	}
+	if rule.matchFlowLabel && ipv6header.flowLabel() != rule.flowLabel {
+		return false
+	}
+	if rule.matchNextHdr && ipv6header.nextHdr != rule.nextHdr {
+		return false
+	}
+
+	return true
+}
+
+/*
+ * "ipv6 rule"の後ろを読む。
+ * PRIORITY [from PREFIX] [iif IFNAME] [tc TC[/MASK]] [dscp DSCP] [flowlabel LABEL] [nexthdr PROTO] (table ID | nexthop ADDRESS)
+ */
+func parsePolicyRule(words []string) (*policyRule, error) {
+	usage := fmt.Errorf("usage: ipv6 rule PRIORITY [from PREFIX] [iif IFNAME] [tc TC[/MASK]] [dscp DSCP] [flowlabel LABEL] [nexthdr PROTO] (table ID | nexthop ADDRESS)")
+	if len(words) < 3 || len(words)%2 != 1 {
+		return nil, usage
+	}
+	priority, err := strconv.ParseUint(words[0], 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid priority %s", words[0])
+	}
+	rule := &policyRule{priority: uint32(priority)}
+	hasTable := false
+	for i := 1; i < len(words); i += 2 {
+		value := words[i+1]
+		switch words[i] {
+		case "from":
+			_, ipNet, err := net.ParseCIDR(value)
+			if err != nil || ipNet.IP.To4() != nil {
+				return nil, fmt.Errorf("invalid ipv6 prefix %s", value)
+			}
+			prefixLen, _ := ipNet.Mask.Size()
+			rule.srcPrefix = in6Addr(ipNet.IP.To16())
+			rule.srcPrefixLen = uint8(prefixLen)
+		case "iif":
+			rule.inDevName = value
+		case "tc":
+			tcStr, maskStr, hasMask := strings.Cut(value, "/")
+			tc, err := strconv.ParseUint(tcStr, 0, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid traffic class %s", value)
+			}
+			rule.matchTc = true
+			rule.tc = uint8(tc)
+			rule.tcMask = 0
+			if hasMask {
+				mask, err := strconv.ParseUint(maskStr, 0, 8)
+				if err != nil {
+					return nil, fmt.Errorf("invalid traffic class %s", value)
+				}
+				rule.tcMask = uint8(mask)
+			}
+		case "dscp":
+			dscp, err := strconv.ParseUint(value, 0, 6)
+			if err != nil {
+				return nil, fmt.Errorf("invalid dscp %s", value)
+			}
+			rule.matchTc = true
+			rule.tc = uint8(dscp) << 2
+			rule.tcMask = TRAFFIC_CLASS_DSCP_MASK
+		case "flowlabel":
+			flowLabel, err := strconv.ParseUint(value, 0, 20)
+			if err != nil {
+				return nil, fmt.Errorf("invalid flow label %s", value)
+			}
+			rule.matchFlowLabel = true
+			rule.flowLabel = uint32(flowLabel)
+		case "nexthdr":
+			nextHdr, err := strconv.ParseUint(value, 0, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid next header %s", value)
+			}
+			rule.matchNextHdr = true
+			rule.nextHdr = uint8(nextHdr)
+		case "table":
+			tableId, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("invalid table id %s", value)
+			}
+			rule.table = uint32(tableId)
+			rule.nextHop = nil
+			hasTable = true
+		case "nexthop":
+			nextHop := net.ParseIP(value)
+			if nextHop == nil || nextHop.To4() != nil {
+				return nil, fmt.Errorf("invalid next hop %s", value)
+			}
+			addr := in6Addr(nextHop.To16())
+			rule.nextHop = &addr
+			hasTable = false
+		default:
+			return nil, usage
+		}
+	}
+	if !hasTable && rule.nextHop == nil {
+		return nil, usage
+	}
+	return rule, nil
+}
+
+/* 設定ファイルに書く形。DSCPだけを比較するものは"dscp"で書く */
+func (rule *policyRule) String() string {
+	words := []string{strconv.FormatUint(uint64(rule.priority), 10)}
+	if rule.srcPrefixLen != 0 {
+		words = append(words, "from", fmtPrefixStr(rule.srcPrefix, rule.srcPrefixLen))
+	}
+	if rule.inDevName != "" {
+		words = append(words, "iif", rule.inDevName)
+	}
+	if rule.matchTc {
+		switch rule.tcMask {
+		case TRAFFIC_CLASS_DSCP_MASK:
+			words = append(words, "dscp", strconv.Itoa(int(rule.tc>>2)))
+		case 0:
+			words = append(words, "tc", strconv.Itoa(int(rule.tc)))
+		default:
+			words = append(words, "tc", fmt.Sprintf("%d/%d", rule.tc, rule.tcMask))
+		}
+	}
+	if rule.matchFlowLabel {
+		words = append(words, "flowlabel", strconv.FormatUint(uint64(rule.flowLabel), 10))
+	}
+	if rule.matchNextHdr {
+		words = append(words, "nexthdr", strconv.Itoa(int(rule.nextHdr)))
+	}
+	if rule.nextHop != nil {
+		words = append(words, "nexthop", fmtIpStr(*rule.nextHop))
+	} else {
+		words = append(words, "table", strconv.FormatUint(uint64(rule.table), 10))
+	}
+	return strings.Join(words, " ")
+}
+
+func configRouteTable(vrfName string, tableId uint32) {
+	v := getVrfByName(vrfName)
+	if v == nil {
+		configLog.Warn("vrf not found", "vrf", vrfName)
+		return
+	}
+	if _, ok := v.tables[tableId]; ok {
+		return
+	}
+
+	v.tables[tableId] = createPatriciaNode(in6Addr{}, 0, false, nil)
+	configLog.Info("configure route table", "vrf", v.name, "table", tableId)
+}
+
+/* メインテーブル以外のルーティングテーブルを消す。使っているルールは先に消しておくこと */
+func unconfigRouteTable(vrfName string, tableId uint32) {
+	v := getVrfByName(vrfName)
+	if v == nil || tableId == MAIN_ROUTE_TABLE_ID {
+		return
+	}
+	if _, ok := v.tables[tableId]; !ok {
+		return
+	}
+
+	delete(v.tables, tableId)
+	configLog.Info("unconfigure route table", "vrf", v.name, "table", tableId)
+}
+
+func configPolicyRule(vrfName string, rule policyRule) {
+	v := getVrfByName(vrfName)
+	if v == nil {
+		configLog.Warn("vrf not found", "vrf", vrfName)
+		return
+	}
+	if rule.nextHop == nil && v.tables[rule.table] == nil {
+		configLog.Warn("route table not found", "vrf", v.name, "table", rule.table)
+		return
+	}
+
+	v.rules = append(v.rules, &rule)
+	sort.SliceStable(v.rules, func(i, j int) bool {
+		return v.rules[i].priority < v.rules[j].priority
+	})
+
+	configLog.Info("configure policy rule", "vrf", v.name, "priority", rule.priority)
+}
+
+func unconfigPolicyRule(vrfName string, priority uint32) {
+	v := getVrfByName(vrfName)
+	if v == nil {
+		return
+	}
+
+	var rules []*policyRule
+	for _, rule := range v.rules {
+		if rule.priority != priority {
+			rules = append(rules, rule)
+		}
+	}
+	v.rules = rules
+	configLog.Info("unconfigure policy rule", "vrf", v.name, "priority", priority)
+}
+
+/*
+ * 受信したパケットの転送先をポリシールールに従って決める。
+ * ルールのテーブルに経路がなければ次のルールを評価し、どのルールでも決まらなければメインテーブルを検索する。
+ */
+func policyRouteLookup(netDev *netDevice, ipv6header *ipv6Header) (*ipv6RouteEntry, *vrf) {
+	v := netDev.vrf
+
+	for _, rule := range v.rules {
+		if !rule.match(netDev, ipv6header) {
+			continue
+		}
+
+		if rule.nextHop != nil {
+			fibLog.Debug("policy rule matched", "priority", rule.priority, "nexthop", *rule.nextHop)
+			if tracedPacket != nil {
+				traceStep(packetTraceStep{node: "ipv6-policy", decision: fmt.Sprintf("rule %d, next hop %s", rule.priority, fmtIpStr(*rule.nextHop))})
+			}
+			return &ipv6RouteEntry{
+				routeType: NETWORK,
+				nextHop:   *rule.nextHop,
+			}, v
+		}
+
+		resNode, outVrf := vrfTableRouteLookup(v, v.tables[rule.table], ipv6header.dstAddr)
+		if resNode != nil && resNode.route != nil {
+			fibLog.Debug("policy rule matched", "priority", rule.priority, "table", rule.table)
+			if tracedPacket != nil {
+				traceStep(packetTraceStep{node: "ipv6-policy", decision: fmt.Sprintf("rule %d, table %d", rule.priority, rule.table)})
+			}
+			return resNode.route, outVrf
+		}
+	}
+
+	resNode, outVrf := vrfRouteLookup(v, ipv6header.dstAddr)
+	if resNode == nil {
+		return nil, outVrf
+	}
+
+	return resNode.route, outVrf
+}
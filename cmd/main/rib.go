@@ -0,0 +1,150 @@
+package main
+
+/**
+ * 経路の情報源。同じプレフィックスに複数の情報源から経路がある場合は管理距離が小さいものをFIBに入れる
+ */
+type routeProto int
+
+const (
+	PROTO_CONNECTED routeProto = iota
+	PROTO_STATIC
+	PROTO_RIPNG
+	PROTO_OSPFV3
+	PROTO_EBGP
+	PROTO_IBGP
+	PROTO_ISIS
+)
+
+type ribKey struct {
+	prefix    in6Addr
+	prefixLen uint8
+}
+
+func (proto routeProto) String() string {
+	switch proto {
+	case PROTO_CONNECTED:
+		return "connected"
+	case PROTO_STATIC:
+		return "static"
+	case PROTO_RIPNG:
+		return "ripng"
+	case PROTO_OSPFV3:
+		return "ospfv3"
+	case PROTO_EBGP:
+		return "ebgp"
+	case PROTO_IBGP:
+		return "ibgp"
+	case PROTO_ISIS:
+		return "isis"
+	}
+	return "unknown"
+}
+
+/* 管理距離 */
+func (proto routeProto) distance() uint8 {
+	switch proto {
+	case PROTO_CONNECTED:
+		return 0
+	case PROTO_STATIC:
+		return 1
+	case PROTO_RIPNG:
+		return 120
+	case PROTO_OSPFV3:
+		return 110
+	case PROTO_EBGP:
+		return 20
+	case PROTO_IBGP:
+		return 200
+	case PROTO_ISIS:
+		return 115
+	}
+	return 255
+}
+
+func (route *ipv6RouteEntry) adminDistance() uint8 {
+	if route.distance != 0 {
+		return route.distance
+	}
+	return route.proto.distance()
+}
+
+/*
+ * VRFのRIBに経路を追加する。同じ情報源の経路は置き換える。
+ */
+func ribAdd(v *vrf, prefix in6Addr, prefixLen uint8, route *ipv6RouteEntry) {
+	key := ribKey{prefix: in6AddrClearPrefix(prefix, prefixLen), prefixLen: prefixLen}
+
+	routes := v.rib[key]
+	for i, r := range routes {
+		if r.proto == route.proto {
+			routes = append(routes[:i], routes[i+1:]...)
+			break
+		}
+	}
+	v.rib[key] = append(routes, route)
+
+	ribSelect(v, key)
+	if isRedistributed(route.proto) {
+		redistributeSchedule()
+	}
+}
+
+/*
+ * VRFのRIBから情報源の経路を削除する。
+ */
+func ribDelete(v *vrf, prefix in6Addr, prefixLen uint8, proto routeProto) {
+	key := ribKey{prefix: in6AddrClearPrefix(prefix, prefixLen), prefixLen: prefixLen}
+
+	routes := v.rib[key]
+	for i, r := range routes {
+		if r.proto == proto {
+			v.rib[key] = append(routes[:i], routes[i+1:]...)
+			ribSelect(v, key)
+			if isRedistributed(proto) {
+				redistributeSchedule()
+			}
+			return
+		}
+	}
+}
+
+/*
+ * プレフィックスの最適経路を選びFIBに反映する。
+ * FIBのルートマップがあれば、許可された経路の中から設定を適用した後の管理距離で選ぶ。
+ */
+func ribSelect(v *vrf, key ribKey) {
+	var best *ipv6RouteEntry
+	for _, r := range v.rib[key] {
+		r = routeMapApply(v.fibRouteMap, key, r)
+		if r == nil {
+			continue
+		}
+		if best == nil || r.adminDistance() < best.adminDistance() {
+			best = r
+		}
+	}
+
+	if best == nil {
+		if len(v.rib[key]) == 0 {
+			delete(v.rib, key)
+		}
+		if patriciaTrieDelete(v.fib, key.prefix, key.prefixLen) {
+			fibLog.Info("withdraw route", "vrf", v.name, "prefix", fmtPrefixStr(key.prefix, key.prefixLen))
+		}
+		return
+	}
+
+	node := patriciaTrieLookup(v.fib, key.prefix, key.prefixLen)
+	if node != nil && node.route != nil && *node.route == *best {
+		return
+	}
+	patriciaTrieInsert(v.fib, key.prefix, key.prefixLen, best)
+	fibLog.Info("install route", "vrf", v.name, "prefix", fmtPrefixStr(key.prefix, key.prefixLen), "proto", best.proto.String())
+}
+
+/* ルートマップが変わったときにVRFの全てのプレフィックスを選び直す */
+func ribReselectAll(v *vrf) {
+	for key := range v.rib {
+		ribSelect(v, key)
+	}
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"time"
+)
+
+/**
+ * RIPng(RFC 2080)
+ * https://datatracker.ietf.org/doc/html/rfc2080
+ */
+const RIPNG_PORT uint16 = 521
+const RIPNG_MCAST_ADDRESS = "ff02::9"
+
+const RIPNG_COMMAND_REQUEST uint8 = 1
+const RIPNG_COMMAND_RESPONSE uint8 = 2
+const RIPNG_VERSION uint8 = 1
+
+const RIPNG_METRIC_INFINITY uint8 = 16
+const RIPNG_METRIC_NEXT_HOP uint8 = 0xff
+
+const RIPNG_HEADER_LEN = 4
+const RIPNG_RTE_LEN = 20
+
+// 1パケットに入れられるRTEの数。(MTU - IPv6ヘッダ - UDPヘッダ - RIPngヘッダ) / RTE
+const RIPNG_MAX_RTES = (1500 - 40 - UDP_HEADER_LEN - RIPNG_HEADER_LEN) / RIPNG_RTE_LEN
+
+const RIPNG_UPDATE_INTERVAL = 30 * time.Second
+const RIPNG_UPDATE_JITTER = 5 * time.Second
+const RIPNG_TIMEOUT = 180 * time.Second
+const RIPNG_GARBAGE_COLLECTION = 120 * time.Second
+const RIPNG_TRIGGERED_MIN_DELAY = 1 * time.Second
+const RIPNG_TRIGGERED_MAX_DELAY = 5 * time.Second
+
+/* Route Table Entry */
+type ripngRte struct {
+	prefix    in6Addr
+	routeTag  uint16
+	prefixLen uint8
+	metric    uint8
+}
+
+/* RIPngで学習した経路 */
+type ripngRoute struct {
+	vrf       *vrf
+	prefix    in6Addr
+	prefixLen uint8
+	metric    uint8
+	routeTag  uint16
+	nextHop   in6Addr
+	dev       *netDevice // 経路を受信したインターフェイス
+	changed   bool       // トリガードアップデートで送る必要があるか
+	timeout   *timer
+	garbage   *timer
+}
+
+type ripngRedistRoute struct {
+	rte     ripngRte
+	changed bool
+}
+
+type ripngRouteKey struct {
+	vrf *vrf
+	ribKey
+}
+
+// RIPngを有効にしたインターフェイス
+var ripngInterfaces []*netDevice
+
+var ripngRoutes = map[ripngRouteKey]*ripngRoute{}
+
+// 他の情報源から再配布している経路。取り消したものはメトリック無限大で一度広告してから消す
+var ripngRedistRoutes = map[ripngRouteKey]*ripngRedistRoute{}
+
+var ripngUpdateTimer *timer
+var ripngTriggeredTimer *timer
+
+func configRipngInterface(netDev *netDevice) {
+	if netDev == nil {
+		ripngLog.Warn("net device to configure not found")
+		return
+	}
+	for _, dev := range ripngInterfaces {
+		if dev == netDev {
+			return
+		}
+	}
+
+	if len(ripngInterfaces) == 0 {
+		registerUdpHandler(RIPNG_PORT, ripngInput)
+		ripngUpdateTimer = newTimer(ripngUpdateInterval(), ripngRegularUpdate)
+	}
+
+	ipv6JoinMcast(netDev.ipv6Dev, parseIpv6(RIPNG_MCAST_ADDRESS))
+	ripngInterfaces = append(ripngInterfaces, netDev)
+	configLog.Info("configure ripng", "dev", netDev.name)
+
+	// 起動時は隣接ルータに全経路を要求する
+	ripngSendRequest(netDev)
+}
+
+/*
+ * インターフェイスのRIPngを止める。そのインターフェイスに広告していた経路と、
+ * 他のインターフェイスに広告していたそのインターフェイスのプレフィックスはメトリック無限大で取り消す。
+ */
+func unconfigRipngInterface(netDev *netDevice) {
+	if !ripngIsEnabled(netDev) {
+		return
+	}
+
+	rtes := ripngAdvertiseRtes(netDev, false)
+	for i := range rtes {
+		rtes[i].metric = RIPNG_METRIC_INFINITY
+	}
+	ripngSendMcastResponse(netDev, rtes)
+
+	for i, dev := range ripngInterfaces {
+		if dev == netDev {
+			ripngInterfaces = append(ripngInterfaces[:i], ripngInterfaces[i+1:]...)
+			break
+		}
+	}
+	ipv6LeaveMcast(netDev.ipv6Dev, parseIpv6(RIPNG_MCAST_ADDRESS))
+	configLog.Info("unconfigure ripng", "dev", netDev.name)
+
+	ipv6Dev := netDev.ipv6Dev
+	if ipv6Dev.prefixLen != 0 && !in6AddrIsLinkLocal(ipv6Dev.address) {
+		withdrawn := []ripngRte{{
+			prefix:    in6AddrClearPrefix(ipv6Dev.address, ipv6Dev.prefixLen),
+			prefixLen: ipv6Dev.prefixLen,
+			metric:    RIPNG_METRIC_INFINITY,
+		}}
+		for _, dev := range ripngInterfaces {
+			if dev.vrf == netDev.vrf {
+				ripngSendMcastResponse(dev, withdrawn)
+			}
+		}
+	}
+
+	for _, route := range ripngRoutes {
+		if route.dev == netDev && route.timeout != nil {
+			ripngStartDeletion(route)
+		}
+	}
+
+	if len(ripngInterfaces) == 0 {
+		ripngUpdateTimer.stop()
+	}
+}
+
+func ripngIsEnabled(netDev *netDevice) bool {
+	for _, dev := range ripngInterfaces {
+		if dev == netDev {
+			return true
+		}
+	}
+	return false
+}
+
+func ripngUpdateInterval() time.Duration {
+	return RIPNG_UPDATE_INTERVAL - RIPNG_UPDATE_JITTER + time.Duration(rand.Int63n(int64(2*RIPNG_UPDATE_JITTER)))
+}
+
+/* RIPngパケットの受信処理 */
+func ripngInput(netDev *netDevice, ipv6header *ipv6Header, srcPort uint16, payload []byte) {
+	if !ripngIsEnabled(netDev) {
+		return
+	}
+	if len(payload) < RIPNG_HEADER_LEN || (len(payload)-RIPNG_HEADER_LEN)%RIPNG_RTE_LEN != 0 {
+		ripngLog.Debug("invalid packet size", "size", len(payload), "src", ipv6header.srcAddr)
+		return
+	}
+	command := payload[0]
+	version := payload[1]
+	if version != RIPNG_VERSION {
+		ripngLog.Debug("unsupported version", "version", version)
+		return
+	}
+
+	var rtes []ripngRte
+	for i := RIPNG_HEADER_LEN; i < len(payload); i += RIPNG_RTE_LEN {
+		rtes = append(rtes, ripngRte{
+			prefix:    in6Addr(payload[i : i+16]),
+			routeTag:  byteToUint16(payload[i+16 : i+18]),
+			prefixLen: payload[i+18],
+			metric:    payload[i+19],
+		})
+	}
+
+	switch command {
+	case RIPNG_COMMAND_REQUEST:
+		ripngRequestInput(netDev, ipv6header.srcAddr, srcPort, rtes)
+	case RIPNG_COMMAND_RESPONSE:
+		// レスポンスはリンクローカルアドレスからホップリミット255でRIPngのポートから送られてくる
+		if srcPort != RIPNG_PORT || !in6AddrIsLinkLocal(ipv6header.srcAddr) || ipv6header.hopLimit != 0xff {
+			ripngLog.Debug("ignore response", "src", ipv6header.srcAddr, "port", srcPort)
+			return
+		}
+		ripngResponseInput(netDev, ipv6header.srcAddr, rtes)
+	default:
+		ripngLog.Debug("unknown command", "command", command)
+	}
+}
+
+func ripngRequestInput(netDev *netDevice, srcAddr in6Addr, srcPort uint16, rtes []ripngRte) {
+	// ::/0でメトリックが無限大のRTEが1つだけなら全経路の要求
+	if len(rtes) == 1 && rtes[0].prefix == (in6Addr{}) && rtes[0].prefixLen == 0 && rtes[0].metric == RIPNG_METRIC_INFINITY {
+		ripngLog.Debug("whole table request", "src", srcAddr)
+		ripngSendResponse(netDev, srcAddr, srcPort, ripngAdvertiseRtes(netDev, false))
+		return
+	}
+
+	// 特定の経路の要求にはメトリックを埋めて返す
+	for i, rte := range rtes {
+		rtes[i].metric = RIPNG_METRIC_INFINITY
+		if route, ok := ripngRoutes[ripngRouteKey{netDev.vrf, ribKey{rte.prefix, rte.prefixLen}}]; ok {
+			rtes[i].metric = route.metric
+		}
+	}
+	ripngSendResponse(netDev, srcAddr, srcPort, rtes)
+}
+
+func ripngResponseInput(netDev *netDevice, srcAddr in6Addr, rtes []ripngRte) {
+	nextHop := srcAddr
+
+	for _, rte := range rtes {
+		if rte.metric == RIPNG_METRIC_NEXT_HOP {
+			// ネクストホップRTE。リンクローカルアドレス以外は送信元をネクストホップとする
+			nextHop = srcAddr
+			if in6AddrIsLinkLocal(rte.prefix) {
+				nextHop = rte.prefix
+			}
+			continue
+		}
+
+		if rte.prefixLen > 128 || rte.metric == 0 || rte.metric > RIPNG_METRIC_INFINITY || rte.prefix[0] == 0xff || in6AddrIsLinkLocal(rte.prefix) {
+			ripngLog.Debug("ignore invalid rte", "prefix", fmtPrefixStr(rte.prefix, rte.prefixLen), "metric", rte.metric)
+			continue
+		}
+
+		// 自分の直結経路は学習しない
+		key := ripngRouteKey{netDev.vrf, ribKey{in6AddrClearPrefix(rte.prefix, rte.prefixLen), rte.prefixLen}}
+		if ripngIsConnectedPrefix(netDev.vrf, key.ribKey) {
+			continue
+		}
+
+		metric := rte.metric + 1
+		if metric > RIPNG_METRIC_INFINITY {
+			metric = RIPNG_METRIC_INFINITY
+		}
+
+		ripngUpdateRoute(netDev, key, nextHop, metric, rte.routeTag)
+	}
+}
+
+/* RFC 2080 2.4.2 レスポンスの処理 */
+func ripngUpdateRoute(netDev *netDevice, key ripngRouteKey, nextHop in6Addr, metric uint8, routeTag uint16) {
+	route, ok := ripngRoutes[key]
+
+	if !ok {
+		if metric == RIPNG_METRIC_INFINITY {
+			return
+		}
+		route = &ripngRoute{
+			vrf:       key.vrf,
+			prefix:    key.prefix,
+			prefixLen: key.prefixLen,
+		}
+		ripngRoutes[key] = route
+		ripngInstallRoute(route, netDev, nextHop, metric, routeTag)
+		return
+	}
+
+	sameRouter := route.dev == netDev && route.nextHop == nextHop
+
+	if sameRouter {
+		if metric == route.metric {
+			if metric != RIPNG_METRIC_INFINITY {
+				route.timeout.reset(RIPNG_TIMEOUT)
+			}
+			return
+		}
+		if metric == RIPNG_METRIC_INFINITY {
+			ripngStartDeletion(route)
+			return
+		}
+		ripngInstallRoute(route, netDev, nextHop, metric, routeTag)
+		return
+	}
+
+	if metric < route.metric {
+		ripngInstallRoute(route, netDev, nextHop, metric, routeTag)
+	}
+}
+
+func ripngInstallRoute(route *ripngRoute, netDev *netDevice, nextHop in6Addr, metric uint8, routeTag uint16) {
+	route.dev = netDev
+	route.nextHop = nextHop
+	route.metric = metric
+	route.routeTag = routeTag
+	route.changed = true
+
+	route.garbage.stop()
+	route.garbage = nil
+	if route.timeout == nil {
+		route.timeout = newTimer(RIPNG_TIMEOUT, func() {
+			ripngLog.Info("route timed out", "prefix", fmtPrefixStr(route.prefix, route.prefixLen))
+			ripngStartDeletion(route)
+		})
+	} else {
+		route.timeout.reset(RIPNG_TIMEOUT)
+	}
+
+	ribAdd(route.vrf, route.prefix, route.prefixLen, &ipv6RouteEntry{
+		routeType: NETWORK,
+		dev:       netDev,
+		nextHop:   nextHop,
+		proto:     PROTO_RIPNG,
+		metric:    uint32(metric),
+		tag:       uint32(routeTag),
+	})
+	ripngLog.Debug("update route", "prefix", fmtPrefixStr(route.prefix, route.prefixLen), "nexthop", nextHop, "metric", metric)
+
+	ripngScheduleTriggeredUpdate()
+}
+
+/* 経路を到達不能にしてガベージコレクションを開始する */
+func ripngStartDeletion(route *ripngRoute) {
+	route.timeout.stop()
+	route.timeout = nil
+	route.metric = RIPNG_METRIC_INFINITY
+	route.changed = true
+
+	ribDelete(route.vrf, route.prefix, route.prefixLen, PROTO_RIPNG)
+
+	if route.garbage == nil {
+		route.garbage = newTimer(RIPNG_GARBAGE_COLLECTION, func() {
+			ripngLog.Debug("route garbage collected", "prefix", fmtPrefixStr(route.prefix, route.prefixLen))
+			delete(ripngRoutes, ripngRouteKey{route.vrf, ribKey{route.prefix, route.prefixLen}})
+		})
+	}
+
+	ripngScheduleTriggeredUpdate()
+}
+
+func ripngIsInterfacePrefix(v *vrf, key ribKey) bool {
+	for _, dev := range ripngInterfaces {
+		if dev.vrf == v && dev.ipv6Dev.prefixLen == key.prefixLen && in6AddrClearPrefix(dev.ipv6Dev.address, dev.ipv6Dev.prefixLen) == key.prefix {
+			return true
+		}
+	}
+	return false
+}
+
+func ripngIsConnectedPrefix(v *vrf, key ribKey) bool {
+	for _, r := range v.rib[key] {
+		if r.proto == PROTO_CONNECTED {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+ * インターフェイスに広告するRTEを作る。
+ * スプリットホライズン(ポイズンリバース)のため、そのインターフェイスから学習した経路はメトリックを無限大にする。
+ */
+func ripngAdvertiseRtes(netDev *netDevice, onlyChanged bool) []ripngRte {
+	var rtes []ripngRte
+
+	if !onlyChanged {
+		for _, dev := range ripngInterfaces {
+			if dev.vrf != netDev.vrf || dev.ipv6Dev.prefixLen == 0 || in6AddrIsLinkLocal(dev.ipv6Dev.address) {
+				continue
+			}
+			rtes = append(rtes, ripngRte{
+				prefix:    in6AddrClearPrefix(dev.ipv6Dev.address, dev.ipv6Dev.prefixLen),
+				prefixLen: dev.ipv6Dev.prefixLen,
+				metric:    1,
+			})
+		}
+	}
+
+	for key, route := range ripngRedistRoutes {
+		if key.vrf != netDev.vrf || (onlyChanged && !route.changed) {
+			continue
+		}
+		rtes = append(rtes, route.rte)
+	}
+
+	for key, route := range ripngRoutes {
+		if key.vrf != netDev.vrf || (onlyChanged && !route.changed) {
+			continue
+		}
+		metric := route.metric
+		if route.dev == netDev {
+			metric = RIPNG_METRIC_INFINITY
+		}
+		rtes = append(rtes, ripngRte{
+			prefix:    route.prefix,
+			routeTag:  route.routeTag,
+			prefixLen: route.prefixLen,
+			metric:    metric,
+		})
+	}
+
+	return rtes
+}
+
+func ripngRegularUpdate() {
+	for _, netDev := range ripngInterfaces {
+		ripngSendMcastResponse(netDev, ripngAdvertiseRtes(netDev, false))
+	}
+	ripngClearChanged()
+
+	ripngUpdateTimer.reset(ripngUpdateInterval())
+}
+
+/* 停止するときは広告していた経路をメトリック無限大で送り、すぐに取り消させる */
+func ripngShutdown() {
+	ripngUpdateTimer.stop()
+	ripngTriggeredTimer.stop()
+	for _, netDev := range ripngInterfaces {
+		rtes := ripngAdvertiseRtes(netDev, false)
+		for i := range rtes {
+			rtes[i].metric = RIPNG_METRIC_INFINITY
+		}
+		ripngSendMcastResponse(netDev, rtes)
+	}
+}
+
+/* トリガードアップデートは連続して送らないよう1~5秒待ってからまとめて送る */
+func ripngScheduleTriggeredUpdate() {
+	if ripngTriggeredTimer != nil && ripngTriggeredTimer.active {
+		return
+	}
+
+	delay := RIPNG_TRIGGERED_MIN_DELAY + time.Duration(rand.Int63n(int64(RIPNG_TRIGGERED_MAX_DELAY-RIPNG_TRIGGERED_MIN_DELAY)))
+	ripngTriggeredTimer = newTimer(delay, func() {
+		for _, netDev := range ripngInterfaces {
+			rtes := ripngAdvertiseRtes(netDev, true)
+			if len(rtes) > 0 {
+				ripngSendMcastResponse(netDev, rtes)
+			}
+		}
+		ripngClearChanged()
+	})
+}
+
+func ripngClearChanged() {
+	for _, route := range ripngRoutes {
+		route.changed = false
+	}
+	for key, route := range ripngRedistRoutes {
+		route.changed = false
+		if route.rte.metric == RIPNG_METRIC_INFINITY {
+			delete(ripngRedistRoutes, key)
+		}
+	}
+}
+
+/* 再配布する経路を作り直し、変わったものをトリガードアップデートで送る */
+func ripngRedistribute() {
+	wanted := map[ripngRouteKey]ripngRte{}
+	for _, v := range vrfs {
+		for key, r := range redistributedRoutes(PROTO_RIPNG, v) {
+			// RIPngを有効にしたインターフェイスのプレフィックスは既に広告している
+			if ripngIsInterfacePrefix(v, key) {
+				continue
+			}
+			metric := uint8(1)
+			if r.metric != 0 {
+				metric = uint8(min(r.metric, uint32(RIPNG_METRIC_INFINITY-1)))
+			}
+			wanted[ripngRouteKey{v, key}] = ripngRte{
+				prefix:    key.prefix,
+				routeTag:  uint16(r.tag),
+				prefixLen: key.prefixLen,
+				metric:    metric,
+			}
+		}
+	}
+
+	changed := false
+	for key, route := range ripngRedistRoutes {
+		if _, ok := wanted[key]; !ok && route.rte.metric != RIPNG_METRIC_INFINITY {
+			route.rte.metric = RIPNG_METRIC_INFINITY
+			route.changed = true
+			changed = true
+		}
+	}
+	for key, rte := range wanted {
+		if route, ok := ripngRedistRoutes[key]; ok && route.rte == rte {
+			continue
+		}
+		ripngRedistRoutes[key] = &ripngRedistRoute{rte: rte, changed: true}
+		changed = true
+	}
+
+	if changed {
+		ripngScheduleTriggeredUpdate()
+	}
+}
+
+func ripngSendRequest(netDev *netDevice) {
+	packet := ripngToPacket(RIPNG_COMMAND_REQUEST, []ripngRte{{metric: RIPNG_METRIC_INFINITY}})
+	ripngSendMcast(netDev, packet)
+}
+
+func ripngSendMcastResponse(netDev *netDevice, rtes []ripngRte) {
+	for len(rtes) > 0 {
+		n := min(len(rtes), RIPNG_MAX_RTES)
+		ripngSendMcast(netDev, ripngToPacket(RIPNG_COMMAND_RESPONSE, rtes[:n]))
+		rtes = rtes[n:]
+	}
+}
+
+func ripngSendResponse(netDev *netDevice, dstAddr in6Addr, dstPort uint16, rtes []ripngRte) {
+	srcAddr := netDev.ipv6Dev.linkLocalAddr
+	for len(rtes) > 0 {
+		n := min(len(rtes), RIPNG_MAX_RTES)
+		udpPacket := udpEncap(srcAddr, dstAddr, RIPNG_PORT, dstPort, ripngToPacket(RIPNG_COMMAND_RESPONSE, rtes[:n]))
+		ipv6EncapDevUnicastOutput(netDev, srcAddr, dstAddr, udpPacket, IPV6_PROTOCOL_NUM_UDP)
+		rtes = rtes[n:]
+	}
+}
+
+func ripngSendMcast(netDev *netDevice, packet []byte) {
+	srcAddr := netDev.ipv6Dev.linkLocalAddr
+	dstAddr := parseIpv6(RIPNG_MCAST_ADDRESS)
+
+	udpPacket := udpEncap(srcAddr, dstAddr, RIPNG_PORT, RIPNG_PORT, packet)
+	ipv6EncapDevMcastOutput(netDev, srcAddr, dstAddr, udpPacket, IPV6_PROTOCOL_NUM_UDP)
+}
+
+func ripngToPacket(command uint8, rtes []ripngRte) []byte {
+	var b bytes.Buffer
+
+	b.Write(uint8ToByte(command))
+	b.Write(uint8ToByte(RIPNG_VERSION))
+	b.Write(uint16ToByte(0))
+	for _, rte := range rtes {
+		b.Write(rte.prefix[:])
+		b.Write(uint16ToByte(rte.routeTag))
+		b.Write(uint8ToByte(rte.prefixLen))
+		b.Write(uint8ToByte(rte.metric))
+	}
+
+	return b.Bytes()
+}
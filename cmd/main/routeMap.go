@@ -0,0 +1,554 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/**
+ * プレフィックスリストとルートマップ
+ * FIBに入れる経路の選択と、直結経路やスタティック経路をダイナミックルーティングに再配布するときに使う
+ */
+type routeMapAction int
+
+const (
+	ROUTE_MAP_PERMIT routeMapAction = iota
+	ROUTE_MAP_DENY
+)
+
+/*
+ * プレフィックスリストのエントリ。seqの小さい順に評価し最初にマッチしたものを適用する。
+ * ge/leが0ならプレフィックス長の完全一致。どれにもマッチしなければ拒否する。
+ */
+type prefixListEntry struct {
+	seq       uint32
+	action    routeMapAction
+	prefix    in6Addr
+	prefixLen uint8
+	ge        uint8
+	le        uint8
+}
+
+/*
+ * ルートマップのエントリ。条件は指定したものだけを比較し、全てにマッチしたら設定を適用する。
+ * どのエントリにもマッチしなければ拒否する。
+ */
+type routeMapEntry struct {
+	seq    uint32
+	action routeMapAction
+
+	matchPrefixList  string       // 空ならプレフィックスを比較しない
+	matchNextHopList string       // ネクストホップをプレフィックスリストで比較する
+	matchProtos      []routeProto // 経路の情報源
+	matchTag         uint32
+	hasMatchTag      bool
+
+	setMetric    uint32
+	hasSetMetric bool
+	setTag       uint32
+	hasSetTag    bool
+	setNextHop   *in6Addr
+	setDistance  uint8 // 0なら変更しない
+}
+
+/* 再配布の設定。protoの経路をルートマップを通して広告する */
+type redistribution struct {
+	proto    routeProto
+	routeMap string // 空なら全て再配布する
+}
+
+var prefixLists = map[string][]prefixListEntry{}
+var routeMaps = map[string][]routeMapEntry{}
+
+// 再配布先の情報源ごとの設定。BGPはPROTO_EBGPで表す
+var redistributions = map[routeProto][]redistribution{}
+
+var redistributeTimer *timer
+
+// ルートマップの条件と設定の種類。設定ファイルにはこの順に書く
+var routeMapClauses = []string{
+	"match address prefix-list",
+	"match next-hop prefix-list",
+	"match source-protocol",
+	"match tag",
+	"set metric",
+	"set tag",
+	"set next-hop",
+	"set distance",
+}
+
+func (action routeMapAction) String() string {
+	if action == ROUTE_MAP_DENY {
+		return "deny"
+	}
+	return "permit"
+}
+
+func parseRouteMapAction(str string) (routeMapAction, error) {
+	switch str {
+	case "permit":
+		return ROUTE_MAP_PERMIT, nil
+	case "deny":
+		return ROUTE_MAP_DENY, nil
+	}
+	return ROUTE_MAP_PERMIT, fmt.Errorf("invalid action %s", str)
+}
+
+/* 経路の情報源の名前。ebgpとibgpはまとめてbgpとも書ける */
+func parseRouteProtos(str string) ([]routeProto, error) {
+	if str == "bgp" {
+		return []routeProto{PROTO_EBGP, PROTO_IBGP}, nil
+	}
+	for proto := PROTO_CONNECTED; proto <= PROTO_ISIS; proto++ {
+		if proto.String() == str {
+			return []routeProto{proto}, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid protocol %s", str)
+}
+
+/* permit|deny PREFIX [ge LEN] [le LEN] */
+func parsePrefixListEntry(words []string) (*prefixListEntry, error) {
+	usage := fmt.Errorf("usage: ipv6 prefix-list NAME seq SEQ permit|deny PREFIX [ge LEN] [le LEN]")
+	if len(words) < 2 || len(words)%2 != 0 {
+		return nil, usage
+	}
+	action, err := parseRouteMapAction(words[0])
+	if err != nil {
+		return nil, err
+	}
+	_, ipNet, err := net.ParseCIDR(words[1])
+	if err != nil || ipNet.IP.To4() != nil {
+		return nil, fmt.Errorf("invalid ipv6 prefix %s", words[1])
+	}
+	prefixLen, _ := ipNet.Mask.Size()
+	entry := &prefixListEntry{action: action, prefix: in6Addr(ipNet.IP.To16()), prefixLen: uint8(prefixLen)}
+
+	for i := 2; i < len(words); i += 2 {
+		value, err := strconv.ParseUint(words[i+1], 10, 8)
+		if err != nil || value < uint64(entry.prefixLen) || value > 128 {
+			return nil, fmt.Errorf("invalid %s %s", words[i], words[i+1])
+		}
+		switch words[i] {
+		case "ge":
+			entry.ge = uint8(value)
+		case "le":
+			entry.le = uint8(value)
+		default:
+			return nil, usage
+		}
+	}
+	if entry.ge != 0 && entry.le != 0 && entry.ge > entry.le {
+		return nil, fmt.Errorf("ge %d is larger than le %d", entry.ge, entry.le)
+	}
+	return entry, nil
+}
+
+/* 設定ファイルに書く形。seqは含まない */
+func (entry *prefixListEntry) String() string {
+	str := fmt.Sprintf("%s %s", entry.action, fmtPrefixStr(entry.prefix, entry.prefixLen))
+	if entry.ge != 0 {
+		str += fmt.Sprintf(" ge %d", entry.ge)
+	}
+	if entry.le != 0 {
+		str += fmt.Sprintf(" le %d", entry.le)
+	}
+	return str
+}
+
+/* 条件か設定の1行の種類。routeMapClausesのどれでもなければ空 */
+func routeMapClauseOf(words []string) string {
+	line := strings.Join(words, " ") + " "
+	for _, clause := range routeMapClauses {
+		if strings.HasPrefix(line, clause+" ") {
+			return clause
+		}
+	}
+	return ""
+}
+
+/* "match ..."か"set ..."の1行を読んでエントリに入れ、その種類を返す */
+func parseRouteMapClause(entry *routeMapEntry, words []string) (string, error) {
+	clause := routeMapClauseOf(words)
+	if clause == "" {
+		return "", fmt.Errorf("unknown route map clause: %s", strings.Join(words, " "))
+	}
+	args := words[len(strings.Fields(clause)):]
+	if len(args) == 0 || (clause != "match source-protocol" && len(args) != 1) {
+		return "", fmt.Errorf("usage: %s VALUE", clause)
+	}
+
+	var err error
+	var value uint64
+	switch clause {
+	case "match address prefix-list":
+		entry.matchPrefixList = args[0]
+	case "match next-hop prefix-list":
+		entry.matchNextHopList = args[0]
+	case "match source-protocol":
+		entry.matchProtos = nil
+		for _, arg := range args {
+			protos, err := parseRouteProtos(arg)
+			if err != nil {
+				return "", err
+			}
+			entry.matchProtos = append(entry.matchProtos, protos...)
+		}
+	case "match tag", "set metric", "set tag":
+		value, err = strconv.ParseUint(args[0], 10, 32)
+		if err != nil {
+			return "", fmt.Errorf("invalid %s %s", clause, args[0])
+		}
+		switch clause {
+		case "match tag":
+			entry.matchTag, entry.hasMatchTag = uint32(value), true
+		case "set metric":
+			entry.setMetric, entry.hasSetMetric = uint32(value), true
+		case "set tag":
+			entry.setTag, entry.hasSetTag = uint32(value), true
+		}
+	case "set next-hop":
+		ip := net.ParseIP(args[0])
+		if ip == nil || ip.To4() != nil {
+			return "", fmt.Errorf("invalid next hop %s", args[0])
+		}
+		nextHop := in6Addr(ip.To16())
+		entry.setNextHop = &nextHop
+	case "set distance":
+		value, err = strconv.ParseUint(args[0], 10, 8)
+		if err != nil || value == 0 {
+			return "", fmt.Errorf("invalid distance %s", args[0])
+		}
+		entry.setDistance = uint8(value)
+	}
+	return clause, nil
+}
+
+/* 設定ファイルに書くときの条件か設定の値 */
+func (entry *routeMapEntry) clauseValue(clause string) string {
+	switch clause {
+	case "match address prefix-list":
+		return entry.matchPrefixList
+	case "match next-hop prefix-list":
+		return entry.matchNextHopList
+	case "match source-protocol":
+		var names []string
+		for _, proto := range entry.matchProtos {
+			names = append(names, proto.String())
+		}
+		return strings.Join(names, " ")
+	case "match tag":
+		return strconv.FormatUint(uint64(entry.matchTag), 10)
+	case "set metric":
+		return strconv.FormatUint(uint64(entry.setMetric), 10)
+	case "set tag":
+		return strconv.FormatUint(uint64(entry.setTag), 10)
+	case "set next-hop":
+		return fmtIpStr(*entry.setNextHop)
+	case "set distance":
+		return strconv.Itoa(int(entry.setDistance))
+	}
+	return ""
+}
+
+func configPrefixList(name string, entry prefixListEntry) {
+	entries := prefixLists[name]
+	for i := range entries {
+		if entries[i].seq == entry.seq {
+			entries = append(entries[:i], entries[i+1:]...)
+			break
+		}
+	}
+	entries = append(entries, entry)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+	prefixLists[name] = entries
+	configLog.Info("configure prefix list", "name", name, "seq", entry.seq, "prefix", fmtPrefixStr(entry.prefix, entry.prefixLen))
+
+	routeMapChanged()
+}
+
+/* プレフィックスリストのエントリを消す。エントリがなくなればリストも消え、全て拒否するようになる */
+func unconfigPrefixList(name string, seq uint32) {
+	entries := prefixLists[name]
+	for i := range entries {
+		if entries[i].seq != seq {
+			continue
+		}
+		entries = append(entries[:i], entries[i+1:]...)
+		if len(entries) == 0 {
+			delete(prefixLists, name)
+		} else {
+			prefixLists[name] = entries
+		}
+		configLog.Info("unconfigure prefix list", "name", name, "seq", seq)
+		routeMapChanged()
+		return
+	}
+}
+
+func configRouteMap(name string, entry routeMapEntry) {
+	entries := routeMaps[name]
+	for i := range entries {
+		if entries[i].seq == entry.seq {
+			entries = append(entries[:i], entries[i+1:]...)
+			break
+		}
+	}
+	entries = append(entries, entry)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].seq < entries[j].seq })
+	routeMaps[name] = entries
+	configLog.Info("configure route map", "name", name, "seq", entry.seq)
+
+	routeMapChanged()
+}
+
+/* ルートマップのエントリを消す */
+func unconfigRouteMap(name string, seq uint32) {
+	entries := routeMaps[name]
+	for i := range entries {
+		if entries[i].seq != seq {
+			continue
+		}
+		entries = append(entries[:i], entries[i+1:]...)
+		if len(entries) == 0 {
+			delete(routeMaps, name)
+		} else {
+			routeMaps[name] = entries
+		}
+		configLog.Info("unconfigure route map", "name", name, "seq", seq)
+		routeMapChanged()
+		return
+	}
+}
+
+/* VRFのRIBからFIBに入れる経路をルートマップで選ぶ */
+func configFibRouteMap(vrfName string, name string) {
+	v := getVrfByName(vrfName)
+	if v == nil {
+		configLog.Warn("vrf not found", "vrf", vrfName)
+		return
+	}
+	v.fibRouteMap = name
+	configLog.Info("configure fib route map", "name", name, "vrf", v.name)
+
+	ribReselectAll(v)
+}
+
+/* FIBのルートマップを外し、RIBの最適経路をそのままFIBに入れる */
+func unconfigFibRouteMap(vrfName string) {
+	v := getVrfByName(vrfName)
+	if v == nil || v.fibRouteMap == "" {
+		return
+	}
+	v.fibRouteMap = ""
+	configLog.Info("unconfigure fib route map", "vrf", v.name)
+
+	ribReselectAll(v)
+}
+
+/*
+ * fromの経路をintoに再配布する。再配布できるのは直結経路とスタティック経路だけ。
+ */
+func configRedistribute(into routeProto, from routeProto, routeMap string) {
+	if from != PROTO_CONNECTED && from != PROTO_STATIC {
+		configLog.Warn("can not redistribute routes", "from", from.String())
+		return
+	}
+	switch into {
+	case PROTO_RIPNG, PROTO_OSPFV3, PROTO_ISIS, PROTO_EBGP:
+	default:
+		configLog.Warn("can not redistribute into protocol", "into", into.String())
+		return
+	}
+
+	rs := redistributions[into]
+	for i := range rs {
+		if rs[i].proto == from {
+			rs = append(rs[:i], rs[i+1:]...)
+			break
+		}
+	}
+	redistributions[into] = append(rs, redistribution{proto: from, routeMap: routeMap})
+	configLog.Info("configure redistribute", "from", from.String(), "into", into.String(), "routemap", routeMap)
+
+	redistributeSchedule()
+}
+
+/* fromの経路のintoへの再配布をやめる。広告していた経路は各プロトコルが取り下げる */
+func unconfigRedistribute(into routeProto, from routeProto) {
+	rs := redistributions[into]
+	for i := range rs {
+		if rs[i].proto != from {
+			continue
+		}
+		rs = append(rs[:i], rs[i+1:]...)
+		if len(rs) == 0 {
+			delete(redistributions, into)
+		} else {
+			redistributions[into] = rs
+		}
+		configLog.Info("unconfigure redistribute", "from", from.String(), "into", into.String())
+		redistributeSchedule()
+		return
+	}
+}
+
+/* プレフィックスがプレフィックス長の範囲を含めてマッチするか */
+func prefixRangeMatch(key ribKey, prefix in6Addr, prefixLen uint8, ge uint8, le uint8) bool {
+	if key.prefixLen < prefixLen || !in6IsInNetwork(key.prefix, prefix, int(prefixLen)) {
+		return false
+	}
+	if ge == 0 && le == 0 {
+		return key.prefixLen == prefixLen
+	}
+	if ge == 0 {
+		ge = prefixLen
+	}
+	if le == 0 {
+		le = 128
+	}
+	return key.prefixLen >= ge && key.prefixLen <= le
+}
+
+/* プレフィックスリストで許可されるか。リストがなければ拒否する */
+func prefixListPermit(name string, key ribKey) bool {
+	for _, entry := range prefixLists[name] {
+		if prefixRangeMatch(key, entry.prefix, entry.prefixLen, entry.ge, entry.le) {
+			return entry.action == ROUTE_MAP_PERMIT
+		}
+	}
+	return false
+}
+
+func (entry *routeMapEntry) match(key ribKey, route *ipv6RouteEntry) bool {
+	if entry.matchPrefixList != "" && !prefixListPermit(entry.matchPrefixList, key) {
+		return false
+	}
+	if entry.matchNextHopList != "" && !prefixListPermit(entry.matchNextHopList, ribKey{route.nextHop, 128}) {
+		return false
+	}
+	if len(entry.matchProtos) > 0 {
+		found := false
+		for _, proto := range entry.matchProtos {
+			if proto == route.proto {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if entry.hasMatchTag && route.tag != entry.matchTag {
+		return false
+	}
+	return true
+}
+
+/*
+ * ルートマップを適用した経路のコピーを返す。拒否されたらnil。
+ * ルートマップの名前が空なら経路をそのまま返し、存在しないルートマップは全て拒否する。
+ */
+func routeMapApply(name string, key ribKey, route *ipv6RouteEntry) *ipv6RouteEntry {
+	if name == "" {
+		return route
+	}
+	entries := routeMaps[name]
+	for i := range entries {
+		entry := &entries[i]
+		if !entry.match(key, route) {
+			continue
+		}
+		if entry.action == ROUTE_MAP_DENY {
+			return nil
+		}
+
+		copied := *route
+		if entry.hasSetMetric {
+			copied.metric = entry.setMetric
+		}
+		if entry.hasSetTag {
+			copied.tag = entry.setTag
+		}
+		if entry.setNextHop != nil {
+			copied.nextHop = *entry.setNextHop
+			if copied.routeType == CONNECTED {
+				copied.routeType = NETWORK
+				copied.dev = nil
+			}
+		}
+		if entry.setDistance != 0 {
+			copied.distance = entry.setDistance
+		}
+		return &copied
+	}
+	return nil
+}
+
+/* プレフィックスリストやルートマップが変わったら、使っているところを評価し直す */
+func routeMapChanged() {
+	for _, v := range vrfs {
+		if v.fibRouteMap != "" {
+			ribReselectAll(v)
+		}
+	}
+	redistributeSchedule()
+}
+
+func isRedistributed(proto routeProto) bool {
+	for _, rs := range redistributions {
+		for _, r := range rs {
+			if r.proto == proto {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+/*
+ * intoに再配布するVRFの経路。同じプレフィックスに複数の情報源がある場合は管理距離が小さいものを使う
+ */
+func redistributedRoutes(into routeProto, v *vrf) map[ribKey]*ipv6RouteEntry {
+	routes := map[ribKey]*ipv6RouteEntry{}
+	for key, candidates := range v.rib {
+		for _, r := range candidates {
+			for _, rd := range redistributions[into] {
+				if r.proto != rd.proto {
+					continue
+				}
+				applied := routeMapApply(rd.routeMap, key, r)
+				if applied == nil {
+					continue
+				}
+				if old, ok := routes[key]; !ok || r.proto.distance() < old.proto.distance() {
+					routes[key] = applied
+				}
+			}
+		}
+	}
+	return routes
+}
+
+/* 再配布元の経路が変わったら各プロトコルにまとめて知らせる */
+func redistributeSchedule() {
+	if redistributeTimer != nil && redistributeTimer.active {
+		return
+	}
+	redistributeTimer = newTimer(0, func() {
+		if len(ripngInterfaces) > 0 {
+			ripngRedistribute()
+		}
+		if len(ospfv3Areas) > 0 {
+			ospfv3ScheduleOriginate()
+		}
+		if isisSystemIdSelf != (isisSystemId{}) {
+			isisScheduleOriginate()
+		}
+		if bgpLocalAs != 0 {
+			bgpRedistribute()
+		}
+	})
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+)
+
+/**
+ * sFlow v5のエージェント
+ * https://sflow.org/sflow_version_5.txt
+ * サンプリングレートを設定したインターフェイスで、受信したフレームを平均で1/Nの確率で選び、先頭をフローサンプルにする。
+ * インターフェイスのカウンタはポーリング間隔ごとにカウンタサンプルにする。
+ * サンプルはXDR(ビッグエンディアン、4バイト境界)で書いてデータグラムに溜め、1秒ごとかいっぱいになったらUDPでコレクタに送る。
+ */
+const SFLOW_VERSION uint32 = 5
+const SFLOW_DEFAULT_PORT = 6343
+const SFLOW_DEFAULT_POLLING_INTERVAL = 20 * time.Second
+const SFLOW_FLUSH_INTERVAL = time.Second
+
+// フローサンプルに入れるフレームの先頭の長さ
+const SFLOW_HEADER_SIZE = 128
+
+// 1つのデータグラムの大きさ。IPv6の最小MTUに収まるようにする
+const SFLOW_MAX_DATAGRAM_LEN = 1200
+
+const SFLOW_ADDRESS_IPV4 uint32 = 1
+const SFLOW_ADDRESS_IPV6 uint32 = 2
+
+// サンプルとレコードの形式。企業番号0(sFlow.org)なので番号がそのままdata_formatになる
+const SFLOW_FLOW_SAMPLE uint32 = 1
+const SFLOW_COUNTER_SAMPLE uint32 = 2
+const SFLOW_FLOW_RAW_PACKET_HEADER uint32 = 1
+const SFLOW_COUNTERS_GENERIC_INTERFACE uint32 = 1
+
+const SFLOW_HEADER_PROTOCOL_ETHERNET uint32 = 1
+const SFLOW_IF_TYPE_ETHERNET uint32 = 6
+
+// 数えていないカウンタの値
+const SFLOW_COUNTER_UNKNOWN uint32 = 0xffffffff
+
+/* インターフェイスごとのサンプリングの状態 */
+type sflowSampler struct {
+	rate       uint32 // 1/rateでサンプリングする
+	skip       uint32 // 次にサンプルにするまでのフレームの数
+	pool       uint32 // サンプリングの対象になったフレームの数
+	samples    uint64 // 作ったフローサンプルの数
+	flowSeq    uint32
+	counterSeq uint32
+	nextPoll   time.Time
+}
+
+var sflowAgent = struct {
+	enabled         bool
+	collector       string // host:port
+	conn            *net.UDPConn
+	agentAddr       net.IP // データグラムに書くエージェントのアドレス。コレクタへ送るときの送信元
+	pollingInterval time.Duration
+	timer           *timer
+	sequence        uint32 // 送ったデータグラムの数
+
+	// 送るのを待っているサンプル
+	samples  []byte
+	nSamples uint32
+	sent     uint64 // 送ったデータグラム
+	errors   uint64 // 送れなかったデータグラム
+}{}
+
+// エージェントが動き始めた時刻。データグラムのuptimeに使う
+var sflowStartTime = time.Now()
+
+/* "sflow collector"の設定 */
+type sflowCollectorConfig struct {
+	address         string
+	port            int
+	pollingInterval time.Duration
+}
+
+/* ADDRESS PORT [polling SECONDS] */
+func parseSflowCollector(words []string) (*sflowCollectorConfig, error) {
+	if len(words) != 2 && !(len(words) == 4 && words[2] == "polling") {
+		return nil, fmt.Errorf("usage: sflow collector ADDRESS PORT [polling SECONDS]")
+	}
+	addr := net.ParseIP(words[0])
+	if addr == nil {
+		return nil, fmt.Errorf("invalid collector address %s", words[0])
+	}
+	port, err := strconv.ParseUint(words[1], 10, 16)
+	if err != nil || port == 0 {
+		return nil, fmt.Errorf("invalid collector port %s", words[1])
+	}
+	collector := &sflowCollectorConfig{address: addr.String(), port: int(port), pollingInterval: SFLOW_DEFAULT_POLLING_INTERVAL}
+	if len(words) == 4 {
+		seconds, err := strconv.ParseUint(words[3], 10, 32)
+		if err != nil || seconds == 0 {
+			return nil, fmt.Errorf("invalid polling interval %s", words[3])
+		}
+		collector.pollingInterval = time.Duration(seconds) * time.Second
+	}
+	return collector, nil
+}
+
+/* 設定ファイルに書く形。ポーリング間隔は省略しない */
+func (collector *sflowCollectorConfig) String() string {
+	return fmt.Sprintf("%s %d polling %d", collector.address, collector.port, int(collector.pollingInterval.Seconds()))
+}
+
+/* "sflow sampling-rate"の値 */
+func parseSflowSamplingRate(s string) (uint32, error) {
+	rate, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || rate == 0 {
+		return 0, fmt.Errorf("invalid sampling rate %s", s)
+	}
+	return uint32(rate), nil
+}
+
+/* コレクタへ送り始める。設定が変わったときは溜まっているサンプルを送ってからやり直す */
+func configSflow(address string, port int, pollingInterval time.Duration) {
+	collector := net.JoinHostPort(address, strconv.Itoa(port))
+	if sflowAgent.enabled {
+		unconfigSflow()
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", collector)
+	if err == nil {
+		sflowAgent.conn, err = net.DialUDP("udp", nil, addr)
+	}
+	if err != nil {
+		sflowLog.Error("failed to open collector", "collector", collector, "err", err)
+		return
+	}
+	sflowAgent.enabled = true
+	sflowAgent.collector = collector
+	sflowAgent.agentAddr = sflowAgent.conn.LocalAddr().(*net.UDPAddr).IP
+	sflowAgent.pollingInterval = pollingInterval
+	sflowAgent.timer = newTimer(SFLOW_FLUSH_INTERVAL, sflowTick)
+	sflowLog.Info("send samples", "collector", collector, "agent", sflowAgent.agentAddr, "polling", pollingInterval)
+}
+
+func unconfigSflow() {
+	if !sflowAgent.enabled {
+		return
+	}
+	sflowFlush()
+	sflowAgent.timer.stop()
+	sflowAgent.conn.Close()
+	sflowAgent.conn = nil
+	sflowAgent.enabled = false
+	sflowLog.Info("stop sending samples", "collector", sflowAgent.collector)
+}
+
+func sflowShutdown() {
+	unconfigSflow()
+}
+
+/* インターフェイスのサンプリングを始める。レートを変えたときはサンプルの通し番号を引き継ぐ */
+func configSflowInterface(netDev *netDevice, rate uint32) {
+	if netDev.sflow == nil {
+		netDev.sflow = &sflowSampler{}
+	}
+	netDev.sflow.rate = rate
+	netDev.sflow.skip = sflowNextSkip(rate)
+	sflowLog.Info("sample interface", "dev", netDev.name, "rate", rate)
+}
+
+func unconfigSflowInterface(netDev *netDevice) {
+	if netDev.sflow == nil {
+		return
+	}
+	netDev.sflow = nil
+	sflowLog.Info("stop sampling interface", "dev", netDev.name)
+}
+
+/* 次にサンプルにするまでのフレームの数。1からrate*2-1までの一様な乱数にして、平均をrateにする */
+func sflowNextSkip(rate uint32) uint32 {
+	if rate <= 1 {
+		return 1
+	}
+	return uint32(rand.Int63n(int64(rate)*2-1)) + 1
+}
+
+/* 受信したフレームを数え、選ばれたらフローサンプルにする */
+func sflowSample(netDev *netDevice, frame []byte) {
+	sampler := netDev.sflow
+	sampler.pool++
+	sampler.skip--
+	if sampler.skip > 0 {
+		return
+	}
+	sampler.skip = sflowNextSkip(sampler.rate)
+	sampler.samples++
+	sampler.flowSeq++
+
+	header := frame
+	if len(header) > SFLOW_HEADER_SIZE {
+		header = header[:SFLOW_HEADER_SIZE]
+	}
+	ifIndex := uint32(netDev.sockAddr.Ifindex)
+
+	// raw packet header
+	var record []byte
+	record = binary.BigEndian.AppendUint32(record, SFLOW_HEADER_PROTOCOL_ETHERNET)
+	record = binary.BigEndian.AppendUint32(record, uint32(len(frame)))
+	record = binary.BigEndian.AppendUint32(record, 0) // stripped。FCSは受け取っていない
+	record = sflowAppendOpaque(record, header)
+
+	var sample []byte
+	sample = binary.BigEndian.AppendUint32(sample, sampler.flowSeq)
+	sample = binary.BigEndian.AppendUint32(sample, ifIndex) // source_id。タイプ0はifIndex
+	sample = binary.BigEndian.AppendUint32(sample, sampler.rate)
+	sample = binary.BigEndian.AppendUint32(sample, sampler.pool)
+	sample = binary.BigEndian.AppendUint32(sample, 0) // drops
+	sample = binary.BigEndian.AppendUint32(sample, ifIndex)
+	sample = binary.BigEndian.AppendUint32(sample, 0) // output。受信した時点では決まっていない
+	sample = binary.BigEndian.AppendUint32(sample, 1)
+	sample = sflowAppendRecord(sample, SFLOW_FLOW_RAW_PACKET_HEADER, record)
+
+	sflowAddSample(SFLOW_FLOW_SAMPLE, sample)
+}
+
+/*
+ * インターフェイスのカウンタをカウンタサンプルにする。
+ * ユニキャスト、マルチキャスト、ブロードキャストを分けて数えていないので、フレームの数は全てユニキャストに入れる。
+ */
+func sflowPollCounters(netDev *netDevice) {
+	sampler := netDev.sflow
+	sampler.counterSeq++
+	ifIndex := uint32(netDev.sockAddr.Ifindex)
+
+	var discards uint64
+	for _, n := range netDev.stats.drops {
+		discards += n
+	}
+	var status uint32
+	if netDev.socketFd >= 0 {
+		status |= 1 // ifAdminStatus
+	}
+	if netDev.up {
+		status |= 2 // ifOperStatus
+	}
+
+	var record []byte
+	record = binary.BigEndian.AppendUint32(record, ifIndex)
+	record = binary.BigEndian.AppendUint32(record, SFLOW_IF_TYPE_ETHERNET)
+	record = binary.BigEndian.AppendUint64(record, 0) // ifSpeed
+	record = binary.BigEndian.AppendUint32(record, 0) // ifDirection
+	record = binary.BigEndian.AppendUint32(record, status)
+	record = binary.BigEndian.AppendUint64(record, netDev.stats.rxBytes)
+	record = binary.BigEndian.AppendUint32(record, uint32(netDev.stats.rxPackets))
+	record = binary.BigEndian.AppendUint32(record, SFLOW_COUNTER_UNKNOWN) // ifInMulticastPkts
+	record = binary.BigEndian.AppendUint32(record, SFLOW_COUNTER_UNKNOWN) // ifInBroadcastPkts
+	record = binary.BigEndian.AppendUint32(record, uint32(discards))
+	record = binary.BigEndian.AppendUint32(record, uint32(netDev.stats.rxErrors))
+	record = binary.BigEndian.AppendUint32(record, SFLOW_COUNTER_UNKNOWN) // ifInUnknownProtos
+	record = binary.BigEndian.AppendUint64(record, netDev.stats.txBytes)
+	record = binary.BigEndian.AppendUint32(record, uint32(netDev.stats.txPackets))
+	record = binary.BigEndian.AppendUint32(record, SFLOW_COUNTER_UNKNOWN) // ifOutMulticastPkts
+	record = binary.BigEndian.AppendUint32(record, SFLOW_COUNTER_UNKNOWN) // ifOutBroadcastPkts
+	record = binary.BigEndian.AppendUint32(record, 0)                     // ifOutDiscards
+	record = binary.BigEndian.AppendUint32(record, uint32(netDev.stats.txErrors))
+	record = binary.BigEndian.AppendUint32(record, 1) // ifPromiscuousMode。パケットソケットで全て受け取っている
+
+	var sample []byte
+	sample = binary.BigEndian.AppendUint32(sample, sampler.counterSeq)
+	sample = binary.BigEndian.AppendUint32(sample, ifIndex)
+	sample = binary.BigEndian.AppendUint32(sample, 1)
+	sample = sflowAppendRecord(sample, SFLOW_COUNTERS_GENERIC_INTERFACE, record)
+
+	sflowAddSample(SFLOW_COUNTER_SAMPLE, sample)
+}
+
+/* 溜まっているサンプルを送り、ポーリング間隔が来たインターフェイスのカウンタを読む */
+func sflowTick() {
+	now := timerClock.now()
+	for _, netDev := range netDevices {
+		if netDev.sflow == nil || now.Before(netDev.sflow.nextPoll) {
+			continue
+		}
+		sflowPollCounters(netDev)
+		netDev.sflow.nextPoll = now.Add(sflowAgent.pollingInterval)
+	}
+	sflowFlush()
+	sflowAgent.timer.reset(SFLOW_FLUSH_INTERVAL)
+}
+
+/* 長さを付け、4バイト境界まで0で埋める */
+func sflowAppendOpaque(b []byte, data []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(data)))
+	b = append(b, data...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+/* 形式と長さを付けたレコードかサンプル */
+func sflowAppendRecord(b []byte, format uint32, data []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, format)
+	return sflowAppendOpaque(b, data)
+}
+
+/* サンプルを溜め、データグラムに収まらなくなったら送る */
+func sflowAddSample(format uint32, sample []byte) {
+	if 28+16+len(sflowAgent.samples)+8+len(sample) > SFLOW_MAX_DATAGRAM_LEN {
+		sflowFlush()
+	}
+	sflowAgent.samples = sflowAppendRecord(sflowAgent.samples, format, sample)
+	sflowAgent.nSamples++
+}
+
+/* 溜まっているサンプルを1つのデータグラムにして送る */
+func sflowFlush() {
+	if sflowAgent.nSamples == 0 {
+		return
+	}
+	sflowAgent.sequence++
+
+	var datagram []byte
+	datagram = binary.BigEndian.AppendUint32(datagram, SFLOW_VERSION)
+	if ip4 := sflowAgent.agentAddr.To4(); ip4 != nil {
+		datagram = binary.BigEndian.AppendUint32(datagram, SFLOW_ADDRESS_IPV4)
+		datagram = append(datagram, ip4...)
+	} else {
+		datagram = binary.BigEndian.AppendUint32(datagram, SFLOW_ADDRESS_IPV6)
+		datagram = append(datagram, sflowAgent.agentAddr.To16()...)
+	}
+	datagram = binary.BigEndian.AppendUint32(datagram, 0) // sub_agent_id
+	datagram = binary.BigEndian.AppendUint32(datagram, sflowAgent.sequence)
+	datagram = binary.BigEndian.AppendUint32(datagram, uint32(time.Since(sflowStartTime).Milliseconds()))
+	datagram = binary.BigEndian.AppendUint32(datagram, sflowAgent.nSamples)
+	datagram = append(datagram, sflowAgent.samples...)
+
+	_, err := sflowAgent.conn.Write(datagram)
+	if err != nil {
+		sflowAgent.errors++
+		sflowLog.Debug("failed to send", "collector", sflowAgent.collector, "err", err)
+	} else {
+		sflowAgent.sent++
+	}
+	sflowAgent.samples = sflowAgent.samples[:0]
+	sflowAgent.nSamples = 0
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+/**
+ * シグナルの処理
+ * シグナルはgoroutineで受け取り、番号をパイプに書いてイベントループに渡す。
+ * SIGHUPで設定ファイルを読み直して差分を反映し、SIGTERMとSIGINTで停止する。
+ */
+
+// 読み出し側をepollで監視するパイプ
+var signalFds = [2]int{-1, -1}
+
+// SIGTERMかSIGINTを受け取った。イベントループを抜けてshutdownを呼ぶ
+var shutdownRequested bool
+
+func initSignals() error {
+	var fds [2]int
+	err := syscall.Pipe2(fds[:], syscall.O_NONBLOCK|syscall.O_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("create pipe: %s", err)
+	}
+	err = epollAdd(fds[0], syscall.EPOLLIN, func(events uint32) { signalInput() })
+	if err != nil {
+		syscall.Close(fds[0])
+		syscall.Close(fds[1])
+		return err
+	}
+	signalFds = fds
+
+	ch := make(chan os.Signal, 8)
+	signal.Notify(ch, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		for sig := range ch {
+			syscall.Write(fds[1], []byte{byte(sig.(syscall.Signal))})
+		}
+	}()
+	return nil
+}
+
+func signalInput() {
+	buf := make([]byte, 16)
+	for {
+		n, err := syscall.Read(signalFds[0], buf)
+		if err != nil || n == 0 {
+			return
+		}
+		for _, b := range buf[:n] {
+			signalHandle(syscall.Signal(b))
+		}
+	}
+}
+
+func signalHandle(sig syscall.Signal) {
+	sysLog.Info("received signal", "signal", sig.String())
+	switch sig {
+	case syscall.SIGHUP:
+		err := configLoadFile(configFilePath)
+		if err != nil {
+			sysLog.Error("failed to reload config", "path", configFilePath, "err", err)
+		}
+	case syscall.SIGTERM, syscall.SIGINT:
+		shutdownRequested = true
+	}
+}
+
+/*
+ * 停止する。受け付け済みのAPIの操作を済ませ、各プロトコルで隣接ルータに停止を知らせてから、
+ * AF_PACKETのソケットとepollを閉じる。
+ */
+func shutdown() {
+	sysLog.Info("shutting down")
+
+	apiShutdown()
+
+	vrrpShutdown()
+	bgpShutdown()
+	ospfv3Shutdown()
+	isisShutdown()
+	ripngShutdown()
+	bfdShutdown()
+	ipfixShutdown()
+	sflowShutdown()
+
+	for _, netDev := range netDevices {
+		netDev.close()
+	}
+	closeLinkMonitor()
+	closeTimers()
+	closeCaptures()
+
+	signal.Reset(syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	epollDelete(signalFds[0])
+	syscall.Close(signalFds[0])
+	syscall.Close(signalFds[1])
+
+	syscall.Close(epollFd)
+	sysLog.Info("shutdown complete")
+}
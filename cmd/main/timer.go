@@ -0,0 +1,200 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+/**
+ * イベントループから呼び出されるタイマー
+ * 期限の早い順のヒープで管理し、先頭の期限をtimerfdに設定する。timerfdはepollで監視する。
+ * 時刻はtimerClockから取るので、fakeClockに差し替えればタイマーで動く処理を決まった時刻で動かせる。
+ */
+type timer struct {
+	expire time.Time
+	fn     func()
+	active bool
+	index  int // ヒープの中の位置
+}
+
+/* タイマーが使う時刻 */
+type clock interface {
+	now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) now() time.Time {
+	return time.Now()
+}
+
+var timerClock clock = systemClock{}
+
+/*
+ * テストで使う時計。advanceで進めたときだけ時刻が変わり、期限が来たタイマーを実行する。
+ * 差し替えている間はtimerfdを使わない。
+ */
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) now() time.Time {
+	return c.t
+}
+
+/* dだけ進める。途中に期限のあるタイマーは、その期限まで進めてから順に実行する */
+func (c *fakeClock) advance(d time.Duration) {
+	end := c.t.Add(d)
+	for len(timers) > 0 && !timers[0].expire.After(end) {
+		if timers[0].expire.After(c.t) {
+			c.t = timers[0].expire
+		}
+		runExpiredTimers()
+	}
+	c.t = end
+}
+
+// 起動中のタイマー
+var timers timerHeap
+
+// 期限をepollに知らせるtimerfd
+var timerFd = -1
+
+// timerfdに設定している期限。設定していなければゼロ値
+var timerArmed time.Time
+
+type timerHeap []*timer
+
+func (h timerHeap) Len() int           { return len(h) }
+func (h timerHeap) Less(i, j int) bool { return h[i].expire.Before(h[j].expire) }
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x any) {
+	t := x.(*timer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() any {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	t.index = -1
+	return t
+}
+
+/* timerfdを作ってepollで監視する。initEpollの後に呼ぶ */
+func initTimers() error {
+	fd, err := unix.TimerfdCreate(unix.CLOCK_MONOTONIC, unix.TFD_NONBLOCK|unix.TFD_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("create timerfd: %s", err)
+	}
+	err = epollAdd(fd, syscall.EPOLLIN, func(events uint32) { timerInput() })
+	if err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	timerFd = fd
+	timerArmed = time.Time{}
+	timerArm()
+	return nil
+}
+
+func closeTimers() {
+	if timerFd < 0 {
+		return
+	}
+	epollDelete(timerFd)
+	syscall.Close(timerFd)
+	timerFd = -1
+}
+
+func timerInput() {
+	// 期限が来た回数が入っている。読んでおかないとepollが返り続ける
+	buf := make([]byte, 8)
+	syscall.Read(timerFd, buf)
+	timerArmed = time.Time{}
+	runExpiredTimers()
+}
+
+func newTimer(d time.Duration, fn func()) *timer {
+	t := &timer{fn: fn, index: -1}
+	t.reset(d)
+	return t
+}
+
+func (t *timer) reset(d time.Duration) {
+	t.expire = timerClock.now().Add(d)
+	if t.active {
+		heap.Fix(&timers, t.index)
+	} else {
+		t.active = true
+		heap.Push(&timers, t)
+	}
+	timerArm()
+}
+
+func (t *timer) stop() {
+	if t == nil || !t.active {
+		return
+	}
+	t.active = false
+	heap.Remove(&timers, t.index)
+	timerArm()
+}
+
+/* 先頭の期限が変わっていればtimerfdに設定し直す。timerfdはCLOCK_MONOTONICで動くので、時計を差し替えていれば使わない */
+func timerArm() {
+	if timerFd < 0 {
+		return
+	}
+	if _, ok := timerClock.(systemClock); !ok {
+		return
+	}
+
+	var expire time.Time
+	if len(timers) > 0 {
+		expire = timers[0].expire
+	}
+	if expire.Equal(timerArmed) {
+		return
+	}
+	timerArmed = expire
+
+	// it_valueが0だと止まってしまうので、期限を過ぎていれば1ナノ秒後にする
+	var spec unix.ItimerSpec
+	if !expire.IsZero() {
+		d := expire.Sub(timerClock.now())
+		if d <= 0 {
+			d = time.Nanosecond
+		}
+		spec.Value = unix.NsecToTimespec(int64(d))
+	}
+	err := unix.TimerfdSettime(timerFd, 0, &spec, nil)
+	if err != nil {
+		sysLog.Error("failed to set timerfd", "err", err)
+	}
+}
+
+/*
+ * 期限が来たタイマーを期限の順に実行する。
+ * 先に実行した処理で止められたタイマーはヒープから外れているので実行されない。
+ */
+func runExpiredTimers() {
+	now := timerClock.now()
+	for len(timers) > 0 && !timers[0].expire.After(now) {
+		t := heap.Pop(&timers).(*timer)
+		t.active = false
+		t.fn()
+	}
+	timerArm()
+}
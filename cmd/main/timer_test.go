@@ -0,0 +1,145 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+/* タイマーを空にしてfakeClockに差し替える。テストが終われば元に戻す */
+func useFakeClock(t *testing.T) *fakeClock {
+	t.Helper()
+	c := &fakeClock{t: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	prevClock, prevTimers := timerClock, timers
+	timerClock = c
+	timers = nil
+	t.Cleanup(func() {
+		timerClock = prevClock
+		timers = prevTimers
+	})
+	return c
+}
+
+func TestTimerOrder(t *testing.T) {
+	c := useFakeClock(t)
+	var fired []string
+	record := func(name string) func() {
+		return func() { fired = append(fired, name) }
+	}
+	newTimer(30*time.Millisecond, record("c"))
+	newTimer(10*time.Millisecond, record("a"))
+	newTimer(20*time.Millisecond, record("b"))
+
+	c.advance(15 * time.Millisecond)
+	if !reflect.DeepEqual(fired, []string{"a"}) {
+		t.Fatalf("fired %v after 15ms, want [a]", fired)
+	}
+	c.advance(15 * time.Millisecond)
+	if !reflect.DeepEqual(fired, []string{"a", "b", "c"}) {
+		t.Fatalf("fired %v after 30ms, want [a b c]", fired)
+	}
+	if len(timers) != 0 {
+		t.Fatalf("%d timers left", len(timers))
+	}
+}
+
+/* 期限のときにはその時刻で実行する */
+func TestTimerFiresAtExpire(t *testing.T) {
+	c := useFakeClock(t)
+	start := c.now()
+	var at []time.Duration
+	newTimer(10*time.Millisecond, func() { at = append(at, c.now().Sub(start)) })
+	newTimer(25*time.Millisecond, func() { at = append(at, c.now().Sub(start)) })
+
+	c.advance(time.Second)
+	want := []time.Duration{10 * time.Millisecond, 25 * time.Millisecond}
+	if !reflect.DeepEqual(at, want) {
+		t.Fatalf("fired at %v, want %v", at, want)
+	}
+	if got := c.now().Sub(start); got != time.Second {
+		t.Fatalf("clock at %v, want 1s", got)
+	}
+}
+
+func TestTimerStop(t *testing.T) {
+	c := useFakeClock(t)
+	var fired []string
+	a := newTimer(10*time.Millisecond, func() { fired = append(fired, "a") })
+	b := newTimer(20*time.Millisecond, func() { fired = append(fired, "b") })
+	newTimer(30*time.Millisecond, func() { fired = append(fired, "c") })
+
+	a.stop()
+	a.stop()
+	var nilTimer *timer
+	nilTimer.stop()
+	if a.active || a.index != -1 {
+		t.Fatalf("stopped timer is active %v at index %d", a.active, a.index)
+	}
+
+	// 先に期限が来た処理で止めたタイマーは実行しない
+	newTimer(20*time.Millisecond, func() {
+		fired = append(fired, "stopper")
+		b.stop()
+	})
+	b.reset(20*time.Millisecond + time.Nanosecond)
+
+	c.advance(time.Second)
+	if !reflect.DeepEqual(fired, []string{"stopper", "c"}) {
+		t.Fatalf("fired %v, want [stopper c]", fired)
+	}
+}
+
+func TestTimerReset(t *testing.T) {
+	c := useFakeClock(t)
+	var fired []string
+	a := newTimer(10*time.Millisecond, func() { fired = append(fired, "a") })
+	b := newTimer(20*time.Millisecond, func() { fired = append(fired, "b") })
+
+	// 遅らせると後ろに、早めると先頭に並び直す
+	a.reset(30 * time.Millisecond)
+	if timers[0] != b {
+		t.Fatalf("head is not b after delaying a")
+	}
+	a.reset(5 * time.Millisecond)
+	if timers[0] != a {
+		t.Fatalf("head is not a after advancing a")
+	}
+	for i, tm := range timers {
+		if tm.index != i {
+			t.Fatalf("timer at %d has index %d", i, tm.index)
+		}
+	}
+
+	c.advance(10 * time.Millisecond)
+	if !reflect.DeepEqual(fired, []string{"a"}) {
+		t.Fatalf("fired %v after 10ms, want [a]", fired)
+	}
+
+	// 実行済みのタイマーは起動し直せる
+	a.reset(20 * time.Millisecond)
+	c.advance(20 * time.Millisecond)
+	if !reflect.DeepEqual(fired, []string{"a", "b", "a"}) {
+		t.Fatalf("fired %v after 30ms, want [a b a]", fired)
+	}
+}
+
+/* 実行中に自分を起動し直す周期的なタイマー */
+func TestTimerPeriodic(t *testing.T) {
+	c := useFakeClock(t)
+	count := 0
+	var tm *timer
+	tm = newTimer(10*time.Millisecond, func() {
+		count++
+		tm.reset(10 * time.Millisecond)
+	})
+
+	c.advance(35 * time.Millisecond)
+	if count != 3 {
+		t.Fatalf("fired %d times in 35ms, want 3", count)
+	}
+	tm.stop()
+	c.advance(time.Second)
+	if count != 3 {
+		t.Fatalf("fired %d times after stop, want 3", count)
+	}
+}
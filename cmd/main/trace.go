@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+/**
+ * パケットのトレース(VPPのtraceに相当)
+ * 受信したフレームのうちフィルタに一致するものを指定した数だけ選び、処理した段階ごとに
+ * 判断、一致した経路、選んだ近隣、出力インターフェイスを残す。
+ * 処理はイベントループの中で同期して進むので、受信してから処理を終えるまでをtracedPacketに記録する。
+ */
+const PACKET_TRACE_MAX = 1000
+
+type packetTraceStep struct {
+	node     string // 処理した段階。ethernet-input, ipv6-lookupなど
+	decision string
+	route    string // 一致した経路
+	neighbor string // 選んだ近隣
+	outDev   string // 出力インターフェイス
+}
+
+type packetTraceEntry struct {
+	id      int
+	time    time.Time
+	dev     string
+	length  int
+	summary string // アドレスとプロトコル
+	steps   []packetTraceStep
+}
+
+var packetTrace = struct {
+	remaining  int // これから残すパケットの数
+	ifName     string
+	filterExpr string
+	filter     captureFilter
+	entries    []*packetTraceEntry
+	nextId     int
+}{}
+
+// 処理中のトレースするパケット。トレースしないときはnil
+var tracedPacket *packetTraceEntry
+
+/* トレースを始める。countは残すパケットの数で、それまでに残したものは消す */
+func configPacketTrace(count int, ifName string, filterExpr string, filter captureFilter) {
+	packetTrace.remaining = count
+	packetTrace.ifName = ifName
+	packetTrace.filterExpr = filterExpr
+	packetTrace.filter = filter
+	packetTrace.entries = nil
+	packetTrace.nextId = 1
+}
+
+/* 受信したフレームをトレースするか決める。トレースするなら処理を終えるまでtracedPacketに記録する */
+func traceBegin(netDev *netDevice, frame []byte) {
+	if packetTrace.remaining == 0 || (packetTrace.ifName != "" && packetTrace.ifName != netDev.name) {
+		return
+	}
+	p := parseCapturePacket(frame, true)
+	if packetTrace.filter != nil && !packetTrace.filter(p) {
+		return
+	}
+	packetTrace.remaining--
+
+	tracedPacket = &packetTraceEntry{
+		id:      packetTrace.nextId,
+		time:    timerClock.now(),
+		dev:     netDev.name,
+		length:  len(frame),
+		summary: traceSummary(p),
+	}
+	packetTrace.nextId++
+	packetTrace.entries = append(packetTrace.entries, tracedPacket)
+}
+
+func traceEnd() {
+	tracedPacket = nil
+}
+
+/* 処理した段階を記録する。引数を作るのに手間がかかるところでは、呼ぶ前にtracedPacketを確かめる */
+func traceStep(step packetTraceStep) {
+	if tracedPacket == nil {
+		return
+	}
+	tracedPacket.steps = append(tracedPacket.steps, step)
+}
+
+func traceSummary(p *capturePacket) string {
+	if !p.isIpv6 {
+		return "non-ipv6"
+	}
+	summary := fmt.Sprintf("%s -> %s %s", fmtIpStr(p.srcAddr), fmtIpStr(p.dstAddr), traceProtoName(p.nextHdr))
+	if p.l4 && (p.nextHdr == IPV6_PROTOCOL_NUM_UDP || p.nextHdr == IPV6_PROTOCOL_NUM_TCP) {
+		summary += fmt.Sprintf(" %d -> %d", p.srcPort, p.dstPort)
+	}
+	return summary
+}
+
+func traceProtoName(nextHdr uint8) string {
+	switch nextHdr {
+	case IPV6_PROTOCOL_NUM_ICMP:
+		return "icmp6"
+	case IPV6_PROTOCOL_NUM_UDP:
+		return "udp"
+	case IPV6_PROTOCOL_NUM_TCP:
+		return "tcp"
+	case IPV6_PROTOCOL_NUM_OSPF:
+		return "ospf"
+	case IPV6_PROTOCOL_NUM_VRRP:
+		return "vrrp"
+	}
+	return fmt.Sprintf("proto %d", nextHdr)
+}
+
+/* 一致した経路を"プレフィックス 種類 ネクストホップ インターフェイス (プロトコル)"で */
+func traceRouteStr(node *patriciaNode) string {
+	route := node.route
+	prefixLen := node.prefixLen()
+	s := fmtPrefixStr(in6AddrClearPrefix(node.addr, prefixLen), prefixLen) + " " + route.routeType.String()
+	switch route.routeType {
+	case NETWORK:
+		s += " via " + fmtIpStr(route.nextHop)
+	case VRF_LEAK:
+		s += " to vrf " + route.vrf.name
+	}
+	if route.dev != nil {
+		s += " dev " + route.dev.name
+	}
+	return s + " (" + route.proto.String() + ")"
+}
+
+/* FIBを引いた結果を記録する。resNodeがnilか経路がなければ一致しなかった */
+func traceRouteLookup(v *vrf, resNode *patriciaNode) {
+	if tracedPacket == nil {
+		return
+	}
+	if resNode == nil || resNode.route == nil {
+		traceStep(packetTraceStep{node: "ipv6-lookup", decision: "no route in vrf " + v.name})
+		return
+	}
+	traceStep(packetTraceStep{node: "ipv6-lookup", decision: "matched in vrf " + v.name, route: traceRouteStr(resNode)})
+}
+
+func traceNeighborStr(entry *ndTableEntry) string {
+	return fmt.Sprintf("%s %s dev %s", fmtIpStr(entry.v6Addr), fmtMacStr(entry.macAddr), entry.dev.name)
+}
+
+/* 残したパケットを"show trace"の形式で */
+func packetTraceText() string {
+	var b strings.Builder
+	state := "stopped"
+	if packetTrace.remaining > 0 {
+		state = fmt.Sprintf("running, %d packets to go", packetTrace.remaining)
+	}
+	fmt.Fprintf(&b, "Packet trace is %s", state)
+	if packetTrace.ifName != "" {
+		fmt.Fprintf(&b, ", interface %s", packetTrace.ifName)
+	}
+	if packetTrace.filterExpr != "" {
+		fmt.Fprintf(&b, ", filter %q", packetTrace.filterExpr)
+	}
+	b.WriteString("\n")
+
+	for _, entry := range packetTrace.entries {
+		fmt.Fprintf(&b, "\nPacket %d\n  %s %s %d bytes: %s\n", entry.id, entry.time.Format("15:04:05.000000"), entry.dev, entry.length, entry.summary)
+		for _, step := range entry.steps {
+			fmt.Fprintf(&b, "  %-16s %s", step.node, step.decision)
+			if step.route != "" {
+				fmt.Fprintf(&b, ", route %s", step.route)
+			}
+			if step.neighbor != "" {
+				fmt.Fprintf(&b, ", neighbor %s", step.neighbor)
+			}
+			if step.outDev != "" {
+				fmt.Fprintf(&b, ", out %s", step.outDev)
+			}
+			b.WriteString("\n")
+		}
+	}
+	return b.String()
+}
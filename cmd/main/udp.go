@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+)
+
+const IPV6_PROTOCOL_NUM_UDP uint8 = 0x11
+
+const UDP_HEADER_LEN = 8
+
+/* 宛先ポートごとの受信処理 */
+type udpHandler func(netDev *netDevice, ipv6header *ipv6Header, srcPort uint16, payload []byte)
+
+var udpHandlers = map[uint16]udpHandler{}
+
+type udpHeader struct {
+	srcPort  uint16
+	dstPort  uint16
+	length   uint16
+	checksum uint16
+}
+
+func registerUdpHandler(port uint16, handler udpHandler) {
+	udpHandlers[port] = handler
+}
+
+/* UDPパケットの受信処理 */
+func udpInput(netDev *netDevice, ipv6header *ipv6Header, buffer []byte) {
+	if len(buffer) < UDP_HEADER_LEN {
+		udpLog.Debug("packet too short", "dev", netDev.name, "len", len(buffer))
+		dropPacket(netDev, DROP_UDP_INVALID_LENGTH, buffer)
+		return
+	}
+
+	udpHdr := udpHeader{
+		srcPort:  byteToUint16(buffer[0:2]),
+		dstPort:  byteToUint16(buffer[2:4]),
+		length:   byteToUint16(buffer[4:6]),
+		checksum: byteToUint16(buffer[6:8]),
+	}
+	if int(udpHdr.length) < UDP_HEADER_LEN || int(udpHdr.length) > len(buffer) {
+		udpLog.Debug("invalid length", "dev", netDev.name, "len", udpHdr.length, "size", len(buffer))
+		dropPacket(netDev, DROP_UDP_INVALID_LENGTH, buffer)
+		return
+	}
+	buffer = buffer[:udpHdr.length]
+
+	// IPv6ではUDPのチェックサムは必須
+	phdr := ipv6PseudoHeader{
+		srcAddr:      ipv6header.srcAddr,
+		dstAddr:      ipv6header.dstAddr,
+		packetLength: uint32(udpHdr.length),
+		nextHeader:   IPV6_PROTOCOL_NUM_UDP,
+	}
+	if checksum16(buffer, ^checksum16(phdr.toPseudoHeader(), 0)) != 0 {
+		udpLog.Debug("invalid checksum", "dev", netDev.name, "src", ipv6header.srcAddr)
+		dropPacket(netDev, DROP_UDP_BAD_CHECKSUM, buffer)
+		return
+	}
+
+	if tracedPacket != nil {
+		traceStep(packetTraceStep{node: "udp-input", decision: fmt.Sprintf("port %d", udpHdr.dstPort)})
+	}
+	handler, ok := udpHandlers[udpHdr.dstPort]
+	if !ok {
+		udpLog.Debug("unhandled port", "dev", netDev.name, "port", udpHdr.dstPort)
+		dropPacket(netDev, DROP_UDP_NO_LISTENER, buffer)
+		return
+	}
+	handler(netDev, ipv6header, udpHdr.srcPort, buffer[UDP_HEADER_LEN:])
+}
+
+/* UDPヘッダを付けてチェックサムを計算する */
+func udpEncap(srcAddr in6Addr, dstAddr in6Addr, srcPort uint16, dstPort uint16, payload []byte) []byte {
+	udpHdr := udpHeader{
+		srcPort: srcPort,
+		dstPort: dstPort,
+		length:  uint16(UDP_HEADER_LEN + len(payload)),
+	}
+
+	phdr := ipv6PseudoHeader{
+		srcAddr:      srcAddr,
+		dstAddr:      dstAddr,
+		packetLength: uint32(udpHdr.length),
+		nextHeader:   IPV6_PROTOCOL_NUM_UDP,
+	}
+	psum := ^checksum16(phdr.toPseudoHeader(), 0)
+	udpHdr.checksum = checksum16(append(udpHdr.toPacket(), payload...), psum)
+	// 計算結果が0の場合は0xffffを入れる
+	if udpHdr.checksum == 0 {
+		udpHdr.checksum = 0xffff
+	}
+
+	return append(udpHdr.toPacket(), payload...)
+}
+
+func (udpHdr udpHeader) toPacket() []byte {
+	var b bytes.Buffer
+
+	b.Write(uint16ToByte(udpHdr.srcPort))
+	b.Write(uint16ToByte(udpHdr.dstPort))
+	b.Write(uint16ToByte(udpHdr.length))
+	b.Write(uint16ToByte(udpHdr.checksum))
+
+	return b.Bytes()
+}
@@ -2,10 +2,8 @@ package main
 
 import (
 	"encoding/binary"
-	"encoding/hex"
 	"fmt"
 	"net"
-	"strings"
 )
 
 func byteToUint16(b []byte) uint16 {
@@ -42,7 +40,7 @@ func checksum16(buffer []byte, start uint16) uint16 {
 
 	// もし1バイト余ってたら足す
 	if len(buffer)%2 != 0 {
-		sum += uint32(buffer[len(buffer)-1])
+		sum += uint32(buffer[len(buffer)-1]) << 8
 	}
 
 	// あふれた桁を折り返して足す
@@ -61,17 +59,56 @@ func fmtIpStr(ipAddr in6Addr) string {
 	return net.IP(ipAddr[:]).String()
 }
 
+func fmtPrefixStr(prefix in6Addr, prefixLen uint8) string {
+	return fmt.Sprintf("%s/%d", fmtIpStr(prefix), prefixLen)
+}
+
 func parseIpv6(ipStr string) in6Addr {
 	return in6Addr(net.ParseIP(ipStr).To16())
 }
 
-func parseMac(macStr string) [6]byte {
-	macAddr, err := hex.DecodeString(strings.ReplaceAll(macStr, ":", ""))
-	if err != nil {
-		fmt.Errorf("mac addr parse error. macStr is %d", macStr)
+/*
+ * ISO 8473のFletcherチェックサム。OSPFのLSAやIS-ISのLSPで使う。
+ * bufferのchecksumOffsetの位置の2byteは0にしておくこと。
+ */
+func fletcherChecksum(buffer []byte, checksumOffset int) uint16 {
+	var c0, c1 int
+	for _, b := range buffer {
+		c0 = (c0 + int(b)) % 255
+		c1 = (c1 + c0) % 255
+	}
+
+	x := ((len(buffer)-checksumOffset-1)*c0 - c1) % 255
+	if x <= 0 {
+		x += 255
 	}
+	y := 510 - c0 - x
+	if y > 255 {
+		y -= 255
+	}
+
+	return uint16(x<<8 | y)
+}
+
+/* チェックサムを含めて計算して0になれば正しい */
+func fletcherChecksumValid(buffer []byte) bool {
+	var c0, c1 int
+	for _, b := range buffer {
+		c0 = (c0 + int(b)) % 255
+		c1 = (c1 + c0) % 255
+	}
+	return c0 == 0 && c1 == 0
+}
+
+func parseRouterId(idStr string) uint32 {
+	ip := net.ParseIP(idStr).To4()
+	if ip == nil {
+		configLog.Error("invalid router id", "id", idStr)
+		return 0
+	}
+	return byteToUint32(ip)
+}
 
-	var result [6]byte
-	copy(result[:], macAddr)
-	return result
+func fmtRouterIdStr(id uint32) string {
+	return net.IP(uint32ToByte(id)).String()
 }
@@ -0,0 +1,168 @@
+package main
+
+const DEFAULT_VRF_NAME = "default"
+
+// ルータ内のVRFのリスト
+var vrfs []*vrf
+
+// VRFを指定していないインターフェイスが所属するVRF
+var defaultVrf *vrf
+
+/**
+ * VRF(Virtual Routing and Forwarding)
+ * VRFごとにルーティングテーブルとNDテーブルを持ち、所属するインターフェイス間でのみ転送を行う
+ */
+type vrf struct {
+	name    string
+	fib     *patriciaNode                // このVRFのメインテーブルのルートノード
+	tables  map[uint32]*patriciaNode     // ポリシールーティングで使うテーブル。メインテーブルも含む
+	rules   []*policyRule                // 優先度順に並んだポリシールール
+	rib     map[ribKey][]*ipv6RouteEntry // メインテーブルに入れる経路の候補
+	ndTable map[uint32]*ndTableEntry
+
+	fibRouteMap string // RIBからFIBに入れるときに適用するルートマップ
+}
+
+func newVrf(name string) *vrf {
+	fib := createPatriciaNode(in6Addr{}, 0, false, nil)
+	return &vrf{
+		name:    name,
+		fib:     fib,
+		tables:  map[uint32]*patriciaNode{MAIN_ROUTE_TABLE_ID: fib},
+		rib:     make(map[ribKey][]*ipv6RouteEntry),
+		ndTable: make(map[uint32]*ndTableEntry),
+	}
+}
+
+func initVrfs() {
+	defaultVrf = newVrf(DEFAULT_VRF_NAME)
+	vrfs = []*vrf{defaultVrf}
+}
+
+func getVrfByName(name string) *vrf {
+	for _, v := range vrfs {
+		if v.name == name {
+			return v
+		}
+	}
+
+	return nil
+}
+
+func configVrf(name string) *vrf {
+	if v := getVrfByName(name); v != nil {
+		return v
+	}
+
+	v := newVrf(name)
+	vrfs = append(vrfs, v)
+	configLog.Info("configure vrf", "vrf", name)
+
+	return v
+}
+
+/*
+ * VRFを消す。所属していたインターフェイスはデフォルトのVRFに戻し、スタティック経路は捨てる。
+ */
+func unconfigVrf(name string) {
+	v := getVrfByName(name)
+	if v == nil || v == defaultVrf {
+		return
+	}
+
+	for _, netDev := range netDevices {
+		if netDev.vrf == v {
+			netDev.vrf = defaultVrf
+		}
+	}
+	var routes []*staticRoute
+	for _, sr := range staticRoutes {
+		if sr.vrf != v {
+			routes = append(routes, sr)
+		}
+	}
+	staticRoutes = routes
+	for i := range vrfs {
+		if vrfs[i] == v {
+			vrfs = append(vrfs[:i], vrfs[i+1:]...)
+			break
+		}
+	}
+	configLog.Info("unconfigure vrf", "vrf", name)
+}
+
+/*
+ * インターフェイスをVRFに所属させる。
+ * 直結経路は所属先のVRFに作られるので、configIpv6Addrより先に呼び出すこと。
+ */
+func configVrfMember(netDev *netDevice, vrfName string) {
+	if netDev == nil {
+		configLog.Warn("net device to configure not found")
+		return
+	}
+
+	v := getVrfByName(vrfName)
+	if v == nil {
+		configLog.Warn("vrf not found", "vrf", vrfName)
+		return
+	}
+
+	netDev.vrf = v
+	configLog.Info("configure vrf member", "dev", netDev.name, "vrf", v.name)
+}
+
+/*
+ * VRF間の経路リーク。srcVrfでprefixにマッチしたパケットはdstVrfのルーティングテーブルで再度検索される。
+ */
+func configVrfLeakRoute(srcVrfName string, prefix in6Addr, prefixLen uint8, dstVrfName string) {
+	srcVrf := getVrfByName(srcVrfName)
+	dstVrf := getVrfByName(dstVrfName)
+	if srcVrf == nil || dstVrf == nil {
+		configLog.Warn("vrf to leak route not found", "src", srcVrfName, "dst", dstVrfName)
+		return
+	}
+
+	route := &ipv6RouteEntry{
+		routeType: VRF_LEAK,
+		vrf:       dstVrf,
+		proto:     PROTO_STATIC,
+	}
+	ribAdd(srcVrf, prefix, prefixLen, route)
+
+	configLog.Info("configure leak route", "prefix", fmtPrefixStr(prefix, prefixLen), "src", srcVrf.name, "dst", dstVrf.name)
+}
+
+func unconfigVrfLeakRoute(srcVrfName string, prefix in6Addr, prefixLen uint8) {
+	srcVrf := getVrfByName(srcVrfName)
+	if srcVrf == nil {
+		return
+	}
+	ribDelete(srcVrf, prefix, prefixLen, PROTO_STATIC)
+	configLog.Info("unconfigure leak route", "prefix", fmtPrefixStr(prefix, prefixLen), "src", srcVrf.name)
+}
+
+/*
+ * VRFのルーティングテーブルを検索し、マッチしたノードと経路が見つかったVRFを返す。
+ * リーク経路にマッチした場合はリーク先のVRFで検索し直す。リーク先でさらにリーク経路にマッチしてもループを避けるため追わない。
+ */
+func vrfRouteLookup(v *vrf, dstAddr in6Addr) (*patriciaNode, *vrf) {
+	return vrfTableRouteLookup(v, v.fib, dstAddr)
+}
+
+func vrfTableRouteLookup(v *vrf, table *patriciaNode, dstAddr in6Addr) (*patriciaNode, *vrf) {
+	resNode := patriciaTrieSearch(table, dstAddr)
+	traceRouteLookup(v, resNode)
+	if resNode == nil || resNode.route == nil || resNode.route.routeType != VRF_LEAK {
+		return resNode, v
+	}
+
+	leakVrf := resNode.route.vrf
+	fibLog.Debug("leak route", "dst", dstAddr, "vrf", leakVrf.name)
+	resNode = patriciaTrieSearch(leakVrf.fib, dstAddr)
+	traceRouteLookup(leakVrf, resNode)
+	if resNode != nil && resNode.route != nil && resNode.route.routeType == VRF_LEAK {
+		return nil, leakVrf
+	}
+
+	return resNode, leakVrf
+}
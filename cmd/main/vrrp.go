@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+ * VRRPv3(RFC 5798)のIPv6
+ * インターフェイスごとに仮想ルータを作り、マスターになったルータが仮想アドレスと仮想MACアドレスを引き受ける
+ */
+const IPV6_PROTOCOL_NUM_VRRP uint8 = 112
+
+const VRRP_MCAST_ADDRESS = "ff02::12"
+const VRRP_VERSION uint8 = 3
+const VRRP_TYPE_ADVERTISEMENT uint8 = 1
+const VRRP_HEADER_LEN = 8
+
+const VRRP_PRIORITY_OWNER uint8 = 255
+const VRRP_DEFAULT_PRIORITY uint8 = 100
+const VRRP_DEFAULT_ADVER_INTERVAL = time.Second
+
+type vrrpState int
+
+const (
+	VRRP_STATE_INITIALIZE vrrpState = iota
+	VRRP_STATE_BACKUP
+	VRRP_STATE_MASTER
+)
+
+type vrrpRouter struct {
+	dev            *netDevice
+	vrid           uint8
+	priority       uint8
+	preempt        bool
+	adverInterval  time.Duration
+	addrs          []in6Addr // 仮想アドレス。先頭は仮想リンクローカルアドレス
+	virtualMac     [6]uint8
+	state          vrrpState
+	masterInterval time.Duration // マスターが広告している間隔
+
+	adverTimer      *timer
+	masterDownTimer *timer
+}
+
+var vrrpRouters []*vrrpRouter
+
+func (state vrrpState) String() string {
+	return [...]string{"Initialize", "Backup", "Master"}[state]
+}
+
+/* インターフェイスの"vrrp VRID"の後ろの設定 */
+type vrrpConfig struct {
+	priority      uint8
+	adverInterval time.Duration
+	addrs         []in6Addr
+}
+
+/* [priority PRIORITY] [interval MILLISECONDS] address ADDRESS... */
+func parseVrrpConfig(words []string) (*vrrpConfig, error) {
+	usage := fmt.Errorf("usage: vrrp VRID [priority PRIORITY] [interval MILLISECONDS] address ADDRESS...")
+	config := &vrrpConfig{priority: VRRP_DEFAULT_PRIORITY, adverInterval: VRRP_DEFAULT_ADVER_INTERVAL}
+	for len(words) >= 2 && words[0] != "address" {
+		switch words[0] {
+		case "priority":
+			priority, err := strconv.ParseUint(words[1], 10, 8)
+			if err != nil || priority == 0 || uint8(priority) == VRRP_PRIORITY_OWNER {
+				return nil, fmt.Errorf("invalid priority %s", words[1])
+			}
+			config.priority = uint8(priority)
+		case "interval":
+			// 広告間隔はセンチ秒の12ビットで送る
+			ms, err := strconv.ParseUint(words[1], 10, 32)
+			if err != nil || ms == 0 || ms%10 != 0 || ms/10 > 0x0fff {
+				return nil, fmt.Errorf("invalid interval %s", words[1])
+			}
+			config.adverInterval = time.Duration(ms) * time.Millisecond
+		default:
+			return nil, usage
+		}
+		words = words[2:]
+	}
+	if len(words) < 2 || words[0] != "address" {
+		return nil, usage
+	}
+	for _, word := range words[1:] {
+		addr := net.ParseIP(word)
+		if addr == nil || addr.To4() != nil {
+			return nil, fmt.Errorf("invalid ipv6 address %s", word)
+		}
+		config.addrs = append(config.addrs, in6Addr(addr.To16()))
+	}
+	return config, nil
+}
+
+/* 設定ファイルに書く形。優先度と広告間隔は省略しない */
+func (config *vrrpConfig) String() string {
+	var addrs []string
+	for _, addr := range config.addrs {
+		addrs = append(addrs, fmtIpStr(addr))
+	}
+	return fmt.Sprintf("priority %d interval %d address %s", config.priority, config.adverInterval.Milliseconds(), strings.Join(addrs, " "))
+}
+
+/*
+ * 仮想ルータを設定する。仮想アドレスにインターフェイスのアドレスが含まれていればアドレスオーナーになる。
+ */
+func configVrrp(netDev *netDevice, vrid uint8, priority uint8, adverInterval time.Duration, addrs []in6Addr) {
+	if netDev == nil {
+		vrrpLog.Warn("net device to configure not found")
+		return
+	}
+	if vrid == 0 || priority == 0 {
+		configLog.Warn("invalid vrrp vrid or priority", "vrid", vrid, "priority", priority)
+		return
+	}
+
+	vr := &vrrpRouter{
+		dev:           netDev,
+		vrid:          vrid,
+		priority:      priority,
+		preempt:       true,
+		adverInterval: adverInterval,
+		virtualMac:    [6]uint8{0x00, 0x00, 0x5e, 0x00, 0x02, vrid},
+	}
+	vr.addrs = append([]in6Addr{in6AddrLinkLocal(vr.virtualMac)}, addrs...)
+	for _, addr := range addrs {
+		if addr == netDev.ipv6Dev.address {
+			vr.priority = VRRP_PRIORITY_OWNER
+		}
+	}
+	vrrpRouters = append(vrrpRouters, vr)
+
+	ipv6JoinMcast(netDev.ipv6Dev, parseIpv6(VRRP_MCAST_ADDRESS))
+	netDev.addMacMembership(ipv6McastMac(parseIpv6(VRRP_MCAST_ADDRESS)))
+	for _, addr := range vr.addrs {
+		ipv6JoinMcast(netDev.ipv6Dev, in6AddrSolicitedNode(addr))
+		netDev.addMacMembership(ipv6McastMac(in6AddrSolicitedNode(addr)))
+	}
+	configLog.Info("configure vrrp", "vrid", vrid, "dev", netDev.name, "priority", vr.priority)
+
+	vrrpStartup(vr)
+}
+
+/*
+ * 仮想ルータを消す。マスターなら優先度0を送ってすぐにバックアップに引き継がせ、
+ * 仮想MACアドレスとマルチキャストの受信もやめる。
+ */
+func unconfigVrrp(netDev *netDevice, vrid uint8) {
+	vr := getVrrpRouter(netDev, vrid)
+	if vr == nil {
+		return
+	}
+	vr.adverTimer.stop()
+	vr.masterDownTimer.stop()
+	if vr.state == VRRP_STATE_MASTER {
+		vrrpSendAdvertisement(vr, 0)
+		netDev.dropMacMembership(vr.virtualMac)
+	}
+	for i := range vrrpRouters {
+		if vrrpRouters[i] == vr {
+			vrrpRouters = append(vrrpRouters[:i], vrrpRouters[i+1:]...)
+			break
+		}
+	}
+
+	vrrpLeaveMcast(netDev, parseIpv6(VRRP_MCAST_ADDRESS))
+	for _, addr := range vr.addrs {
+		vrrpLeaveMcast(netDev, in6AddrSolicitedNode(addr))
+	}
+	configLog.Info("unconfigure vrrp", "vrid", vrid, "dev", netDev.name)
+}
+
+/* インターフェイス自身のアドレスや他の仮想ルータが使っているグループは抜けずにMACアドレスの登録だけを外す */
+func vrrpLeaveMcast(netDev *netDevice, group in6Addr) {
+	netDev.dropMacMembership(ipv6McastMac(group))
+
+	ipv6Dev := netDev.ipv6Dev
+	if group == in6AddrSolicitedNode(ipv6Dev.address) || group == in6AddrSolicitedNode(ipv6Dev.linkLocalAddr) {
+		return
+	}
+	for _, vr := range vrrpRouters {
+		if vr.dev != netDev {
+			continue
+		}
+		if group == parseIpv6(VRRP_MCAST_ADDRESS) {
+			return
+		}
+		for _, addr := range vr.addrs {
+			if group == in6AddrSolicitedNode(addr) {
+				return
+			}
+		}
+	}
+	ipv6LeaveMcast(ipv6Dev, group)
+}
+
+func getVrrpRouter(netDev *netDevice, vrid uint8) *vrrpRouter {
+	for _, vr := range vrrpRouters {
+		if vr.dev == netDev && vr.vrid == vrid {
+			return vr
+		}
+	}
+	return nil
+}
+
+/* 設定したインターフェイスでマスターになっている仮想ルータのうち、仮想MACアドレスが一致するもの */
+func vrrpMasterByMac(netDev *netDevice, mac [6]uint8) *vrrpRouter {
+	for _, vr := range vrrpRouters {
+		if vr.dev == netDev && vr.state == VRRP_STATE_MASTER && vr.virtualMac == mac {
+			return vr
+		}
+	}
+	return nil
+}
+
+/* 設定したインターフェイスでマスターになっている仮想ルータのうち、仮想アドレスを持つもの */
+func vrrpMasterByAddr(netDev *netDevice, addr in6Addr) *vrrpRouter {
+	for _, vr := range vrrpRouters {
+		if vr.dev != netDev || vr.state != VRRP_STATE_MASTER {
+			continue
+		}
+		for _, a := range vr.addrs {
+			if a == addr {
+				return vr
+			}
+		}
+	}
+	return nil
+}
+
+func vrrpSkewTime(vr *vrrpRouter) time.Duration {
+	return time.Duration(256-int(vr.priority)) * vr.masterInterval / 256
+}
+
+func vrrpMasterDownInterval(vr *vrrpRouter) time.Duration {
+	return 3*vr.masterInterval + vrrpSkewTime(vr)
+}
+
+func vrrpStartup(vr *vrrpRouter) {
+	vr.masterInterval = vr.adverInterval
+	if vr.priority == VRRP_PRIORITY_OWNER {
+		vrrpBecomeMaster(vr)
+		return
+	}
+	vrrpBecomeBackup(vr, vrrpMasterDownInterval(vr))
+}
+
+func vrrpSetState(vr *vrrpRouter, state vrrpState) {
+	vrrpLog.Info("state changed", "vrid", vr.vrid, "dev", vr.dev.name, "prev", vr.state.String(), "state", state.String())
+	vr.state = state
+}
+
+/* マスターになったら広告を送り、仮想アドレスを仮想MACアドレスで知らせる */
+func vrrpBecomeMaster(vr *vrrpRouter) {
+	vr.masterDownTimer.stop()
+	vrrpSetState(vr, VRRP_STATE_MASTER)
+	vr.dev.addMacMembership(vr.virtualMac)
+
+	vrrpSendAdvertisement(vr, vr.priority)
+	for _, addr := range vr.addrs {
+		sendUnsolicitedNa(vr.dev, vr.virtualMac, addr)
+	}
+
+	vr.adverTimer.stop()
+	vr.adverTimer = newTimer(vr.adverInterval, func() { vrrpAdverTimerExpired(vr) })
+}
+
+func vrrpBecomeBackup(vr *vrrpRouter, masterDown time.Duration) {
+	if vr.state == VRRP_STATE_MASTER {
+		vr.dev.dropMacMembership(vr.virtualMac)
+	}
+	vr.adverTimer.stop()
+	if vr.state != VRRP_STATE_BACKUP {
+		vrrpSetState(vr, VRRP_STATE_BACKUP)
+	}
+
+	if vr.masterDownTimer == nil {
+		vr.masterDownTimer = newTimer(masterDown, func() { vrrpBecomeMaster(vr) })
+	} else {
+		vr.masterDownTimer.reset(masterDown)
+	}
+}
+
+func vrrpAdverTimerExpired(vr *vrrpRouter) {
+	vrrpSendAdvertisement(vr, vr.priority)
+	vr.adverTimer.reset(vr.adverInterval)
+}
+
+/* 停止するときにマスターなら優先度0を送ってすぐに引き継がせる */
+func vrrpShutdown() {
+	for _, vr := range vrrpRouters {
+		vr.adverTimer.stop()
+		vr.masterDownTimer.stop()
+		if vr.state == VRRP_STATE_MASTER {
+			vrrpSendAdvertisement(vr, 0)
+		}
+		vr.state = VRRP_STATE_INITIALIZE
+	}
+}
+
+func vrrpSendAdvertisement(vr *vrrpRouter, priority uint8) {
+	srcAddr := vr.dev.ipv6Dev.linkLocalAddr
+	dstAddr := parseIpv6(VRRP_MCAST_ADDRESS)
+
+	var b bytes.Buffer
+	b.WriteByte(VRRP_VERSION<<4 | VRRP_TYPE_ADVERTISEMENT)
+	b.WriteByte(vr.vrid)
+	b.WriteByte(priority)
+	b.WriteByte(uint8(len(vr.addrs)))
+	b.Write(uint16ToByte(uint16(vr.adverInterval/(10*time.Millisecond)) & 0x0fff))
+	b.Write(uint16ToByte(0)) // チェックサム
+	for _, addr := range vr.addrs {
+		b.Write(addr[:])
+	}
+	packet := b.Bytes()
+
+	phdr := ipv6PseudoHeader{
+		srcAddr:      srcAddr,
+		dstAddr:      dstAddr,
+		packetLength: uint32(len(packet)),
+		nextHeader:   IPV6_PROTOCOL_NUM_VRRP,
+	}
+	copy(packet[6:8], uint16ToByte(checksum16(packet, ^checksum16(phdr.toPseudoHeader(), 0))))
+
+	ipv6hdr := ipv6Header{
+		verTcFl:    0x60000000,
+		payloadLen: uint16(len(packet)),
+		nextHdr:    IPV6_PROTOCOL_NUM_VRRP,
+		hopLimit:   0xff,
+		srcAddr:    srcAddr,
+		dstAddr:    dstAddr,
+	}
+	// 広告の送信元MACアドレスは仮想MACアドレスにする
+	ethernetEncapsulateOutputFrom(vr.dev, vr.virtualMac, ipv6McastMac(dstAddr), append(ipv6hdr.toPacket(), packet...), ETHER_TYPE_IPV6)
+}
+
+/* VRRPパケットの受信処理(RFC 5798 6.4) */
+func vrrpInput(netDev *netDevice, ipv6header *ipv6Header, buffer []byte) {
+	if ipv6header.hopLimit != 0xff {
+		vrrpLog.Debug("invalid hop limit", "hopLimit", ipv6header.hopLimit)
+		return
+	}
+	if len(buffer) < VRRP_HEADER_LEN {
+		return
+	}
+	if buffer[0]>>4 != VRRP_VERSION || buffer[0]&0x0f != VRRP_TYPE_ADVERTISEMENT {
+		return
+	}
+	count := int(buffer[3])
+	if len(buffer) < VRRP_HEADER_LEN+count*16 {
+		return
+	}
+
+	phdr := ipv6PseudoHeader{
+		srcAddr:      ipv6header.srcAddr,
+		dstAddr:      ipv6header.dstAddr,
+		packetLength: uint32(len(buffer)),
+		nextHeader:   IPV6_PROTOCOL_NUM_VRRP,
+	}
+	if checksum16(buffer, ^checksum16(phdr.toPseudoHeader(), 0)) != 0 {
+		vrrpLog.Debug("invalid checksum", "src", ipv6header.srcAddr)
+		return
+	}
+
+	vrid := buffer[1]
+	priority := buffer[2]
+	interval := time.Duration(byteToUint16(buffer[4:6])&0x0fff) * 10 * time.Millisecond
+
+	var vr *vrrpRouter
+	for _, v := range vrrpRouters {
+		if v.dev == netDev && v.vrid == vrid {
+			vr = v
+			break
+		}
+	}
+	if vr == nil {
+		return
+	}
+
+	switch vr.state {
+	case VRRP_STATE_BACKUP:
+		if priority == 0 {
+			// マスターが停止したのですぐに引き継ぐ
+			vrrpBecomeBackup(vr, vrrpSkewTime(vr))
+			return
+		}
+		if !vr.preempt || priority >= vr.priority {
+			vr.masterInterval = interval
+			vrrpBecomeBackup(vr, vrrpMasterDownInterval(vr))
+		}
+	case VRRP_STATE_MASTER:
+		if priority == 0 {
+			vrrpSendAdvertisement(vr, vr.priority)
+			vr.adverTimer.reset(vr.adverInterval)
+			return
+		}
+		// 優先度が高いか、同じなら送信元アドレスが大きい方がマスターになる
+		if priority > vr.priority || (priority == vr.priority && bytes.Compare(ipv6header.srcAddr[:], vr.dev.ipv6Dev.linkLocalAddr[:]) > 0) {
+			vrrpLog.Info("higher priority master", "vrid", vr.vrid, "dev", vr.dev.name, "master", ipv6header.srcAddr)
+			vr.masterInterval = interval
+			vrrpBecomeBackup(vr, vrrpMasterDownInterval(vr))
+		}
+	}
+}
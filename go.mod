@@ -2,4 +2,16 @@ module github.com/atsushi-matsui/ipv6-router
 
 go 1.21.5
 
-require golang.org/x/exp v0.0.0-20231226003508-02704c960a9b // indirect
+require (
+	golang.org/x/sys v0.13.0
+	golang.org/x/term v0.13.0
+	google.golang.org/grpc v1.60.1
+	google.golang.org/protobuf v1.31.0
+)
+
+require (
+	github.com/golang/protobuf v1.5.3 // indirect
+	golang.org/x/net v0.16.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20231002182017-d307bd883b97 // indirect
+)